@@ -1 +1,3 @@
 module github.com/hhorai/gnbsim/encoding/gtp
+
+go 1.27.1
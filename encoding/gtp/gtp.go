@@ -54,9 +54,11 @@ const (
 	protocolTypeGTP = 0x10
 	protocolTypeGTPprime = 0x00
 	hasExtensionHeader = 0x04
+	hasSequenceNumber = 0x02
+	hasNPDUNumber = 0x01
 )
 
-func (gtp *GTP) encGTPHeader(payloadLen int) (pdu []byte) {
+func (gtp *GTP) encGTPHeader(payloadLen int, qfi uint8) (pdu []byte) {
 
 	var versAndFlags uint8
 	versAndFlags |= gtpuVersion
@@ -76,7 +78,7 @@ func (gtp *GTP) encGTPHeader(payloadLen int) (pdu []byte) {
 	extHead := []byte{}
 	extHeaders = append(extHeaders, extHeaderTypeNone)
 	for _, extType := range extHeaders {
-		extHead = append(extHead, gtp.encExtensionHeader(extType)...)
+		extHead = append(extHead, gtp.encExtensionHeader(extType, qfi)...)
 	}
 
 	if gtp.HasExtensionHeader {
@@ -97,15 +99,47 @@ func (gtp *GTP) encGTPHeader(payloadLen int) (pdu []byte) {
 	return
 }
 
-func (gtp *GTP) decGTPHeader(payload []byte) (raw []byte) {
+func (gtp *GTP) decGTPHeader(payload []byte) (
+	raw []byte, info *DLPduSessionInformation) {
 
-	versAndFlags := readPayloadByte(&payload)
+	if len(payload) < 8 {
+		return
+	}
+	versAndFlags := payload[0]
 
-	if (versAndFlags & hasExtensionHeader) == 0 {
-		raw = payload[7:]
+	// the optional fields are present if any of E, S and PN flags is set.
+	if (versAndFlags &
+		(hasExtensionHeader | hasSequenceNumber | hasNPDUNumber)) == 0 {
+		raw = payload[8:]
+		return
+	}
+	if len(payload) < 12 {
 		return
 	}
-	raw = payload[15:]
+
+	var next uint8 = extHeaderTypeNone
+	if (versAndFlags & hasExtensionHeader) != 0 {
+		next = payload[11]
+	}
+	payload = payload[12:]
+
+	// the length of the extension header is in 4 octets unit, and the last
+	// octet is the next extension header type.
+	for next != extHeaderTypeNone {
+		if len(payload) < 1 {
+			return nil, nil
+		}
+		length := int(payload[0]) * 4
+		if length == 0 || len(payload) < length {
+			return nil, nil
+		}
+		if next == extHeaderTypePDUSessionContainer {
+			info = gtp.decDLPduSessionInformation(payload[1 : length-1])
+		}
+		next = payload[length-1]
+		payload = payload[length:]
+	}
+	raw = payload
 	return
 }
 
@@ -116,7 +150,7 @@ const (
 	extHeaderTypePDUSessionContainer = 0x85
 )
 
-func (gtp *GTP) encExtensionHeader(extHeaderType uint8) (pdu []byte) {
+func (gtp *GTP) encExtensionHeader(extHeaderType, qfi uint8) (pdu []byte) {
 
 	var content []byte
 
@@ -125,7 +159,7 @@ func (gtp *GTP) encExtensionHeader(extHeaderType uint8) (pdu []byte) {
 		pdu = append(pdu, extHeaderType)
 		return
 	case extHeaderTypePDUSessionContainer:
-		content = gtp.encULPduSessionInformation()
+		content = gtp.encULPduSessionInformation(qfi)
 	default:
 		fmt.Printf("unknown extension header type.")
 		return
@@ -157,26 +191,65 @@ type ULPduSessionInformation struct {
 	qosFlowIdentifier uint8
 }
 
-func (gtp *GTP) encULPduSessionInformation() (pdu []byte) {
+func (gtp *GTP) encULPduSessionInformation(qfi uint8) (pdu []byte) {
 
 	var pduTypeAndFlags uint8
 	pduTypeAndFlags = pduTypeUL << 4
 
 	pdu = append([]byte{}, pduTypeAndFlags)
-	pdu = append(pdu, gtp.QosFlowID)
+	pdu = append(pdu, qfi)
 
 	return
 }
 
+// 5.5.2.1 DL PDU SESSION INFORMATION (PDU Type 0) in TS 38.415
+type DLPduSessionInformation struct {
+	QFI uint8
+	RQI bool // Reflective QoS Indicator
+}
+
+const (
+	rqiFlag = 0x40
+	qfiMask = 0x3f
+)
+
+func (gtp *GTP) decDLPduSessionInformation(
+	content []byte) (info *DLPduSessionInformation) {
+
+	if len(content) < 2 || content[0]>>4 != pduTypeDL {
+		return
+	}
+	info = &DLPduSessionInformation{
+		QFI: content[1] & qfiMask,
+		RQI: content[1]&rqiFlag != 0,
+	}
+	return
+}
+
 func (gtp *GTP) Encap(raw []byte) (payload []byte) {
+	payload = gtp.EncapWithQFI(raw, gtp.QosFlowID)
+	return
+}
+
+// EncapWithQFI sets the QFI of the uplink packet in the PDU Session
+// Container instead of QosFlowID.
+func (gtp *GTP) EncapWithQFI(raw []byte, qfi uint8) (payload []byte) {
 	length := len(raw)
-	payload = append(payload, gtp.encGTPHeader(length)...)
+	payload = append(payload, gtp.encGTPHeader(length, qfi)...)
 	payload = append(payload, raw...)
 	return
 }
 
 func (gtp *GTP) Decap(payload []byte) (raw []byte) {
-	raw = gtp.decGTPHeader(payload)
+	raw, _ = gtp.decGTPHeader(payload)
+	return
+}
+
+// DecapWithInfo returns the DL PDU SESSION INFORMATION in the PDU Session
+// Container with the payload. info is nil without the PDU Session Container.
+func (gtp *GTP) DecapWithInfo(payload []byte) (
+	raw []byte, info *DLPduSessionInformation) {
+	raw, info = gtp.decGTPHeader(payload)
 	return
 }
 //-----
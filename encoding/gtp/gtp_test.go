@@ -1,6 +1,8 @@
 package gtp
 
 import (
+	"encoding/hex"
+	"reflect"
 	"testing"
 )
 
@@ -8,3 +10,65 @@ func TestXXX(t *testing.T) {
 
 	return
 }
+
+func TestEncapWithQFI(t *testing.T) {
+
+	gtp := NewGTP(1, 0x12345678)
+	gtp.SetExtensionHeader(true)
+	gtp.SetQosFlowID(1)
+	raw := []byte{0x45, 0x00, 0x00, 0x00}
+
+	pattern := []struct {
+		qfi    uint8
+		expect string
+	}{
+		{1, "34ff000c12345678" + "0000008501100100" + "45000000"},
+		{9, "34ff000c12345678" + "0000008501100900" + "45000000"},
+	}
+
+	for _, p := range pattern {
+		expect, _ := hex.DecodeString(p.expect)
+		v := gtp.EncapWithQFI(raw, p.qfi)
+		if reflect.DeepEqual(expect, v) == false {
+			t.Errorf("QFI %d\nexpect: %x\nactual: %x", p.qfi, expect, v)
+		}
+	}
+
+	if v := gtp.Encap(raw); reflect.DeepEqual(v, gtp.EncapWithQFI(raw, 1)) == false {
+		t.Errorf("Encap: %x", v)
+	}
+}
+
+func TestDecapWithInfo(t *testing.T) {
+
+	gtp := NewGTP(1, 0x12345678)
+
+	pattern := []struct {
+		in     string
+		expect *DLPduSessionInformation
+	}{
+		{"30ff000400000001" + "45000000", nil},
+		{"34ff000c00000001" + "00000085" + "01000900" + "45000000",
+			&DLPduSessionInformation{QFI: 9}},
+		{"34ff000c00000001" + "00000085" + "01004900" + "45000000",
+			&DLPduSessionInformation{QFI: 9, RQI: true}},
+		// the PDU Session Container following another extension header
+		{"34ff001000000001" + "00000040" + "01000085" + "01004100" + "45000000",
+			&DLPduSessionInformation{QFI: 1, RQI: true}},
+	}
+
+	raw := []byte{0x45, 0x00, 0x00, 0x00}
+	for _, p := range pattern {
+		in, _ := hex.DecodeString(p.in)
+		v, info := gtp.DecapWithInfo(in)
+		if reflect.DeepEqual(raw, v) == false {
+			t.Errorf("%s\nexpect: %x\nactual: %x", p.in, raw, v)
+		}
+		if reflect.DeepEqual(p.expect, info) == false {
+			t.Errorf("%s\nexpect: %+v\nactual: %+v", p.in, p.expect, info)
+		}
+		if v := gtp.Decap(in); reflect.DeepEqual(raw, v) == false {
+			t.Errorf("Decap: %x", v)
+		}
+	}
+}
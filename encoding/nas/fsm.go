@@ -0,0 +1,331 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import "fmt"
+
+// 5GMM and 5GSM state machines. HandleNAS reacts to each downlink NAS
+// message in the current 5GMM state and 5GSM state of the PDU session,
+// and returns the uplink messages and the events for the application.
+// The message not compatible with the protocol state is answered by
+// 5GMM STATUS or 5GSM STATUS (7.3, 7.4).
+
+// Event is the result of the procedure notified by HandleNAS.
+type Event struct {
+	Type int
+	PSI  uint8 // PDU session identity for the 5GSM events
+	Err  error // the reject or the decoding error
+}
+
+const (
+	EventRegistered = iota + 1
+	EventRegistrationRejected
+	EventAuthenticationRejected
+	EventDeregistered
+	EventReregistrationRequired
+	EventServiceAccepted
+	EventServiceRejected
+	EventConfigurationUpdated
+	EventPDUSessionEstablished
+	EventPDUSessionEstablishmentRejected
+	EventPDUSessionModified
+	EventPDUSessionReleased
+	EventPDUSessionReleaseRejected
+	EventSMSReceived
+	EventSMSSent
+	EventSMSFailed
+	EventUEPolicyUpdated
+	EventDecodeError
+)
+
+var EventStr = map[int]string{
+	EventRegistered:                      "Registered",
+	EventRegistrationRejected:            "Registration rejected",
+	EventAuthenticationRejected:          "Authentication rejected",
+	EventDeregistered:                    "Deregistered",
+	EventReregistrationRequired:          "Re-registration required",
+	EventServiceAccepted:                 "Service accepted",
+	EventServiceRejected:                 "Service rejected",
+	EventConfigurationUpdated:            "Configuration updated",
+	EventPDUSessionEstablished:           "PDU session established",
+	EventPDUSessionEstablishmentRejected: "PDU session establishment rejected",
+	EventPDUSessionModified:              "PDU session modified",
+	EventPDUSessionReleased:              "PDU session released",
+	EventPDUSessionReleaseRejected:       "PDU session release rejected",
+	EventSMSReceived:                     "SMS received",
+	EventSMSSent:                         "SMS sent",
+	EventSMSFailed:                       "SMS failed",
+	EventUEPolicyUpdated:                 "UE policy updated",
+	EventDecodeError:                     "Decode error",
+}
+
+// HandleNAS decodes the downlink NAS message and returns the uplink NAS
+// messages to be sent in order, and the events to be handled by the
+// application, e.g. to set up the user plane on EventPDUSessionEstablished.
+func (ue *UE) HandleNAS(pdu []byte) (ul [][]byte, events []Event) {
+
+	ue.fsm.active = true
+	ue.decoded(0)
+	ue.fsm.mmCause = 0
+	ue.fsm.smCause = 0
+
+	ue.Decode(&pdu)
+	ue.fsm.active = false
+	ue.fsm.reject = ue.sm.cause
+
+	switch {
+	case ue.fsm.mmCause != 0:
+		ue.fsm.answered = true
+		ul = append(ul, ue.MakeMMStatus(ue.fsm.mmCause))
+		return
+	case ue.fsm.smCause != 0:
+		ue.fsm.answered = true
+		ul = append(ul, ue.MakeSMStatus(ue.fsm.smCause))
+		return
+	}
+
+	// the response is given to the message type in the 5GMM state and the
+	// 5GSM state, and CP-ACK and RP-ACK follow for SMS.
+	if v := ue.MakeNasPdu(); v != nil {
+		ul = append(ul, v)
+	}
+	ul = append(ul, ue.MakeSMSResponses()...)
+
+	switch {
+	case ue.fsm.rpType != 0:
+		events = ue.smsEvents(events)
+	case ue.fsm.policy:
+		events = ue.policyEvents(events)
+	case ue.fsm.mmType == MessageTypeDLNasTransport:
+		events = ue.smEvents(events)
+	default:
+		events = ue.mmEvents(events)
+	}
+
+	if ue.DecodeError != nil && len(events) == 0 {
+		events = append(events, Event{Type: EventDecodeError, Err: ue.DecodeError})
+	}
+	return
+}
+
+// decoded records the 5GMM message type decoded, which is answered by
+// MakeNasPdu. The 5GSM message and the UE policy delivery service message
+// in DL NAS transport are recorded by their decoders.
+func (ue *UE) decoded(mmType int) {
+	ue.fsm.mmType = mmType
+	ue.fsm.smType = 0
+	ue.fsm.rpType = 0
+	ue.fsm.policy = false
+	ue.fsm.answered = false
+}
+
+// commanded reports whether the 5GMM message of the type is decoded last
+// and not answered yet.
+func (ue *UE) commanded(mmType int) bool {
+	return ue.fsm.mmType == mmType && ue.fsm.answered == false
+}
+
+// smCommanded reports whether the 5GSM message of the type is decoded
+// last in DL NAS transport and not answered yet.
+func (ue *UE) smCommanded(smType int) bool {
+	return ue.commanded(MessageTypeDLNasTransport) && ue.fsm.smType == smType
+}
+
+// response returns the response to the message decoded last in the 5GMM
+// state and the 5GSM state, or nil if no response is required. The command
+// not accepted by the decoder is answered by the failure or the reject.
+func (ue *UE) response() []byte {
+
+	switch ue.fsm.mmType {
+	case MessageTypeAuthenticationRequest:
+		if ue.AuthParam.cause != 0 {
+			return ue.MakeAuthenticationFailure()
+		}
+		return ue.MakeAuthenticationResponse()
+	case MessageTypeSecurityModeCommand:
+		if ue.sec.rejected {
+			return ue.MakeSecurityModeReject()
+		}
+		return ue.MakeSecurityModeComplete()
+	case MessageTypeIdentityRequest:
+		return ue.MakeIdentityResponse()
+	case MessageTypeRegistrationAccept:
+		if ue.MMstate == MMRegistered {
+			ue.dprint("GNBSIM: [REGISTERED]")
+			return ue.MakeRegistrationComplete()
+		}
+	case MessageTypeDeregistrationRequestUETerm:
+		return ue.MakeDeregistrationAccept()
+	case MessageTypeConfigurationUpdateCommand:
+		if ue.Recv.flag.cuAck {
+			return ue.MakeConfigurationUpdateComplete()
+		}
+	case MessageTypeDLNasTransport:
+		return ue.smResponse()
+	}
+	return nil
+}
+
+// smResponse returns the response to the 5GSM message or the UE policy
+// delivery service message in DL NAS transport.
+func (ue *UE) smResponse() []byte {
+
+	if ue.fsm.policy {
+		if ue.UEPolicyRejected() {
+			return ue.MakeManageUEPolicyCommandReject()
+		}
+		return ue.MakeManageUEPolicyComplete()
+	}
+
+	switch ue.fsm.smType {
+	case MessageTypePDUSessionReleaseCommand:
+		return ue.MakePDUSessionReleaseComplete()
+	case MessageTypePDUSessionModificationCommand:
+		// the command to the PDU session not active is rejected by the
+		// decoder with the cause.
+		s := ue.PDUSession(ue.sm.pduSessionId)
+		if ue.sm.cause != 0 || s == nil || s.SMstate != SMActive {
+			return ue.MakePDUSessionModificationCommandReject()
+		}
+		return ue.MakePDUSessionModificationComplete()
+	}
+	return nil
+}
+
+func (ue *UE) mmEvents(events []Event) []Event {
+
+	emit := func(evType int) {
+		events = append(events, Event{Type: evType, Err: ue.DecodeError})
+	}
+
+	switch ue.fsm.mmType {
+	case MessageTypeAuthenticationReject:
+		emit(EventAuthenticationRejected)
+	case MessageTypeRegistrationAccept:
+		if ue.MMstate == MMRegistered {
+			emit(EventRegistered)
+		}
+	case MessageTypeRegistrationReject:
+		emit(EventRegistrationRejected)
+	case MessageTypeDeregistrationRequestUETerm:
+		emit(EventDeregistered)
+		if ue.ReregistrationRequired() {
+			emit(EventReregistrationRequired)
+		}
+	case MessageTypeDeregistrationAccept:
+		emit(EventDeregistered)
+	case MessageTypeServiceAccept:
+		emit(EventServiceAccepted)
+	case MessageTypeServiceReject:
+		emit(EventServiceRejected)
+	case MessageTypeConfigurationUpdateCommand:
+		emit(EventConfigurationUpdated)
+	}
+	return events
+}
+
+func (ue *UE) smEvents(events []Event) []Event {
+
+	psi := ue.sm.pduSessionId
+	emit := func(evType int) {
+		events = append(events, Event{Type: evType, PSI: psi, Err: ue.DecodeError})
+	}
+
+	switch ue.fsm.smType {
+	case MessageTypePDUSessionEstablishmentAccept:
+		if ue.DecodeError == nil {
+			emit(EventPDUSessionEstablished)
+		}
+	case MessageTypePDUSessionEstablishmentReject:
+		emit(EventPDUSessionEstablishmentRejected)
+	case MessageTypePDUSessionModificationCommand:
+		// notified with the error if the command is rejected, since the
+		// gNB answers the resource modify request in either case.
+		err := ue.DecodeError
+		if err == nil && ue.fsm.reject != 0 {
+			err = fmt.Errorf("nas: PDU session modification rejected: %s(%d)",
+				smCauseStr[ue.fsm.reject], ue.fsm.reject)
+		}
+		events = append(events, Event{Type: EventPDUSessionModified, PSI: psi, Err: err})
+	case MessageTypePDUSessionReleaseCommand:
+		emit(EventPDUSessionReleased)
+	case MessageTypePDUSessionReleaseReject:
+		emit(EventPDUSessionReleaseRejected)
+	}
+	return events
+}
+
+func (ue *UE) smsEvents(events []Event) []Event {
+
+	emit := func(evType int) {
+		events = append(events, Event{Type: evType, Err: ue.DecodeError})
+	}
+
+	switch ue.fsm.rpType {
+	case rpDataMT:
+		if ue.DecodeError == nil {
+			emit(EventSMSReceived)
+		}
+	case rpAckMT:
+		emit(EventSMSSent)
+	case rpErrorMT:
+		emit(EventSMSFailed)
+	}
+	return events
+}
+
+// policyEvents notifies the update of the UE policy sections. Err is set
+// if any instruction failed and Manage UE Policy Command Reject is sent.
+func (ue *UE) policyEvents(events []Event) []Event {
+
+	err := ue.DecodeError
+	if err == nil && ue.UEPolicyRejected() {
+		err = fmt.Errorf("nas: %d UE policy instruction(s) failed",
+			len(ue.policy.results))
+	}
+	return append(events, Event{Type: EventUEPolicyUpdated, Err: err})
+}
+
+// mmCompatible reports whether the 5GMM message is compatible with the
+// current 5GMM state.
+func (ue *UE) mmCompatible(msgType int) bool {
+
+	switch msgType {
+	case MessageTypeRegistrationAccept, MessageTypeRegistrationReject:
+		return ue.MMstate == MMRegisteredInitiated
+	case MessageTypeServiceAccept, MessageTypeServiceReject:
+		return ue.MMstate == MMServiceRequestInitiated
+	case MessageTypeDeregistrationAccept:
+		return ue.MMstate == MMDeregistaredInitiated
+	case MessageTypeDeregistrationRequestUETerm,
+		MessageTypeConfigurationUpdateCommand,
+		MessageTypeDLNasTransport:
+		return ue.MMstate != MMNULL && ue.MMstate != MMDeregistared
+	}
+	// the common procedures may be run in any state.
+	return true
+}
+
+// smCompatible reports whether the 5GSM message is compatible with the
+// state of the PDU session. The PDU session not configured is handled
+// by the decoder.
+func (ue *UE) smCompatible(msgType int) bool {
+
+	s := ue.PDUSession(ue.sm.pduSessionId)
+	if s == nil {
+		return true
+	}
+
+	switch msgType {
+	case MessageTypePDUSessionEstablishmentAccept,
+		MessageTypePDUSessionEstablishmentReject:
+		return s.SMstate == SMActivePending
+	case MessageTypePDUSessionReleaseReject:
+		return s.SMstate == SMInactivePending
+	case MessageTypePDUSessionReleaseCommand:
+		return s.SMstate != SMInactive
+	}
+	return true
+}
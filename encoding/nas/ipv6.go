@@ -0,0 +1,161 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IPv6 address configuration of the PDU session. The UE forms the link
+// local address with the interface identifier given by the network, and
+// gets the /64 prefix by the router advertisement over the PDU session.
+// document: 3GPP TS 23.501 5.8.2.2.1, RFC 4861, RFC 4862
+const (
+	ipv6HeaderLen = 40
+	ipv6HopLimit  = 255 // required for the neighbor discovery
+
+	nextHeaderICMPv6 = 58
+
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+
+	ndOptPrefixInformation = 3
+	ndOptPrefixAutonomous  = 0x40
+)
+
+var allRoutersAddr = net.ParseIP("ff02::2")
+
+// LinkLocalAddress returns the IPv6 link local address of the PDU session,
+// or nil if the network did not assign the interface identifier.
+func (s *PDUSession) LinkLocalAddress() net.IP {
+	if len(s.InterfaceID) != interfaceIDLen {
+		return nil
+	}
+	addr := make(net.IP, net.IPv6len)
+	addr[0], addr[1] = 0xfe, 0x80
+	copy(addr[net.IPv6len-interfaceIDLen:], s.InterfaceID)
+	return addr
+}
+
+// MakeRouterSolicitation returns the IPv6 packet of the router
+// solicitation to be sent over the PDU session. It returns nil if the
+// PDU session has no IPv6.
+func (s *PDUSession) MakeRouterSolicitation() (pkt []byte) {
+
+	src := s.LinkLocalAddress()
+	if src == nil {
+		return nil
+	}
+
+	// type, code, checksum and reserved. the source link-layer address
+	// option is not included since there is no link-layer address.
+	icmp := []byte{icmpv6RouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(src, allRoutersAddr, icmp))
+
+	pkt = encIPv6Header(src, allRoutersAddr, len(icmp))
+	pkt = append(pkt, icmp...)
+	return
+}
+
+// IsRouterAdvertisement returns true if the IPv6 packet is the router
+// advertisement, which is to be given to RecvRouterAdvertisement instead
+// of the TUN device.
+func IsRouterAdvertisement(pkt []byte) bool {
+	return len(pkt) > ipv6HeaderLen &&
+		pkt[0]>>4 == 6 &&
+		pkt[6] == nextHeaderICMPv6 &&
+		pkt[ipv6HeaderLen] == icmpv6RouterAdvertisement
+}
+
+// RecvRouterAdvertisement validates the router advertisement and forms
+// Address6 with the autonomous /64 prefix and the interface identifier.
+func (s *PDUSession) RecvRouterAdvertisement(pkt []byte) (err error) {
+
+	if len(s.InterfaceID) != interfaceIDLen {
+		return fmt.Errorf("PDU session(%d) has no interface identifier", s.ID)
+	}
+	if IsRouterAdvertisement(pkt) == false {
+		return fmt.Errorf("not a router advertisement")
+	}
+	if pkt[7] != ipv6HopLimit {
+		return fmt.Errorf("invalid hop limit: %d", pkt[7])
+	}
+
+	length := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if len(pkt) < ipv6HeaderLen+length {
+		return fmt.Errorf("router advertisement too short: %d", len(pkt))
+	}
+	src := net.IP(pkt[8:24])
+	dst := net.IP(pkt[24:40])
+	icmp := pkt[ipv6HeaderLen : ipv6HeaderLen+length]
+	if icmpv6Checksum(src, dst, icmp) != 0 {
+		return fmt.Errorf("invalid ICMPv6 checksum")
+	}
+
+	// type, code, checksum, cur hop limit, flags, router lifetime,
+	// reachable time and retrans timer are followed by the options.
+	const raHeaderLen = 16
+	if len(icmp) < raHeaderLen || icmp[1] != 0 {
+		return fmt.Errorf("invalid router advertisement")
+	}
+
+	for opt := icmp[raHeaderLen:]; len(opt) >= 2; {
+		optLen := int(opt[1]) * 8
+		if optLen == 0 || optLen > len(opt) {
+			return fmt.Errorf("invalid option length: %d", opt[1])
+		}
+		if opt[0] == ndOptPrefixInformation && optLen == 32 &&
+			opt[2] == 64 && opt[3]&ndOptPrefixAutonomous != 0 {
+			addr := make(net.IP, net.IPv6len)
+			copy(addr, opt[16:24])
+			copy(addr[net.IPv6len-interfaceIDLen:], s.InterfaceID)
+			s.Address6 = addr
+			return
+		}
+		opt = opt[optLen:]
+	}
+
+	return fmt.Errorf("no prefix for the autoconfiguration")
+}
+
+func encIPv6Header(src, dst net.IP, length int) (pkt []byte) {
+
+	pkt = make([]byte, ipv6HeaderLen)
+	pkt[0] = 6 << 4 // version, traffic class and flow label
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(length))
+	pkt[6] = nextHeaderICMPv6
+	pkt[7] = ipv6HopLimit
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+	return
+}
+
+// icmpv6Checksum returns the checksum with the pseudo-header (RFC 8200 8.1).
+// It is zero for the message with the valid checksum.
+func icmpv6Checksum(src, dst net.IP, icmp []byte) uint16 {
+
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	add(src.To16())
+	add(dst.To16())
+	sum += uint32(len(icmp))
+	sum += nextHeaderICMPv6
+	add(icmp)
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,997 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Message is the NAS message decoded by DecodeMessage. Body is the pointer
+// to the struct of the message type, e.g. *RegistrationAccept, whose fields
+// are the IEs in the order of TS 24.501 clause 8. The optional IE not
+// included is nil. Encode gives back the same octets as decoded, with the
+// optional IEs in the order received, even if the order is not the one of
+// the clause 8 or the IE is repeated. Only the first of the repeated IEs
+// is given by Body. see 11.4.5 in TS 24.007
+//
+// The IE in the struct is tagged with the format and the IEI as below.
+//
+//	nas:"V"            value, uint8 or []byte with the length, e.g. "V,2"
+//	nas:"H"            half octet, the first one is in bits 1 to 4
+//	nas:"LV", "LV-E"
+//	nas:"TV1,0x9"      type 1 IE with the IEI in bits 5 to 8
+//	nas:"TV,0x12,1"    *uint8 for the value of 1 octet, or []byte
+//	nas:"TLV,0x22", "TLV-E,0x7b"
+type Message struct {
+	EPD uint8
+
+	// 5GS mobility management message. free5gc may set the security
+	// header type in the plain message as well.
+	SecurityHeaderType uint8
+	// the security protected message has no Body. Protected is the NAS
+	// message which may be ciphered.
+	MAC            []byte
+	SequenceNumber uint8
+	Protected      []byte
+
+	// 5GS session management message
+	PSI uint8
+	PTI uint8
+
+	MessageType uint8
+	Body        interface{}
+
+	// the non-imperative IEs not known to the message. They are encoded
+	// after the other IEs unless the message is decoded.
+	Unknown []byte
+
+	// the optional IEs in the order decoded
+	ies []ieRecord
+}
+
+var messageBody = map[uint8]func() interface{}{
+	MessageTypeRegistrationRequest:            func() interface{} { return &RegistrationRequest{} },
+	MessageTypeRegistrationAccept:             func() interface{} { return &RegistrationAccept{} },
+	MessageTypeRegistrationComplete:           func() interface{} { return &RegistrationComplete{} },
+	MessageTypeRegistrationReject:             func() interface{} { return &RegistrationReject{} },
+	MessageTypeDeregistrationRequest:          func() interface{} { return &DeregistrationRequest{} },
+	MessageTypeDeregistrationAccept:           func() interface{} { return &DeregistrationAccept{} },
+	MessageTypeDeregistrationRequestUETerm:    func() interface{} { return &DeregistrationRequestUETerm{} },
+	MessageTypeDeregistrationAcceptUETerm:     func() interface{} { return &DeregistrationAcceptUETerm{} },
+	MessageTypeServiceRequest:                 func() interface{} { return &ServiceRequest{} },
+	MessageTypeServiceReject:                  func() interface{} { return &ServiceReject{} },
+	MessageTypeServiceAccept:                  func() interface{} { return &ServiceAccept{} },
+	MessageTypeConfigurationUpdateCommand:     func() interface{} { return &ConfigurationUpdateCommand{} },
+	MessageTypeConfigurationUpdateComplete:    func() interface{} { return &ConfigurationUpdateComplete{} },
+	MessageTypeAuthenticationRequest:          func() interface{} { return &AuthenticationRequest{} },
+	MessageTypeAuthenticationResponse:         func() interface{} { return &AuthenticationResponse{} },
+	MessageTypeAuthenticationReject:           func() interface{} { return &AuthenticationReject{} },
+	MessageTypeAuthenticationFailure:          func() interface{} { return &AuthenticationFailure{} },
+	MessageTypeIdentityRequest:                func() interface{} { return &IdentityRequest{} },
+	MessageTypeIdentityResponse:               func() interface{} { return &IdentityResponse{} },
+	MessageTypeSecurityModeCommand:            func() interface{} { return &SecurityModeCommand{} },
+	MessageTypeSecurityModeComplete:           func() interface{} { return &SecurityModeComplete{} },
+	MessageTypeSecurityModeReject:             func() interface{} { return &SecurityModeReject{} },
+	MessageTypeMMStatus:                       func() interface{} { return &MMStatus{} },
+	MessageTypeULNasTransport:                 func() interface{} { return &ULNASTransport{} },
+	MessageTypeDLNasTransport:                 func() interface{} { return &DLNASTransport{} },
+	MessageTypePDUSessionEstablishmentRequest: func() interface{} { return &PDUSessionEstablishmentRequest{} },
+	MessageTypePDUSessionEstablishmentAccept:  func() interface{} { return &PDUSessionEstablishmentAccept{} },
+	MessageTypePDUSessionEstablishmentReject:  func() interface{} { return &PDUSessionEstablishmentReject{} },
+	MessageTypePDUSessionModificationCommand:  func() interface{} { return &PDUSessionModificationCommand{} },
+	MessageTypePDUSessionModificationComplete: func() interface{} { return &PDUSessionModificationComplete{} },
+	MessageTypePDUSessionModCommandReject:     func() interface{} { return &PDUSessionModificationCommandReject{} },
+	MessageTypePDUSessionReleaseRequest:       func() interface{} { return &PDUSessionReleaseRequest{} },
+	MessageTypePDUSessionReleaseReject:        func() interface{} { return &PDUSessionReleaseReject{} },
+	MessageTypePDUSessionReleaseCommand:       func() interface{} { return &PDUSessionReleaseCommand{} },
+	MessageTypePDUSessionReleaseComplete:      func() interface{} { return &PDUSessionReleaseComplete{} },
+	MessageTypeSMStatus:                       func() interface{} { return &SMStatus{} },
+}
+
+// DecodeMessage decodes the plain or the security protected NAS message.
+func DecodeMessage(pdu []byte) (m *Message, err error) {
+	return decodeMessage(pdu, false)
+}
+
+func decodeMessage(pdu []byte, plain bool) (m *Message, err error) {
+
+	if len(pdu) < 3 {
+		return nil, fmt.Errorf("nas: message too short: %d", len(pdu))
+	}
+	m = &Message{EPD: pdu[0]}
+
+	switch m.EPD {
+	case EPD5GSMobilityManagement:
+		m.SecurityHeaderType = pdu[1] & 0x0f
+		if m.SecurityHeaderType != SecurityHeaderTypePlain && plain == false {
+			// MAC and sequence number
+			const headerLen = 7
+			if len(pdu) < headerLen {
+				return nil, fmt.Errorf("nas: security header too short: %d",
+					len(pdu))
+			}
+			m.MAC = append([]byte{}, pdu[2:6]...)
+			m.SequenceNumber = pdu[6]
+			m.Protected = append([]byte{}, pdu[headerLen:]...)
+			return
+		}
+		m.MessageType = pdu[2]
+		pdu = pdu[3:]
+	case EPD5GSSessionManagement:
+		if len(pdu) < 4 {
+			return nil, fmt.Errorf("nas: message too short: %d", len(pdu))
+		}
+		m.PSI = pdu[1]
+		m.PTI = pdu[2]
+		m.MessageType = pdu[3]
+		pdu = pdu[4:]
+	default:
+		return nil, fmt.Errorf("nas: unsupported EPD: 0x%x", m.EPD)
+	}
+
+	newBody, ok := messageBody[m.MessageType]
+	if ok == false {
+		return nil, fmt.Errorf("nas: unsupported message type: 0x%x",
+			m.MessageType)
+	}
+	m.Body = newBody()
+	m.Unknown, m.ies, err = decodeIEs(pdu, m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("nas: %s: %v", msgTypeStr[int(m.MessageType)], err)
+	}
+	return
+}
+
+// Encode encodes the message.
+func (m *Message) Encode() (pdu []byte, err error) {
+
+	switch m.EPD {
+	case EPD5GSMobilityManagement:
+		pdu = []byte{m.EPD, m.SecurityHeaderType}
+		if m.SecurityHeaderType != SecurityHeaderTypePlain && m.Body == nil {
+			if len(m.MAC) != 4 {
+				return nil, fmt.Errorf("nas: invalid MAC length: %d", len(m.MAC))
+			}
+			pdu = append(pdu, m.MAC...)
+			pdu = append(pdu, m.SequenceNumber)
+			pdu = append(pdu, m.Protected...)
+			return
+		}
+		pdu = append(pdu, m.MessageType)
+	case EPD5GSSessionManagement:
+		pdu = []byte{m.EPD, m.PSI, m.PTI, m.MessageType}
+	default:
+		return nil, fmt.Errorf("nas: unsupported EPD: 0x%x", m.EPD)
+	}
+
+	if m.Body == nil {
+		return nil, fmt.Errorf("nas: no message body")
+	}
+	v, err := encodeIEs(m.Body, m.ies)
+	if err != nil {
+		return nil, fmt.Errorf("nas: %s: %v", msgTypeStr[int(m.MessageType)], err)
+	}
+	pdu = append(pdu, v...)
+	if m.ies == nil {
+		pdu = append(pdu, m.Unknown...)
+	}
+	return
+}
+
+// Plain decodes the NAS message in the security protected message. The
+// message ciphered by other than 5G-EA0 cannot be decoded.
+func (m *Message) Plain() (*Message, error) {
+	if m.Body != nil {
+		return nil, fmt.Errorf("nas: message is not security protected")
+	}
+	return decodeMessage(m.Protected, true)
+}
+
+// SMMessage decodes the 5GSM message in the payload container.
+func (m *ULNASTransport) SMMessage() (*Message, error) {
+	return decodeSMPayload(m.PayloadContainerType, m.PayloadContainer)
+}
+
+// SMMessage decodes the 5GSM message in the payload container.
+func (m *DLNASTransport) SMMessage() (*Message, error) {
+	return decodeSMPayload(m.PayloadContainerType, m.PayloadContainer)
+}
+
+func decodeSMPayload(payloadType uint8, payload []byte) (*Message, error) {
+	if payloadType != PayloadContainerN1SMInformation {
+		return nil, fmt.Errorf("nas: payload container type is not N1 SM: %d",
+			payloadType)
+	}
+	return DecodeMessage(payload)
+}
+
+// ReceivedMessage returns the last plain 5GMM message decoded by Decode.
+func (ue *UE) ReceivedMessage() *Message {
+	return ue.Recv.message
+}
+
+// 8.2 5GS mobility management messages
+
+// 8.2.1 Authentication request
+type AuthenticationRequest struct {
+	NgKSI      uint8  `nas:"H"`
+	Spare      uint8  `nas:"H"`
+	ABBA       []byte `nas:"LV"`
+	RAND       []byte `nas:"TV,0x21,16"`
+	AUTN       []byte `nas:"TLV,0x20"`
+	EAPMessage []byte `nas:"TLV-E,0x78"`
+}
+
+// 8.2.2 Authentication response
+type AuthenticationResponse struct {
+	AuthenticationResponseParameter []byte `nas:"TLV,0x2d"`
+	EAPMessage                      []byte `nas:"TLV-E,0x78"`
+}
+
+// 8.2.4 Authentication failure
+type AuthenticationFailure struct {
+	Cause                          uint8  `nas:"V"`
+	AuthenticationFailureParameter []byte `nas:"TLV,0x30"`
+}
+
+// 8.2.5 Authentication reject
+type AuthenticationReject struct {
+	EAPMessage []byte `nas:"TLV-E,0x78"`
+}
+
+// 8.2.6 Registration request
+type RegistrationRequest struct {
+	RegistrationType               uint8  `nas:"H"`
+	NgKSI                          uint8  `nas:"H"`
+	MobileIdentity                 []byte `nas:"LV-E"`
+	NonCurrentNativeNgKSI          *uint8 `nas:"TV1,0xc"`
+	MMCapability                   []byte `nas:"TLV,0x10"`
+	UESecurityCapability           []byte `nas:"TLV,0x2e"`
+	RequestedNSSAI                 []byte `nas:"TLV,0x2f"`
+	LastVisitedRegisteredTAI       []byte `nas:"TV,0x52,6"`
+	S1UENetworkCapability          []byte `nas:"TLV,0x17"`
+	UplinkDataStatus               []byte `nas:"TLV,0x40"`
+	PDUSessionStatus               []byte `nas:"TLV,0x50"`
+	MICOIndication                 *uint8 `nas:"TV1,0xb"`
+	UEStatus                       []byte `nas:"TLV,0x2b"`
+	AdditionalGUTI                 []byte `nas:"TLV-E,0x77"`
+	AllowedPDUSessionStatus        []byte `nas:"TLV,0x25"`
+	UEUsageSetting                 []byte `nas:"TLV,0x18"`
+	RequestedDRXParameters         []byte `nas:"TLV,0x51"`
+	EPSNASMessageContainer         []byte `nas:"TLV-E,0x70"`
+	LADNIndication                 []byte `nas:"TLV-E,0x74"`
+	PayloadContainerType           *uint8 `nas:"TV1,0x8"`
+	PayloadContainer               []byte `nas:"TLV-E,0x7b"`
+	NetworkSlicingIndication       *uint8 `nas:"TV1,0x9"`
+	UpdateType                     []byte `nas:"TLV,0x53"`
+	MobileStationClassmark2        []byte `nas:"TLV,0x41"`
+	SupportedCodecs                []byte `nas:"TLV,0x42"`
+	NASMessageContainer            []byte `nas:"TLV-E,0x71"`
+	EPSBearerContextStatus         []byte `nas:"TLV,0x60"`
+	RequestedExtendedDRXParameters []byte `nas:"TLV,0x6e"`
+	T3324Value                     []byte `nas:"TLV,0x6a"`
+	UERadioCapabilityID            []byte `nas:"TLV,0x67"`
+	RequestedMappedNSSAI           []byte `nas:"TLV,0x35"`
+	AdditionalInformationRequested []byte `nas:"TLV,0x48"`
+	RequestedWUSAssistanceInfo     []byte `nas:"TLV,0x1a"`
+	N5GCIndication                 *uint8 `nas:"TV1,0xa"`
+	RequestedNBN1ModeDRXParameters []byte `nas:"TLV,0x30"`
+}
+
+// 8.2.7 Registration accept
+type RegistrationAccept struct {
+	RegistrationResult                 []byte `nas:"LV"`
+	GUTI                               []byte `nas:"TLV-E,0x77"`
+	EquivalentPLMNs                    []byte `nas:"TLV,0x4a"`
+	TAIList                            []byte `nas:"TLV,0x54"`
+	AllowedNSSAI                       []byte `nas:"TLV,0x15"`
+	RejectedNSSAI                      []byte `nas:"TLV,0x11"`
+	ConfiguredNSSAI                    []byte `nas:"TLV,0x31"`
+	NetworkFeatureSupport              []byte `nas:"TLV,0x21"`
+	PDUSessionStatus                   []byte `nas:"TLV,0x50"`
+	PDUSessionReactivationResult       []byte `nas:"TLV,0x26"`
+	PDUSessionReactivationResultError  []byte `nas:"TLV-E,0x72"`
+	LADNInformation                    []byte `nas:"TLV-E,0x79"`
+	MICOIndication                     *uint8 `nas:"TV1,0xb"`
+	NetworkSlicingIndication           *uint8 `nas:"TV1,0x9"`
+	ServiceAreaList                    []byte `nas:"TLV,0x27"`
+	T3512Value                         []byte `nas:"TLV,0x5e"`
+	Non3GPPDeregistrationTimerValue    []byte `nas:"TLV,0x5d"`
+	T3502Value                         []byte `nas:"TLV,0x16"`
+	EmergencyNumberList                []byte `nas:"TLV,0x34"`
+	ExtendedEmergencyNumberList        []byte `nas:"TLV-E,0x7a"`
+	SORTransparentContainer            []byte `nas:"TLV-E,0x73"`
+	EAPMessage                         []byte `nas:"TLV-E,0x78"`
+	NSSAIInclusionMode                 *uint8 `nas:"TV1,0xa"`
+	OperatorDefinedAccessCategoryDefs  []byte `nas:"TLV-E,0x76"`
+	NegotiatedDRXParameters            []byte `nas:"TLV,0x51"`
+	Non3GPPNWProvidedPolicies          *uint8 `nas:"TV1,0xd"`
+	EPSBearerContextStatus             []byte `nas:"TLV,0x60"`
+	NegotiatedExtendedDRXParameters    []byte `nas:"TLV,0x6e"`
+	T3447Value                         []byte `nas:"TLV,0x6c"`
+	T3448Value                         []byte `nas:"TLV,0x6b"`
+	T3324Value                         []byte `nas:"TLV,0x6a"`
+	UERadioCapabilityID                []byte `nas:"TLV,0x67"`
+	UERadioCapabilityIDDeletion        *uint8 `nas:"TV1,0xe"`
+	PendingNSSAI                       []byte `nas:"TLV,0x39"`
+	CipheringKeyData                   []byte `nas:"TLV-E,0x74"`
+	CAGInformationList                 []byte `nas:"TLV-E,0x75"`
+	Truncated5GSTMSIConfiguration      []byte `nas:"TLV,0x1b"`
+	NegotiatedWUSAssistanceInformation []byte `nas:"TLV,0x1c"`
+	NegotiatedNBN1ModeDRXParameters    []byte `nas:"TLV,0x29"`
+	ExtendedRejectedNSSAI              []byte `nas:"TLV,0x68"`
+}
+
+// 8.2.8 Registration complete
+type RegistrationComplete struct {
+	SORTransparentContainer []byte `nas:"TLV-E,0x73"`
+}
+
+// 8.2.9 Registration reject
+type RegistrationReject struct {
+	Cause                 uint8  `nas:"V"`
+	T3346Value            []byte `nas:"TLV,0x5f"`
+	T3502Value            []byte `nas:"TLV,0x16"`
+	EAPMessage            []byte `nas:"TLV-E,0x78"`
+	RejectedNSSAI         []byte `nas:"TLV,0x69"`
+	CAGInformationList    []byte `nas:"TLV-E,0x75"`
+	ExtendedRejectedNSSAI []byte `nas:"TLV,0x68"`
+}
+
+// 8.2.10 UL NAS transport
+type ULNASTransport struct {
+	PayloadContainerType        uint8  `nas:"H"`
+	Spare                       uint8  `nas:"H"`
+	PayloadContainer            []byte `nas:"LV-E"`
+	PDUSessionID                *uint8 `nas:"TV,0x12,1"`
+	OldPDUSessionID             *uint8 `nas:"TV,0x59,1"`
+	RequestType                 *uint8 `nas:"TV1,0x8"`
+	SNSSAI                      []byte `nas:"TLV,0x22"`
+	DNN                         []byte `nas:"TLV,0x25"`
+	AdditionalInformation       []byte `nas:"TLV,0x24"`
+	MAPDUSessionInformation     *uint8 `nas:"TV1,0xa"`
+	ReleaseAssistanceIndication *uint8 `nas:"TV1,0xf"`
+}
+
+// 8.2.11 DL NAS transport
+type DLNASTransport struct {
+	PayloadContainerType  uint8  `nas:"H"`
+	Spare                 uint8  `nas:"H"`
+	PayloadContainer      []byte `nas:"LV-E"`
+	PDUSessionID          *uint8 `nas:"TV,0x12,1"`
+	AdditionalInformation []byte `nas:"TLV,0x24"`
+	Cause                 *uint8 `nas:"TV,0x58,1"`
+	BackOffTimerValue     []byte `nas:"TLV,0x37"`
+}
+
+// 8.2.12 De-registration request (UE originating de-registration)
+type DeregistrationRequest struct {
+	DeregistrationType uint8  `nas:"H"`
+	NgKSI              uint8  `nas:"H"`
+	MobileIdentity     []byte `nas:"LV-E"`
+}
+
+// 8.2.13 De-registration accept (UE originating de-registration)
+type DeregistrationAccept struct {
+}
+
+// 8.2.14 De-registration request (UE terminated de-registration)
+type DeregistrationRequestUETerm struct {
+	DeregistrationType    uint8  `nas:"H"`
+	Spare                 uint8  `nas:"H"`
+	Cause                 *uint8 `nas:"TV,0x58,1"`
+	T3346Value            []byte `nas:"TLV,0x5f"`
+	RejectedNSSAI         []byte `nas:"TLV,0x6d"`
+	ExtendedRejectedNSSAI []byte `nas:"TLV,0x68"`
+}
+
+// 8.2.15 De-registration accept (UE terminated de-registration)
+type DeregistrationAcceptUETerm struct {
+}
+
+// 8.2.16 Service request
+type ServiceRequest struct {
+	NgKSI                   uint8  `nas:"H"`
+	ServiceType             uint8  `nas:"H"`
+	STMSI                   []byte `nas:"LV-E"`
+	UplinkDataStatus        []byte `nas:"TLV,0x40"`
+	PDUSessionStatus        []byte `nas:"TLV,0x50"`
+	AllowedPDUSessionStatus []byte `nas:"TLV,0x25"`
+	NASMessageContainer     []byte `nas:"TLV-E,0x71"`
+}
+
+// 8.2.17 Service accept
+type ServiceAccept struct {
+	PDUSessionStatus                  []byte `nas:"TLV,0x50"`
+	PDUSessionReactivationResult      []byte `nas:"TLV,0x26"`
+	PDUSessionReactivationResultError []byte `nas:"TLV-E,0x72"`
+	EAPMessage                        []byte `nas:"TLV-E,0x78"`
+	T3448Value                        []byte `nas:"TLV,0x6b"`
+}
+
+// 8.2.18 Service reject
+type ServiceReject struct {
+	Cause              uint8  `nas:"V"`
+	PDUSessionStatus   []byte `nas:"TLV,0x50"`
+	T3346Value         []byte `nas:"TLV,0x5f"`
+	EAPMessage         []byte `nas:"TLV-E,0x78"`
+	T3448Value         []byte `nas:"TLV,0x6b"`
+	CAGInformationList []byte `nas:"TLV-E,0x75"`
+}
+
+// 8.2.19 Configuration update command
+type ConfigurationUpdateCommand struct {
+	ConfigurationUpdateIndication     *uint8 `nas:"TV1,0xd"`
+	GUTI                              []byte `nas:"TLV-E,0x77"`
+	TAIList                           []byte `nas:"TLV,0x54"`
+	AllowedNSSAI                      []byte `nas:"TLV,0x15"`
+	ServiceAreaList                   []byte `nas:"TLV,0x27"`
+	FullNameForNetwork                []byte `nas:"TLV,0x43"`
+	ShortNameForNetwork               []byte `nas:"TLV,0x45"`
+	LocalTimeZone                     *uint8 `nas:"TV,0x46,1"`
+	UniversalTimeAndLocalTimeZone     []byte `nas:"TV,0x47,7"`
+	NetworkDaylightSavingTime         []byte `nas:"TLV,0x49"`
+	LADNInformation                   []byte `nas:"TLV-E,0x79"`
+	MICOIndication                    *uint8 `nas:"TV1,0xb"`
+	NetworkSlicingIndication          *uint8 `nas:"TV1,0x9"`
+	ConfiguredNSSAI                   []byte `nas:"TLV,0x31"`
+	RejectedNSSAI                     []byte `nas:"TLV,0x11"`
+	OperatorDefinedAccessCategoryDefs []byte `nas:"TLV-E,0x76"`
+	SMSIndication                     *uint8 `nas:"TV1,0xf"`
+	T3447Value                        []byte `nas:"TLV,0x6c"`
+	CAGInformationList                []byte `nas:"TLV-E,0x75"`
+	UERadioCapabilityID               []byte `nas:"TLV,0x67"`
+	UERadioCapabilityIDDeletion       *uint8 `nas:"TV1,0xa"`
+	RegistrationResult                []byte `nas:"TLV,0x44"`
+	Truncated5GSTMSIConfiguration     []byte `nas:"TLV,0x1b"`
+	AdditionalConfigurationIndication *uint8 `nas:"TV1,0xc"`
+	ExtendedRejectedNSSAI             []byte `nas:"TLV,0x68"`
+}
+
+// 8.2.20 Configuration update complete
+type ConfigurationUpdateComplete struct {
+}
+
+// 8.2.21 Identity request
+type IdentityRequest struct {
+	IdentityType uint8 `nas:"H"`
+	Spare        uint8 `nas:"H"`
+}
+
+// 8.2.22 Identity response
+type IdentityResponse struct {
+	MobileIdentity []byte `nas:"LV-E"`
+}
+
+// 8.2.25 Security mode command
+type SecurityModeCommand struct {
+	SelectedNASSecurityAlgorithms    uint8  `nas:"V"`
+	NgKSI                            uint8  `nas:"H"`
+	Spare                            uint8  `nas:"H"`
+	ReplayedUESecurityCapabilities   []byte `nas:"LV"`
+	IMEISVRequest                    *uint8 `nas:"TV1,0xe"`
+	SelectedEPSNASSecurityAlgorithms *uint8 `nas:"TV,0x57,1"`
+	Additional5GSecurityInformation  []byte `nas:"TLV,0x36"`
+	EAPMessage                       []byte `nas:"TLV-E,0x78"`
+	ABBA                             []byte `nas:"TLV,0x38"`
+	ReplayedS1UESecurityCapabilities []byte `nas:"TLV,0x19"`
+}
+
+// 8.2.26 Security mode complete
+type SecurityModeComplete struct {
+	IMEISV              []byte `nas:"TLV-E,0x77"`
+	NASMessageContainer []byte `nas:"TLV-E,0x71"`
+	NonIMEISVPEI        []byte `nas:"TLV-E,0x78"`
+}
+
+// 8.2.27 Security mode reject
+type SecurityModeReject struct {
+	Cause uint8 `nas:"V"`
+}
+
+// 8.2.29 5GMM status
+type MMStatus struct {
+	Cause uint8 `nas:"V"`
+}
+
+// 8.3 5GS session management messages
+
+// 8.3.1 PDU session establishment request
+type PDUSessionEstablishmentRequest struct {
+	IntegrityProtectionMaximumDataRate []byte `nas:"V,2"`
+	PDUSessionType                     *uint8 `nas:"TV1,0x9"`
+	SSCMode                            *uint8 `nas:"TV1,0xa"`
+	SMCapability                       []byte `nas:"TLV,0x28"`
+	MaximumNumberOfPacketFilters       []byte `nas:"TV,0x55,2"`
+	AlwaysOnPDUSessionRequested        *uint8 `nas:"TV1,0xb"`
+	SMPDUDNRequestContainer            []byte `nas:"TLV,0x39"`
+	ExtendedPCO                        []byte `nas:"TLV-E,0x7b"`
+	HeaderCompressionConfiguration     []byte `nas:"TLV,0x66"`
+	DSTTEthernetPortMACAddress         []byte `nas:"TLV,0x6e"`
+	UEDSTTResidenceTime                []byte `nas:"TLV,0x6f"`
+	PortManagementInformation          []byte `nas:"TLV-E,0x74"`
+	EthernetHeaderCompressionConfig    []byte `nas:"TLV,0x1f"`
+	SuggestedInterfaceIdentifier       []byte `nas:"TLV,0x29"`
+}
+
+// 8.3.2 PDU session establishment accept
+type PDUSessionEstablishmentAccept struct {
+	PDUSessionType                  uint8  `nas:"H"`
+	SSCMode                         uint8  `nas:"H"`
+	AuthorizedQoSRules              []byte `nas:"LV-E"`
+	SessionAMBR                     []byte `nas:"LV"`
+	Cause                           *uint8 `nas:"TV,0x59,1"`
+	PDUAddress                      []byte `nas:"TLV,0x29"`
+	RQTimerValue                    *uint8 `nas:"TV,0x56,1"`
+	SNSSAI                          []byte `nas:"TLV,0x22"`
+	AlwaysOnPDUSessionIndication    *uint8 `nas:"TV1,0x8"`
+	MappedEPSBearerContexts         []byte `nas:"TLV-E,0x75"`
+	EAPMessage                      []byte `nas:"TLV-E,0x78"`
+	AuthorizedQoSFlowDescriptions   []byte `nas:"TLV-E,0x79"`
+	ExtendedPCO                     []byte `nas:"TLV-E,0x7b"`
+	DNN                             []byte `nas:"TLV,0x25"`
+	SMNetworkFeatureSupport         []byte `nas:"TLV,0x17"`
+	ServingPLMNRateControl          []byte `nas:"TLV,0x18"`
+	ATSSSContainer                  []byte `nas:"TLV-E,0x77"`
+	ControlPlaneOnlyIndication      *uint8 `nas:"TV1,0xc"`
+	HeaderCompressionConfiguration  []byte `nas:"TLV,0x66"`
+	EthernetHeaderCompressionConfig []byte `nas:"TLV,0x1f"`
+}
+
+// 8.3.3 PDU session establishment reject
+type PDUSessionEstablishmentReject struct {
+	Cause                  uint8  `nas:"V"`
+	BackOffTimerValue      []byte `nas:"TLV,0x37"`
+	AllowedSSCMode         *uint8 `nas:"TV1,0xf"`
+	EAPMessage             []byte `nas:"TLV-E,0x78"`
+	CongestionReattemptInd []byte `nas:"TLV,0x61"`
+	ExtendedPCO            []byte `nas:"TLV-E,0x7b"`
+	ReattemptIndicator     []byte `nas:"TLV,0x1d"`
+}
+
+// 8.3.7 PDU session modification command
+type PDUSessionModificationCommand struct {
+	Cause                           *uint8 `nas:"TV,0x59,1"`
+	SessionAMBR                     []byte `nas:"TLV,0x2a"`
+	RQTimerValue                    *uint8 `nas:"TV,0x56,1"`
+	AlwaysOnPDUSessionIndication    *uint8 `nas:"TV1,0x8"`
+	AuthorizedQoSRules              []byte `nas:"TLV-E,0x7a"`
+	MappedEPSBearerContexts         []byte `nas:"TLV-E,0x75"`
+	AuthorizedQoSFlowDescriptions   []byte `nas:"TLV-E,0x79"`
+	ExtendedPCO                     []byte `nas:"TLV-E,0x7b"`
+	ATSSSContainer                  []byte `nas:"TLV-E,0x77"`
+	HeaderCompressionConfiguration  []byte `nas:"TLV,0x66"`
+	PortManagementInformation       []byte `nas:"TLV-E,0x74"`
+	ServingPLMNRateControl          []byte `nas:"TLV,0x1e"`
+	EthernetHeaderCompressionConfig []byte `nas:"TLV,0x1f"`
+}
+
+// 8.3.8 PDU session modification complete
+type PDUSessionModificationComplete struct {
+	ExtendedPCO               []byte `nas:"TLV-E,0x7b"`
+	PortManagementInformation []byte `nas:"TLV-E,0x74"`
+}
+
+// 8.3.9 PDU session modification command reject
+type PDUSessionModificationCommandReject struct {
+	Cause       uint8  `nas:"V"`
+	ExtendedPCO []byte `nas:"TLV-E,0x7b"`
+}
+
+// 8.3.12 PDU session release request
+type PDUSessionReleaseRequest struct {
+	Cause       *uint8 `nas:"TV,0x59,1"`
+	ExtendedPCO []byte `nas:"TLV-E,0x7b"`
+}
+
+// 8.3.13 PDU session release reject
+type PDUSessionReleaseReject struct {
+	Cause       uint8  `nas:"V"`
+	ExtendedPCO []byte `nas:"TLV-E,0x7b"`
+}
+
+// 8.3.14 PDU session release command
+type PDUSessionReleaseCommand struct {
+	Cause                  uint8  `nas:"V"`
+	BackOffTimerValue      []byte `nas:"TLV,0x37"`
+	EAPMessage             []byte `nas:"TLV-E,0x78"`
+	CongestionReattemptInd []byte `nas:"TLV,0x61"`
+	ExtendedPCO            []byte `nas:"TLV-E,0x7b"`
+	AccessType             *uint8 `nas:"TV1,0xd"`
+}
+
+// 8.3.15 PDU session release complete
+type PDUSessionReleaseComplete struct {
+	Cause       *uint8 `nas:"TV,0x59,1"`
+	ExtendedPCO []byte `nas:"TLV-E,0x7b"`
+}
+
+// 8.3.16 5GSM status
+type SMStatus struct {
+	Cause uint8 `nas:"V"`
+}
+
+// 11.2.4 Formats of information elements
+const (
+	ieFormatV = iota
+	ieFormatH
+	ieFormatLV
+	ieFormatLVE
+	ieFormatTV1
+	ieFormatTV
+	ieFormatTLV
+	ieFormatTLVE
+)
+
+var ieFormat = map[string]int{
+	"V":     ieFormatV,
+	"H":     ieFormatH,
+	"LV":    ieFormatLV,
+	"LV-E":  ieFormatLVE,
+	"TV1":   ieFormatTV1,
+	"TV":    ieFormatTV,
+	"TLV":   ieFormatTLV,
+	"TLV-E": ieFormatTLVE,
+}
+
+type ieSpec struct {
+	field  int
+	name   string
+	format int
+	iei    uint8
+	length int // of the value in V and TV
+}
+
+// ieRecord is the optional IE decoded. raw is the IE not known to the
+// message or the repeated one, which is encoded as it is.
+type ieRecord struct {
+	field int
+	raw   []byte
+}
+
+func (s *ieSpec) mandatory() bool {
+	return s.format <= ieFormatLVE
+}
+
+// lengthLen returns the number of octets of the length indicator.
+func (s *ieSpec) lengthLen() int {
+	if s.format == ieFormatLVE || s.format == ieFormatTLVE {
+		return 2
+	}
+	return 1
+}
+
+// match reports whether the octet is the IEI of the optional IE.
+func (s *ieSpec) match(b uint8) bool {
+	if s.format == ieFormatTV1 {
+		return b>>4 == s.iei
+	}
+	return b == s.iei
+}
+
+func ieSpecs(t reflect.Type) (specs []ieSpec, err error) {
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("nas"), ",")
+		format, ok := ieFormat[tag[0]]
+		if ok == false {
+			return nil, fmt.Errorf("%s: invalid format: %s", f.Name, tag[0])
+		}
+		s := ieSpec{field: i, name: f.Name, format: format, length: 1}
+
+		if s.mandatory() == false {
+			if len(tag) < 2 {
+				return nil, fmt.Errorf("%s: no IEI", f.Name)
+			}
+			iei, err := strconv.ParseUint(tag[1], 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid IEI: %s", f.Name, tag[1])
+			}
+			s.iei = uint8(iei)
+			tag = tag[1:]
+		}
+		if len(tag) > 1 {
+			n, err := strconv.Atoi(tag[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid length: %s", f.Name, tag[1])
+			}
+			s.length = n
+		}
+		specs = append(specs, s)
+	}
+	return
+}
+
+func decodeIEs(pdu []byte, body interface{}) (
+	unknown []byte, ies []ieRecord, err error) {
+
+	v := reflect.ValueOf(body).Elem()
+	specs, err := ieSpecs(v.Type())
+	if err != nil {
+		return
+	}
+
+	read := func(n int) (b []byte, err error) {
+		if len(pdu) < n {
+			return nil, fmt.Errorf("message too short")
+		}
+		b = append([]byte{}, pdu[:n]...)
+		pdu = pdu[n:]
+		return
+	}
+	readLength := func(lengthLen int) (int, error) {
+		b, err := read(lengthLen)
+		if err != nil {
+			return 0, err
+		}
+		if lengthLen == 1 {
+			return int(b[0]), nil
+		}
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+
+	i := 0
+	upper := false // bits 5 to 8 of the octet for the half octet IE
+	for ; i < len(specs) && specs[i].mandatory(); i++ {
+		s := &specs[i]
+		f := v.Field(s.field)
+		var b []byte
+
+		switch s.format {
+		case ieFormatH:
+			if len(pdu) == 0 {
+				return nil, nil, fmt.Errorf("%s: message too short", s.name)
+			}
+			if upper {
+				f.SetUint(uint64(pdu[0] >> 4))
+				pdu = pdu[1:]
+			} else {
+				f.SetUint(uint64(pdu[0] & 0x0f))
+			}
+			upper = !upper
+			continue
+		case ieFormatV:
+			b, err = read(s.length)
+		case ieFormatLV, ieFormatLVE:
+			var n int
+			n, err = readLength(s.lengthLen())
+			if err == nil {
+				b, err = read(n)
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.name, err)
+		}
+		setValue(f, b)
+	}
+
+	// the optional IEs are recorded in the order decoded to be encoded in
+	// the same order.
+	ies = []ieRecord{}
+	optional := specs[i:]
+	for len(pdu) > 0 {
+		var s *ieSpec
+		for j := range optional {
+			if optional[j].match(pdu[0]) {
+				s = &optional[j]
+				break
+			}
+		}
+
+		f := reflect.Value{}
+		if s != nil {
+			f = v.Field(s.field)
+		}
+		if s == nil || f.IsNil() == false {
+			var n int
+			if s == nil {
+				n, err = unknownIELen(pdu)
+			} else {
+				n, err = s.ieLen(pdu)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if s == nil {
+				unknown = append(unknown, pdu[:n]...)
+			}
+			ies = append(ies, ieRecord{field: -1,
+				raw: append([]byte{}, pdu[:n]...)})
+			pdu = pdu[n:]
+			continue
+		}
+		ies = append(ies, ieRecord{field: s.field})
+
+		var b []byte
+		switch s.format {
+		case ieFormatTV1:
+			b = []byte{pdu[0] & 0x0f}
+			pdu = pdu[1:]
+		case ieFormatTV:
+			pdu = pdu[1:]
+			b, err = read(s.length)
+		case ieFormatTLV, ieFormatTLVE:
+			pdu = pdu[1:]
+			var n int
+			n, err = readLength(s.lengthLen())
+			if err == nil {
+				b, err = read(n)
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.name, err)
+		}
+		setValue(f, b)
+	}
+	return
+}
+
+func setValue(f reflect.Value, b []byte) {
+	switch f.Kind() {
+	case reflect.Uint8:
+		f.SetUint(uint64(b[0]))
+	case reflect.Ptr:
+		x := b[0]
+		f.Set(reflect.ValueOf(&x))
+	case reflect.Slice:
+		f.SetBytes(b)
+	}
+}
+
+// ieLen returns the length of the optional IE of the spec.
+func (s *ieSpec) ieLen(pdu []byte) (n int, err error) {
+
+	switch s.format {
+	case ieFormatTV1:
+		n = 1
+	case ieFormatTV:
+		n = 1 + s.length
+	case ieFormatTLV:
+		n = 2
+		if len(pdu) >= n {
+			n += int(pdu[1])
+		}
+	case ieFormatTLVE:
+		n = 3
+		if len(pdu) >= n {
+			n += int(binary.BigEndian.Uint16(pdu[1:3]))
+		}
+	}
+	if len(pdu) < n {
+		err = fmt.Errorf("%s: IE 0x%x too short", s.name, pdu[0])
+	}
+	return
+}
+
+// unknownIELen returns the length of the IE by the IEI.
+// see 11.2.4 and 9.11.1 for the IE of the type 6 (TLV-E).
+func unknownIELen(pdu []byte) (n int, err error) {
+
+	switch {
+	case pdu[0]&0x80 != 0:
+		return 1, nil
+	case pdu[0]>>4 == 0x7:
+		n = 3
+		if len(pdu) >= n {
+			n += int(binary.BigEndian.Uint16(pdu[1:3]))
+		}
+	default:
+		n = 2
+		if len(pdu) >= n {
+			n += int(pdu[1])
+		}
+	}
+	if len(pdu) < n {
+		err = fmt.Errorf("IE 0x%x too short", pdu[0])
+	}
+	return
+}
+
+// encodeIEs encodes the optional IEs in the order of ies if the message
+// is decoded, and then the ones not decoded in the order of the struct.
+func encodeIEs(body interface{}, ies []ieRecord) (pdu []byte, err error) {
+
+	v := reflect.ValueOf(body)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("invalid message body: %T", body)
+	}
+	v = v.Elem()
+	specs, err := ieSpecs(v.Type())
+	if err != nil {
+		return
+	}
+
+	encoded := map[int]bool{}
+	upper := false
+	encode := func(s *ieSpec) error {
+		f := v.Field(s.field)
+		if encoded[s.field] || (s.mandatory() == false && f.IsNil()) {
+			return nil
+		}
+		encoded[s.field] = true
+		b := getValue(f)
+
+		switch s.format {
+		case ieFormatH:
+			if upper {
+				pdu[len(pdu)-1] |= b[0] << 4
+			} else {
+				pdu = append(pdu, b[0]&0x0f)
+			}
+			upper = !upper
+			return nil
+		case ieFormatV, ieFormatTV:
+			if len(b) != s.length {
+				return fmt.Errorf("%s: invalid length: %d", s.name, len(b))
+			}
+		case ieFormatLV, ieFormatTLV:
+			if len(b) > 0xff {
+				return fmt.Errorf("%s: too long: %d", s.name, len(b))
+			}
+		case ieFormatLVE, ieFormatTLVE:
+			if len(b) > 0xffff {
+				return fmt.Errorf("%s: too long: %d", s.name, len(b))
+			}
+		}
+
+		switch s.format {
+		case ieFormatTV1:
+			pdu = append(pdu, s.iei<<4|b[0]&0x0f)
+		case ieFormatTV, ieFormatTLV, ieFormatTLVE:
+			pdu = append(pdu, s.iei)
+		}
+		switch s.format {
+		case ieFormatLV, ieFormatTLV:
+			pdu = append(pdu, uint8(len(b)))
+		case ieFormatLVE, ieFormatTLVE:
+			pdu = append(pdu, uint8(len(b)>>8), uint8(len(b)))
+		}
+		if s.format != ieFormatTV1 {
+			pdu = append(pdu, b...)
+		}
+		return nil
+	}
+
+	i := 0
+	for ; i < len(specs) && specs[i].mandatory(); i++ {
+		if err = encode(&specs[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, ie := range ies {
+		if ie.field < 0 {
+			pdu = append(pdu, ie.raw...)
+			continue
+		}
+		for j := i; j < len(specs); j++ {
+			if specs[j].field == ie.field {
+				if err = encode(&specs[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for ; i < len(specs); i++ {
+		if err = encode(&specs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func getValue(f reflect.Value) []byte {
+	switch f.Kind() {
+	case reflect.Uint8:
+		return []byte{uint8(f.Uint())}
+	case reflect.Ptr:
+		return []byte{uint8(f.Elem().Uint())}
+	}
+	return f.Bytes()
+}
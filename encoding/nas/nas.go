@@ -10,18 +10,24 @@ package nas
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
 
 	"github.com/aead/cmac"
 	"github.com/wmnsk/milenage"
@@ -37,33 +43,124 @@ type UE struct {
 	RoutingIndicator uint16
 	ProtectionScheme string
 	AuthParam        AuthParam
-	SNSSAI           SNSSAI
-	DNN              string
+	PDUSessions      []*PDUSession
 	URL              string
 
+	// Emergency makes the registration for the emergency services, and
+	// all the PDU sessions are established for the emergency services.
+	// NoUSIM is for the UE without the valid subscription, which is
+	// identified by the IMEI instead of the SUCI.
+	Emergency bool
+	NoUSIM    bool
+
+	// SMSOverNAS requests SMS over NAS in the registration. The MT-SMS is
+	// given to SMSHandler, and SMSCAddress is the service centre for the
+	// MO-SMS. see sms.go
+	SMSOverNAS  bool
+	SMSCAddress string
+	SMSHandler  func(sms SMS) `json:"-"`
+
+	// home network public key for SUCI concealment (hex string).
+	HomeNetworkPublicKey   string
+	HomeNetworkPublicKeyID uint8
+
 	MMstate int
-	SMstate int
 
 	sm struct {
 		pduSessionId           uint8
 		procedureTransactionId uint8
+		lastAllocatedPTI       uint8 // PTI of the last UE requested procedure
+		cause                  uint8 // 5GSM cause to reject the command
+	}
+
+	sec struct {
+		cipher    uint8 // selected NAS ciphering algorithm
+		integrity uint8 // selected NAS integrity algorithm
+		ngKSI     uint8
+
+		dlCountValid bool // any downlink message has been accepted
+		newContext   bool // KAMF by the authentication is not taken into use
+		rejected     bool // the last Security Mode Command is not accepted
+	}
+
+	sr struct {
+		serviceType uint8
+	}
+
+	// state machine run by HandleNAS. The last message decoded is answered
+	// in the 5GMM state and the 5GSM state. see fsm.go
+	fsm struct {
+		active   bool
+		mmType   int   // 5GMM message type decoded
+		smType   int   // 5GSM message type decoded
+		mmCause  uint8 // 5GMM cause of 5GMM STATUS to be sent
+		smCause  uint8 // 5GSM cause of 5GSM STATUS to be sent
+		rpType   int   // RP message type of SMS decoded
+		policy   bool  // Manage UE Policy Command decoded
+		reject   uint8 // 5GSM cause of the command to be rejected
+		answered bool  // the response is given by MakeNasPdu
+	}
+
+	sms struct {
+		ti      uint8    // transaction identifier of CP layer
+		mr      uint8    // RP message reference of MO-SMS
+		tpMR    uint8    // TP message reference of MO-SMS
+		pending [][]byte // CP-ACK and RP-ACK to be sent
+		err     error    // RP-ERROR of MO-SMS
+	}
+
+	// UE policy sections installed by the PCF. see ursp.go
+	policy struct {
+		sections map[uePolicySectionKey][]URSPRule
+		pti      uint8            // PTI of the last Manage UE Policy Command
+		results  []uePolicyResult // instructions failed
+	}
+
+	// NAS timers run only if TimerCh is set, and the expiry is notified
+	// to TimerCh. see TimerExpired. The expiry is dropped if TimerCh is
+	// full, so it should be buffered and drained all the time.
+	TimerCh chan<- TimerEvent
+	tm      struct {
+		timers     map[nasTimerKey]*nasTimer
+		seq        uint64
+		value      map[int]time.Duration
+		regAttempt int // registration attempt counter
 	}
 
 	Recv struct {
 		flag struct {
 			imeisv bool
 			rinmr  bool
+			cuAck  bool // acknowledgement requested by CUC
 		}
-		state        int
+		message      *Message // the last plain 5GMM message
+		idType       int      // identity type requested by the network
+		reregister   bool
+		emergency    bool // registered for emergency services
+		smsAllowed   bool // SMS over NAS allowed
+		mmCause      uint8
 		fiveGGUTI    []byte
 		tai          []TAI
 		allowedNSSAI []SNSSAI
+		t3346        int
 		t3502        int
 		t3512        int
-		PDUAddress   net.IP
+
+		// network information by Configuration Update Command.
+		network struct {
+			fullName      string
+			shortName     string
+			timeZone      int // in quarters of an hour
+			universalTime time.Time
+			dst           int // daylight saving time in hours
+		}
 	}
 
-	NasCount uint32
+	// NAS COUNT of the current NAS security context. ULCount is used for
+	// the next uplink message, and DLCount is of the last downlink message
+	// accepted. see 4.4.3.1
+	ULCount uint32
+	DLCount uint32
 
 	wa struct {
 		securityHeaderParsed bool
@@ -74,6 +171,10 @@ type UE struct {
 	indent   int // indent for debug print.
 
 	DecodeError error
+
+	// EncodeError is the reason why the last message was not made, e.g.
+	// the SUCI concealment failed.
+	EncodeError error
 }
 
 // 5.1.3 5GMM sublayer states
@@ -114,19 +215,81 @@ var SMstateStr = map[int]string{
 	SMActive:              "5GSM PDU SESSION ACTIVE",
 }
 
-// my receive flag definition
-const (
-	rcvdNull = iota
-	rcvdAuthenticationRequest
-	rcvdSecurityModeCommand
-	rcvdRegistrationAccept
-)
+// PDUSession is a PDU session of the UE. DNN, S-NSSAI and the PDU session
+// type are given by the configuration, and the others are maintained by
+// the 5GSM procedures. ID is assigned in order from 1 if not given.
+//
+// Address is the IPv4 address. For IPv6, the network assigns only
+// the interface identifier, and Address6 is formed from the prefix in
+// the router advertisement (TS 23.501 5.8.2.2.1). No address is assigned
+// to the Ethernet and the Unstructured PDU sessions.
+type PDUSession struct {
+	ID     uint8
+	DNN    string
+	SNSSAI SNSSAI
+	Type   string // "IPv4", "IPv6", "IPv4v6", "Unstructured" or "Ethernet"
+
+	// ReflectiveQoS indicates the support of the reflective QoS in the
+	// PDU session establishment request.
+	ReflectiveQoS bool
+
+	// Emergency requests the PDU session for the emergency services.
+	Emergency bool
+
+	SMstate     int
+	Address     net.IP
+	InterfaceID []byte
+	Address6    net.IP
+
+	// qosRules is replaced as a whole under mu since the user plane
+	// classifies the uplink packets with it.
+	mu       sync.RWMutex
+	qosRules []QoSRule
+	qosFlows []QoSFlowDescription
+
+	// the UE-derived QoS rules are deleted on expiry of the RQ timer.
+	rqTimer      time.Duration
+	derivedRules []derivedQoSRule
+
+	// UnstructuredHandler is called with the downlink payload of the
+	// Unstructured PDU session. see unstructured.go
+	UnstructuredHandler func(payload []byte) `json:"-"`
+	unstructuredUL      chan []byte
+}
+
+// PDUSession returns the PDU session of the PDU session identity,
+// or nil if it is not configured.
+func (ue *UE) PDUSession(id uint8) *PDUSession {
+	for _, s := range ue.PDUSessions {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// CurrentPDUSession returns the PDU session of the 5GSM procedure in
+// progress, e.g. the one commanded by the network.
+func (ue *UE) CurrentPDUSession() *PDUSession {
+	return ue.PDUSession(ue.sm.pduSessionId)
+}
+
+// QoSRules returns the QoS rules of the PDU session.
+func (s *PDUSession) QoSRules() []QoSRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.qosRules
+}
+
+func (s *PDUSession) setQoSRules(rules []QoSRule) {
+	s.mu.Lock()
+	s.qosRules = rules
+	s.mu.Unlock()
+}
 
-var rcvdStateStr = map[int]string{
-	rcvdNull:                  "NULL",
-	rcvdAuthenticationRequest: "Received Authentication Request",
-	rcvdSecurityModeCommand:   "Received Security Mode Command",
-	rcvdRegistrationAccept:    "Received Registration Accept",
+// QoSFlowDescriptions returns the QoS flow descriptions of the PDU session.
+func (s *PDUSession) QoSFlowDescriptions() []QoSFlowDescription {
+	return s.qosFlows
 }
 
 // TS 24.007 11.2.3.1.1A Extended protocol discriminator (EPD)
@@ -154,55 +317,124 @@ const (
 	MessageTypeRegistrationRequest            = 0x41
 	MessageTypeRegistrationAccept             = 0x42
 	MessageTypeRegistrationComplete           = 0x43
+	MessageTypeRegistrationReject             = 0x44
 	MessageTypeDeregistrationRequest          = 0x45
 	MessageTypeDeregistrationAccept           = 0x46
+	MessageTypeDeregistrationRequestUETerm    = 0x47
+	MessageTypeDeregistrationAcceptUETerm     = 0x48
+	MessageTypeServiceRequest                 = 0x4c
+	MessageTypeServiceReject                  = 0x4d
+	MessageTypeServiceAccept                  = 0x4e
+	MessageTypeConfigurationUpdateCommand     = 0x54
+	MessageTypeConfigurationUpdateComplete    = 0x55
 	MessageTypeAuthenticationRequest          = 0x56
 	MessageTypeAuthenticationResponse         = 0x57
+	MessageTypeAuthenticationReject           = 0x58
+	MessageTypeAuthenticationFailure          = 0x59
+	MessageTypeIdentityRequest                = 0x5b
+	MessageTypeIdentityResponse               = 0x5c
 	MessageTypeSecurityModeCommand            = 0x5d
 	MessageTypeSecurityModeComplete           = 0x5e
+	MessageTypeSecurityModeReject             = 0x5f
+	MessageTypeMMStatus                       = 0x64
 	MessageTypeULNasTransport                 = 0x67
 	MessageTypeDLNasTransport                 = 0x68
 	MessageTypePDUSessionEstablishmentRequest = 0xc1
 	MessageTypePDUSessionEstablishmentAccept  = 0xc2
+	MessageTypePDUSessionEstablishmentReject  = 0xc3
+	MessageTypePDUSessionModificationCommand  = 0xcb
+	MessageTypePDUSessionModificationComplete = 0xcc
+	MessageTypePDUSessionModCommandReject     = 0xcd
+	MessageTypePDUSessionReleaseRequest       = 0xd1
+	MessageTypePDUSessionReleaseReject        = 0xd2
+	MessageTypePDUSessionReleaseCommand       = 0xd3
+	MessageTypePDUSessionReleaseComplete      = 0xd4
+	MessageTypeSMStatus                       = 0xd6
 )
 
 var msgTypeStr = map[int]string{
 	MessageTypeRegistrationRequest:            "Registration Request",
 	MessageTypeRegistrationAccept:             "Registration Accept",
 	MessageTypeRegistrationComplete:           "Registration Complete",
+	MessageTypeRegistrationReject:             "Registration Reject",
 	MessageTypeDeregistrationRequest:          "Deregistration Request",
 	MessageTypeDeregistrationAccept:           "Deregistration Accept",
+	MessageTypeDeregistrationRequestUETerm:    "Deregistration Request (UE terminated)",
+	MessageTypeDeregistrationAcceptUETerm:     "Deregistration Accept (UE terminated)",
+	MessageTypeServiceRequest:                 "Service Request",
+	MessageTypeServiceReject:                  "Service Reject",
+	MessageTypeServiceAccept:                  "Service Accept",
+	MessageTypeConfigurationUpdateCommand:     "Configuration Update Command",
+	MessageTypeConfigurationUpdateComplete:    "Configuration Update Complete",
 	MessageTypeAuthenticationRequest:          "Authentication Request",
 	MessageTypeAuthenticationResponse:         "Authentication Response",
+	MessageTypeAuthenticationReject:           "Authentication Reject",
+	MessageTypeAuthenticationFailure:          "Authentication Failure",
+	MessageTypeIdentityRequest:                "Identity Request",
+	MessageTypeIdentityResponse:               "Identity Response",
 	MessageTypeSecurityModeCommand:            "Security Mode Command",
 	MessageTypeSecurityModeComplete:           "Security Mode Complete",
+	MessageTypeSecurityModeReject:             "Security Mode Reject",
+	MessageTypeMMStatus:                       "5GMM Status",
 	MessageTypeULNasTransport:                 "UL NAS Transport",
 	MessageTypeDLNasTransport:                 "DL NAS Transport",
 	MessageTypePDUSessionEstablishmentRequest: "PDU Session Establishment Request",
 	MessageTypePDUSessionEstablishmentAccept:  "PDU Session Establishment Accept",
+	MessageTypePDUSessionEstablishmentReject:  "PDU Session Establishment Reject",
+	MessageTypePDUSessionModificationCommand:  "PDU Session Modification Command",
+	MessageTypePDUSessionModificationComplete: "PDU Session Modification Complete",
+	MessageTypePDUSessionModCommandReject:     "PDU Session Modification Command Reject",
+	MessageTypePDUSessionReleaseRequest:       "PDU Session Release Request",
+	MessageTypePDUSessionReleaseReject:        "PDU Session Release Reject",
+	MessageTypePDUSessionReleaseCommand:       "PDU Session Release Command",
+	MessageTypePDUSessionReleaseComplete:      "PDU Session Release Complete",
+	MessageTypeSMStatus:                       "5GSM Status",
 }
 
 const (
 	ieiRequestType          = 0x8
+	ieiAlwaysOnPDUSessInd   = 0x8
+	ieiConfigUpdateInd      = 0xd
 	ieiPDUSessionType       = 0x9
 	ieiIMEISVRequest        = 0xe
 	iei5GMMCapability       = 0x10
 	ieiPDUSessionID2        = 0x12
 	ieiNSSAI                = 0x15
 	ieiGPRSTimer2           = 0x16
+	ieiMMCause              = 0x58
 	ieiAuthParamAUTN        = 0x20
 	ieiAuthParamRAND        = 0x21
 	ieiSNSSAI               = 0x22
 	ieiDNN                  = 0x25
+	ieiSMCapability         = 0x28
+	ieiPDUSessReactResult   = 0x26
 	ieiPDUAddress           = 0x29
+	ieiSessionAMBR          = 0x2a
 	ieiAuthParamRES         = 0x2d
+	ieiAuthFailureParam     = 0x30
 	ieiUESecurityCapability = 0x2e
 	ieiAdditional5GSecInfo  = 0x36
+	ieiUplinkDataStatus     = 0x40
+	ieiFullNameForNetwork   = 0x43
+	ieiShortNameForNetwork  = 0x45
+	ieiLocalTimeZone        = 0x46
+	ieiUniversalTimeAndTZ   = 0x47
+	ieiNetworkDST           = 0x49
+	ieiPDUSessionStatus     = 0x50
 	ieiTAIList              = 0x54
+	ieiRQTimerValue         = 0x56
 	iei5GSMCause            = 0x59
+	ieiLastVisitedRegTAI    = 0x52
+	iei5GSUpdateType        = 0x53
 	ieiGPRSTimer3           = 0x5e
+	ieiT3346Value           = 0x5f
+	ieiT3448Value           = 0x6b
 	ieiNASMessageContainer  = 0x71
+	ieiMappedEPSBearerCtx   = 0x75
 	iei5GSMobileIdentity    = 0x77
+	ieiAuthorizedQoSFlows   = 0x79
+	ieiAuthorizedQoSRules   = 0x7a
+	ieiExtendedPCO          = 0x7b
 	ieiNonSupported         = 0xff
 )
 
@@ -218,15 +450,37 @@ var ieStr = map[int]string{
 	ieiAuthParamRAND:        "Authentication Parameter RAND",
 	ieiSNSSAI:               "S-NSSAI",
 	ieiDNN:                  "DNN",
+	ieiPDUSessReactResult:   "PDU session reactivation result",
 	ieiPDUAddress:           "PDU address",
+	ieiSessionAMBR:          "Session-AMBR",
 	ieiAuthParamRES:         "Authentication response parameter",
+	ieiAuthFailureParam:     "Authentication failure parameter",
 	ieiUESecurityCapability: "UE Security Capability",
 	ieiAdditional5GSecInfo:  "Additional 5G Security Information",
+	ieiUplinkDataStatus:     "Uplink data status",
+	ieiConfigUpdateInd:      "Configuration update indication",
+	ieiFullNameForNetwork:   "Full name for network",
+	ieiShortNameForNetwork:  "Short name for network",
+	ieiLocalTimeZone:        "Local time zone",
+	ieiUniversalTimeAndTZ:   "Universal time and local time zone",
+	ieiNetworkDST:           "Network daylight saving time",
+	ieiPDUSessionStatus:     "PDU session status",
+	iei5GSUpdateType:        "5GS update type",
+	ieiLastVisitedRegTAI:    "Last visited registered TAI",
 	ieiTAIList:              "Tracking Area Identity List",
+	ieiRQTimerValue:         "RQ timer value",
+	ieiSMCapability:         "5GSM capability",
+	ieiMMCause:              "5GMM cause",
 	iei5GSMCause:            "5GSM cause",
 	ieiGPRSTimer3:           "GPRS Timer 3",
+	ieiT3346Value:           "T3346 value",
+	ieiT3448Value:           "T3448 value",
 	ieiNASMessageContainer:  "NAS Message Container",
 	iei5GSMobileIdentity:    "5GS Mobile Identity",
+	ieiMappedEPSBearerCtx:   "Mapped EPS bearer contexts",
+	ieiAuthorizedQoSFlows:   "Authorized QoS flow descriptions",
+	ieiAuthorizedQoSRules:   "Authorized QoS rules",
+	ieiExtendedPCO:          "Extended protocol configuration options",
 	ieiNonSupported:         "Non Supported",
 }
 
@@ -250,8 +504,83 @@ func (ue *UE) PowerON() {
 	ue.dbgLevel = 0
 
 	ue.MMstate = MMDeregistared
-	ue.Recv.state = rcvdNull
+	ue.decoded(0)
+	ue.sec.ngKSI = KeySetIdentityNoKeyIsAvailable
+	ue.sec.newContext = false
 	ue.SUPI = fmt.Sprintf("%d%02d%s", ue.MCC, ue.MNC, ue.MSIN)
+
+	// any SQN is accepted first unless SQN_MS is given.
+	ue.AuthParam.sqnMS = nil
+	if sqn, err := hex.DecodeString(ue.AuthParam.SQN); err == nil &&
+		len(sqn) > 0 && len(sqn) <= 6 {
+		ue.AuthParam.sqnMS = make([]byte, 6)
+		copy(ue.AuthParam.sqnMS[6-len(sqn):], sqn)
+	}
+
+	// the PDU sessions in the configuration may be shared with other UEs.
+	sessions := ue.PDUSessions
+	ue.PDUSessions = nil
+	ids := ue.allocPDUSessionIDs(sessions)
+	for i, s := range sessions {
+		if ids[i] == 0 {
+			continue
+		}
+		tmp := PDUSession{ID: ids[i], DNN: s.DNN, SNSSAI: s.SNSSAI,
+			Type: s.Type, ReflectiveQoS: s.ReflectiveQoS,
+			Emergency: s.Emergency}
+		ue.PDUSessions = append(ue.PDUSessions, &tmp)
+	}
+	ue.sm.lastAllocatedPTI = 0
+	ue.sms.pending = nil
+
+	// the UE policy is given by the network after the registration, and
+	// the sections of the configuration may be shared with other UEs.
+	ue.policy.sections = nil
+	ue.policy.pti = 0
+	ue.policy.results = nil
+
+	ue.stopAllTimers()
+	ue.tm.regAttempt = 0
+}
+
+// maxPSI is the last PDU session identity value. see 9.4 PDU session
+// identity
+const maxPSI = 15
+
+// allocPDUSessionIDs returns the PDU session identity of each session in
+// the configuration. The session without the ID takes the lowest free one,
+// and the ID out of range or used by the other session is rejected as 0.
+func (ue *UE) allocPDUSessionIDs(sessions []*PDUSession) (ids []uint8) {
+
+	ids = make([]uint8, len(sessions))
+	var used [maxPSI + 1]bool
+	for i, s := range sessions {
+		switch {
+		case s.ID == 0:
+		case s.ID > maxPSI || used[s.ID]:
+			log.Printf("nas: %s: PDU session ID %d is out of range or "+
+				"duplicated, and ignored", ue.SUPI, s.ID)
+		default:
+			used[s.ID] = true
+			ids[i] = s.ID
+		}
+	}
+	for i, s := range sessions {
+		if s.ID != 0 {
+			continue
+		}
+		for id := uint8(1); id <= maxPSI && ids[i] == 0; id++ {
+			if used[id] == false {
+				used[id] = true
+				ids[i] = id
+			}
+		}
+		if ids[i] == 0 {
+			log.Printf("nas: %s: no PDU session ID is left for DNN %q",
+				ue.SUPI, s.DNN)
+		}
+	}
+	return
 }
 
 func (ue *UE) Receive(pdu *[]byte) {
@@ -259,20 +588,19 @@ func (ue *UE) Receive(pdu *[]byte) {
 	return
 }
 
+// MakeNasPdu returns the response to the last received message, or nil if
+// no response is required or it is already given. The response is given
+// by the message type in the 5GMM state and the 5GSM state. see fsm.go
 func (ue *UE) MakeNasPdu() (pdu []byte) {
 
-	ue.dprint("MakeNasPdu: called in %s", rcvdStateStr[ue.Recv.state])
+	ue.dprint("MakeNasPdu: called for %s in %s",
+		msgTypeStr[ue.fsm.mmType], MMstateStr[ue.MMstate])
 
-	switch ue.Recv.state {
-	case rcvdNull:
-	case rcvdAuthenticationRequest:
-		pdu = ue.MakeAuthenticationResponse()
-	case rcvdSecurityModeCommand:
-		pdu = ue.MakeSecurityModeComplete()
-	case rcvdRegistrationAccept:
-		pdu = ue.MakeRegistrationComplete()
-		ue.dprint("GNBSIM: [REGISTERED]")
+	if ue.fsm.answered {
+		return
 	}
+	pdu = ue.response()
+	ue.fsm.answered = true
 	return
 }
 
@@ -304,19 +632,62 @@ func (ue *UE) Decode5GMM(pdu *[]byte) (msgType int) {
 		seq := uint8((*pdu)[0])
 		ue.dprinti("seq: %d", seq)
 
-		macCalc := ue.ComputeMAC(1, pdu)
+		// the NAS COUNTs start from zero in the new security context. The
+		// algorithms and the NAS COUNTs are taken into use only after the
+		// integrity is checked, so the replayed or forged Security Mode
+		// Command changes nothing.
+		sec := ue.sec
+		kenc, kint := ue.AuthParam.Kenc, ue.AuthParam.Kint
+		discard := func(err error) {
+			ue.sec = sec
+			ue.AuthParam.Kenc, ue.AuthParam.Kint = kenc, kint
+			ue.DecodeError = err
+			ue.dprint("***** %v", err)
+			*pdu = []byte{}
+		}
+		newContext := false
+		if secHeader == SecurityHeaderTypeIntegrityProtectedWithNewContext {
+			var err error
+			if newContext, err = ue.peekNASSecurityAlgorithms(*pdu); err != nil {
+				discard(err)
+				ue.decoded(MessageTypeSecurityModeCommand)
+				ue.sec.rejected = true
+				return
+			}
+		}
+
+		count := uint32(seq)
+		if newContext == false {
+			var err error
+			if count, err = ue.estimateDLCount(seq); err != nil {
+				discard(err)
+				return
+			}
+		}
+		ue.dprinti("count: 0x%06x", count)
+
+		macCalc := ue.computeMAC(1, count, pdu)
 		if reflect.DeepEqual(mac, macCalc) == false {
-			ue.DecodeError = fmt.Errorf("nas: integrity checking failed")
-			ue.dprint("***** Integrity check failed...")
 			ue.dprint("Received  : %x", mac)
 			ue.dprint("Calculated: %x", macCalc)
-			*pdu = []byte{}
+			discard(fmt.Errorf("nas: integrity checking failed"))
 			return
 		}
 		ue.dprint("***** Integrity check passed")
+		if newContext {
+			ue.resetNASCount()
+			ue.sec.newContext = false
+		}
+		ue.DLCount = count
+		ue.sec.dlCountValid = true
 
 		readPduByte(pdu)
 
+		if secHeader == SecurityHeaderTypeIntegrityProtectedAndCiphered ||
+			secHeader == SecurityHeaderTypeIntegrityProtectedAndCipheredWithNewContext {
+			*pdu = ue.Cipher(1, count, *pdu)
+		}
+
 		ue.wa.securityHeaderParsed = true
 		msgType = ue.Decode(pdu)
 		return
@@ -330,16 +701,55 @@ func (ue *UE) Decode5GMM(pdu *[]byte) (msgType int) {
 		ue.dprinti("### workaround: SecurityHeaderParsed.")
 	}
 
+	raw := append([]byte{EPD5GSMobilityManagement, secHeader}, *pdu...)
+	if m, err := decodeMessage(raw, true); err == nil {
+		ue.Recv.message = m
+	}
+
 	msgType = ue.decMessageType(pdu)
 
+	ue.decoded(msgType)
+	if ue.fsm.active && ue.mmCompatible(msgType) == false {
+		ue.dprint("%s is not compatible with %s",
+			msgTypeStr[msgType], MMstateStr[ue.MMstate])
+		ue.fsm.mmCause = MMCauseMessageNotCompatible
+		*pdu = []byte{}
+		ue.wa.securityHeaderParsed = false
+		return
+	}
+
 	ue.indent++
 	switch msgType {
 	case MessageTypeRegistrationAccept:
 		ue.decRegistrationAccept(pdu)
 		break
+	case MessageTypeRegistrationReject:
+		ue.decRegistrationReject(pdu)
+		break
+	case MessageTypeDeregistrationAccept:
+		ue.decDeregistrationAccept(pdu)
+		break
+	case MessageTypeDeregistrationRequestUETerm:
+		ue.decDeregistrationRequest(pdu)
+		break
 	case MessageTypeAuthenticationRequest:
 		ue.decAuthenticationRequest(pdu)
 		break
+	case MessageTypeAuthenticationReject:
+		ue.decAuthenticationReject(pdu)
+		break
+	case MessageTypeServiceAccept:
+		ue.decServiceAccept(pdu)
+		break
+	case MessageTypeServiceReject:
+		ue.decServiceReject(pdu)
+		break
+	case MessageTypeConfigurationUpdateCommand:
+		ue.decConfigurationUpdateCommand(pdu)
+		break
+	case MessageTypeIdentityRequest:
+		ue.decIdentityRequest(pdu)
+		break
 	case MessageTypeSecurityModeCommand:
 		ue.decSecurityModeCommand(pdu)
 		break
@@ -363,11 +773,32 @@ func (ue *UE) Decode5GSM(pdu *[]byte) (msgType int) {
 
 	msgType = ue.decMessageType(pdu)
 
+	ue.fsm.smType = msgType
+	if ue.fsm.active && ue.smCompatible(msgType) == false {
+		ue.dprint("%s is not compatible with the PDU session(%d) state",
+			msgTypeStr[msgType], ue.sm.pduSessionId)
+		ue.fsm.smCause = smCauseMessageNotCompatible
+		*pdu = []byte{}
+		return
+	}
+
 	ue.indent++
 	switch msgType {
 	case MessageTypePDUSessionEstablishmentAccept:
 		ue.decPDUSessionEstablishmentAccept(pdu)
 		break
+	case MessageTypePDUSessionEstablishmentReject:
+		ue.decPDUSessionEstablishmentReject(pdu)
+		break
+	case MessageTypePDUSessionModificationCommand:
+		ue.decPDUSessionModificationCommand(pdu)
+		break
+	case MessageTypePDUSessionReleaseReject:
+		ue.decPDUSessionReleaseReject(pdu)
+		break
+	case MessageTypePDUSessionReleaseCommand:
+		ue.decPDUSessionReleaseCommand(pdu)
+		break
 	default:
 		break
 	}
@@ -406,24 +837,76 @@ func (ue *UE) decInformationElement(pdu *[]byte, ieStrMap map[int]string) {
 		switch iei {
 		case ieiIMEISVRequest:
 			ue.decIMEISVRequest(pdu)
+		case ieiConfigUpdateInd:
+			ue.decConfigurationUpdateIndication(pdu)
+		case ieiFullNameForNetwork:
+			ue.Recv.network.fullName = ue.decNetworkName(pdu)
+		case ieiShortNameForNetwork:
+			ue.Recv.network.shortName = ue.decNetworkName(pdu)
+		case ieiLocalTimeZone:
+			ue.decTimeZone(pdu)
+		case ieiUniversalTimeAndTZ:
+			ue.decTimeZoneAndTime(pdu)
+		case ieiNetworkDST:
+			ue.decDaylightSavingTime(pdu)
 		case ieiPDUSessionID2:
 			ue.decPDUSessionID2(pdu)
 		case ieiNSSAI:
 			ue.decNSSAI(pdu)
 		case ieiGPRSTimer2:
+			ue.Recv.t3502 = ue.decGPRSTimer2(pdu)
+		case ieiT3346Value:
+			ue.Recv.t3346 = ue.decGPRSTimer2(pdu)
+		case ieiMMCause:
+			ue.Recv.mmCause = ue.dec5GMMCause(pdu)
+		case ieiT3448Value:
 			ue.decGPRSTimer2(pdu)
+		case ieiPDUSessionStatus:
+			ue.decPDUSessionStatus(pdu)
+		case ieiPDUSessReactResult:
+			ue.decPDUSessionReactivationResult(pdu)
 		case ieiAuthParamAUTN:
 			ue.decAuthParamAUTN(pdu)
 		case ieiAuthParamRAND:
 			ue.decAuthParamRAND(pdu)
 		case ieiPDUAddress:
-			ue.decPDUAddress(pdu)
+			addr, iid := ue.decPDUAddress(pdu)
+			if s := ue.PDUSession(ue.sm.pduSessionId); s != nil {
+				s.Address = addr
+				s.InterfaceID = iid
+				s.Address6 = nil
+			}
 		case ieiAdditional5GSecInfo:
 			ue.decAdditional5GSecInfo(pdu)
 		case ieiTAIList:
 			ue.decTAIList(pdu)
 		case iei5GSMCause:
 			ue.dec5GSMCause(pdu)
+		case ieiSNSSAI:
+			ue.decSNSSAI(false, pdu)
+		case ieiSessionAMBR:
+			ue.decSessionAMBR(pdu)
+		case ieiRQTimerValue:
+			sec := ue.decGPRSTimer(pdu)
+			if s := ue.PDUSession(ue.sm.pduSessionId); s != nil {
+				s.setRQTimer(time.Duration(sec) * time.Second)
+			}
+		case ieiAlwaysOnPDUSessInd:
+			ue.dprinti("Always-on PDU session: %v", (*pdu)[0]&0x1 != 0)
+			readPduByte(pdu)
+		case ieiAuthorizedQoSRules:
+			if err := ue.decQoSRules(pdu); err != nil {
+				ue.dprint("error: %v", err)
+				ue.sm.cause = smCauseSemanticErrorInQoSOperation
+			}
+		case ieiAuthorizedQoSFlows:
+			if err := ue.decQoSFlowDescriptions(pdu); err != nil {
+				ue.dprint("error: %v", err)
+				ue.sm.cause = smCauseSemanticErrorInQoSOperation
+			}
+		case ieiMappedEPSBearerCtx, ieiExtendedPCO:
+			length := int(readPduUint16(pdu))
+			readPduByteSlice(pdu, length)
 		case ieiGPRSTimer3:
 			ue.decGPRSTimer3(pdu)
 		case iei5GSMobileIdentity:
@@ -482,17 +965,32 @@ func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 		ue.dprint("RES : %x", m.RES)
 	*/
 
+	// TS 33.102 6.3.3 Authentication and key agreement
+	ue.AuthParam.cause = 0
+	ue.AuthParam.auts = nil
 	if reflect.DeepEqual(ue.AuthParam.mac, m.MACA) == false {
 		ue.dprinti("received and calculated MAC values do not match.\n")
 		ue.indent = orig
-		// need response for error.
+		ue.AuthParam.cause = MMCauseMACFailure
+		return
+	}
+
+	if ue.AuthParam.sqnMS != nil &&
+		bytes.Compare(m.SQN, ue.AuthParam.sqnMS) <= 0 {
+		ue.dprinti("SQN %x is not fresh, SQN_MS: %x.\n",
+			m.SQN, ue.AuthParam.sqnMS)
+		ue.indent = orig
+		ue.AuthParam.cause = MMCauseSynchFailure
+		ue.AuthParam.auts = ue.computeAUTS(m)
 		return
 	}
+	ue.AuthParam.sqnMS = append([]byte{}, m.SQN...)
 
 	ue.ComputeKausf(m.CK, m.IK)
 	ue.ComputeKseaf()
 	ue.ComputeKamf()
 	ue.ComputeAlgKey()
+	ue.sec.newContext = true
 
 	ue.ComputeRESstar(m.RAND, m.RES, m.CK, m.IK)
 
@@ -507,8 +1005,6 @@ func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 	ue.dprint("received and calculated MAC values match.")
 	ue.indent = orig
 
-	ue.Recv.state = rcvdAuthenticationRequest
-
 	return
 }
 
@@ -525,29 +1021,160 @@ func (ue *UE) MakeAuthenticationResponse() (pdu []byte) {
 	return
 }
 
+// 8.2.5 Authentication reject
+// 5.4.1.3.5 Authentication not accepted by the network
+func (ue *UE) decAuthenticationReject(pdu *[]byte) {
+
+	ue.dprint("Authentication Reject")
+
+	// the EAP message IE is not used for 5G AKA.
+	*pdu = []byte{}
+
+	ue.Recv.fiveGGUTI = nil
+	ue.Recv.tai = nil
+	ue.MMstate = MMDeregistared
+	ue.stopTimer(T3510, 0)
+	ue.stopTimer(T3517, 0)
+	ue.stopTimer(T3521, 0)
+
+	ue.DecodeError = &RejectError{
+		MsgType: MessageTypeAuthenticationReject,
+	}
+	return
+}
+
+// 8.2.4 Authentication failure
+func (ue *UE) MakeAuthenticationFailure() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeAuthenticationFailure)
+	pdu = append(pdu, ue.AuthParam.cause)
+
+	if ue.AuthParam.cause == MMCauseSynchFailure {
+		pdu = append(pdu, ue.encAuthFailureParam()...)
+	}
+
+	return
+}
+
+// AuthenticationFailed reports whether the last Authentication Request
+// was not accepted, i.e. Authentication Failure is to be sent.
+func (ue *UE) AuthenticationFailed() bool {
+	return ue.commanded(MessageTypeAuthenticationRequest) &&
+		ue.AuthParam.cause != 0
+}
+
 // 8.2.6 Registration request
 // 5.5.1.2 Registration procedure for initial registration
+// It returns nil with EncodeError if the SUCI cannot be concealed by the
+// protection scheme configured, not to send the SUPI in cleartext.
 func (ue *UE) MakeRegistrationRequest() (pdu []byte) {
 
+	ue.EncodeError = nil
+
+	// the UE without the valid subscription is identified by the PEI for
+	// the emergency registration. see 5.5.1.2.2
+	typeID := TypeIDSUCI
+	if ue.Emergency && ue.NoUSIM {
+		typeID = TypeIDIMEI
+	}
+	id, err := ue.enc5GSMobileID(false, typeID)
+	if err != nil {
+		ue.EncodeError = err
+		ue.dprint("error: Registration Request is not sent: %v", err)
+		return nil
+	}
+
 	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
 		MessageTypeRegistrationRequest)
 
 	tmp := ue.encRegistrationType()
 	pdu = append(pdu, ue.encNASKeySetIdentifier(&tmp)...)
-	pdu = append(pdu, ue.enc5GSMobileID(false, TypeIDSUCI)...)
+	pdu = append(pdu, id...)
 
 	data := new(bytes.Buffer)
 	binary.Write(data, binary.BigEndian, enc5GMMCapability())
 	binary.Write(data, binary.BigEndian, encUESecurityCapability())
 	pdu = append(pdu, data.Bytes()...)
+	if ue.SMSOverNAS {
+		pdu = append(pdu, ue.enc5GSUpdateType()...)
+	}
 
 	ue.MMstate = MMRegisteredInitiated
 
 	// start T3510 timer. see 5.5.1.2.2 Initial registration initiation
+	ue.stopTimer(T3511, 0)
+	ue.stopTimer(T3502, 0)
+	ue.startTimer(T3510, 0, nil, func() {
+		ue.MMstate = MMDeregistared
+		ue.abortRegistration()
+	})
+
+	return
+}
+
+// MakeRegistrationUpdate makes Registration Request for the mobility or
+// the periodic registration updating with the 5G-GUTI and the current
+// NAS security context.
+// 5.5.1.3 Mobility and periodic registration update
+// It returns nil with EncodeError if no 5G-GUTI is assigned.
+func (ue *UE) MakeRegistrationUpdate(regType uint8) (pdu []byte) {
+
+	ue.EncodeError = nil
+
+	guti, err := ue.enc5GSMobileID(false, TypeID5GGUTI)
+	if err != nil {
+		ue.EncodeError = err
+		ue.dprint("error: Registration Request is not sent: %v", err)
+		return nil
+	}
+
+	head := ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeRegistrationRequest)
+	head = append(head, ue.sec.ngKSI<<4|regType)
+	head = append(head, guti...)
+
+	var ies []byte
+	if regType == RegistrationTypeMobilityRegistrationUpdating {
+		data := new(bytes.Buffer)
+		binary.Write(data, binary.BigEndian, encUESecurityCapability())
+		head = append(head, data.Bytes()...)
+		ies = append(ies, enc5GMMCapability()...)
+	}
+
+	// non-cleartext IEs. see 4.4.6 Protection of initial NAS signalling messages
+	ies = append(ies, ue.encLastVisitedRegisteredTAI()...)
+	active := ue.activePDUSessions()
+	if len(active) > 0 {
+		ies = append(ies, ue.encUplinkDataStatus(active)...)
+	}
+	ies = append(ies, ue.encPDUSessionStatus(active)...)
+	if ue.SMSOverNAS {
+		ies = append(ies, ue.enc5GSUpdateType()...)
+	}
+
+	pdu = ue.encInitialNASMessage(head, ies)
+
+	ue.MMstate = MMRegisteredInitiated
+
+	// start T3510 timer. see 5.5.1.3.2 Mobility and periodic registration
+	// update initiation
+	ue.stopTimer(T3511, 0)
+	ue.stopTimer(T3502, 0)
+	ue.startTimer(T3510, 0, nil, func() {
+		ue.MMstate = MMRegistered
+		ue.abortRegistration()
+	})
 
 	return
 }
 
+// T3512 returns the periodic registration update timer given by the
+// network, or 0 if it is deactivated or not received.
+func (ue *UE) T3512() time.Duration {
+	return time.Duration(ue.Recv.t3512) * time.Second
+}
+
 // 8.2.7 Registration accept
 var ieStrRegAcc = map[int]string{
 	ieiNSSAI:             "Allowed NSSAI",
@@ -567,8 +1194,67 @@ func (ue *UE) decRegistrationAccept(pdu *[]byte) {
 	ue.decInformationElement(pdu, ieStrRegAcc)
 	ue.indent--
 
-	ue.Recv.state = rcvdRegistrationAccept
+	ue.MMstate = MMRegistered
+	ue.stopTimer(T3510, 0)
+	ue.stopTimer(T3511, 0)
+	ue.stopTimer(T3502, 0)
+	ue.tm.regAttempt = 0
+
+	return
+}
+
+// EmergencyRegistered reports whether the UE is registered for the
+// emergency services by the last Registration Accept.
+func (ue *UE) EmergencyRegistered() bool {
+	return ue.MMstate == MMRegistered && ue.Recv.emergency
+}
+
+// SMSAllowed reports whether SMS over NAS is allowed by the last
+// Registration Accept.
+func (ue *UE) SMSAllowed() bool {
+	return ue.MMstate == MMRegistered && ue.Recv.smsAllowed
+}
+
+// emergencyPDUSession reports whether the PDU session is for the
+// emergency services. The UE registered for the emergency services
+// requests only the emergency PDU session. see 5.5.1.2.4
+func (ue *UE) emergencyPDUSession(s *PDUSession) bool {
+	return s.Emergency || ue.Emergency
+}
+
+// 8.2.9 Registration reject
+var ieStrRegRej = map[int]string{
+	ieiT3346Value: "T3346 value",
+	ieiGPRSTimer2: "T3502 value",
+}
+
+// 5.5.1.2.5 Initial registration not accepted by the network
+func (ue *UE) decRegistrationReject(pdu *[]byte) {
+
+	ue.dprint("Registration Reject")
+
+	ue.Recv.t3346 = 0
+	ue.Recv.t3502 = 0
+	ue.indent++
+	ue.dprint("5GMM cause IE")
+	cause := ue.dec5GMMCause(pdu)
+	ue.decInformationElement(pdu, ieStrRegRej)
+	ue.indent--
+
+	switch cause {
+	case MMCauseIllegalUE, MMCauseIllegalME, MMCause5GSServicesNotAllowed:
+		ue.Recv.fiveGGUTI = nil
+		ue.Recv.tai = nil
+	}
+	ue.MMstate = MMDeregistared
+	ue.stopTimer(T3510, 0)
 
+	ue.DecodeError = &RejectError{
+		MsgType: MessageTypeRegistrationReject,
+		Cause:   cause,
+		T3346:   ue.Recv.t3346,
+		T3502:   ue.Recv.t3502,
+	}
 	return
 }
 
@@ -606,15 +1292,28 @@ func (ue *UE) MakeULNasTransport(
 		pdu = append(pdu, ue.encPDUSessionID2(ue.sm.pduSessionId)...)
 	}
 
+	s := ue.PDUSession(ue.sm.pduSessionId)
+	emergency := s != nil && ue.emergencyPDUSession(s)
+
 	switch msgType {
 	case MessageTypePDUSessionEstablishmentRequest:
-		pdu = append(pdu, ue.encRequestType(RequestTypeInitialRequest)...)
+		if emergency {
+			pdu = append(pdu,
+				ue.encRequestType(RequestTypeInitialEmergencyRequest)...)
+		} else {
+			pdu = append(pdu, ue.encRequestType(RequestTypeInitialRequest)...)
+		}
 	}
 
+	// S-NSSAI and DNN are not given for the emergency PDU session.
+	// see 6.4.1.2
 	if payloadType == PayloadContainerN1SMInformation &&
-		msgType == MessageTypePDUSessionEstablishmentRequest {
-		pdu = append(pdu, ue.encSNSSAI()...)
-		pdu = append(pdu, ue.encDNN()...)
+		msgType == MessageTypePDUSessionEstablishmentRequest && s != nil &&
+		emergency == false {
+		pdu = append(pdu, ue.encSNSSAI(s.SNSSAI)...)
+		if s.DNN != "" {
+			pdu = append(pdu, ue.encDNN(s.DNN)...)
+		}
 	}
 
 	return
@@ -634,10 +1333,10 @@ func (ue *UE) decDLNasTransport(pdu *[]byte) {
 
 	ue.indent++
 	ue.dprint("Payload container type")
-	ue.decPayloadContainerType(pdu)
+	ctype := ue.decPayloadContainerType(pdu)
 
 	ue.dprint("Payload container")
-	ue.decPayloadContainer(pdu)
+	ue.decPayloadContainer(ctype, pdu)
 
 	ue.decInformationElement(pdu, ieStrDLNasTransport)
 	ue.indent--
@@ -646,15 +1345,34 @@ func (ue *UE) decDLNasTransport(pdu *[]byte) {
 }
 
 // 8.2.12 De-registration request (UE originating de-registration)
+// 5.5.2.2 UE-initiated de-registration procedure
 func (ue *UE) MakeDeregistrationRequest() (pdu []byte) {
 
+	pdu = ue.encDeregistrationRequest()
+	ue.MMstate = MMDeregistaredInitiated
+
+	// T3521 would not be started for the switch off, but the UE never
+	// de-registers for the switch off. see encDeregistrationType and
+	// 5.5.2.2.1
+	ue.startTimer(T3521, 0, ue.encDeregistrationRequest, func() {
+		ue.MMstate = MMDeregistared
+		for _, s := range ue.PDUSessions {
+			s.SMstate = SMInactive
+		}
+	})
+	return
+}
+
+func (ue *UE) encDeregistrationRequest() (pdu []byte) {
+
 	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
 		MessageTypeDeregistrationRequest)
 	tmp := ue.encDeregistrationType()
 	pdu = append(pdu, ue.encNASKeySetIdentifier(&tmp)...)
 
 	// see detail is shown in 5.5.2.2 UE-initiated de-registration procedure
-	pdu = append(pdu, ue.enc5GSMobileID(false, TypeID5GGUTI)...)
+	guti, _ := ue.enc5GSMobileID(false, TypeID5GGUTI)
+	pdu = append(pdu, guti...)
 	head := ue.enc5GSecurityProtectedMessageHeader(
 		SecurityHeaderTypeIntegrityProtectedAndCipheredWithNewContext,
 		&pdu)
@@ -663,130 +1381,773 @@ func (ue *UE) MakeDeregistrationRequest() (pdu []byte) {
 	return
 }
 
-// 8.2.25 Security mode command
-var ieStrSecModeCmd = map[int]string{
-	ieiIMEISVRequest:       ieStr[ieiIMEISVRequest],
-	ieiAdditional5GSecInfo: ieStr[ieiAdditional5GSecInfo],
-}
+// 8.2.13 De-registration accept (UE originating de-registration)
+func (ue *UE) decDeregistrationAccept(pdu *[]byte) {
 
-func (ue *UE) decSecurityModeCommand(pdu *[]byte) {
+	ue.dprint("Deregistration Accept (UE originating)")
 
-	ue.dprint("Security Mode Command")
+	ue.stopTimer(T3521, 0)
+	ue.MMstate = MMDeregistared
+	for _, s := range ue.PDUSessions {
+		s.SMstate = SMInactive
+	}
+	return
+}
 
-	ue.indent++
-	ue.dprint("Selected NAS security algorithms IE")
-	ue.decNASSecurityAlgorithms(pdu)
+// 8.2.14 De-registration request (UE terminated de-registration)
+var ieStrDeregReq = map[int]string{
+	ieiMMCause:    ieStr[ieiMMCause],
+	ieiT3346Value: ieStr[ieiT3346Value],
+}
 
-	ue.dprint("ngKSI IE")
-	ue.decNASKeySetIdentifier(pdu)
+// 5.5.2.3 Network-initiated de-registration procedure
+func (ue *UE) decDeregistrationRequest(pdu *[]byte) {
 
-	ue.dprint("Replayed UE security capabilities IE")
-	ue.decUESecurityCapability(pdu)
+	ue.dprint("Deregistration Request (UE terminated)")
 
-	ue.decInformationElement(pdu, ieStrSecModeCmd)
+	ue.Recv.mmCause = 0
+	ue.Recv.t3346 = 0
+	ue.indent++
+	ue.dprint("De-registration type IE")
+	ue.decDeregistrationType(pdu)
+	ue.decInformationElement(pdu, ieStrDeregReq)
 	ue.indent--
 
-	ue.Recv.state = rcvdSecurityModeCommand
+	// the PDU sessions are released locally.
+	for _, s := range ue.PDUSessions {
+		s.SMstate = SMInactive
+	}
+
+	switch ue.Recv.mmCause {
+	case MMCauseIllegalUE, MMCauseIllegalME, MMCause5GSServicesNotAllowed:
+		ue.Recv.fiveGGUTI = nil
+		ue.Recv.tai = nil
+	}
 
 	return
 }
 
-// 8.2.26 Security mode complete
-func (ue *UE) MakeSecurityModeComplete() (pdu []byte) {
+// DeregistrationRequested reports whether the network has deregistered
+// the UE and Deregistration Accept has not been sent yet.
+func (ue *UE) DeregistrationRequested() bool {
+	return ue.commanded(MessageTypeDeregistrationRequestUETerm)
+}
 
-	pdu = ue.enc5GSMMMessageHeader(
-		SecurityHeaderTypePlain,
-		MessageTypeSecurityModeComplete)
+// ReregistrationRequired reports whether the last network initiated
+// de-registration requires the initial registration again.
+func (ue *UE) ReregistrationRequired() bool {
+	return ue.Recv.reregister
+}
 
-	if ue.Recv.flag.imeisv {
-		pdu = append(pdu, ue.enc5GSMobileID(true, TypeIDIMEISV)...)
-		ue.Recv.flag.imeisv = false
-	}
+// 8.2.15 De-registration accept (UE terminated de-registration)
+func (ue *UE) MakeDeregistrationAccept() (pdu []byte) {
 
-	if ue.Recv.flag.rinmr || ue.wa.forceRINMR {
-		pdu = append(pdu,
-			ue.encNASMessageContainer(true, MessageTypeRegistrationRequest)...)
-		ue.Recv.flag.rinmr = false
-	}
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeDeregistrationAcceptUETerm)
 
 	head := ue.enc5GSecurityProtectedMessageHeader(
-		SecurityHeaderTypeIntegrityProtectedAndCipheredWithNewContext, &pdu)
-
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
 	pdu = append(head, pdu...)
 
+	ue.MMstate = MMDeregistared
+
 	return
 }
 
-// 8.3.1 PDU session establishment request
-func (ue *UE) MakePDUSessionEstablishmentRequest() (pdu []byte) {
+// 8.2.16 Service request
+// 5.6.1 Service request procedure
+func (ue *UE) MakeServiceRequest(serviceType uint8) (pdu []byte) {
 
-	ue.sm.pduSessionId = 0x01
-	ue.sm.procedureTransactionId = 0x01
+	ue.sr.serviceType = serviceType
 
-	pdu = ue.enc5GSSMMessageHeader(
-		ue.sm.pduSessionId,           // 9.4 PDU Session ID
-		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
-		MessageTypePDUSessionEstablishmentRequest)
+	head := ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeServiceRequest)
+	head = append(head, serviceType<<4|ue.sec.ngKSI)
+	tmsi, _ := ue.enc5GSMobileID(false, TypeID5GSTMSI)
+	head = append(head, tmsi...)
 
-	pdu = append(pdu, ue.encIntegrityProtectionMaximuDataRate()...)
-	pdu = append(pdu, ue.encPDUSessionType()...)
+	// non-cleartext IEs. see 4.4.6 Protection of initial NAS signalling messages
+	var ies []byte
+	active := ue.activePDUSessions()
+	if serviceType == ServiceTypeData && len(active) > 0 {
+		ies = append(ies, ue.encUplinkDataStatus(active)...)
+	}
+	ies = append(ies, ue.encPDUSessionStatus(active)...)
 
-	pdu = ue.MakeULNasTransport(
-		PayloadContainerN1SMInformation,
-		MessageTypePDUSessionEstablishmentRequest, &pdu)
+	ue.MMstate = MMServiceRequestInitiated
 
-	head := ue.enc5GSecurityProtectedMessageHeader(
-		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = ue.encInitialNASMessage(head, ies)
 
-	pdu = append(head, pdu...)
+	// start T3517 timer. see 5.6.1.2 Service request procedure initiation
+	ue.startTimer(T3517, 0, nil, func() {
+		ue.MMstate = MMRegistered
+	})
 
 	return
 }
 
-// 8.3.2 PDU session establishment accept
-var ieStrPSEAccept = map[int]string{
-	ieiPDUAddress: ieStr[ieiPDUAddress],
-	iei5GSMCause:  ieStr[iei5GSMCause],
+// ServiceType returns the service type of the last Service Request.
+func (ue *UE) ServiceType() uint8 {
+	return ue.sr.serviceType
 }
 
-func (ue *UE) decPDUSessionEstablishmentAccept(pdu *[]byte) {
+// 8.2.17 Service accept
+var ieStrServiceAcc = map[int]string{
+	ieiPDUSessionStatus:   ieStr[ieiPDUSessionStatus],
+	ieiPDUSessReactResult: ieStr[ieiPDUSessReactResult],
+	ieiT3448Value:         ieStr[ieiT3448Value],
+}
 
-	ue.dprint("PDU Session Establishment Accept")
+func (ue *UE) decServiceAccept(pdu *[]byte) {
+
+	ue.dprint("Service Accept")
 
 	ue.indent++
-	ue.dprint("Selected PDU session type")
-	ue.decPDUSessionType(false, pdu)
+	ue.decInformationElement(pdu, ieStrServiceAcc)
+	ue.indent--
 
-	ue.dprint("Selected SSC mode")
-	ue.decSSCMode(false, pdu)
-	*pdu = (*pdu)[1:]
+	ue.MMstate = MMRegistered
+	ue.stopTimer(T3517, 0)
 
-	ue.dprint("Authorized QoS rules")
-	ue.decQoSRules(pdu)
+	return
+}
 
-	ue.dprint("Session AMBR")
-	ue.decSessionAMBR(pdu)
+// 8.2.18 Service reject
+var ieStrServiceRej = map[int]string{
+	ieiPDUSessionStatus: ieStr[ieiPDUSessionStatus],
+	ieiT3346Value:       ieStr[ieiT3346Value],
+	ieiT3448Value:       ieStr[ieiT3448Value],
+}
 
-	ue.decInformationElement(pdu, ieStrPSEAccept)
+// 5.6.1.5 Service request procedure not accepted by the network
+func (ue *UE) decServiceReject(pdu *[]byte) {
 
+	ue.dprint("Service Reject")
+
+	ue.Recv.t3346 = 0
+	ue.indent++
+	ue.dprint("5GMM cause IE")
+	cause := ue.dec5GMMCause(pdu)
+	ue.decInformationElement(pdu, ieStrServiceRej)
 	ue.indent--
 
+	ue.MMstate = MMRegistered
+	ue.stopTimer(T3517, 0)
+	switch cause {
+	case MMCauseIllegalUE, MMCauseIllegalME, MMCause5GSServicesNotAllowed:
+		ue.Recv.fiveGGUTI = nil
+		ue.Recv.tai = nil
+		ue.MMstate = MMDeregistared
+	case MMCauseUEIdentityCannotBeDerived, MMCauseImplicitlyDeregistered:
+		ue.MMstate = MMDeregistared
+	}
+
+	ue.DecodeError = &RejectError{
+		MsgType: MessageTypeServiceReject,
+		Cause:   cause,
+		T3346:   ue.Recv.t3346,
+	}
 	return
 }
 
-// 9.1.1 NAS message format
-func (ue *UE) enc5GSMMMessageHeader(
-	headType uint8, msgType uint8) (head []byte) {
+// 8.2.19 Configuration update command
+var ieStrConfigUpdateCmd = map[int]string{
+	ieiConfigUpdateInd:     ieStr[ieiConfigUpdateInd],
+	iei5GSMobileIdentity:   "5G-GUTI",
+	ieiTAIList:             ieStr[ieiTAIList],
+	ieiNSSAI:               "Allowed NSSAI",
+	ieiFullNameForNetwork:  ieStr[ieiFullNameForNetwork],
+	ieiShortNameForNetwork: ieStr[ieiShortNameForNetwork],
+	ieiLocalTimeZone:       ieStr[ieiLocalTimeZone],
+	ieiUniversalTimeAndTZ:  ieStr[ieiUniversalTimeAndTZ],
+	ieiNetworkDST:          ieStr[ieiNetworkDST],
+}
 
-	head = append(head, EPD5GSMobilityManagement)
-	head = append(head, headType)
-	head = append(head, msgType)
+// 5.4.4 Generic UE configuration update procedure
+func (ue *UE) decConfigurationUpdateCommand(pdu *[]byte) {
+
+	ue.dprint("Configuration Update Command")
+
+	ue.Recv.flag.cuAck = false
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrConfigUpdateCmd)
+	ue.indent--
 
 	return
 }
 
-func (ue *UE) enc5GSSMMessageHeader(
-	psi uint8, pti uint8, msgType uint8) (head []byte) {
+// ConfigurationUpdateAckRequested reports whether the network requests
+// Configuration Update Complete for the last Configuration Update Command.
+func (ue *UE) ConfigurationUpdateAckRequested() bool {
+	return ue.commanded(MessageTypeConfigurationUpdateCommand) &&
+		ue.Recv.flag.cuAck
+}
+
+// NetworkName returns the full name for network, or the short name if
+// the full name is not provided by Configuration Update Command.
+func (ue *UE) NetworkName() string {
+	if ue.Recv.network.fullName != "" {
+		return ue.Recv.network.fullName
+	}
+	return ue.Recv.network.shortName
+}
+
+// 8.2.20 Configuration update complete
+func (ue *UE) MakeConfigurationUpdateComplete() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeConfigurationUpdateComplete)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 8.2.21 Identity request
+// 5.4.3 Identification procedure
+func (ue *UE) decIdentityRequest(pdu *[]byte) {
+
+	ue.dprint("Identity Request")
+
+	ue.indent++
+	ue.dprint("Identity type IE")
+	ue.decIdentityType(pdu)
+	ue.indent--
+
+	return
+}
+
+// IdentityRequested reports whether the network requested the identity
+// and Identity Response has not been sent yet.
+func (ue *UE) IdentityRequested() bool {
+	return ue.commanded(MessageTypeIdentityRequest)
+}
+
+// 8.2.22 Identity response
+func (ue *UE) MakeIdentityResponse() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeIdentityResponse)
+
+	typeID := ue.Recv.idType
+	switch typeID {
+	case TypeIDSUCI, TypeIDIMEI, TypeIDIMEISV:
+	case TypeID5GSTMSI:
+		if ue.FiveGSTMSI() == nil {
+			typeID = TypeIDNoIdentity
+		}
+	default:
+		typeID = TypeIDNoIdentity
+	}
+
+	// no identity is given if the SUCI cannot be concealed.
+	ue.EncodeError = nil
+	id, err := ue.enc5GSMobileID(false, typeID)
+	if err != nil {
+		ue.EncodeError = err
+		ue.dprint("error: %v", err)
+		id, _ = ue.enc5GSMobileID(false, TypeIDNoIdentity)
+	}
+	pdu = append(pdu, id...)
+
+	// the identity may be requested before the security mode control.
+	if ue.AuthParam.Kenc != nil {
+		head := ue.enc5GSecurityProtectedMessageHeader(
+			SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+		pdu = append(head, pdu...)
+	}
+
+	return
+}
+
+// 8.2.25 Security mode command
+var ieStrSecModeCmd = map[int]string{
+	ieiIMEISVRequest:       ieStr[ieiIMEISVRequest],
+	ieiAdditional5GSecInfo: ieStr[ieiAdditional5GSecInfo],
+}
+
+func (ue *UE) decSecurityModeCommand(pdu *[]byte) {
+
+	ue.dprint("Security Mode Command")
+
+	ue.sec.rejected = false
+	ue.indent++
+	if err := ue.checkNASSecurityAlgorithms((*pdu)[0]); err != nil {
+		ue.indent--
+		ue.DecodeError = err
+		ue.dprint("***** %v", err)
+		ue.sec.rejected = true
+		return
+	}
+	ue.dprint("Selected NAS security algorithms IE")
+	ue.decNASSecurityAlgorithms(pdu)
+
+	ue.dprint("ngKSI IE")
+	ue.decNASKeySetIdentifier(pdu)
+
+	ue.dprint("Replayed UE security capabilities IE")
+	ue.decUESecurityCapability(pdu)
+
+	ue.decInformationElement(pdu, ieStrSecModeCmd)
+	ue.indent--
+
+	return
+}
+
+// 8.2.26 Security mode complete
+func (ue *UE) MakeSecurityModeComplete() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(
+		SecurityHeaderTypePlain,
+		MessageTypeSecurityModeComplete)
+
+	if ue.Recv.flag.imeisv {
+		imeisv, _ := ue.enc5GSMobileID(true, TypeIDIMEISV)
+		pdu = append(pdu, imeisv...)
+		ue.Recv.flag.imeisv = false
+	}
+
+	if ue.Recv.flag.rinmr || ue.wa.forceRINMR {
+		pdu = append(pdu,
+			ue.encNASMessageContainer(true, MessageTypeRegistrationRequest)...)
+		ue.Recv.flag.rinmr = false
+	}
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCipheredWithNewContext, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 8.2.27 Security mode reject
+// it is sent without the integrity protection since the security mode
+// control is not taken into use. see 4.4.4.2
+func (ue *UE) MakeSecurityModeReject() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeSecurityModeReject)
+	pdu = append(pdu, MMCauseSecurityModeRejected)
+
+	return
+}
+
+// 8.2.29 5GMM status
+// It is sent without the protection if no security context is in use.
+func (ue *UE) MakeMMStatus(cause uint8) (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeMMStatus)
+	pdu = append(pdu, cause)
+
+	if ue.securityContextInUse() == false {
+		return
+	}
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// securityContextInUse reports whether the NAS security context has been
+// taken into use by Security Mode Command.
+func (ue *UE) securityContextInUse() bool {
+	return ue.AuthParam.Kenc != nil && ue.sec.newContext == false
+}
+
+// 8.3.1 PDU session establishment request
+// id is the PDU session identity of the session in the configuration.
+// It returns nil with EncodeError if the PDU session type is unknown.
+func (ue *UE) MakePDUSessionEstablishmentRequest(id uint8) (pdu []byte) {
+
+	ue.EncodeError = nil
+
+	s := ue.PDUSession(id)
+	if s == nil {
+		ue.dprint("error: PDU session(%d) is not configured", id)
+		return
+	}
+	if _, err := ue.encPDUSessionType(s.Type); err != nil {
+		ue.EncodeError = err
+		ue.dprint("error: PDU session(%d): %v", id, err)
+		return nil
+	}
+
+	ue.sm.pduSessionId = id
+	ue.allocPTI()
+	s.SMstate = SMActivePending
+
+	// the same PTI is used for the retransmission. see 6.4.1.2
+	pti := ue.sm.procedureTransactionId
+	pdu, _ = ue.encPDUSessionEstablishmentRequest(s, pti)
+
+	// the PDU session type is already checked above.
+	ue.startTimer(T3580, id, func() []byte {
+		pdu, _ := ue.encPDUSessionEstablishmentRequest(s, pti)
+		return pdu
+	}, func() {
+		s.SMstate = SMInactive
+	})
+
+	return
+}
+
+func (ue *UE) encPDUSessionEstablishmentRequest(
+	s *PDUSession, pti uint8) (pdu []byte, err error) {
+
+	ue.sm.pduSessionId = s.ID
+	ue.sm.procedureTransactionId = pti
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypePDUSessionEstablishmentRequest)
+
+	pdu = append(pdu, ue.encIntegrityProtectionMaximuDataRate()...)
+	pduType, err := ue.encPDUSessionType(s.Type)
+	if err != nil {
+		return nil, err
+	}
+	pdu = append(pdu, pduType...)
+	if s.ReflectiveQoS {
+		pdu = append(pdu, ue.enc5GSMCapability(smCapabilityRqoS)...)
+	}
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypePDUSessionEstablishmentRequest, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 8.3.2 PDU session establishment accept
+var ieStrPSEAccept = map[int]string{
+	ieiPDUAddress:         ieStr[ieiPDUAddress],
+	iei5GSMCause:          ieStr[iei5GSMCause],
+	ieiRQTimerValue:       ieStr[ieiRQTimerValue],
+	ieiSNSSAI:             ieStr[ieiSNSSAI],
+	ieiAuthorizedQoSFlows: ieStr[ieiAuthorizedQoSFlows],
+}
+
+func (ue *UE) decPDUSessionEstablishmentAccept(pdu *[]byte) {
+
+	ue.dprint("PDU Session Establishment Accept")
+
+	s := ue.PDUSession(ue.sm.pduSessionId)
+	if s == nil {
+		ue.DecodeError = fmt.Errorf("nas: PDU session(%d) is not configured",
+			ue.sm.pduSessionId)
+		*pdu = []byte{}
+		return
+	}
+
+	ue.indent++
+	// the network may select the type other than the requested one,
+	// e.g. IPv4 for IPv4v6.
+	ue.dprint("Selected PDU session type")
+	if name := ue.decPDUSessionType(false, pdu); name != "" {
+		s.Type = name
+	}
+
+	ue.dprint("Selected SSC mode")
+	ue.decSSCMode(false, pdu)
+	*pdu = (*pdu)[1:]
+
+	ue.dprint("Authorized QoS rules")
+	s.setQoSRules(nil)
+	s.qosFlows = nil
+	s.resetDerivedQoSRules()
+	ue.decQoSRules(pdu)
+
+	ue.dprint("Session AMBR")
+	ue.decSessionAMBR(pdu)
+
+	ue.decInformationElement(pdu, ieStrPSEAccept)
+
+	ue.indent--
+
+	s.SMstate = SMActive
+	ue.stopTimer(T3580, s.ID)
+
+	return
+}
+
+// 8.3.3 PDU session establishment reject
+// 6.4.1.4 UE-requested PDU session establishment procedure not accepted
+// by the network
+func (ue *UE) decPDUSessionEstablishmentReject(pdu *[]byte) {
+
+	ue.dprint("PDU Session Establishment Reject")
+
+	ue.indent++
+	ue.dprint("5GSM cause")
+	cause := ue.dec5GSMCause(pdu)
+	// the optional IEs are not used.
+	*pdu = []byte{}
+	ue.indent--
+
+	if s := ue.PDUSession(ue.sm.pduSessionId); s != nil {
+		s.SMstate = SMInactive
+	}
+	ue.stopTimer(T3580, ue.sm.pduSessionId)
+	ue.DecodeError = fmt.Errorf(
+		"nas: PDU session establishment rejected: %s(%d)",
+		smCauseStr[cause], cause)
+
+	return
+}
+
+// 8.3.9 PDU session modification command
+// 6.3.2 Network-requested PDU session modification procedure
+var ieStrPSModCommand = map[int]string{
+	iei5GSMCause:          ieStr[iei5GSMCause],
+	ieiSessionAMBR:        ieStr[ieiSessionAMBR],
+	ieiRQTimerValue:       ieStr[ieiRQTimerValue],
+	ieiAlwaysOnPDUSessInd: "Always-on PDU session indication",
+	ieiAuthorizedQoSRules: ieStr[ieiAuthorizedQoSRules],
+	ieiMappedEPSBearerCtx: ieStr[ieiMappedEPSBearerCtx],
+	ieiAuthorizedQoSFlows: ieStr[ieiAuthorizedQoSFlows],
+	ieiExtendedPCO:        ieStr[ieiExtendedPCO],
+}
+
+func (ue *UE) decPDUSessionModificationCommand(pdu *[]byte) {
+
+	ue.dprint("PDU Session Modification Command")
+
+	ue.sm.cause = 0
+
+	if s := ue.PDUSession(ue.sm.pduSessionId); s == nil || s.SMstate != SMActive {
+		ue.dprint("error: PDU session(%d) is not active", ue.sm.pduSessionId)
+		ue.sm.cause = smCauseInvalidPDUSessionIdentity
+		*pdu = []byte{}
+		return
+	}
+
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrPSModCommand)
+	ue.indent--
+
+	return
+}
+
+// PDUSessionModificationCommanded reports whether the network modified
+// the PDU session and the response has not been sent yet.
+func (ue *UE) PDUSessionModificationCommanded() bool {
+	return ue.smCommanded(MessageTypePDUSessionModificationCommand)
+}
+
+// 8.3.10 PDU session modification complete
+func (ue *UE) MakePDUSessionModificationComplete() (pdu []byte) {
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypePDUSessionModificationComplete)
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypePDUSessionModificationComplete, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 8.3.11 PDU session modification command reject
+func (ue *UE) MakePDUSessionModificationCommandReject() (pdu []byte) {
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypePDUSessionModCommandReject)
+
+	pdu = append(pdu, ue.sm.cause)
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypePDUSessionModCommandReject, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	ue.sm.cause = 0
+
+	return
+}
+
+// 8.3.12 PDU session release request
+// 6.4.3 UE-requested PDU session release procedure
+func (ue *UE) MakePDUSessionReleaseRequest(id uint8) (pdu []byte) {
+
+	s := ue.PDUSession(id)
+	if s == nil {
+		ue.dprint("error: PDU session(%d) is not configured", id)
+		return
+	}
+
+	ue.sm.pduSessionId = id
+	ue.allocPTI()
+	s.SMstate = SMInactivePending
+
+	// the same PTI is used for the retransmission. see 6.4.3.2
+	pti := ue.sm.procedureTransactionId
+	pdu = ue.encPDUSessionReleaseRequest(s, pti)
+
+	ue.startTimer(T3582, id, func() []byte {
+		return ue.encPDUSessionReleaseRequest(s, pti)
+	}, func() {
+		s.SMstate = SMInactive
+	})
+
+	return
+}
+
+func (ue *UE) encPDUSessionReleaseRequest(
+	s *PDUSession, pti uint8) (pdu []byte) {
+
+	ue.sm.pduSessionId = s.ID
+	ue.sm.procedureTransactionId = pti
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypePDUSessionReleaseRequest)
+
+	pdu = append(pdu, ue.enc5GSMCause(smCauseRegularDeactivation)...)
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypePDUSessionReleaseRequest, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 8.3.13 PDU session release reject
+func (ue *UE) decPDUSessionReleaseReject(pdu *[]byte) {
+
+	ue.dprint("PDU Session Release Reject")
+
+	ue.indent++
+	ue.dprint("5GSM cause")
+	cause := ue.dec5GSMCause(pdu)
+	ue.indent--
+
+	if s := ue.PDUSession(ue.sm.pduSessionId); s != nil {
+		s.SMstate = SMActive
+	}
+	ue.stopTimer(T3582, ue.sm.pduSessionId)
+	ue.DecodeError = fmt.Errorf("nas: PDU session release rejected: %s(%d)",
+		smCauseStr[cause], cause)
+
+	return
+}
+
+// 8.3.14 PDU session release command
+// 6.3.3 Network-requested PDU session release procedure
+func (ue *UE) decPDUSessionReleaseCommand(pdu *[]byte) {
+
+	ue.dprint("PDU Session Release Command")
+
+	ue.indent++
+	ue.dprint("5GSM cause")
+	ue.dec5GSMCause(pdu)
+	// the optional IEs are not used.
+	*pdu = []byte{}
+	ue.indent--
+
+	ue.stopTimer(T3582, ue.sm.pduSessionId)
+
+	return
+}
+
+// PDUSessionReleaseCommanded reports whether the network released the
+// PDU session and PDU Session Release Complete has not been sent yet.
+func (ue *UE) PDUSessionReleaseCommanded() bool {
+	return ue.smCommanded(MessageTypePDUSessionReleaseCommand)
+}
+
+// 8.3.15 PDU session release complete
+func (ue *UE) MakePDUSessionReleaseComplete() (pdu []byte) {
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypePDUSessionReleaseComplete)
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypePDUSessionReleaseComplete, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	if s := ue.PDUSession(ue.sm.pduSessionId); s != nil {
+		s.SMstate = SMInactive
+		s.Address = nil
+		s.InterfaceID = nil
+		s.Address6 = nil
+	}
+
+	return
+}
+
+// 8.3.16 5GSM status
+// the PDU session identity and the PTI are those of the received message.
+func (ue *UE) MakeSMStatus(cause uint8) (pdu []byte) {
+
+	pdu = ue.enc5GSSMMessageHeader(
+		ue.sm.pduSessionId,           // 9.4 PDU Session ID
+		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		MessageTypeSMStatus)
+	pdu = append(pdu, cause)
+
+	pdu = ue.MakeULNasTransport(
+		PayloadContainerN1SMInformation,
+		MessageTypeSMStatus, &pdu)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+
+	pdu = append(head, pdu...)
+
+	return
+}
+
+// 9.1.1 NAS message format
+func (ue *UE) enc5GSMMMessageHeader(
+	headType uint8, msgType uint8) (head []byte) {
+
+	head = append(head, EPD5GSMobilityManagement)
+	head = append(head, headType)
+	head = append(head, msgType)
+
+	return
+}
+
+func (ue *UE) enc5GSSMMessageHeader(
+	psi uint8, pti uint8, msgType uint8) (head []byte) {
 
 	head = append(head, EPD5GSSessionManagement)
 	head = append(head, psi)
@@ -802,13 +2163,18 @@ func (ue *UE) enc5GSecurityProtectedMessageHeader(
 	head = append(head, []byte{EPD5GSMobilityManagement}...)
 	head = append(head, []byte{headType}...)
 
-	seq := []byte{uint8(ue.NasCount)}
+	if headType == SecurityHeaderTypeIntegrityProtectedAndCiphered ||
+		headType == SecurityHeaderTypeIntegrityProtectedAndCipheredWithNewContext {
+		*pdu = ue.Cipher(0, ue.ULCount, *pdu)
+	}
+
+	seq := []byte{uint8(ue.ULCount)}
 	*pdu = append(seq, *pdu...)
 
-	mac := ue.ComputeMAC(0, pdu)
+	mac := ue.computeMAC(0, ue.ULCount, pdu)
 	head = append(head, mac...)
 
-	ue.NasCount++
+	ue.ULCount = (ue.ULCount + 1) & nasCountMask
 
 	return
 }
@@ -819,17 +2185,28 @@ func (ue *UE) decPDUSessionIdentity(pdu *[]byte) {
 	id := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 	ue.dprint("PDU Session Identity: 0x%x", id)
+	ue.sm.pduSessionId = uint8(id)
 	return
 }
 
 // 9.6 Procedure transaction identity
+// the network initiated procedure is answered with the same identity.
 func (ue *UE) decProcedureTransactionIdentity(pdu *[]byte) {
 	id := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 	ue.dprint("Procedure Transaction Identity: 0x%x", id)
+	ue.sm.procedureTransactionId = uint8(id)
 	return
 }
 
+// allocPTI allocates the procedure transaction identity for the UE
+// requested procedure. the values from 1 to 254 are used in turn.
+func (ue *UE) allocPTI() uint8 {
+	ue.sm.lastAllocatedPTI = ue.sm.lastAllocatedPTI%254 + 1
+	ue.sm.procedureTransactionId = ue.sm.lastAllocatedPTI
+	return ue.sm.procedureTransactionId
+}
+
 // 9.7 Message type
 func (ue *UE) decMessageType(pdu *[]byte) (msgType int) {
 	msgType = int((*pdu)[0])
@@ -839,12 +2216,12 @@ func (ue *UE) decMessageType(pdu *[]byte) (msgType int) {
 }
 
 // 9.11.2.1B DNN
-func (ue *UE) encDNN() (pdu []byte) {
+func (ue *UE) encDNN(name string) (pdu []byte) {
 
 	pdu = append(pdu, byte(ieiDNN))
 
 	dnn := []byte{}
-	for _, str := range strings.Split(ue.DNN, ".") {
+	for _, str := range strings.Split(name, ".") {
 		dnn = append(dnn, byte(len(str)))
 		dnn = append(dnn, []byte(str)...)
 	}
@@ -855,9 +2232,31 @@ func (ue *UE) encDNN() (pdu []byte) {
 	return
 }
 
+// 9.11.2.3 GPRS timer
+// See subclause 10.5.7.3 in 3GPP TS 24.008.
+func (ue *UE) decGPRSTimer(pdu *[]byte) (sec int) {
+
+	tmp := int(readPduByte(pdu))
+
+	multiple := 2 // 2 seconds
+	switch tmp >> 5 {
+	case 0x1:
+		multiple = 60 // 1 minute
+	case 0x2:
+		multiple = 60 * 60 / 10 // 1 decihours
+	case 0x7:
+		multiple = 0 // deactivated
+	}
+
+	sec = (tmp & 0x1f) * multiple
+	ue.dprinti("GPRS timer: %d sec", sec)
+
+	return
+}
+
 // 9.11.2.4 GPRS timer 2
 // See subclause 10.5.7.4 in 3GPP TS 24.008.
-func (ue *UE) decGPRSTimer2(pdu *[]byte) {
+func (ue *UE) decGPRSTimer2(pdu *[]byte) (sec int) {
 
 	tmp := int((*pdu)[1])
 
@@ -871,9 +2270,9 @@ func (ue *UE) decGPRSTimer2(pdu *[]byte) {
 		multiple = 0 // deactivated
 	}
 
-	ue.Recv.t3502 = (tmp & 0x1f) * multiple
+	sec = (tmp & 0x1f) * multiple
 	*pdu = (*pdu)[2:]
-	ue.dprinti("GPRS timer 2: %d sec", ue.Recv.t3502)
+	ue.dprinti("GPRS timer 2: %d sec", sec)
 
 	return
 }
@@ -957,14 +2356,14 @@ func (ue *UE) decSNSSAI(iei bool, pdu *[]byte) (snssai SNSSAI) {
 	return
 }
 
-func (ue *UE) encSNSSAI() (pdu []byte) {
+func (ue *UE) encSNSSAI(snssai SNSSAI) (pdu []byte) {
 
-	pdu = append(pdu, byte(ieiSNSSAI))
-	pdu = append(pdu, byte(4)) // length: sst = 1, ssd = 3
-	pdu = append(pdu, byte(ue.SNSSAI.SST))
+	sd, _ := hex.DecodeString(snssai.SD)
 
-	tmp, _ := hex.DecodeString(ue.SNSSAI.SD)
-	pdu = append(pdu, tmp...)
+	pdu = append(pdu, byte(ieiSNSSAI))
+	pdu = append(pdu, byte(1+len(sd))) // length: sst = 1, sd = 3
+	pdu = append(pdu, byte(snssai.SST))
+	pdu = append(pdu, sd...)
 
 	return
 }
@@ -995,6 +2394,96 @@ func enc5GMMCapability() (pdu []byte) {
 	return
 }
 
+// 9.11.3.2 5GMM cause
+const (
+	MMCauseIllegalUE                       = 0x03
+	MMCausePEINotAccepted                  = 0x05
+	MMCauseIllegalME                       = 0x06
+	MMCause5GSServicesNotAllowed           = 0x07
+	MMCauseUEIdentityCannotBeDerived       = 0x09
+	MMCauseImplicitlyDeregistered          = 0x0a
+	MMCausePLMNNotAllowed                  = 0x0b
+	MMCauseTrackingAreaNotAllowed          = 0x0c
+	MMCauseRoamingNotAllowedInTA           = 0x0d
+	MMCauseNoSuitableCellsInTA             = 0x0f
+	MMCauseMACFailure                      = 0x14
+	MMCauseSynchFailure                    = 0x15
+	MMCauseCongestion                      = 0x16
+	MMCauseUESecurityCapabilitiesMismatch  = 0x17
+	MMCauseSecurityModeRejected            = 0x18
+	MMCauseNon5GAuthenticationUnacceptable = 0x1a
+	MMCauseN1ModeNotAllowed                = 0x1b
+	MMCauseRestrictedServiceArea           = 0x1c
+	MMCauseRedirectionToEPCRequired        = 0x1f
+	MMCauseNoNetworkSlicesAvailable        = 0x3e
+	MMCauseMaximumNumberOfPDUSessions      = 0x41
+	MMCauseSemanticallyIncorrectMessage    = 0x5f
+	MMCauseInvalidMandatoryInformation     = 0x60
+	MMCauseMessageNotCompatible            = 0x62
+	MMCauseProtocolErrorUnspecified        = 0x6f
+)
+
+var mmCauseStr = map[byte]string{
+	MMCauseIllegalUE:                       "Illegal UE",
+	MMCausePEINotAccepted:                  "PEI not accepted",
+	MMCauseIllegalME:                       "Illegal ME",
+	MMCause5GSServicesNotAllowed:           "5GS services not allowed",
+	MMCauseUEIdentityCannotBeDerived:       "UE identity cannot be derived by the network",
+	MMCauseImplicitlyDeregistered:          "Implicitly de-registered",
+	MMCausePLMNNotAllowed:                  "PLMN not allowed",
+	MMCauseTrackingAreaNotAllowed:          "Tracking area not allowed",
+	MMCauseRoamingNotAllowedInTA:           "Roaming not allowed in this tracking area",
+	MMCauseNoSuitableCellsInTA:             "No suitable cells in tracking area",
+	MMCauseMACFailure:                      "MAC failure",
+	MMCauseSynchFailure:                    "Synch failure",
+	MMCauseCongestion:                      "Congestion",
+	MMCauseUESecurityCapabilitiesMismatch:  "UE security capabilities mismatch",
+	MMCauseSecurityModeRejected:            "Security mode rejected, unspecified",
+	MMCauseNon5GAuthenticationUnacceptable: "Non-5G authentication unacceptable",
+	MMCauseN1ModeNotAllowed:                "N1 mode not allowed",
+	MMCauseRestrictedServiceArea:           "Restricted service area",
+	MMCauseRedirectionToEPCRequired:        "Redirection to EPC required",
+	MMCauseNoNetworkSlicesAvailable:        "No network slices available",
+	MMCauseMaximumNumberOfPDUSessions:      "Maximum number of PDU sessions reached",
+	MMCauseSemanticallyIncorrectMessage:    "Semantically incorrect message",
+	MMCauseInvalidMandatoryInformation:     "Invalid mandatory information",
+	MMCauseMessageNotCompatible:            "Message type not compatible with the protocol state",
+	MMCauseProtocolErrorUnspecified:        "Protocol error, unspecified",
+}
+
+func (ue *UE) dec5GMMCause(pdu *[]byte) (cause uint8) {
+
+	cause = readPduByte(pdu)
+	ue.dprinti("cause: %s(%d)", mmCauseStr[cause], cause)
+	return
+}
+
+// RejectError is set to DecodeError when the network rejects the 5GMM
+// procedure. Cause is not available for Authentication Reject, and the
+// timer values are in seconds (0 if not provided).
+type RejectError struct {
+	MsgType int
+	Cause   uint8
+	T3346   int
+	T3502   int
+}
+
+func (e *RejectError) Error() string {
+	if e.MsgType == MessageTypeAuthenticationReject {
+		return fmt.Sprintf("nas: %s", msgTypeStr[e.MsgType])
+	}
+	return fmt.Sprintf("nas: %s: %s(%d)",
+		msgTypeStr[e.MsgType], mmCauseStr[e.Cause], e.Cause)
+}
+
+// 9.11.3.3 5GS identity type
+func (ue *UE) decIdentityType(pdu *[]byte) {
+
+	ue.Recv.idType = int(readPduByte(pdu) & 0x07)
+	ue.dprinti("type of identity: %d", ue.Recv.idType)
+	return
+}
+
 // 9.11.3.4 5GS mobile identity
 // I need C 'union' for golang...
 const (
@@ -1017,26 +2506,42 @@ const (
 	ProtectionSchemeProfileB
 )
 
-func (ue *UE) enc5GSMobileID(iei bool, typeID int) (pdu []byte) {
+// only the SUCI may fail to be encoded.
+func (ue *UE) enc5GSMobileID(iei bool, typeID int) (pdu []byte, err error) {
 
 	if iei == true {
 		pdu = append(pdu, []byte{iei5GSMobileIdentity}...)
 	}
 
 	switch typeID {
-	//case TypeIDNoIdentity:
+	case TypeIDNoIdentity:
+		pdu = append(pdu, ue.enc5GSMobileIDTypeNoIdentity()...)
 	case TypeIDSUCI:
-		pdu = append(pdu, ue.enc5GSMobileIDTypeSUCI()...)
+		var suci []byte
+		if suci, err = ue.enc5GSMobileIDTypeSUCI(); err != nil {
+			return nil, err
+		}
+		pdu = append(pdu, suci...)
 	case TypeID5GGUTI:
+		if len(ue.Recv.fiveGGUTI) == 0 {
+			return nil, fmt.Errorf("no 5G-GUTI is assigned")
+		}
 		pdu = append(pdu, ue.enc5GSMobileIDType5GGUTI()...)
-	//case TypeIDIMEI:
-	//case TypeID5GSTMSI:
+	case TypeIDIMEI:
+		pdu = append(pdu, ue.enc5GSMobileIDTypeIMEI()...)
+	case TypeID5GSTMSI:
+		pdu = append(pdu, ue.enc5GSMobileIDType5GSTMSI()...)
 	case TypeIDIMEISV:
 		pdu = append(pdu, ue.enc5GSMobileIDTypeIMEISV()...)
 	}
 	return
 }
 
+func (ue *UE) enc5GSMobileIDTypeNoIdentity() (pdu []byte) {
+	pdu = []byte{0x00, 0x01, TypeIDNoIdentity}
+	return
+}
+
 type FiveGSMobileIDSUCI struct {
 	length                 uint16
 	supiFormatAndTypeID    uint8
@@ -1044,30 +2549,40 @@ type FiveGSMobileIDSUCI struct {
 	routingIndicator       [2]uint8
 	protectionScheme       uint8
 	homeNetworkPublicKeyID uint8
-	schemeOutput           [5]uint8
 }
 
-func (ue *UE) enc5GSMobileIDTypeSUCI() (pdu []byte) {
+// the null-scheme is used only if it is configured explicitly, and the
+// concealment failure is not recovered by it.
+func (ue *UE) enc5GSMobileIDTypeSUCI() (pdu []byte, err error) {
 
 	var f FiveGSMobileIDSUCI
 	var typeID uint8 = TypeIDSUCI
 	var supiFormat uint8 = SUPIFormatIMSI
 
+	f.supiFormatAndTypeID = typeID | (supiFormat << 4)
+	f.plmn = encPLMN(ue.MCC, ue.MNC)
+	f.routingIndicator = encRoutingIndicator(ue.RoutingIndicator)
+	if f.protectionScheme, err = encProtectionScheme(ue.ProtectionScheme); err != nil {
+		return nil, err
+	}
+	if f.protectionScheme != ProtectionSchemeNull {
+		f.homeNetworkPublicKeyID = ue.HomeNetworkPublicKeyID
+	}
+
+	so, err := ue.encSchemeOutput(f.protectionScheme)
+	if err != nil {
+		return nil, fmt.Errorf("nas: SUCI concealment failed: %v", err)
+	}
+
 	/*
 	 * it doesn't work with "f.length = uint16(unsafe.Sizeof(*f) - 2)"
 	 * because of the octet alignment.
 	 */
-	f.length = 13
-	f.supiFormatAndTypeID = typeID | (supiFormat << 4)
-	f.plmn = encPLMN(ue.MCC, ue.MNC)
-	f.routingIndicator = encRoutingIndicator(ue.RoutingIndicator)
-	f.protectionScheme = encProtectionScheme(ue.ProtectionScheme)
-	f.homeNetworkPublicKeyID = 0
-	f.schemeOutput = encSchemeOutput(ue.MSIN)
+	f.length = uint16(8 + len(so))
 
 	data := new(bytes.Buffer)
 	binary.Write(data, binary.BigEndian, f)
-	pdu = data.Bytes()
+	pdu = append(data.Bytes(), so...)
 
 	return
 }
@@ -1085,6 +2600,87 @@ func (ue *UE) enc5GSMobileIDType5GGUTI() (pdu []byte) {
 	return
 }
 
+func (ue *UE) enc5GSMobileIDType5GSTMSI() (pdu []byte) {
+
+	id := byte(TypeID5GSTMSI)
+	id |= 0xf0
+	pdu = append(pdu, id)
+	pdu = append(pdu, ue.FiveGSTMSI()...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(pdu)))
+	pdu = append(length, pdu...)
+	return
+}
+
+// FiveGSTMSI returns AMF Set ID, AMF Pointer and 5G-TMSI of the 5G-GUTI
+// assigned by the network, or nil before the registration.
+func (ue *UE) FiveGSTMSI() []byte {
+	// PLMN (3 octets) and AMF Region ID (1 octet) are omitted.
+	const offset = 4
+	if len(ue.Recv.fiveGGUTI) <= offset {
+		return nil
+	}
+	return ue.Recv.fiveGGUTI[offset:]
+}
+
+type FiveGSMobileIDIMEI struct {
+	length uint16
+	imei   [8]byte
+}
+
+func (ue *UE) enc5GSMobileIDTypeIMEI() (pdu []byte) {
+
+	var f FiveGSMobileIDIMEI
+	var typeID uint8 = TypeIDIMEI
+
+	f.length = 8
+
+	imei := ue.IMEI()
+	if len(imei)%2 == 1 {
+		typeID |= 0x08 // odd even bit
+	}
+
+	for i, v := range Str2BCD(fmt.Sprintf("%x%s", typeID, imei)) {
+		f.imei[i] = v
+	}
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, f)
+	pdu = data.Bytes()
+
+	return
+}
+
+// IMEI returns the IMEI derived from the IMEISV, that is TAC and SNR
+// followed by the check digit (TS 23.003 6.2.1 and 6.2.2).
+func (ue *UE) IMEI() string {
+
+	if len(ue.IMEISV) < 14 {
+		return ""
+	}
+	imei := ue.IMEISV[:14]
+	return imei + luhnCheckDigit(imei)
+}
+
+// luhnCheckDigit computes the check digit by the Luhn formula
+// (TS 23.003 Annex B).
+func luhnCheckDigit(digits string) string {
+
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// double every other digit from the rightmost one.
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return strconv.Itoa((10 - sum%10) % 10)
+}
+
 type FiveGSMobileIDIMEISV struct {
 	length uint16
 	imeisv [9]byte
@@ -1157,17 +2753,48 @@ func encRoutingIndicator(ind uint16) (ri [2]byte) {
 	return
 }
 
-func encProtectionScheme(profile string) (p uint8) {
+// encProtectionScheme takes the null-scheme if no scheme is configured.
+func encProtectionScheme(profile string) (p uint8, err error) {
 	switch profile {
-	case "null":
+	case "", "null":
 		p = ProtectionSchemeNull
+	case "profileA":
+		p = ProtectionSchemeProfileA
+	case "profileB":
+		p = ProtectionSchemeProfileB
+	default:
+		err = fmt.Errorf("nas: unknown protection scheme: %q", profile)
 	}
 	return
 }
 
-func encSchemeOutput(msin string) (so [5]byte) {
-	for i, v := range Str2BCD(msin) {
-		so[i] = v
+// suciRand is the source of the ephemeral key pair for SUCI concealment.
+var suciRand io.Reader = rand.Reader
+
+func (ue *UE) encSchemeOutput(scheme uint8) (so []byte, err error) {
+
+	msin := ue.MSIN
+	if len(msin)%2 == 1 {
+		msin += "f"
+	}
+	plain := Str2BCD(msin)
+	if scheme == ProtectionSchemeNull {
+		so = plain
+		return
+	}
+
+	hnPubKey, err := hex.DecodeString(ue.HomeNetworkPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network public key: %v", err)
+	}
+
+	switch scheme {
+	case ProtectionSchemeProfileA:
+		so, err = concealProfileA(hnPubKey, plain, suciRand)
+	case ProtectionSchemeProfileB:
+		so, err = concealProfileB(hnPubKey, plain, suciRand)
+	default:
+		err = fmt.Errorf("unsupported protection scheme: %d", scheme)
 	}
 	return
 }
@@ -1227,6 +2854,8 @@ func (ue *UE) dec5GSRegistrationResult(pdu *[]byte) {
 		not = "Not r"
 	}
 	ue.dprinti("%segistered for emergency services", not)
+	ue.Recv.emergency = result&0x20 != 0
+	ue.Recv.smsAllowed = result&0x8 != 0
 
 	not = ""
 	if result&0x10 == 0 {
@@ -1249,14 +2878,36 @@ func (ue *UE) dec5GSRegistrationResult(pdu *[]byte) {
 
 // 9.11.3.7 5GS registration type
 const (
-	RegistrationTypeInitialRegistration        = 0x01
-	RegistrationTypeFlagFollowOnRequestPending = 0x08
+	RegistrationTypeInitialRegistration          = 0x01
+	RegistrationTypeMobilityRegistrationUpdating = 0x02
+	RegistrationTypePeriodicRegistrationUpdating = 0x03
+	RegistrationTypeEmergencyRegistration        = 0x04
+	RegistrationTypeFlagFollowOnRequestPending   = 0x08
 )
 
 func (ue *UE) encRegistrationType() (pdu []byte) {
 
-	pdu = []byte{RegistrationTypeInitialRegistration |
-		RegistrationTypeFlagFollowOnRequestPending}
+	regType := uint8(RegistrationTypeInitialRegistration)
+	if ue.Emergency {
+		regType = RegistrationTypeEmergencyRegistration
+	}
+	pdu = []byte{regType | RegistrationTypeFlagFollowOnRequestPending}
+	return
+}
+
+// 9.11.3.8 5GS tracking area identity
+// the UE regards the first TAI in the list as the last visited one.
+func (ue *UE) encLastVisitedRegisteredTAI() (pdu []byte) {
+
+	if len(ue.Recv.tai) == 0 {
+		return
+	}
+	tai := ue.Recv.tai[0]
+	plmn := encPLMN(tai.mcc, tai.mnc)
+
+	pdu = append(pdu, ieiLastVisitedRegTAI)
+	pdu = append(pdu, plmn[:]...)
+	pdu = append(pdu, tai.tac...)
 	return
 }
 
@@ -1265,6 +2916,9 @@ func (ue *UE) decTAIList(pdu *[]byte) {
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
+	// the new list replaces the old one.
+	ue.Recv.tai = nil
+
 	tmp := (*pdu)[0]
 	elementNum := int(tmp&0x1f) + 1
 	typeOfList := tmp >> 5
@@ -1313,6 +2967,16 @@ func (ue *UE) decTAIListType00(pdu *[]byte, num int) {
 	return
 }
 
+// 9.11.3.9A 5GS update type
+const (
+	updateTypeSMSRequested = 0x01
+)
+
+func (ue *UE) enc5GSUpdateType() (pdu []byte) {
+	pdu = []byte{iei5GSUpdateType, 1, updateTypeSMSRequested}
+	return
+}
+
 // 9.11.3.10 ABBA
 func (ue *UE) decABBA(pdu *[]byte) {
 
@@ -1365,11 +3029,41 @@ func (ue *UE) decAdditional5GSecInfo(pdu *[]byte) {
 	return
 }
 
+// 9.11.3.14 Authentication failure parameter
+// TS 24.008 10.5.3.2.2 Authentication Failure parameter
+func (ue *UE) encAuthFailureParam() (pdu []byte) {
+
+	pdu = append(pdu, ieiAuthFailureParam)
+	pdu = append(pdu, byte(len(ue.AuthParam.auts)))
+	pdu = append(pdu, ue.AuthParam.auts...)
+	return
+}
+
+// TS 33.102 6.3.5 Re-synchronisation procedure
+// AUTS = SQN_MS xor AK* || MAC-S
+func (ue *UE) computeAUTS(m *milenage.Milenage) (auts []byte) {
+
+	// the dummy AMF is used for MAC-S.
+	macs, _ := m.F1Star(ue.AuthParam.sqnMS, []byte{0x00, 0x00})
+	aks, _ := m.F5Star()
+
+	for n, v := range ue.AuthParam.sqnMS {
+		auts = append(auts, v^aks[n])
+	}
+	auts = append(auts, macs...)
+	ue.dprinti("AUTS: %x", auts)
+	return
+}
+
 // 9.11.3.15 Authentication parameter AUTN
 // TS 24.008 10.5.3.1.1 Authentication Parameter AUTN (UMTS and EPS authentication challenge)
 type AuthParam struct {
 	K        string
 	OPc      string
+	SQN      string // initial SQN_MS, the highest SQN accepted (hex).
+	sqnMS    []byte
+	cause    uint8
+	auts     []byte
 	rand     []byte
 	autn     []byte
 	seqxorak []byte
@@ -1435,6 +3129,35 @@ func (ue *UE) encAuthParamRes() (res AuthParamRes) {
 	return
 }
 
+// 9.11.3.18 Configuration update indication
+const (
+	configUpdateIndAck        = 0x01 // acknowledgement requested
+	configUpdateIndRegRequest = 0x02 // registration requested
+)
+
+func (ue *UE) decConfigurationUpdateIndication(pdu *[]byte) {
+
+	val := readPduByte(pdu) & 0x0f
+	ue.Recv.flag.cuAck = val&configUpdateIndAck != 0
+	ue.dprinti("acknowledgement requested: %v", ue.Recv.flag.cuAck)
+	ue.dprinti("registration requested: %v",
+		val&configUpdateIndRegRequest != 0)
+	return
+}
+
+// 9.11.3.19 Daylight saving time
+// See subclause 10.5.3.12 in 3GPP TS 24.008.
+func (ue *UE) decDaylightSavingTime(pdu *[]byte) {
+
+	length := int(readPduByte(pdu))
+	v := readPduByteSlice(pdu, length)
+	if length > 0 {
+		ue.Recv.network.dst = int(v[0] & 0x03)
+	}
+	ue.dprinti("daylight saving time: +%d hour", ue.Recv.network.dst)
+	return
+}
+
 // 9.11.3.20 De-registration type
 const (
 	accessTypeNull = iota
@@ -1443,12 +3166,27 @@ const (
 	accessType3GPPandNon3GPP
 )
 
+const (
+	deregistrationTypeSwitchOff              = 0x08 // UE originating
+	deregistrationTypeReregistrationRequired = 0x08 // UE terminated
+)
+
+func (ue *UE) decDeregistrationType(pdu *[]byte) {
+
+	val := readPduByte(pdu) & 0x0f
+	ue.Recv.reregister =
+		val&deregistrationTypeReregistrationRequired != 0
+	ue.dprinti("re-registration required: %v", ue.Recv.reregister)
+	ue.dprinti("access type: %d", val&0x03)
+	return
+}
+
 func (ue *UE) encDeregistrationType() (pdu []byte) {
 
 	pdu = []byte{0}
 	switchOff := false
 	if switchOff {
-		pdu[0] |= (1 << 3)
+		pdu[0] |= deregistrationTypeSwitchOff
 	}
 	pdu[0] |= accessType3GPP
 	return
@@ -1477,6 +3215,7 @@ func (ue *UE) decNASKeySetIdentifier(pdu *[]byte) {
 
 	ksi := int((*pdu)[0])
 	ue.dprinti("NAS key set identifier: 0x%x", ksi)
+	ue.sec.ngKSI = uint8(ksi) & 0x0f
 	*pdu = (*pdu)[1:]
 
 	return
@@ -1515,14 +3254,177 @@ func (ue *UE) encNASMessageContainer(iei bool, msgType int) (pdu []byte) {
 	return
 }
 
-// 9.11.3.34 NAS security algorithms
-func (ue *UE) decNASSecurityAlgorithms(pdu *[]byte) {
-
-	alg := (*pdu)[:1]
-	ue.dprinti("NAS Security Algorithms: 0x%02x", alg)
-	*pdu = (*pdu)[1:]
+// encInitialNASMessage protects the initial NAS message with the current
+// NAS security context. The whole message is ciphered into the NAS message
+// container and only the cleartext IEs are sent in the clear.
+// see 4.4.6 Protection of initial NAS signalling messages
+func (ue *UE) encInitialNASMessage(cleartext, ies []byte) (pdu []byte) {
+
+	if ue.AuthParam.Kenc == nil {
+		pdu = append(cleartext, ies...)
+		return
+	}
+
+	whole := append(append([]byte{}, cleartext...), ies...)
+	container := ue.Cipher(0, ue.ULCount, whole)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(container)))
+
+	pdu = append(cleartext, ieiNASMessageContainer)
+	pdu = append(pdu, length...)
+	pdu = append(pdu, container...)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtected, &pdu)
+	pdu = append(head, pdu...)
+	return
+}
+
+// 9.11.3.34 NAS security algorithms
+const (
+	NEA0 = iota // 5G-EA0, null ciphering algorithm
+	NEA1        // 128-5G-EA1
+	NEA2        // 128-5G-EA2
+	NEA3        // 128-5G-EA3
+)
+
+var cipherAlgStr = map[uint8]string{
+	NEA0: "5G-EA0",
+	NEA1: "128-5G-EA1",
+	NEA2: "128-5G-EA2",
+	NEA3: "128-5G-EA3",
+}
+
+const (
+	NIA0 = iota // 5G-IA0, null integrity protection algorithm
+	NIA1        // 128-5G-IA1
+	NIA2        // 128-5G-IA2
+	NIA3        // 128-5G-IA3
+)
+
+var integrityAlgStr = map[uint8]string{
+	NIA0: "5G-IA0",
+	NIA1: "128-5G-IA1",
+	NIA2: "128-5G-IA2",
+	NIA3: "128-5G-IA3",
+}
+
+func (ue *UE) decNASSecurityAlgorithms(pdu *[]byte) {
+
+	alg := (*pdu)[:1]
+	ue.dprinti("NAS Security Algorithms: 0x%02x", alg)
+	ue.selectNASSecurityAlgorithms(alg[0])
+	ue.dprinti("Type of ciphering algorithm: %s(%d)",
+		cipherAlgStr[ue.sec.cipher], ue.sec.cipher)
+	ue.dprinti("Type of integrity protection algorithm: %s(%d)",
+		integrityAlgStr[ue.sec.integrity], ue.sec.integrity)
+	*pdu = (*pdu)[1:]
+
+	return
+}
+
+// checkNASSecurityAlgorithms rejects 5G-IA0 unless the UE is registered
+// or registering for emergency services, or establishing the emergency PDU
+// session. see 5.4.2.3
+func (ue *UE) checkNASSecurityAlgorithms(alg uint8) error {
+
+	if alg&0x7 != NIA0 || ue.Emergency || ue.Recv.emergency {
+		return nil
+	}
+	for _, s := range ue.PDUSessions {
+		if s.Emergency && s.SMstate != SMInactive {
+			return nil
+		}
+	}
+	return fmt.Errorf("nas: 5G-IA0 is not allowed for non-emergency services")
+}
+
+func (ue *UE) selectNASSecurityAlgorithms(alg uint8) {
+
+	ue.sec.cipher = (alg >> 4) & 0x7
+	ue.sec.integrity = alg & 0x7
+	ue.ComputeAlgKey()
+
+	return
+}
+
+/*
+ * the NAS keys depend on the algorithms selected by the Security Mode
+ * Command, so they are needed before checking its integrity. It reports
+ * whether the command brings the new security context, i.e. the KAMF of
+ * the last authentication or the other ngKSI.
+ */
+func (ue *UE) peekNASSecurityAlgorithms(pdu []byte) (
+	newContext bool, err error) {
+
+	// sequence number, EPD, security header type and message type
+	const offset = 4
+
+	if len(pdu) <= offset+1 || pdu[3] != MessageTypeSecurityModeCommand {
+		return
+	}
+	if err = ue.checkNASSecurityAlgorithms(pdu[offset]); err != nil {
+		return
+	}
+	ue.selectNASSecurityAlgorithms(pdu[offset])
+
+	ngKSI := pdu[offset+1] & 0x0f
+	newContext = ue.sec.newContext || ngKSI != ue.sec.ngKSI
+	return
+}
+
+// 9.11.3.35 Network name
+// See subclause 10.5.3.5a in 3GPP TS 24.008.
+const (
+	networkNameCodingGSM7bit = 0
+	networkNameCodingUCS2    = 1
+)
+
+func (ue *UE) decNetworkName(pdu *[]byte) (name string) {
+
+	length := int(readPduByte(pdu))
+	v := readPduByteSlice(pdu, length)
+	if length == 0 {
+		return
+	}
+
+	coding := (v[0] >> 4) & 0x7
+	spare := int(v[0] & 0x7)
+	v = v[1:]
+
+	switch coding {
+	case networkNameCodingGSM7bit:
+		name = decGSM7bit(v, (len(v)*8-spare)/7)
+	case networkNameCodingUCS2:
+		s := make([]uint16, len(v)/2)
+		for i := range s {
+			s[i] = binary.BigEndian.Uint16(v[i*2:])
+		}
+		name = string(utf16.Decode(s))
+	default:
+		ue.dprinti("unknown coding scheme: %d", coding)
+	}
+	ue.dprinti("network name: %s", name)
+	return
+}
+
+// decGSM7bit unpacks the GSM 7 bit default alphabet (TS 23.038 6.1.2.2).
+// Only the characters in common with ASCII are converted.
+func decGSM7bit(v []byte, num int) string {
 
-	return
+	s := make([]byte, num)
+	for i := 0; i < num; i++ {
+		bit := i * 7
+		c := uint16(v[bit/8])
+		if bit/8+1 < len(v) {
+			c |= uint16(v[bit/8+1]) << 8
+		}
+		s[i] = byte(c>>(bit%8)) & 0x7f
+		if s[i] == 0x00 {
+			s[i] = '@'
+		}
+	}
+	return string(s)
 }
 
 // 9.11.3.37 NSSAI
@@ -1531,6 +3433,9 @@ func (ue *UE) decNSSAI(pdu *[]byte) {
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
+	// the new allowed NSSAI replaces the old one.
+	ue.Recv.allowedNSSAI = nil
+
 	for length > 0 {
 		lenBefore := len(*pdu)
 		snssai := ue.decSNSSAI(false, pdu)
@@ -1544,14 +3449,24 @@ func (ue *UE) decNSSAI(pdu *[]byte) {
 }
 
 // 9.11.3.39 Payload container
-func (ue *UE) decPayloadContainer(pdu *[]byte) {
+func (ue *UE) decPayloadContainer(ctype uint8, pdu *[]byte) {
 
 	ue.indent++
 	length := int(binary.BigEndian.Uint16(*pdu))
 	*pdu = (*pdu)[2:]
 	ue.dprint("Length: %d", length)
 	payload := readPduByteSlice(pdu, length)
-	ue.Decode(&payload)
+
+	switch ctype {
+	case PayloadContainerN1SMInformation:
+		ue.Decode(&payload)
+	case PayloadContainerSMS:
+		ue.decSMS(payload)
+	case PayloadContainerUEPolicy:
+		ue.decUEPolicyContainer(payload)
+	default:
+		ue.dprint("info: payload container type(0x%x) is not supported", ctype)
+	}
 	ue.indent--
 
 	return
@@ -1560,19 +3475,22 @@ func (ue *UE) decPayloadContainer(pdu *[]byte) {
 // 9.11.3.40 Payload container type
 const (
 	PayloadContainerN1SMInformation = 0x1
+	PayloadContainerSMS             = 0x2
+	PayloadContainerUEPolicy        = 0x5
 )
 
 var payloadContainerStr = map[int]string{
 	PayloadContainerN1SMInformation: "N1 SM Information",
+	PayloadContainerSMS:             "SMS",
+	PayloadContainerUEPolicy:        "UE policy container",
 }
 
-func (ue *UE) decPayloadContainerType(pdu *[]byte) {
+func (ue *UE) decPayloadContainerType(pdu *[]byte) (ctype uint8) {
 
-	ctype := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
+	ctype = readPduByte(pdu)
 
 	ue.dprinti("Type: %s(0x%x)",
-		payloadContainerStr[ctype], ctype)
+		payloadContainerStr[int(ctype)], ctype)
 
 	return
 }
@@ -1592,9 +3510,91 @@ func (ue *UE) encPDUSessionID2(id uint8) (pdu []byte) {
 	return
 }
 
+// 9.11.3.42 PDU session reactivation result
+func (ue *UE) decPDUSessionReactivationResult(pdu *[]byte) {
+
+	psi := decPSIBitmap(pdu)
+	ue.dprinti("user-plane resources failed to be re-established: %v", psi)
+	return
+}
+
+// 9.11.3.44 PDU session status
+func (ue *UE) encPDUSessionStatus(psi []uint8) (pdu []byte) {
+
+	pdu = append(pdu, ieiPDUSessionStatus)
+	pdu = append(pdu, encPSIBitmap(psi)...)
+	return
+}
+
+func (ue *UE) decPDUSessionStatus(pdu *[]byte) {
+
+	psi := decPSIBitmap(pdu)
+	ue.dprinti("PDU session status: %v", psi)
+
+	// the PDU sessions not active in the network are released locally.
+	for _, s := range ue.PDUSessions {
+		if s.SMstate != SMInactive && psiContains(psi, s.ID) == false {
+			ue.dprinti("PDU session %d is released locally", s.ID)
+			s.SMstate = SMInactive
+		}
+	}
+	return
+}
+
+// encPSIBitmap encodes the PSI list into the length and the bitmap of
+// PSI(0) to PSI(15), which is common to the PDU session status,
+// the PDU session reactivation result and the uplink data status.
+func encPSIBitmap(psi []uint8) (pdu []byte) {
+
+	var bitmap uint16
+	for _, id := range psi {
+		if id < 16 {
+			bitmap |= 1 << id
+		}
+	}
+	pdu = append(pdu, 2)
+	pdu = append(pdu, uint8(bitmap), uint8(bitmap>>8))
+	return
+}
+
+func decPSIBitmap(pdu *[]byte) (psi []uint8) {
+
+	length := int(readPduByte(pdu))
+	bitmap := readPduByteSlice(pdu, length)
+	for i, v := range bitmap {
+		for j := 0; j < 8; j++ {
+			if v&(1<<j) != 0 {
+				psi = append(psi, uint8(i*8+j))
+			}
+		}
+	}
+	return
+}
+
+func psiContains(psi []uint8, id uint8) bool {
+	for _, v := range psi {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (ue *UE) activePDUSessions() (psi []uint8) {
+	for _, s := range ue.PDUSessions {
+		if s.SMstate == SMActive {
+			psi = append(psi, s.ID)
+		}
+	}
+	return
+}
+
 // 9.11.3.47 Request type
 const (
-	RequestTypeInitialRequest = 0x01
+	RequestTypeInitialRequest          = 0x01
+	RequestTypeExistingPDUSession      = 0x02
+	RequestTypeInitialEmergencyRequest = 0x03
+	RequestTypeExistingEmergencyPDU    = 0x04
 )
 
 func (ue *UE) encRequestType(val uint8) (pdu []byte) {
@@ -1602,6 +3602,66 @@ func (ue *UE) encRequestType(val uint8) (pdu []byte) {
 	return
 }
 
+// 9.11.3.50 Service type
+const (
+	ServiceTypeSignalling = iota
+	ServiceTypeData
+	ServiceTypeMobileTerminatedServices
+	ServiceTypeEmergencyServices
+	ServiceTypeEmergencyServicesFallback
+	ServiceTypeHighPriorityAccess
+	ServiceTypeElevatedSignalling
+)
+
+// 9.11.3.52 Time zone
+// See subclause 10.5.3.8 in 3GPP TS 24.008.
+func (ue *UE) decTimeZone(pdu *[]byte) {
+
+	ue.Recv.network.timeZone = decTimeZoneValue(readPduByte(pdu))
+	ue.dprinti("time zone: %d quarters", ue.Recv.network.timeZone)
+	return
+}
+
+// the time zone is in quarters of an hour coded as the swapped BCD with
+// the sign in bit 4 (TS 23.040 9.2.3.11).
+func decTimeZoneValue(v byte) (tz int) {
+
+	tz = int(v&0x07)*10 + int(v>>4)
+	if v&0x08 != 0 {
+		tz = -tz
+	}
+	return
+}
+
+func decSwappedBCD(v byte) int {
+	return int(v&0x0f)*10 + int(v>>4)
+}
+
+// 9.11.3.53 Time zone and time
+// See subclause 10.5.3.9 in 3GPP TS 24.008.
+func (ue *UE) decTimeZoneAndTime(pdu *[]byte) {
+
+	if len(*pdu) < 7 {
+		ue.DecodeError = fmt.Errorf("nas: time zone and time: "+
+			"length(7) exceeds the pdu(%d)", len(*pdu))
+		*pdu = nil
+		return
+	}
+	v := readPduByteSlice(pdu, 7)
+
+	tz := decTimeZoneValue(v[6])
+	loc := time.FixedZone("", tz*15*60)
+	t := time.Date(2000+decSwappedBCD(v[0]), time.Month(decSwappedBCD(v[1])),
+		decSwappedBCD(v[2]), decSwappedBCD(v[3]), decSwappedBCD(v[4]),
+		decSwappedBCD(v[5]), 0, time.UTC)
+
+	ue.Recv.network.universalTime = t
+	ue.Recv.network.timeZone = tz
+	ue.dprinti("universal time: %v", t)
+	ue.dprinti("local time: %v", t.In(loc))
+	return
+}
+
 // 9.11.3.54 UE security capability
 type UESecurityCapability struct {
 	iei    uint8
@@ -1616,18 +3676,19 @@ const (
 	EA0 = 0x80
 	EA1 = 0x40
 	EA2 = 0x20
+	EA3 = 0x10
 	IA0 = 0x80
 	IA1 = 0x40
 	IA2 = 0x20
+	IA3 = 0x10
 )
 
 func encUESecurityCapability() (sc UESecurityCapability) {
 	sc.iei = ieiUESecurityCapability
 	sc.length = 4
 
-	// use null encryption at this moment.
-	sc.ea = EA0
-	sc.ia = IA0 | IA2
+	sc.ea = EA0 | EA1 | EA2 | EA3
+	sc.ia = IA0 | IA1 | IA2 | IA3
 
 	return
 }
@@ -1644,23 +3705,56 @@ func (ue *UE) decUESecurityCapability(pdu *[]byte) {
 	return
 }
 
+// 9.11.3.57 Uplink data status
+func (ue *UE) encUplinkDataStatus(psi []uint8) (pdu []byte) {
+
+	pdu = append(pdu, ieiUplinkDataStatus)
+	pdu = append(pdu, encPSIBitmap(psi)...)
+	return
+}
+
+// 9.11.4.1 5GSM capability
+const (
+	smCapabilityRqoS = 0x01 // Reflective QoS
+)
+
+func (ue *UE) enc5GSMCapability(capability uint8) (pdu []byte) {
+	pdu = []byte{ieiSMCapability, 1, capability}
+	return
+}
+
 // 9.11.4.2 5GSM cause
 const (
+	smCauseRegularDeactivation            = 0x24
+	smCauseInvalidPDUSessionIdentity      = 0x2b
 	smCausePDUSessionTypeIPv4OnlyeAllowed = 0x32
+	smCausePDUSessionTypeIPv6OnlyAllowed  = 0x33
+	smCauseSemanticErrorInQoSOperation    = 0x53
+	smCauseMessageNotCompatible           = 0x62
 )
 
 var smCauseStr = map[byte]string{
+	smCauseRegularDeactivation:            "Regular deactivation",
+	smCauseInvalidPDUSessionIdentity:      "Invalid PDU session identity",
 	smCausePDUSessionTypeIPv4OnlyeAllowed: "PDU session type IPv4 only allowed",
+	smCausePDUSessionTypeIPv6OnlyAllowed:  "PDU session type IPv6 only allowed",
+	smCauseSemanticErrorInQoSOperation:    "Semantic error in the QoS operation",
+	smCauseMessageNotCompatible:           "Message type not compatible with the protocol state",
 }
 
-func (ue *UE) dec5GSMCause(pdu *[]byte) {
+func (ue *UE) dec5GSMCause(pdu *[]byte) (cause uint8) {
 
-	cause := readPduByte(pdu)
+	cause = readPduByte(pdu)
 	ue.dprinti("cause: %s(%d)", smCauseStr[cause], cause)
 
 	return
 }
 
+func (ue *UE) enc5GSMCause(cause uint8) (pdu []byte) {
+	pdu = []byte{iei5GSMCause, cause}
+	return
+}
+
 // 9.11.4.7 Integrity protection maximum data rate
 func (ue *UE) encIntegrityProtectionMaximuDataRate() (pdu []byte) {
 
@@ -1673,54 +3767,315 @@ func (ue *UE) encIntegrityProtectionMaximuDataRate() (pdu []byte) {
 }
 
 // 9.11.4.10 PDU address
-func (ue *UE) decPDUAddress(pdu *[]byte) {
+const (
+	interfaceIDLen = 8
+)
 
-	length := readPduByte(pdu)
+// decPDUAddress returns the IPv4 address and the IPv6 interface identifier
+// which are given by the PDU session type.
+func (ue *UE) decPDUAddress(pdu *[]byte) (addr net.IP, iid []byte) {
+
+	length := int(readPduByte(pdu))
 	ue.dprinti("Length: %d", length)
 
-	pduSessionType := readPduByte(pdu) & 0x7
+	octet := readPduByte(pdu)
+	length--
+	si6lla := (octet >> 3) & 0x1
+	pduSessionType := octet & 0x7
+	ue.dprinti("SI6LLA: %d", si6lla)
 	ue.dprinti("PDU session type: %s(%d)",
 		pduSessionTypeStr[pduSessionType], pduSessionType)
 
 	switch pduSessionType {
 	case PDUSessionIPv4:
-		ue.Recv.PDUAddress = readPduByteSlice(pdu, net.IPv4len)
-		ue.dprinti("PDU address information: %v", ue.Recv.PDUAddress)
+		addr = readPduByteSlice(pdu, net.IPv4len)
+		length -= net.IPv4len
+		ue.dprinti("PDU address information: %v", addr)
+	case PDUSessionIPv6:
+		iid = readPduByteSlice(pdu, interfaceIDLen)
+		length -= interfaceIDLen
+		ue.dprinti("PDU address information: IID %x", iid)
+	case PDUSessionIPv4v6:
+		iid = readPduByteSlice(pdu, interfaceIDLen)
+		addr = readPduByteSlice(pdu, net.IPv4len)
+		length -= interfaceIDLen + net.IPv4len
+		ue.dprinti("PDU address information: IID %x, %v", iid, addr)
 	default:
 		ue.dprinti("unsupported PDU session type: %d", pduSessionType)
 	}
 
+	if si6lla == 1 && length >= net.IPv6len {
+		lla := net.IP(readPduByteSlice(pdu, net.IPv6len))
+		length -= net.IPv6len
+		ue.dprinti("SMF's IPv6 link local address: %v", lla)
+	}
+	if length > 0 {
+		readPduByteSlice(pdu, length)
+	}
+
 	return
 }
 
 // 9.11.4.11 PDU session type
 const (
-	PDUSessionIPv4   = 0x01
-	PDUSessionIPv6   = 0x02
-	PDUSessionIPv4v6 = 0x03
+	PDUSessionIPv4         = 0x01
+	PDUSessionIPv6         = 0x02
+	PDUSessionIPv4v6       = 0x03
+	PDUSessionUnstructured = 0x04
+	PDUSessionEthernet     = 0x05
 )
 
 var pduSessionTypeStr = map[byte]string{
-	PDUSessionIPv4:   "IPv4",
-	PDUSessionIPv6:   "IPv6",
-	PDUSessionIPv4v6: "IPv4v6",
+	PDUSessionIPv4:         "IPv4",
+	PDUSessionIPv6:         "IPv6",
+	PDUSessionIPv4v6:       "IPv4v6",
+	PDUSessionUnstructured: "Unstructured",
+	PDUSessionEthernet:     "Ethernet",
 }
 
-func (ue *UE) encPDUSessionType() (pdu []byte) {
-	pdu = []byte{byte((ieiPDUSessionType << 4) | PDUSessionIPv4v6)}
+// encPDUSessionType encodes the type given by the name in
+// pduSessionTypeStr. IPv4v6 is requested if the name is not given.
+func (ue *UE) encPDUSessionType(name string) (pdu []byte, err error) {
+	val := byte(PDUSessionIPv4v6)
+	if name != "" {
+		found := false
+		for k, v := range pduSessionTypeStr {
+			if v == name {
+				val = k
+				found = true
+			}
+		}
+		if found == false {
+			return nil, fmt.Errorf("nas: unknown PDU session type: %q", name)
+		}
+	}
+	pdu = []byte{byte((ieiPDUSessionType << 4) | val)}
 	return
 }
 
-func (ue *UE) decPDUSessionType(iei bool, pdu *[]byte) {
+// decPDUSessionType returns the name of the PDU session type, or "" if
+// the type is unknown.
+func (ue *UE) decPDUSessionType(iei bool, pdu *[]byte) (name string) {
 	pduSessionType := 0x0f & (*pdu)[0]
-	ue.dprinti("PDU Session Type: %s(%d)",
-		pduSessionTypeStr[pduSessionType], pduSessionType)
+	name = pduSessionTypeStr[pduSessionType]
+	ue.dprinti("PDU Session Type: %s(%d)", name, pduSessionType)
 	ShiftType1IE(iei, pdu)
 	return
 }
 
+// 9.11.4.12 QoS flow descriptions
+type QoSFlowDescription struct {
+	QFI             uint8
+	FiveQI          uint8
+	GFBRUplink      uint64 // in kbps
+	GFBRDownlink    uint64 // in kbps
+	MFBRUplink      uint64 // in kbps
+	MFBRDownlink    uint64 // in kbps
+	AveragingWindow uint16 // in milliseconds
+	EBI             uint8
+}
+
+const (
+	flowOpCodeCreateNewQoSFlow = 1
+	flowOpCodeDeleteQoSFlow    = 2
+	flowOpCodeModifyQoSFlow    = 3
+)
+
+var flowOpCodeStr = map[int]string{
+	flowOpCodeCreateNewQoSFlow: "Create new QoS flow description",
+	flowOpCodeDeleteQoSFlow:    "Delete existing QoS flow description",
+	flowOpCodeModifyQoSFlow:    "Modify existing QoS flow description",
+}
+
+const (
+	flowParam5QI             = 0x01
+	flowParamGFBRUplink      = 0x02
+	flowParamGFBRDownlink    = 0x03
+	flowParamMFBRUplink      = 0x04
+	flowParamMFBRDownlink    = 0x05
+	flowParamAveragingWindow = 0x06
+	flowParamEBI             = 0x07
+)
+
+func (ue *UE) decQoSFlowDescriptions(pdu *[]byte) (err error) {
+
+	ue.indent++
+	ue.dprint("QoS flow descriptions")
+
+	if len(*pdu) < 2 {
+		ue.indent--
+		return fmt.Errorf("QoS flow descriptions: no length")
+	}
+	length := int(readPduUint16(pdu))
+	ue.dprinti("Length: %d", length)
+	if len(*pdu) < length {
+		ue.indent--
+		return fmt.Errorf("QoS flow descriptions: length(%d) exceeds the pdu(%d)",
+			length, len(*pdu))
+	}
+	v := readPduByteSlice(pdu, length)
+
+	s := ue.PDUSession(ue.sm.pduSessionId)
+	if s == nil {
+		ue.indent--
+		return fmt.Errorf("PDU session(%d) is not configured", ue.sm.pduSessionId)
+	}
+	flows := append([]QoSFlowDescription{}, s.qosFlows...)
+
+	for i := 0; len(v) > 0 && err == nil; i++ {
+		ue.indent++
+		ue.dprint("QoS flow description %d", i)
+
+		if len(v) < 3 {
+			err = fmt.Errorf("QoS flow description %d is too short: %x", i, v)
+			ue.indent--
+			break
+		}
+		qfi := readPduByte(&v) & 0x3f
+		ue.dprinti("QoS flow identifier: QFI%d", qfi)
+
+		opCode := int(readPduByte(&v) >> 5)
+		ue.dprinti("Operation code: %s(%d)", flowOpCodeStr[opCode], opCode)
+
+		tmp := readPduByte(&v)
+		replace := (tmp>>6)&0x1 != 0
+		paramNum := int(tmp & 0x3f)
+		ue.dprinti("E bit: %v, Number of parameters: %d", replace, paramNum)
+
+		idx := -1
+		for n, f := range flows {
+			if f.QFI == qfi {
+				idx = n
+			}
+		}
+
+		flow := QoSFlowDescription{QFI: qfi}
+		if idx >= 0 && opCode == flowOpCodeModifyQoSFlow && replace == false {
+			flow = flows[idx]
+		}
+		for j := 0; j < paramNum && err == nil; j++ {
+			err = ue.decQoSFlowParameter(&flow, &v)
+		}
+
+		switch {
+		case err != nil:
+		case opCode == flowOpCodeCreateNewQoSFlow && idx < 0:
+			flows = append(flows, flow)
+		case opCode == flowOpCodeCreateNewQoSFlow:
+			flows[idx] = flow
+		case opCode == flowOpCodeDeleteQoSFlow && idx >= 0:
+			flows = append(flows[:idx], flows[idx+1:]...)
+		case opCode == flowOpCodeModifyQoSFlow && idx >= 0:
+			flows[idx] = flow
+		case opCode == flowOpCodeModifyQoSFlow:
+			err = fmt.Errorf("QoS flow description(QFI%d) does not exist", qfi)
+		}
+		ue.indent--
+	}
+	ue.indent--
+
+	if err == nil {
+		s.qosFlows = flows
+	}
+	return
+}
+
+// flowParamMinLen is the minimum length of the contents of the parameter.
+var flowParamMinLen = map[uint8]int{
+	flowParam5QI:             1,
+	flowParamGFBRUplink:      3,
+	flowParamGFBRDownlink:    3,
+	flowParamMFBRUplink:      3,
+	flowParamMFBRDownlink:    3,
+	flowParamAveragingWindow: 2,
+	flowParamEBI:             1,
+}
+
+func (ue *UE) decQoSFlowParameter(
+	flow *QoSFlowDescription, pdu *[]byte) (err error) {
+
+	if len(*pdu) < 2 {
+		return fmt.Errorf("QoS flow parameter is too short: %x", *pdu)
+	}
+	id := readPduByte(pdu)
+	length := int(readPduByte(pdu))
+	if len(*pdu) < length {
+		return fmt.Errorf("QoS flow parameter(0x%x): length(%d) exceeds the pdu(%d)",
+			id, length, len(*pdu))
+	}
+	v := readPduByteSlice(pdu, length)
+	if length < flowParamMinLen[id] {
+		return fmt.Errorf("QoS flow parameter(0x%x): length(%d) is too short",
+			id, length)
+	}
+
+	switch id {
+	case flowParam5QI:
+		flow.FiveQI = v[0]
+		ue.dprinti("5QI: %d", flow.FiveQI)
+	case flowParamGFBRUplink:
+		flow.GFBRUplink = decBitRate(v)
+		ue.dprinti("GFBR uplink: %d kbps", flow.GFBRUplink)
+	case flowParamGFBRDownlink:
+		flow.GFBRDownlink = decBitRate(v)
+		ue.dprinti("GFBR downlink: %d kbps", flow.GFBRDownlink)
+	case flowParamMFBRUplink:
+		flow.MFBRUplink = decBitRate(v)
+		ue.dprinti("MFBR uplink: %d kbps", flow.MFBRUplink)
+	case flowParamMFBRDownlink:
+		flow.MFBRDownlink = decBitRate(v)
+		ue.dprinti("MFBR downlink: %d kbps", flow.MFBRDownlink)
+	case flowParamAveragingWindow:
+		flow.AveragingWindow = binary.BigEndian.Uint16(v)
+		ue.dprinti("Averaging window: %d ms", flow.AveragingWindow)
+	case flowParamEBI:
+		flow.EBI = v[0] >> 4
+		ue.dprinti("EPS bearer identity: %d", flow.EBI)
+	default:
+		ue.dprinti("unknown parameter(0x%x): %x", id, v)
+	}
+	return
+}
+
+// decBitRate returns the bit rate in kbps. The unit is coded as
+// 1(1Kbps), 2(4Kbps), ..., 6(1Mbps), 7(4Mbps), ..., 11(1Gbps) and so on.
+// v shorter than 3 octets is decoded as 0 kbps.
+func decBitRate(v []byte) (kbps uint64) {
+
+	if len(v) < 3 {
+		return
+	}
+	unit := int(v[0])
+	if unit == 0 {
+		return
+	}
+
+	kbps = uint64(binary.BigEndian.Uint16(v[1:3]))
+	for unit--; unit >= 5; unit -= 5 {
+		kbps *= 1000
+	}
+	kbps <<= 2 * uint(unit)
+	return
+}
+
 // 9.11.4.13 QoS rules
-func (ue *UE) decQoSRules(pdu *[]byte) {
+type QoSRule struct {
+	ID            uint8
+	Default       bool
+	PacketFilters []PacketFilter
+	Precedence    uint8
+	Segregation   bool
+	QFI           uint8
+}
+
+type PacketFilter struct {
+	ID         uint8
+	Direction  int
+	Contents   []byte
+	Components []PacketFilterComponent // decoded from Contents. see qos.go
+}
+
+func (ue *UE) decQoSRules(pdu *[]byte) (err error) {
 
 	ue.indent++
 	ue.dprint("QoS rules")
@@ -1730,47 +4085,75 @@ func (ue *UE) decQoSRules(pdu *[]byte) {
 	ue.dprinti("Length: %d", length)
 	remain := int(length)
 
+	s := ue.PDUSession(ue.sm.pduSessionId)
+	if s == nil {
+		readPduByteSlice(pdu, remain)
+		ue.indent--
+		return fmt.Errorf("PDU session(%d) is not configured", ue.sm.pduSessionId)
+	}
+	rules := append([]QoSRule{}, s.QoSRules()...)
+
 	for i := 0; remain > 0; i++ {
 		ue.indent++
 		ue.dprint("Qos rule %d", i)
-		remain -= ue.decQoSRule(pdu)
+		rule, opCode, n := ue.decQoSRule(pdu)
+		remain -= n
+		if err == nil {
+			rules, err = applyQoSRule(rules, opCode, rule)
+		}
 		ue.indent--
 	}
 	ue.indent--
 
+	if err == nil {
+		s.setQoSRules(rules)
+	}
 	return
 }
 
 const (
-	ruleOpCodeCreateNewQoSRule = 1
+	ruleOpCodeCreateNewQoSRule        = 1
+	ruleOpCodeDeleteQoSRule           = 2
+	ruleOpCodeModifyAndAddFilters     = 3
+	ruleOpCodeModifyAndReplaceFilters = 4
+	ruleOpCodeModifyAndDeleteFilters  = 5
+	ruleOpCodeModifyWithoutFilters    = 6
 )
 
 var ruleOpCodeStr = map[int]string{
-	ruleOpCodeCreateNewQoSRule: "Create new QoS rule",
+	ruleOpCodeCreateNewQoSRule:        "Create new QoS rule",
+	ruleOpCodeDeleteQoSRule:           "Delete existing QoS rule",
+	ruleOpCodeModifyAndAddFilters:     "Modify existing QoS rule and add packet filters",
+	ruleOpCodeModifyAndReplaceFilters: "Modify existing QoS rule and replace all packet filters",
+	ruleOpCodeModifyAndDeleteFilters:  "Modify existing QoS rule and delete packet filters",
+	ruleOpCodeModifyWithoutFilters:    "Modify existing QoS rule without modifying packet filters",
 }
 
-func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
+func (ue *UE) decQoSRule(pdu *[]byte) (rule QoSRule, ruleOpCode, length int) {
 
-	id := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprinti("QoS rule identifier: %d", id)
+	rule.ID = readPduByte(pdu)
+	ue.dprinti("QoS rule identifier: %d", rule.ID)
 	length = 1
 
-	ruleLen := binary.BigEndian.Uint16(*pdu)
-	*pdu = (*pdu)[2:]
+	ruleLen := int(readPduUint16(pdu))
 	length += 2
 	ue.dprinti("Length: %d", ruleLen)
-	length += int(ruleLen)
+	length += ruleLen
 
-	tmp := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
+	v := readPduByteSlice(pdu, ruleLen)
+	if ruleLen == 0 {
+		return
+	}
+
+	tmp := int(readPduByte(&v))
 
-	ruleOpCode := tmp >> 5
+	ruleOpCode = tmp >> 5
 	ue.dprinti("Rule operation code: %s(%d)",
 		ruleOpCodeStr[ruleOpCode], ruleOpCode)
 
 	not := "not "
-	if (tmp>>4)&0x1 != 0 {
+	rule.Default = (tmp>>4)&0x1 != 0
+	if rule.Default {
 		not = ""
 	}
 	ue.dprinti("the QoS rule is %sthe default QoS rule", not)
@@ -1781,27 +4164,119 @@ func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
 	for i := 0; i < filterNum; i++ {
 		ue.dprinti("packet filter %d", i)
 		ue.indent++
-		ue.decPacketFilter(pdu)
+		var filter PacketFilter
+		if ruleOpCode == ruleOpCodeModifyAndDeleteFilters {
+			filter.ID = readPduByte(&v) & 0xf
+			ue.dprinti("Packet filter identifier: %d", filter.ID)
+		} else {
+			filter = ue.decPacketFilter(&v)
+		}
+		rule.PacketFilters = append(rule.PacketFilters, filter)
 		ue.indent--
 	}
 
-	precedence := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprinti("QoS rule precedence: %d", precedence)
+	// the precedence and the QFI are not included to delete the rule.
+	if len(v) < 2 {
+		return
+	}
 
-	tmp = int((*pdu)[0])
-	*pdu = (*pdu)[1:]
+	rule.Precedence = readPduByte(&v)
+	ue.dprinti("QoS rule precedence: %d", rule.Precedence)
+
+	tmp = int(readPduByte(&v))
 
 	not = "not "
-	if (tmp>>6)&0x1 != 0 {
+	rule.Segregation = (tmp>>6)&0x1 != 0
+	if rule.Segregation {
 		not = ""
 	}
 	ue.dprinti("Segregation: Segregation %srequested", not)
-	ue.dprinti("QoS flow identifier: QFI%d", tmp&0x3f)
+	rule.QFI = uint8(tmp & 0x3f)
+	ue.dprinti("QoS flow identifier: QFI%d", rule.QFI)
 
 	return
 }
 
+// applyQoSRule returns the QoS rules after the operation.
+// See 6.3.2.4 for the semantic errors in QoS operations.
+func applyQoSRule(rules []QoSRule, ruleOpCode int, rule QoSRule) (
+	[]QoSRule, error) {
+
+	idx := -1
+	for n, r := range rules {
+		if r.ID == rule.ID {
+			idx = n
+		}
+	}
+
+	switch ruleOpCode {
+	case ruleOpCodeCreateNewQoSRule:
+		if idx < 0 {
+			return append(rules, rule), nil
+		}
+		rules[idx] = rule
+		return rules, nil
+	case ruleOpCodeDeleteQoSRule:
+		if idx < 0 {
+			return rules, nil
+		}
+		if rules[idx].Default {
+			return rules, fmt.Errorf("default QoS rule(%d) cannot be deleted",
+				rule.ID)
+		}
+		return append(rules[:idx], rules[idx+1:]...), nil
+	}
+
+	if idx < 0 {
+		return rules, fmt.Errorf("QoS rule(%d) does not exist", rule.ID)
+	}
+
+	r := rules[idx]
+	var filters []PacketFilter
+
+	switch ruleOpCode {
+	case ruleOpCodeModifyAndAddFilters:
+		for _, f := range r.PacketFilters {
+			if containsPacketFilter(rule.PacketFilters, f.ID) == false {
+				filters = append(filters, f)
+			}
+		}
+		filters = append(filters, rule.PacketFilters...)
+	case ruleOpCodeModifyAndReplaceFilters:
+		filters = rule.PacketFilters
+	case ruleOpCodeModifyAndDeleteFilters:
+		for _, f := range r.PacketFilters {
+			if containsPacketFilter(rule.PacketFilters, f.ID) == false {
+				filters = append(filters, f)
+			}
+		}
+	case ruleOpCodeModifyWithoutFilters:
+		filters = r.PacketFilters
+	default:
+		return rules, fmt.Errorf("unknown rule operation code: %d", ruleOpCode)
+	}
+	r.PacketFilters = filters
+
+	// QFI is never 0 if the precedence and the QFI are included.
+	if rule.QFI != 0 {
+		r.Precedence = rule.Precedence
+		r.Segregation = rule.Segregation
+		r.QFI = rule.QFI
+	}
+	rules[idx] = r
+
+	return rules, nil
+}
+
+func containsPacketFilter(filters []PacketFilter, id uint8) bool {
+	for _, f := range filters {
+		if f.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	pktFilterDirDownlinkOnly  = 1
 	pktFilterDirUplinkOnly    = 2
@@ -1809,34 +4284,34 @@ const (
 )
 
 var pktFilterDirStr = map[int]string{
+	pktFilterDirDownlinkOnly:  "Downlink only",
+	pktFilterDirUplinkOnly:    "Uplink only",
 	pktFilterDirBidirectional: "Bidirectional",
 }
 
-const (
-	pktFilterContentMatchAll = 1
-)
-
-var pktFilterContentStr = map[int]string{
-	pktFilterContentMatchAll: "Match-all type",
-}
-
-func (ue *UE) decPacketFilter(pdu *[]byte) {
+func (ue *UE) decPacketFilter(pdu *[]byte) (filter PacketFilter) {
 	tmp := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
 	tmp &= 0x3f
-	ue.dprinti("Packet filter identifier: %d", tmp&0xf)
-	ue.dprinti("Packet filter direction: %s", pktFilterDirStr[tmp>>4])
+	filter.ID = uint8(tmp & 0xf)
+	filter.Direction = tmp >> 4
+	ue.dprinti("Packet filter identifier: %d", filter.ID)
+	ue.dprinti("Packet filter direction: %s", pktFilterDirStr[filter.Direction])
 
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 	ue.dprinti("Length of packet filter contents: %d", length)
 
-	for i := 0; i < length; i++ {
-		content := int((*pdu)[0])
-		*pdu = (*pdu)[1:]
-		ue.dprinti("Packet filter content %d: %s(%d)",
-			i, pktFilterContentStr[content], content)
+	filter.Contents = readPduByteSlice(pdu, length)
+	components, err := decPacketFilterComponents(filter.Contents)
+	if err != nil {
+		ue.dprinti("Packet filter contents: %x (%v)", filter.Contents, err)
+		return
+	}
+	filter.Components = components
+	for i, c := range components {
+		ue.dprinti("Packet filter component %d: %s", i, c.String())
 	}
 	return
 }
@@ -2114,13 +4589,13 @@ func (ue *UE) ComputeKamf() {
 // A.8 Algorithm key derivation functions
 func (ue *UE) ComputeAlgKey() {
 
-	var cipher byte = 0x00
+	cipher := ue.sec.cipher
 	Senc := []byte{0x69, 0x01, 0x00, 0x01, cipher, 0x00, 0x01}
 	Menc := hmac.New(sha256.New, ue.AuthParam.Kamf)
 	Menc.Write(Senc)
 	ue.AuthParam.Kenc = Menc.Sum(nil)
 
-	var integrity byte = 0x02 // 128-EIA2 see TS 33.401 5.1.4.2
+	integrity := ue.sec.integrity
 	Sint := []byte{0x69, 0x02, 0x00, 0x01, integrity, 0x00, 0x01}
 	Mint := hmac.New(sha256.New, ue.AuthParam.Kamf)
 	Mint.Write(Sint)
@@ -2135,29 +4610,126 @@ func (ue *UE) ComputeAlgKey() {
 	return
 }
 
+// NAS connection identifier is used as the BEARER input of the
+// algorithms. see TS 33.501 6.4.3.1 and 6.4.4.1
+const nasBearer = 1 // is the same value as free5gc v3.0.2
+
+// 4.4.3.1 NAS COUNT
+// NAS COUNT is the 16 bit NAS overflow and the 8 bit NAS sequence number.
+// The downlink sequence number is accepted within dlCountWindow after the
+// last one, and the older one is regarded as replayed.
+const (
+	nasCountMask  = 0xffffff
+	dlCountWindow = 0x80
+)
+
+func (ue *UE) resetNASCount() {
+	ue.ULCount = 0
+	ue.DLCount = 0
+	ue.sec.dlCountValid = false
+}
+
+// estimateDLCount returns the NAS COUNT of the received sequence number.
+func (ue *UE) estimateDLCount(seq uint8) (count uint32, err error) {
+
+	if ue.sec.dlCountValid == false {
+		count = ue.DLCount&^0xff | uint32(seq)
+		return
+	}
+
+	// 5G-IA0 provides no replay protection. see TS 33.501 D.1
+	delta := seq - uint8(ue.DLCount)
+	if ue.sec.integrity != NIA0 && (delta == 0 || delta >= dlCountWindow) {
+		err = fmt.Errorf("nas: replayed message: seq %d, last %d",
+			seq, uint8(ue.DLCount))
+		return
+	}
+	count = (ue.DLCount + uint32(delta)) & nasCountMask
+	return
+}
+
+// TS 33.501
+// 6.4.3 NAS integrity mechanism
+// the first octet of pdu is the sequence number, which is taken as the
+// NAS COUNT without the overflow.
 func (ue *UE) ComputeMAC(dir uint8, pdu *[]byte) (mac []byte) {
+	return ue.computeMAC(dir, uint32((*pdu)[0]), pdu)
+}
+
+func (ue *UE) computeMAC(dir uint8, count uint32, pdu *[]byte) (mac []byte) {
+
+	key := ue.AuthParam.Kint
+
+	switch ue.sec.integrity {
+	case NIA1:
+		mac = nia1(key, count, nasBearer, dir, *pdu)
+	case NIA2:
+		mac = nia2(key, count, nasBearer, dir, *pdu)
+	case NIA3:
+		mac = nia3(key, count, nasBearer, dir, *pdu)
+	default:
+		// NIA0 generates the 32 bit MAC of all zeros.
+		mac = make([]byte, 4)
+	}
+	return
+}
+
+// TS 33.401 B.2.3 128-EIA2
+func nia2(key []byte, count uint32, bearer, dir uint8, msg []byte) (mac []byte) {
 
 	m := []byte{}
 
 	tmp := make([]byte, 4)
-	count := uint32((*pdu)[0])
 	binary.BigEndian.PutUint32(tmp, count)
 	m = append(m, tmp...)
 
 	tmp = make([]byte, 1)
-	var bearer uint8 = 1                // is the same value as free5gc v3.0.2
 	tmp[0] = (bearer << 3) | (dir << 2) // bearer is 5 bit field.
 	m = append(m, tmp...)
 	m = append(m, []byte{0, 0, 0}...) // 24 bit padding
-	m = append(m, *pdu...)
+	m = append(m, msg...)
 
-	block, _ := aes.NewCipher(ue.AuthParam.Kint)
+	block, _ := aes.NewCipher(key)
 	mac, _ = cmac.Sum(m, block, 16)
 	mac = mac[:4]
 
 	return
 }
 
+// TS 33.501
+// 6.4.4 NAS confidentiality mechanism
+// ciphering and deciphering are the same operation for all algorithms.
+func (ue *UE) Cipher(dir uint8, count uint32, in []byte) (out []byte) {
+
+	key := ue.AuthParam.Kenc
+
+	switch ue.sec.cipher {
+	case NEA1:
+		out = nea1(key, count, nasBearer, dir, in)
+	case NEA2:
+		out = nea2(key, count, nasBearer, dir, in)
+	case NEA3:
+		out = nea3(key, count, nasBearer, dir, in)
+	default:
+		out = in
+	}
+	return
+}
+
+// TS 33.401 B.1.3 128-EEA2
+func nea2(key []byte, count uint32, bearer, dir uint8, in []byte) (out []byte) {
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv, count)
+	iv[4] = (bearer&0x1f)<<3 | (dir&0x1)<<2
+
+	block, _ := aes.NewCipher(key)
+	out = make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+
+	return
+}
+
 //-----
 func readPduByte(pdu *[]byte) (val byte) {
 	val = byte((*pdu)[0])
@@ -1,31 +1,111 @@
 package nas
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/wmnsk/milenage"
 )
 
 // send
-var TestRegistrationRequest string = "7e004179000d0102f8392143000010325476981001202e0480a00000"
+var TestRegistrationRequest string = "7e004179000d0102f8392143000010325476981001202e04f0f00000"
+var TestRegistrationRequestSMS string = "7e004179000d0102f8392143000010325476981001202e04f0f00000" + "530101"
+var TestEmergencyRegistrationRequest string = "7e00417c" + "00080b00000001000061" + "100120" + "2e04f0f00000"
 var TestAuthenticationResponse string = "7e00572d10803adcacc364fc000bdc0f65e324eaa1"
 var TestSecurityModeComplete []string = []string{
 	"7e04da52b828007e005e",
 	"7e042e7d15af017e005e7700090500000001000001f1",
-	"7e042bcd6bc3027e005e7700090500000001000001f171001c7e004179000d0102f8392143000010325476981001202e0480a00000",
-	"7e04a314ad62037e005e7700090500000001000001f171001c7e004179000d0102f8392143000010325476981001202e0480a00000",
+	"7e0419bc94e5027e005e7700090500000001000001f171001c7e004179000d0102f8392143000010325476981001202e04f0f00000",
+	"7e04deb40598037e005e7700090500000001000001f171001c7e004179000d0102f8392143000010325476981001202e04f0f00000",
 }
+var TestServiceRequest string = "7e004c070007f4fe00000000015002" + "0000"
+var TestPeriodicRegistrationUpdate string = "7e004173000bf202f839cafe0000000001" + "5202f839000001" + "50020000"
 var TestRegistrationComplete string = "7e04006d1298007e0043"
 var TestPDUSessionEstablishmentRequest string = "7e0208d593cc007e00670100072e0101c1ffff93120181220401010203250908696e7465726e6574"
+var TestPDUSessionEstablishmentRequest2 string = "7e024a1fc970017e00670100072e0202c1ffff91120281220101250403696d73"
 var TestDeregistrationRequest string = "7e04d733af71007e004571000bf202f839cafe0000000001"
+var TestConfigUpdateComplete string = "7e02a791f1cd007e0055"
+var TestIdentityResponse string = "7e005c00080b00000001000061"
+var TestPDUSessionReleaseRequest string = "7e020934cd01007e00670100062e0101d159241201"
+var TestPDUSessionReleaseComplete string = "7e02f74a8b52017e00670100042e0102d41201"
+var TestDeregistrationAcceptUETerm string = "7e0201073b9a007e0048"
+var TestPDUSessionModificationComplete string = "7e02e7efff64007e00670100042e0100cc1201"
+var TestPDUSessionModCommandReject string = "7e0204e482d9017e00670100052e0100cd531201"
+var TestSecurityModeReject string = "7e005f18"
 
 // receive
 var TestAuthenticationRequest string = "7e00560002000021fc64081953bb33c0682edf1690b25821201094bbaf40940a8000c6a72c4efbaf0337"
 var TestSecurityModeCommand string = "7e03937711bc007e035d02000480a00000e1360100"
+var TestSecurityModeCommandNIA0 string = "7e0300000000" + "00" + "7e005d00000480a00000e1"
+var TestEmergencyRegistrationAccept string = "7e00420121"
+var TestRegistrationAcceptSMS string = "7e00420109"
+
+// CP-DATA(RP-DATA(SMS-SUBMIT)) to +81901234567 by the service centre
+// +819000, CP-DATA(RP-ACK) for it and CP-DATA(RP-DATA(SMS-DELIVER)).
+var TestMOSMS string = "19011b" + "0001000491180900" + "12" +
+	"0101" + "0b911809214365f7" + "000005" + "e8329bfd06"
+var TestMOSMSAck string = "990102" + "0301"
+var TestMOSMSError string = "990104" + "0502012a"
+var TestMTSMS string = "090121" + "0105049118090000" + "18" +
+	"04" + "0b911809214365f7" + "0000" + "12102131500063" + "05" + "e8329bfd06"
+
+// Manage UE Policy Command of the UE policy section (208-93, UPSC 1) with
+// the URSP rules for SIP over UDP to 10.0.0.0/8 on DNN ims, and the
+// match-all on DNN internet. The second one deletes the section and fails
+// to install the section (UPSC 2) with the unknown route selection
+// descriptor component.
+var TestManageUEPolicyCommand string = "7e006805" + "0050" + "8101" + "004c" +
+	"004a02f839" + "00450001" + "004101" +
+	"002001" + "000e" + "100a000000ff000000" + "3011" + "5013c4" +
+	"000d" + "000b01" + "0008" + "040403696d73" + "0801" +
+	"001cff" + "0001" + "01" +
+	"0016" + "001401" + "0011" + "040908696e7465726e6574" + "020401010203"
+var TestManageUEPolicyCommandReject string = "7e006805" + "0022" + "8201" +
+	"001e" + "001c02f839" + "00020001" + "00130002" + "000f01" +
+	"000c01" + "0001" + "01" + "0006" + "000401" + "0001" + "40"
 var TestRegistrationAccept string = "7e02930d75cf017e0242010177000b0202f839cafe000000000154070002f839000001150a040101020304011122335e010616012c"
 var TestPDUSessionEstablishmentAccept string = "7e0222994e9f027e00680100202e0100c21100090100063131010100000601e80301e80359322905013c3c00011201"
+var TestPDUSessionEstablishmentAccept2 string = "7e0068010020" + "2e0200c2" + "11" +
+	"0009010006313101010000" + "0601e80301e803" + "5932" + "2905013c3c0002" + "1202"
+var TestPDUSessionEstablishmentAcceptRQ string = "7e0068010020" + "2e0100c2" + "11" +
+	"000901000631310101ff01" + "0601e80301e803" + "2905013c3c0001" + "5621" + "1201"
+var TestPDUSessionEstablishmentAcceptIPv4v6 string = "7e0068010026" + "2e0101c2" + "13" +
+	"0009010006313101010000" + "0601e80301e803" + "290d030000000000000001" + "3c3c0001" + "1201"
+var TestPDUSessionEstablishmentAcceptIPv6 string = "7e0068010032" + "2e0101c2" + "12" +
+	"0009010006313101010000" + "0601e80301e803" + "29190a0000000000000001" +
+	"fe800000000000000000000000000002" + "1201"
+var TestPDUSessionEstablishmentRequestEthernet string = "7e027ebef138007e00670100072e0201c1ffff95120281220101250403696d73"
+var TestPDUSessionEstablishmentAcceptEthernet string = "7e0068010017" + "2e0201c2" + "15" +
+	"0009010006313101010000" + "0601e80301e803" + "1202"
+var TestRouterSolicitation string = "6000000000083afffe800000000000000000000000000001" +
+	"ff020000000000000000000000000002" + "85007d3600000000"
+var TestRouterAdvertisement string = "6000000000303afffe800000000000000000000000000002" +
+	"ff020000000000000000000000000001" + "860039c440000708000000000000000003" +
+	"0440c000015180000038400000000020010db8000100020000000000000000"
 var TestDeregistrationAccept string = "7e0046"
+var TestRegistrationReject string = "7e0044165f0121" + "16012c"
+var TestAuthenticationReject string = "7e0058"
+var TestDeregistrationRequestUETerm string = "7e004709" + "580a"
+var TestConfigUpdateCommand string = "7e0054" + "d1" + "430f10004f00700065006e003500470053" +
+	"4505" + "84d4f29c0e" + "4702010151114500" + "490101"
+var TestIdentityRequest string = "7e005b03"
+var TestPDUSessionReleaseCommand string = "7e00680100052e0102d3241201"
+var TestPDUSessionModificationCommand string = "7e0068010021" + "2e0100cb" +
+	"7a0011" + "010003d0ff01" + "02000821310340" + "1f902002" +
+	"790006" + "022041010107" + "1201"
+var TestPDUSessionModificationCommand2 string = "7e006801000d" + "2e0100cb" +
+	"7a0006" + "050003d0ff05" + "1201"
+var TestServiceAccept string = "7e004e"
+var TestServiceReject string = "7e004d0a"
 
 func receive(ue *UE, msg string) {
 	in, _ := hex.DecodeString(msg)
@@ -59,6 +139,52 @@ func TestMakeAuthenticationResponse(t *testing.T) {
 	}
 }
 
+func TestMakeAuthenticationFailure(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.AuthParam.K = "00112233445566778899aabbccddeeff"
+
+	receive(ue, TestAuthenticationRequest)
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString("7e005914")
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Authentication Failure (MAC failure)\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	ue = NewNAS("nas_test.json")
+	receive(ue, TestAuthenticationRequest)
+	if ue.AuthenticationFailed() {
+		t.Errorf("fresh SQN is not accepted")
+	}
+	sqn := append([]byte{}, ue.AuthParam.sqnMS...)
+
+	// the same AUTN is replayed.
+	receive(ue, TestAuthenticationRequest)
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString("7e005915300e")
+	if reflect.DeepEqual(expect, v[:len(expect)]) == false || len(v) != 20 {
+		t.Errorf("Authentication Failure (synch failure)\nexpect: %x...\nactual: %x", expect, v)
+		return
+	}
+
+	// the network side of the re-synchronisation.
+	auts := v[6:]
+	k, _ := hex.DecodeString(ue.AuthParam.K)
+	opc, _ := hex.DecodeString(ue.AuthParam.OPc)
+	m := milenage.NewWithOPc(k, opc, ue.AuthParam.rand, 0, 0)
+	aks, _ := m.F5Star()
+	sqnMS := make([]byte, 6)
+	for n := range sqnMS {
+		sqnMS[n] = auts[n] ^ aks[n]
+	}
+	macs, _ := m.F1Star(sqnMS, []byte{0x00, 0x00})
+	if reflect.DeepEqual(sqn, sqnMS) == false {
+		t.Errorf("SQN_MS expect: %x, actual: %x", sqn, sqnMS)
+	}
+	if reflect.DeepEqual(macs, auts[6:]) == false {
+		t.Errorf("MAC-S expect: %x, actual: %x", macs, auts[6:])
+	}
+}
+
 func TestMakeRegistrationRequest(t *testing.T) {
 	ue := NewNAS("nas_test.json")
 	v := ue.MakeRegistrationRequest()
@@ -128,7 +254,7 @@ func TestMakePDUSessionEstablishmentRequest(t *testing.T) {
 	receive(ue, TestSecurityModeCommand)
 	receive(ue, TestRegistrationAccept)
 
-	v := ue.MakePDUSessionEstablishmentRequest()
+	v := ue.MakePDUSessionEstablishmentRequest(1)
 	expect_str := TestPDUSessionEstablishmentRequest
 	expect, _ := hex.DecodeString(expect_str)
 	if reflect.DeepEqual(expect, v) == false {
@@ -154,6 +280,307 @@ func TestMakeDeregistrationRequest(t *testing.T) {
 	}
 }
 
+func TestSUCIProfileA(t *testing.T) {
+	// 3GPP TS 33.501 C.4.3 Test data for ECIES Profile A
+	ue := NewNAS("nas_test.json")
+	ue.MSIN = "001002086"
+	ue.ProtectionScheme = "profileA"
+	ue.HomeNetworkPublicKey = "5a8d38864820197c3394b92613b20b91" +
+		"633cbd897119273bf8e4a6f4eec0a650"
+	ue.HomeNetworkPublicKeyID = 1
+
+	ephPriv, _ := hex.DecodeString("c80949f13ebe61af4ebdbd293ea4f942" +
+		"696b9e815d7e8f0096bbf6ed7de62256")
+	suciRand = bytes.NewReader(ephPriv)
+	defer func() { suciRand = rand.Reader }()
+
+	v, _ := ue.enc5GSMobileIDTypeSUCI()
+	expect, _ := hex.DecodeString("0035" + "0102f8392143" + "0101" +
+		"b2e92f836055a255837debf850b528997ce0201cb82adfe4be1f587d07d8457d" +
+		"cb02352410" + "cddd9e730ef3fa87")
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("SUCI\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestSUCIConcealmentFailure(t *testing.T) {
+
+	pattern := []struct {
+		scheme string
+		key    string
+	}{
+		{"profileA", ""},
+		{"profileB", "00"},
+		{"profileC", ""},
+	}
+	for _, p := range pattern {
+		ue := NewNAS("nas_test.json")
+		ue.ProtectionScheme = p.scheme
+		ue.HomeNetworkPublicKey = p.key
+
+		// the SUPI is never sent in cleartext by the null-scheme.
+		if v := ue.MakeRegistrationRequest(); v != nil ||
+			ue.EncodeError == nil || ue.MMstate != MMDeregistared {
+			t.Errorf("%q: Registration Request %x, %v, %s", p.scheme, v,
+				ue.EncodeError, MMstateStr[ue.MMstate])
+		}
+	}
+
+	// the null-scheme is used if no protection scheme is configured.
+	ue := NewNAS("nas_test.json")
+	ue.ProtectionScheme = ""
+	if v := ue.MakeRegistrationRequest(); v == nil || ue.EncodeError != nil {
+		t.Errorf("Registration Request without protection scheme: %v",
+			ue.EncodeError)
+	}
+}
+
+func TestSUCIProfileB(t *testing.T) {
+	// 3GPP TS 33.501 C.4.4 Test data for ECIES Profile B
+	ue := NewNAS("nas_test.json")
+	ue.MSIN = "001002086"
+	ue.ProtectionScheme = "profileB"
+	ue.HomeNetworkPublicKey = "0272da71976234ce833a6907425867b8" +
+		"2e074d44ef907dfb4b3e21c1c2256ebcd1"
+	ue.HomeNetworkPublicKeyID = 2
+
+	ephPriv, _ := hex.DecodeString("99798858a1dc6a2c68637149a4b1dbfd" +
+		"1fdff5addd62a2142f06699ed7602529")
+	suciRand = bytes.NewReader(ephPriv)
+	v, _ := ue.enc5GSMobileIDTypeSUCI()
+	suciRand = rand.Reader
+	expect, _ := hex.DecodeString("0036" + "0102f8392143" + "0202" +
+		"039aab8376597021e855679a9778ea0b67396e68c66df32c0f41e9acca2da9b9d1" +
+		"46a33fc271" + "6ac7dae96aa30a4d")
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("SUCI\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	hnPriv, _ := ecdh.P256().GenerateKey(rand.Reader)
+
+	ue = NewNAS("nas_test.json")
+	ue.ProtectionScheme = "profileB"
+	ue.HomeNetworkPublicKey = hex.EncodeToString(hnPriv.PublicKey().Bytes())
+	ue.HomeNetworkPublicKeyID = 2
+
+	v, _ = ue.enc5GSMobileIDTypeSUCI()
+	expect, _ = hex.DecodeString("0036" + "0102f8392143" + "0202")
+	if reflect.DeepEqual(expect, v[:len(expect)]) == false {
+		t.Errorf("SUCI\nexpect: %x\nactual: %x", expect, v[:len(expect)])
+	}
+	if v[len(expect)] != 0x02 && v[len(expect)] != 0x03 {
+		t.Errorf("ephemeral public key is not compressed: %x", v)
+	}
+
+	supi, err := DeconcealSUCI(v[2:], hnPriv.Bytes())
+	if err != nil || supi != ue.SUPI {
+		t.Errorf("SUPI expect: %s, actual: %s (%v)", ue.SUPI, supi, err)
+	}
+
+	v[len(v)-1] ^= 0x01
+	if _, err = DeconcealSUCI(v[2:], hnPriv.Bytes()); err == nil {
+		t.Errorf("SUCI with the wrong MAC tag is accepted")
+	}
+}
+
+func TestDeconcealSUCI(t *testing.T) {
+	// 3GPP TS 33.501 C.4.3 Test data for ECIES Profile A
+	hnPriv, _ := hex.DecodeString("c53c22208b61860b06c62e5406a7b330" +
+		"c2b577aa5558981510d128247d38bd1d")
+	suci, _ := hex.DecodeString("0102f8392143" + "0101" +
+		"b2e92f836055a255837debf850b528997ce0201cb82adfe4be1f587d07d8457d" +
+		"cb02352410" + "cddd9e730ef3fa87")
+	supi, err := DeconcealSUCI(suci, hnPriv)
+	if err != nil || supi != "20893001002086" {
+		t.Errorf("SUPI expect: 20893001002086, actual: %s (%v)", supi, err)
+	}
+
+	// 3GPP TS 33.501 C.4.4 Test data for ECIES Profile B
+	hnPriv, _ = hex.DecodeString("f1ab1074477ebcc7f554ea1c5fc368b1" +
+		"616730155e0041ac447d6301975fecda")
+	suci, _ = hex.DecodeString("0102f8392143" + "0202" +
+		"039aab8376597021e855679a9778ea0b67396e68c66df32c0f41e9acca2da9b9d1" +
+		"46a33fc271" + "6ac7dae96aa30a4d")
+	supi, err = DeconcealSUCI(suci, hnPriv)
+	if err != nil || supi != "20893001002086" {
+		t.Errorf("SUPI expect: 20893001002086, actual: %s (%v)", supi, err)
+	}
+
+	ue := NewNAS("nas_test.json")
+	v, _ := ue.enc5GSMobileIDTypeSUCI()
+	supi, err = DeconcealSUCI(v[2:], nil)
+	if err != nil || supi != ue.SUPI {
+		t.Errorf("SUPI expect: %s, actual: %s (%v)", ue.SUPI, supi, err)
+	}
+}
+
+func TestNEA(t *testing.T) {
+
+	pattern := []struct {
+		alg    uint8
+		key    string
+		count  uint32
+		bearer uint8
+		dir    uint8
+		in     string
+		out    string
+	}{
+		// TS 33.401 C.1 128-EEA1 Test Set 1 (the last 3 bits are not used.)
+		{NEA1, "d3c5d592327fb11c4035c6680af8c6d1", 0x398a59b4, 0x15, 1,
+			"981ba6824c1bfb1ab485472029b71d808ce33e2cc3c0b5fc1f3de8a6dc66b1f0",
+			"5d5bfe75eb04f68ce0a12377ea00b37d47c6a0ba06309155086a859c4341b37c"},
+		// TS 33.401 C.1 128-EEA2 Test Set 1
+		{NEA2, "d3c5d592327fb11c4035c6680af8c6d1", 0x398a59b4, 0x15, 1,
+			"981ba6824c1bfb1ab485472029b71d808ce33e2cc3c0b5fc1f3de8a6dc66b1f0",
+			"e9fed8a63d155304d71df20bf3e82214b20ed7dad2f233dc3c22d7bdeeed8e78"},
+		// 128-EEA3 Test Set 1 (the last byte is padded.)
+		{NEA3, "173d14ba5003731d7a60049470f00a29", 0x66035492, 0x0f, 0,
+			"6cf65340735552ab0c9752fa6f9025fe0bd675d9005875b2",
+			"a6c85fc66afb8533aafc2518dfe784940ee1e4b030238cc8"},
+	}
+
+	nea := map[uint8]func([]byte, uint32, uint8, uint8, []byte) []byte{
+		NEA1: nea1,
+		NEA2: nea2,
+		NEA3: nea3,
+	}
+
+	for _, p := range pattern {
+		key, _ := hex.DecodeString(p.key)
+		in, _ := hex.DecodeString(p.in)
+		expect, _ := hex.DecodeString(p.out)
+
+		v := nea[p.alg](key, p.count, p.bearer, p.dir, in)
+		if reflect.DeepEqual(expect, v) == false {
+			t.Errorf("%s\nexpect: %x\nactual: %x",
+				cipherAlgStr[p.alg], expect, v)
+		}
+	}
+}
+
+func TestNIA(t *testing.T) {
+
+	pattern := []struct {
+		alg    uint8
+		key    string
+		count  uint32
+		bearer uint8
+		dir    uint8
+		in     string
+		bits   int // the message length in bits, 0 for the whole message
+		out    string
+	}{
+		// 128-EIA1 (UIA2) Test Set 1
+		{NIA1, "2bd6459f82c5b300952c49104881ff48", 0x38a6f056, 0x1f, 0,
+			"3332346263393861373479", 0, "731f1165"},
+		// TS 33.401 C.2 128-EIA2 Test Set 2
+		{NIA2, "d3c5d592327fb11c4035c6680af8c6d1", 0x398a59b4, 0x1a, 1,
+			"484583d5afe082ae", 0, "b93787e6"},
+		// TS 33.401 C.2 128-EIA2 Test Set 5
+		{NIA2, "83fd23a244a74cf358da3019f1722635", 0x36af6144, 0x0f, 1,
+			"35c68716633c66fb750c266865d53c11ea05b1e9fa49c8398d48e1efa5909d39" +
+				"47902837f5ae96d5a05bc8d61ca8dbef1b13a4b4abfe4fb1006045b674bb5472" +
+				"9304c382be53a5af05556176f6eaa2ef1d05e4b083181ee674cda5a485f74d7a",
+			0, "e657e182"},
+		// TS 33.401 C.4 128-EIA3 Test Set 1
+		{NIA3, "00000000000000000000000000000000", 0, 0, 0,
+			"00000000", 1, "c8a9595e"},
+		// TS 33.401 C.4 128-EIA3 Test Set 2
+		{NIA3, "47054125561eb2dda94059da05097850", 0x561eb2dd, 0x14, 0,
+			"000000000000000000000000", 90, "6719a088"},
+		// TS 33.401 C.4 128-EIA3 Test Set 3
+		{NIA3, "c9e6cec4607c72db000aefa88385ab0a", 0xa94059da, 0x0a, 1,
+			"983b41d47d780c9e1ad11d7eb70391b1de0b35da2dc62f83e7b78d6306ca0ea0" +
+				"7e941b7be91348f9fcb170e2217fecd97f9f68adb16e5d7d21e569d280ed775c" +
+				"ebde3f4093c53881000000",
+			577, "fae8ff0b"},
+	}
+
+	nia := map[uint8]func([]byte, uint32, uint8, uint8, []byte) []byte{
+		NIA1: nia1,
+		NIA2: nia2,
+		NIA3: nia3,
+	}
+
+	for _, p := range pattern {
+		key, _ := hex.DecodeString(p.key)
+		in, _ := hex.DecodeString(p.in)
+		expect, _ := hex.DecodeString(p.out)
+
+		v := nia[p.alg](key, p.count, p.bearer, p.dir, in)
+		if p.bits != 0 {
+			v = nia3Bits(key, p.count, p.bearer, p.dir, in, p.bits)
+		}
+		if reflect.DeepEqual(expect, v) == false {
+			t.Errorf("%s\nexpect: %x\nactual: %x",
+				integrityAlgStr[p.alg], expect, v)
+		}
+	}
+}
+
+func TestDecodeIntegrityProtected(t *testing.T) {
+
+	for _, alg := range []uint8{NIA0, NIA1, NIA2, NIA3} {
+		ue := NewNAS("nas_test.json")
+		// 5G-IA0 is accepted only for emergency services.
+		ue.Emergency = alg == NIA0
+		receive(ue, TestAuthenticationRequest)
+
+		// Security Mode Command selecting 5G-EA0 and the integrity algorithm.
+		plain, _ := hex.DecodeString(TestSecurityModeCommand)
+		plain = plain[7:]
+		plain[3] = alg
+		pdu := append([]byte{0x00}, plain...)
+		ue.selectNASSecurityAlgorithms(alg)
+		mac := ue.ComputeMAC(1, &pdu)
+		ue.selectNASSecurityAlgorithms(0)
+
+		in := []byte{EPD5GSMobilityManagement,
+			SecurityHeaderTypeIntegrityProtectedWithNewContext}
+		in = append(in, mac...)
+		in = append(in, pdu...)
+
+		receive(ue, hex.EncodeToString(in))
+		if ue.DecodeError != nil {
+			t.Errorf("%s: %v", integrityAlgStr[alg], ue.DecodeError)
+		}
+		if ue.sec.integrity != alg {
+			t.Errorf("%s: selected algorithm expect: %d, actual %d",
+				integrityAlgStr[alg], alg, ue.sec.integrity)
+		}
+	}
+}
+
+func TestDecodeCiphered(t *testing.T) {
+
+	for _, alg := range []uint8{NEA0, NEA1, NEA2, NEA3} {
+		ue := NewNAS("nas_test.json")
+		receive(ue, TestAuthenticationRequest)
+		receive(ue, TestSecurityModeCommand)
+		ue.selectNASSecurityAlgorithms(alg<<4 | NIA2)
+
+		// build ciphered Registration Accept in the same way as AMF.
+		plain, _ := hex.DecodeString(TestRegistrationAccept)
+		plain = plain[7:]
+		seq := []byte{0x01}
+		pdu := append(seq, ue.Cipher(1, 1, plain)...)
+		mac := ue.ComputeMAC(1, &pdu)
+		in := []byte{EPD5GSMobilityManagement,
+			SecurityHeaderTypeIntegrityProtectedAndCiphered}
+		in = append(in, mac...)
+		in = append(in, pdu...)
+
+		msgType := ue.Decode(&in)
+		if ue.DecodeError != nil {
+			t.Errorf("%s: %v", cipherAlgStr[alg], ue.DecodeError)
+		}
+		if msgType != MessageTypeRegistrationAccept {
+			t.Errorf("%s: message type expect: 0x%x, actual 0x%x",
+				cipherAlgStr[alg], MessageTypeRegistrationAccept, msgType)
+		}
+	}
+}
+
 func TestDecode(t *testing.T) {
 	ue := NewNAS("nas_test.json")
 	ue.dbgLevel = 1
@@ -183,3 +610,1492 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeReject(t *testing.T) {
+	pattern := []struct {
+		in_str string
+		expect RejectError
+	}{
+		{TestRegistrationReject, RejectError{
+			MsgType: MessageTypeRegistrationReject,
+			Cause:   MMCauseCongestion,
+			T3346:   60,
+			T3502:   720,
+		}},
+		{TestAuthenticationReject, RejectError{
+			MsgType: MessageTypeAuthenticationReject,
+		}},
+	}
+
+	for _, p := range pattern {
+		ue := NewNAS("nas_test.json")
+		ue.MMstate = MMRegisteredInitiated
+		receive(ue, p.in_str)
+
+		err, ok := ue.DecodeError.(*RejectError)
+		if ok == false || reflect.DeepEqual(p.expect, *err) == false {
+			t.Errorf("expect: %+v, actual: %+v", p.expect, ue.DecodeError)
+		}
+		if ue.MMstate != MMDeregistared {
+			t.Errorf("%v: MM state expect: %s, actual: %s", err,
+				MMstateStr[MMDeregistared], MMstateStr[ue.MMstate])
+		}
+	}
+}
+
+func TestMakeServiceRequest(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.PowerON()
+
+	// 5G-GUTI assigned by TestRegistrationAccept.
+	ue.Recv.fiveGGUTI, _ = hex.DecodeString("02f839cafe0000000001")
+
+	v := ue.MakeServiceRequest(ServiceTypeSignalling)
+	expect, _ := hex.DecodeString(TestServiceRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("ServiceRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.MMstate != MMServiceRequestInitiated {
+		t.Errorf("MM state expect: %s, actual: %s",
+			MMstateStr[MMServiceRequestInitiated], MMstateStr[ue.MMstate])
+	}
+
+	receive(ue, TestServiceAccept)
+	if ue.DecodeError != nil || ue.MMstate != MMRegistered {
+		t.Errorf("ServiceAccept: %v, MM state: %s",
+			ue.DecodeError, MMstateStr[ue.MMstate])
+	}
+
+	ue.MakeServiceRequest(ServiceTypeData)
+	receive(ue, TestServiceReject)
+	expectErr := RejectError{
+		MsgType: MessageTypeServiceReject,
+		Cause:   MMCauseImplicitlyDeregistered,
+	}
+	err, ok := ue.DecodeError.(*RejectError)
+	if ok == false || reflect.DeepEqual(expectErr, *err) == false {
+		t.Errorf("expect: %+v, actual: %+v", expectErr, ue.DecodeError)
+	}
+	if ue.MMstate != MMDeregistared {
+		t.Errorf("MM state expect: %s, actual: %s",
+			MMstateStr[MMDeregistared], MMstateStr[ue.MMstate])
+	}
+}
+
+func TestMakeRegistrationUpdate(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.PowerON()
+
+	// no registration update without the 5G-GUTI.
+	if v := ue.MakeRegistrationUpdate(
+		RegistrationTypePeriodicRegistrationUpdating); v != nil ||
+		ue.EncodeError == nil || ue.MMstate != MMDeregistared {
+		t.Errorf("RegistrationUpdate without 5G-GUTI: %x, %v, %s", v,
+			ue.EncodeError, MMstateStr[ue.MMstate])
+	}
+
+	// 5G-GUTI and TAI list assigned by TestRegistrationAccept.
+	ue.Recv.fiveGGUTI, _ = hex.DecodeString("02f839cafe0000000001")
+	ue.Recv.tai = []TAI{{208, 93, []byte{0x00, 0x00, 0x01}}}
+	ue.Recv.t3512 = 3600
+
+	v := ue.MakeRegistrationUpdate(RegistrationTypePeriodicRegistrationUpdating)
+	expect, _ := hex.DecodeString(TestPeriodicRegistrationUpdate)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("RegistrationUpdate\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.MMstate != MMRegisteredInitiated {
+		t.Errorf("MM state expect: %s, actual: %s",
+			MMstateStr[MMRegisteredInitiated], MMstateStr[ue.MMstate])
+	}
+	if ue.T3512() != time.Hour {
+		t.Errorf("T3512 expect: %v, actual: %v", time.Hour, ue.T3512())
+	}
+}
+
+func TestNetworkDeregistration(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	receive(ue, TestDeregistrationRequestUETerm)
+	if ue.DeregistrationRequested() == false {
+		t.Errorf("Deregistration Request is not decoded")
+	}
+	if ue.ReregistrationRequired() == false {
+		t.Errorf("re-registration required is not decoded")
+	}
+	if ue.Recv.mmCause != MMCauseImplicitlyDeregistered {
+		t.Errorf("5GMM cause expect: %d, actual: %d",
+			MMCauseImplicitlyDeregistered, ue.Recv.mmCause)
+	}
+
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestDeregistrationAcceptUETerm)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("DeregistrationAccept\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.DeregistrationRequested() || ue.MMstate != MMDeregistared {
+		t.Errorf("MM state expect: %s, actual: %s",
+			MMstateStr[MMDeregistared], MMstateStr[ue.MMstate])
+	}
+}
+
+func TestConfigurationUpdateCommand(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	receive(ue, TestConfigUpdateCommand)
+	if ue.ConfigurationUpdateAckRequested() == false {
+		t.Errorf("acknowledgement requested is not decoded")
+	}
+	if name := ue.NetworkName(); name != "Open5GS" {
+		t.Errorf("full name expect: %s, actual: %s", "Open5GS", name)
+	}
+	if name := ue.Recv.network.shortName; name != "Test" {
+		t.Errorf("short name expect: %s, actual: %s", "Test", name)
+	}
+	expectTime := time.Date(2020, 10, 10, 15, 11, 54, 0, time.UTC)
+	if ue.Recv.network.universalTime.Equal(expectTime) == false ||
+		ue.Recv.network.timeZone != 0 || ue.Recv.network.dst != 1 {
+		t.Errorf("time expect: %v, actual: %v", expectTime, ue.Recv.network)
+	}
+
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestConfigUpdateComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("ConfigurationUpdateComplete\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.ConfigurationUpdateAckRequested() {
+		t.Errorf("acknowledgement is not cleared")
+	}
+
+	// the truncated time zone and time is the decoding error.
+	ue.DecodeError = nil
+	receive(ue, "7e0054"+"d1"+"4702010151")
+	if ue.DecodeError == nil {
+		t.Errorf("truncated time zone and time is decoded")
+	}
+}
+
+func TestMakeIdentityResponse(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.PowerON()
+
+	receive(ue, TestIdentityRequest)
+	if ue.IdentityRequested() == false {
+		t.Errorf("Identity Request is not decoded")
+	}
+
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestIdentityResponse)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("IdentityResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.IdentityRequested() {
+		t.Errorf("Identity Request is not cleared")
+	}
+
+	// 5G-S-TMSI is not available before the registration.
+	ue.Recv.idType = TypeID5GSTMSI
+	v = ue.MakeIdentityResponse()
+	expect, _ = hex.DecodeString("7e005c000100")
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("IdentityResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	// protected by the current security context after the registration.
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.Recv.idType = TypeIDSUCI
+	v = ue.MakeIdentityResponse()
+	if len(v) < 2 ||
+		v[1] != SecurityHeaderTypeIntegrityProtectedAndCiphered {
+		t.Errorf("IdentityResponse security header type: %x", v)
+	}
+
+	if d := luhnCheckDigit("49015420323751"); d != "8" {
+		t.Errorf("check digit expect: 8, actual: %s", d)
+	}
+}
+
+func TestMakeMMStatus(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.PowerON()
+
+	// sent in plain before the security mode control.
+	v := ue.MakeMMStatus(MMCauseMessageNotCompatible)
+	expect, _ := hex.DecodeString("7e006462")
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("MMStatus\nexpect: %x\nactual: %x", expect, v)
+	}
+	receive(ue, TestAuthenticationRequest)
+	v = ue.MakeMMStatus(MMCauseMessageNotCompatible)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("MMStatus\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	receive(ue, TestSecurityModeCommand)
+	v = ue.MakeMMStatus(MMCauseMessageNotCompatible)
+	if len(v) != 11 ||
+		v[1] != SecurityHeaderTypeIntegrityProtectedAndCiphered {
+		t.Errorf("MMStatus is not protected: %x", v)
+	}
+}
+
+func TestPDUSessionRelease(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+
+	v := ue.MakePDUSessionReleaseRequest(1)
+	expect, _ := hex.DecodeString(TestPDUSessionReleaseRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionReleaseRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+	s := ue.PDUSession(1)
+	if s.SMstate != SMInactivePending {
+		t.Errorf("SM state expect: %s, actual: %s",
+			SMstateStr[SMInactivePending], SMstateStr[s.SMstate])
+	}
+
+	receive(ue, TestPDUSessionReleaseCommand)
+	if ue.PDUSessionReleaseCommanded() == false {
+		t.Errorf("PDU Session Release Command is not decoded")
+	}
+	if ue.CurrentPDUSession() != s {
+		t.Errorf("PDU session commanded expect: %d, actual: %+v",
+			s.ID, ue.CurrentPDUSession())
+	}
+
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString(TestPDUSessionReleaseComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionReleaseComplete\nexpect: %x\nactual: %x", expect, v)
+	}
+	if s.SMstate != SMInactive || s.Address != nil {
+		t.Errorf("SM state expect: %s, actual: %s, address: %v",
+			SMstateStr[SMInactive], SMstateStr[s.SMstate], s.Address)
+	}
+}
+
+func TestPDUSessionModification(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+
+	receive(ue, TestPDUSessionModificationCommand)
+	s := ue.PDUSession(1)
+	if ue.PDUSessionModificationCommanded() == false {
+		t.Errorf("PDU Session Modification Command is not decoded")
+	}
+
+	expectRules := []QoSRule{
+		{ID: 1, Default: true, Precedence: 0xff, QFI: 1,
+			PacketFilters: []PacketFilter{
+				{ID: 1, Direction: pktFilterDirBidirectional,
+					Contents: []byte{PacketFilterMatchAll},
+					Components: []PacketFilterComponent{
+						{Type: PacketFilterMatchAll}}}}},
+		{ID: 2, Precedence: 0x20, QFI: 2,
+			PacketFilters: []PacketFilter{
+				{ID: 1, Direction: pktFilterDirBidirectional,
+					Contents: []byte{0x40, 0x1f, 0x90},
+					Components: []PacketFilterComponent{
+						{Type: PacketFilterSingleLocalPort,
+							PortLow: 8080, PortHigh: 8080}}}}},
+	}
+	if reflect.DeepEqual(expectRules, s.QoSRules()) == false {
+		t.Errorf("QoS rules\nexpect: %+v\nactual: %+v",
+			expectRules, s.QoSRules())
+	}
+
+	expectFlows := []QoSFlowDescription{{QFI: 2, FiveQI: 7}}
+	if reflect.DeepEqual(expectFlows, s.QoSFlowDescriptions()) == false {
+		t.Errorf("QoS flow descriptions\nexpect: %+v\nactual: %+v",
+			expectFlows, s.QoSFlowDescriptions())
+	}
+
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestPDUSessionModificationComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionModificationComplete\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	// the rule to be modified does not exist.
+	receive(ue, TestPDUSessionModificationCommand2)
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString(TestPDUSessionModCommandReject)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionModificationCommandReject\nexpect: %x\nactual: %x", expect, v)
+	}
+	if reflect.DeepEqual(expectRules, s.QoSRules()) == false {
+		t.Errorf("QoS rules are changed by the rejected command: %+v",
+			s.QoSRules())
+	}
+}
+
+func TestMalformedQoSFlowDescriptions(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	s := ue.PDUSession(1)
+	flows := s.QoSFlowDescriptions()
+
+	for _, str := range []string{
+		"00020220",           // the description is truncated.
+		"0006022041010501",   // the 5QI exceeds the description.
+		"0006022041020105",   // the GFBR uplink is too short.
+		"000a02204101010905", // the length exceeds the IE.
+	} {
+		pdu, _ := hex.DecodeString(str)
+		if err := ue.decQoSFlowDescriptions(&pdu); err == nil {
+			t.Errorf("QoS flow descriptions(%s) are decoded", str)
+		}
+		if reflect.DeepEqual(flows, s.QoSFlowDescriptions()) == false {
+			t.Errorf("QoS flow descriptions are changed by %s: %+v",
+				str, s.QoSFlowDescriptions())
+		}
+	}
+}
+
+func TestMultiplePDUSessions(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	ue.MakePDUSessionEstablishmentRequest(1)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+
+	v := ue.MakePDUSessionEstablishmentRequest(2)
+	expect, _ := hex.DecodeString(TestPDUSessionEstablishmentRequest2)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionEstablishmentRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	receive(ue, TestPDUSessionEstablishmentAccept2)
+	if ue.DecodeError != nil {
+		t.Errorf("PDUSessionEstablishmentAccept: %v", ue.DecodeError)
+	}
+
+	for i, addr := range []string{"60.60.0.1", "60.60.0.2"} {
+		s := ue.PDUSession(uint8(i + 1))
+		if s.SMstate != SMActive || s.Address.String() != addr {
+			t.Errorf("PDU session(%d) expect: %s %s, actual: %s %v", s.ID,
+				SMstateStr[SMActive], addr, SMstateStr[s.SMstate], s.Address)
+		}
+	}
+
+	expectPSI := []uint8{1, 2}
+	if psi := ue.activePDUSessions(); reflect.DeepEqual(expectPSI, psi) == false {
+		t.Errorf("active PDU sessions expect: %v, actual: %v", expectPSI, psi)
+	}
+
+	if v := ue.MakePDUSessionEstablishmentRequest(3); v != nil {
+		t.Errorf("PDU session(3) is not configured but requested: %x", v)
+	}
+
+	// the lowest free ID is taken, and the duplicated or out of range
+	// ID is rejected.
+	ue.PDUSessions = []*PDUSession{{ID: 0}, {ID: 1}, {ID: 1}, {ID: 16},
+		{ID: 0}}
+	ue.PowerON()
+	var ids []uint8
+	for _, s := range ue.PDUSessions {
+		ids = append(ids, s.ID)
+	}
+	if expect := []uint8{2, 1, 3}; reflect.DeepEqual(expect, ids) == false {
+		t.Errorf("PDU session IDs expect: %v, actual: %v", expect, ids)
+	}
+}
+
+func TestPDUSessionIPv6(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	ue.MakePDUSessionEstablishmentRequest(1)
+	receive(ue, TestPDUSessionEstablishmentAcceptIPv4v6)
+	if ue.DecodeError != nil {
+		t.Errorf("PDUSessionEstablishmentAccept: %v", ue.DecodeError)
+	}
+
+	s := ue.PDUSession(1)
+	expectIID := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	if s.Address.String() != "60.60.0.1" ||
+		reflect.DeepEqual(expectIID, s.InterfaceID) == false {
+		t.Errorf("PDU address expect: 60.60.0.1 %x, actual: %v %x",
+			expectIID, s.Address, s.InterfaceID)
+	}
+	if lla := s.LinkLocalAddress(); lla.String() != "fe80::1" {
+		t.Errorf("link local address expect: fe80::1, actual: %v", lla)
+	}
+
+	v := s.MakeRouterSolicitation()
+	expect, _ := hex.DecodeString(TestRouterSolicitation)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("RouterSolicitation\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	ra, _ := hex.DecodeString(TestRouterAdvertisement)
+	if IsRouterAdvertisement(ra) == false {
+		t.Errorf("RouterAdvertisement is not detected")
+	}
+	if err := s.RecvRouterAdvertisement(ra); err != nil {
+		t.Errorf("RouterAdvertisement: %v", err)
+	}
+	if s.Address6.String() != "2001:db8:1:2::1" {
+		t.Errorf("IPv6 address expect: 2001:db8:1:2::1, actual: %v", s.Address6)
+	}
+
+	ra[len(ra)-1] ^= 0xff
+	if err := s.RecvRouterAdvertisement(ra); err == nil {
+		t.Errorf("RouterAdvertisement with invalid checksum is accepted")
+	}
+
+	// IPv6 only with the SMF's link local address.
+	ue.MakePDUSessionReleaseRequest(1)
+	receive(ue, TestPDUSessionReleaseCommand)
+	ue.MakePDUSessionReleaseComplete()
+	if s.InterfaceID != nil || s.Address6 != nil {
+		t.Errorf("IPv6 address remains after release: %x %v",
+			s.InterfaceID, s.Address6)
+	}
+
+	ue.MakePDUSessionEstablishmentRequest(1)
+	receive(ue, TestPDUSessionEstablishmentAcceptIPv6)
+	if ue.DecodeError != nil {
+		t.Errorf("PDUSessionEstablishmentAccept: %v", ue.DecodeError)
+	}
+	if s.Address != nil || reflect.DeepEqual(expectIID, s.InterfaceID) == false {
+		t.Errorf("PDU address expect: <nil> %x, actual: %v %x",
+			expectIID, s.Address, s.InterfaceID)
+	}
+}
+
+func TestPDUSessionEthernet(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	s := ue.PDUSession(2)
+	s.Type = "Ethernet"
+	v := ue.MakePDUSessionEstablishmentRequest(2)
+	expect, _ := hex.DecodeString(TestPDUSessionEstablishmentRequestEthernet)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionEstablishmentRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	receive(ue, TestPDUSessionEstablishmentAcceptEthernet)
+	if ue.DecodeError != nil {
+		t.Errorf("PDUSessionEstablishmentAccept: %v", ue.DecodeError)
+	}
+	if s.SMstate != SMActive || s.Address != nil || s.InterfaceID != nil {
+		t.Errorf("PDU session expect: %s without address, actual: %s %v %x",
+			SMstateStr[SMActive], SMstateStr[s.SMstate], s.Address, s.InterfaceID)
+	}
+}
+
+func TestPDUSessionUnstructured(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	// IPv4 is selected for the PDU session requested as IPv4v6.
+	ue.MakePDUSessionEstablishmentRequest(1)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	if s := ue.PDUSession(1); s.Type != "IPv4" {
+		t.Errorf("PDU session type expect: IPv4, actual: %s", s.Type)
+	}
+	if err := ue.PDUSession(1).SendUnstructured([]byte{0x01}); err == nil {
+		t.Errorf("unstructured payload is sent over IPv4 PDU session")
+	}
+
+	s := ue.PDUSession(2)
+	s.Type = "Unstructured"
+	if err := s.SendUnstructured([]byte{0x01}); err == nil {
+		t.Errorf("unstructured payload is sent before the establishment")
+	}
+	ue.MakePDUSessionEstablishmentRequest(2)
+	receive(ue, strings.Replace(TestPDUSessionEstablishmentAcceptEthernet,
+		"2e0201c215", "2e0201c214", 1))
+	if ue.DecodeError != nil || s.SMstate != SMActive ||
+		s.Type != "Unstructured" {
+		t.Errorf("PDUSessionEstablishmentAccept: %s %s %v",
+			SMstateStr[s.SMstate], s.Type, ue.DecodeError)
+	}
+
+	ul := []byte("uplink")
+	if err := s.SendUnstructured(ul); err != nil {
+		t.Errorf("SendUnstructured: %v", err)
+	}
+	select {
+	case v := <-s.UnstructuredUplink():
+		if reflect.DeepEqual(ul, v) == false {
+			t.Errorf("uplink payload expect: %x, actual: %x", ul, v)
+		}
+	default:
+		t.Errorf("uplink payload is not queued")
+	}
+
+	dl := []byte("downlink")
+	if err := s.RecvUnstructured(dl); err == nil {
+		t.Errorf("downlink payload is received without the handler")
+	}
+	var received []byte
+	s.UnstructuredHandler = func(payload []byte) {
+		received = payload
+	}
+	if err := s.RecvUnstructured(dl); err != nil ||
+		reflect.DeepEqual(dl, received) == false {
+		t.Errorf("downlink payload expect: %x, actual: %x, %v",
+			dl, received, err)
+	}
+}
+
+func TestEncPDUSessionType(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	pattern := []struct {
+		in     string
+		expect byte
+	}{
+		{"IPv4", 0x91},
+		{"IPv6", 0x92},
+		{"IPv4v6", 0x93},
+		{"Unstructured", 0x94},
+		{"Ethernet", 0x95},
+		{"", 0x93},
+	}
+	for _, p := range pattern {
+		if v, err := ue.encPDUSessionType(p.in); err != nil ||
+			v[0] != p.expect {
+			t.Errorf("PDU session type %q expect: 0x%02x, actual: %x (%v)",
+				p.in, p.expect, v, err)
+		}
+	}
+
+	// the type misspelled in the configuration is not requested.
+	if _, err := ue.encPDUSessionType("IPV4"); err == nil {
+		t.Errorf("unknown PDU session type is accepted")
+	}
+	ue.PDUSession(1).Type = "IPV4"
+	if v := ue.MakePDUSessionEstablishmentRequest(1); v != nil ||
+		ue.EncodeError == nil || ue.PDUSession(1).SMstate != SMInactive {
+		t.Errorf("PDU session with unknown type is requested: %x, %v", v,
+			ue.EncodeError)
+	}
+}
+
+func TestTimerT3510(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ch := make(chan TimerEvent, 1)
+	ue.TimerCh = ch
+
+	ue.SetTimerValue(T3510, time.Hour)
+	ue.MakeRegistrationRequest()
+	if ue.TimerRunning(T3510, 0) == false {
+		t.Errorf("T3510 is not started by Registration Request")
+	}
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.TimerRunning(T3510, 0) {
+		t.Errorf("T3510 is not stopped by Registration Accept")
+	}
+
+	// the registration is aborted and retried after T3511.
+	ue.SetTimerValue(T3510, time.Millisecond)
+	ue.SetTimerValue(T3511, time.Hour)
+	ue.MakeRegistrationRequest()
+	if pdu := ue.TimerExpired(<-ch); pdu != nil {
+		t.Errorf("Registration Request is retransmitted: %x", pdu)
+	}
+	if ue.MMstate != MMDeregistared || ue.TimerRunning(T3511, 0) == false {
+		t.Errorf("T3510 expiry expect: %s with T3511, actual: %s",
+			MMstateStr[MMDeregistared], MMstateStr[ue.MMstate])
+	}
+
+	// T3502 is started instead after the 5th attempt.
+	ue.SetTimerValue(T3502, time.Hour)
+	for i := 1; i < maxRegistrationAttempt; i++ {
+		ue.MakeRegistrationRequest()
+		ue.TimerExpired(<-ch)
+	}
+	if ue.TimerRunning(T3511, 0) || ue.TimerRunning(T3502, 0) == false {
+		t.Errorf("T3502 is not started after %d attempts", maxRegistrationAttempt)
+	}
+	ue.PowerON()
+	if ue.TimerRunning(T3502, 0) {
+		t.Errorf("T3502 is not stopped by power on")
+	}
+}
+
+func TestTimerT3580(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ch := make(chan TimerEvent, 1)
+	ue.TimerCh = ch
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	ue.SetTimerValue(T3580, time.Millisecond)
+	v := ue.MakePDUSessionEstablishmentRequest(1)
+
+	// the same request is retransmitted in the new security header.
+	for i := 0; i < maxRetransmission; i++ {
+		ev := <-ch
+		if ev.Timer != T3580 || ev.PSI != 1 {
+			t.Errorf("timer event expect: T3580 for 1, actual: T%d for %d",
+				ev.Timer, ev.PSI)
+		}
+		pdu := ue.TimerExpired(ev)
+		if len(pdu) != len(v) || reflect.DeepEqual(v[7:], pdu[7:]) == false {
+			t.Errorf("retransmission %d\nexpect: %x\nactual: %x", i+1, v, pdu)
+		}
+	}
+
+	s := ue.PDUSession(1)
+	if pdu := ue.TimerExpired(<-ch); pdu != nil || s.SMstate != SMInactive {
+		t.Errorf("PDU session establishment is not aborted: %x %s",
+			pdu, SMstateStr[s.SMstate])
+	}
+
+	// the expiry after the accept is ignored.
+	ue.SetTimerValue(T3580, 10*time.Millisecond)
+	ue.MakePDUSessionEstablishmentRequest(1)
+	receive(ue, TestPDUSessionEstablishmentAcceptIPv4v6)
+	if ue.TimerRunning(T3580, 1) {
+		t.Errorf("T3580 is not stopped by PDU Session Establishment Accept")
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("stopped timer is notified: T%d", ev.Timer)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s.SMstate != SMActive {
+		t.Errorf("PDU session expect: %s, actual: %s",
+			SMstateStr[SMActive], SMstateStr[s.SMstate])
+	}
+
+	// the expiry is dropped instead of blocking when TimerCh is full.
+	ch <- TimerEvent{}
+	ue.SetTimerValue(T3582, time.Millisecond)
+	ue.MakePDUSessionReleaseRequest(1)
+	time.Sleep(50 * time.Millisecond)
+	<-ch
+	select {
+	case ev := <-ch:
+		t.Errorf("expiry on the full channel is notified: T%d", ev.Timer)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDecBitRate(t *testing.T) {
+	pattern := []struct {
+		in     []byte
+		expect uint64
+	}{
+		{[]byte{0x00, 0x00, 0x01}, 0},
+		{[]byte{0x01, 0x00, 0x0a}, 10},
+		{[]byte{0x05, 0x00, 0x02}, 512},
+		{[]byte{0x06, 0x00, 0x0a}, 10000},
+		{[]byte{0x07, 0x00, 0x01}, 4000},
+		{[]byte{0x0b, 0x00, 0x01}, 1000000},
+	}
+	for _, p := range pattern {
+		if v := decBitRate(p.in); v != p.expect {
+			t.Errorf("bit rate %x expect: %d, actual: %d", p.in, p.expect, v)
+		}
+	}
+}
+
+func TestHandleNAS(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	var events []Event
+	handle := func(msg string, nUL int, expect ...int) {
+		in, _ := hex.DecodeString(msg)
+		var ul [][]byte
+		ul, events = ue.HandleNAS(in)
+		if len(ul) != nUL {
+			t.Errorf("%s: uplink expect: %d, actual: %d", msg, nUL, len(ul))
+		}
+		var evTypes []int
+		for _, ev := range events {
+			evTypes = append(evTypes, ev.Type)
+		}
+		if reflect.DeepEqual(expect, evTypes) == false {
+			t.Errorf("%s: events expect: %v, actual: %v", msg, expect, evTypes)
+		}
+	}
+
+	ue.MakeRegistrationRequest()
+	handle(TestAuthenticationRequest, 1)
+	handle(TestSecurityModeCommand, 1)
+	handle(TestRegistrationAccept, 1, EventRegistered)
+	if ue.MMstate != MMRegistered {
+		t.Errorf("MMstate expect: %s, actual: %s",
+			MMstateStr[MMRegistered], MMstateStr[ue.MMstate])
+	}
+
+	ue.MakePDUSessionEstablishmentRequest(1)
+	handle(TestPDUSessionEstablishmentAccept, 0, EventPDUSessionEstablished)
+
+	// the messages not compatible with the state are answered by STATUS.
+	handle(protect(ue, TestRegistrationAccept, 3), 1)
+	if ue.fsm.mmCause != MMCauseMessageNotCompatible || ue.MMstate != MMRegistered {
+		t.Errorf("Registration Accept in %s: cause 0x%x",
+			MMstateStr[ue.MMstate], ue.fsm.mmCause)
+	}
+	if v := ue.MakeNasPdu(); v != nil {
+		t.Errorf("Registration Accept answered by STATUS is answered: %x", v)
+	}
+	handle(TestServiceAccept, 1)
+
+	handle(protect(ue, TestPDUSessionEstablishmentAccept, 4), 1)
+	if ue.fsm.smCause != smCauseMessageNotCompatible {
+		t.Errorf("PDU Session Establishment Accept in %s: cause 0x%x",
+			SMstateStr[ue.PDUSession(1).SMstate], ue.fsm.smCause)
+	}
+
+	// the rejected command is also notified for the gNB to answer.
+	handle(TestPDUSessionModificationCommand2, 1,
+		EventPDUSessionModified)
+	if events[0].Err == nil {
+		t.Errorf("PDU Session Modification Command is not rejected")
+	}
+
+	handle(TestPDUSessionReleaseCommand, 1, EventPDUSessionReleased)
+	if s := ue.PDUSession(1); s.SMstate != SMInactive {
+		t.Errorf("PDU session expect: %s, actual: %s",
+			SMstateStr[SMInactive], SMstateStr[s.SMstate])
+	}
+	if v := ue.MakeNasPdu(); v != nil || ue.PDUSessionReleaseCommanded() {
+		t.Errorf("PDU Session Release Command is answered twice: %x", v)
+	}
+
+	handle(TestDeregistrationRequestUETerm, 1, EventDeregistered,
+		EventReregistrationRequired)
+	handle(protect(ue, TestRegistrationAccept, 5), 1)
+}
+
+// protect returns the downlink message protected again with the NAS COUNT
+// in the same way as AMF.
+func protect(ue *UE, msg string, count uint32) string {
+	plain, _ := hex.DecodeString(msg)
+	if plain[1] != SecurityHeaderTypePlain {
+		plain = plain[7:]
+	}
+	pdu := append([]byte{uint8(count)}, ue.Cipher(1, count, plain)...)
+	mac := ue.computeMAC(1, count, &pdu)
+	in := []byte{EPD5GSMobilityManagement,
+		SecurityHeaderTypeIntegrityProtectedAndCiphered}
+	in = append(in, mac...)
+	in = append(in, pdu...)
+	return hex.EncodeToString(in)
+}
+
+func TestNASCount(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	// the NAS overflow is counted up with the sequence number wrapped.
+	ue.ULCount = 0xff
+	for _, count := range []uint32{0xff, 0x100} {
+		pdu := ue.MakeConfigurationUpdateComplete()
+		seq := pdu[6:]
+		expect := ue.computeMAC(0, count, &seq)
+		if pdu[6] != uint8(count) || reflect.DeepEqual(expect, pdu[2:6]) == false {
+			t.Errorf("UL NAS COUNT 0x%x\nexpect: %x\nactual: %x", count, expect, pdu)
+		}
+	}
+	if ue.ULCount != 0x101 {
+		t.Errorf("UL NAS COUNT expect: 0x101, actual: 0x%x", ue.ULCount)
+	}
+
+	ue.DLCount = 0xfe
+	pattern := []struct {
+		count  uint32
+		accept bool
+		desc   string
+	}{
+		{0xff, true, "next"},
+		{0x100, true, "wrapped"},
+		{0x100, false, "replayed"},
+		{0xff, false, "old"},
+		{0x105, true, "lost"},
+		{0x185, false, "out of window"},
+	}
+	for _, p := range pattern {
+		receive(ue, protect(ue, TestConfigUpdateCommand, p.count))
+		if (ue.DecodeError == nil) != p.accept {
+			t.Errorf("%s DL NAS COUNT 0x%x: %v", p.desc, p.count, ue.DecodeError)
+		}
+	}
+	if ue.DLCount != 0x105 {
+		t.Errorf("DL NAS COUNT expect: 0x105, actual: 0x%x", ue.DLCount)
+	}
+
+	// the replayed Security Mode Command of the current security context
+	// is rejected, and the NAS COUNTs are not reset.
+	ul, dl := ue.ULCount, ue.DLCount
+	receive(ue, TestSecurityModeCommand)
+	if ue.DecodeError == nil || ue.ULCount != ul || ue.DLCount != dl ||
+		ue.sec.dlCountValid == false {
+		t.Errorf("replayed Security Mode Command: %v UL 0x%x DL 0x%x",
+			ue.DecodeError, ue.ULCount, ue.DLCount)
+	}
+
+	// the NAS COUNTs are reset by the new security context after the
+	// authentication. SQN_MS is cleared to run it again by the same vector.
+	ue.AuthParam.sqnMS = nil
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	if ue.DecodeError != nil || ue.ULCount != 0 || ue.DLCount != 0 {
+		t.Errorf("NAS COUNT in the new context: %v UL 0x%x DL 0x%x",
+			ue.DecodeError, ue.ULCount, ue.DLCount)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+
+	vectors := []string{
+		TestRegistrationRequest,
+		TestAuthenticationResponse,
+		TestServiceRequest,
+		TestPeriodicRegistrationUpdate,
+		TestRegistrationComplete,
+		TestPDUSessionEstablishmentRequest,
+		TestPDUSessionEstablishmentRequest2,
+		TestDeregistrationRequest,
+		TestConfigUpdateComplete,
+		TestIdentityResponse,
+		TestPDUSessionReleaseRequest,
+		TestPDUSessionReleaseComplete,
+		TestDeregistrationAcceptUETerm,
+		TestPDUSessionModificationComplete,
+		TestPDUSessionModCommandReject,
+		TestAuthenticationRequest,
+		TestSecurityModeCommand,
+		TestRegistrationAccept,
+		TestPDUSessionEstablishmentAccept,
+		TestPDUSessionEstablishmentAccept2,
+		TestPDUSessionEstablishmentAcceptIPv4v6,
+		TestPDUSessionEstablishmentAcceptIPv6,
+		TestPDUSessionEstablishmentRequestEthernet,
+		TestPDUSessionEstablishmentAcceptEthernet,
+		TestPDUSessionEstablishmentAcceptRQ,
+		TestEmergencyRegistrationRequest,
+		TestSecurityModeCommandNIA0,
+		TestSecurityModeReject,
+		TestEmergencyRegistrationAccept,
+		TestRegistrationRequestSMS,
+		TestRegistrationAcceptSMS,
+		TestManageUEPolicyCommand,
+		TestManageUEPolicyCommandReject,
+		TestDeregistrationAccept,
+		TestRegistrationReject,
+		TestAuthenticationReject,
+		TestDeregistrationRequestUETerm,
+		TestConfigUpdateCommand,
+		TestIdentityRequest,
+		TestPDUSessionReleaseCommand,
+		TestPDUSessionModificationCommand,
+		TestPDUSessionModificationCommand2,
+		TestServiceAccept,
+		TestServiceReject,
+	}
+	vectors = append(vectors, TestSecurityModeComplete...)
+
+	// the message is encoded back to the same octets, and so is the
+	// message in the security protected message and in the payload.
+	var roundTrip func(in []byte, plain bool)
+	roundTrip = func(in []byte, plain bool) {
+		m, err := decodeMessage(in, plain)
+		if err != nil {
+			t.Errorf("%x: %v", in, err)
+			return
+		}
+		v, err := m.Encode()
+		if err != nil || reflect.DeepEqual(in, v) == false {
+			t.Errorf("round trip: %v\nexpect: %x\nactual: %x", err, in, v)
+		}
+		if len(m.Unknown) != 0 {
+			t.Errorf("%s: unknown IEs: %x",
+				msgTypeStr[int(m.MessageType)], m.Unknown)
+		}
+
+		switch body := m.Body.(type) {
+		case nil:
+			roundTrip(m.Protected, true)
+		case *ULNASTransport:
+			if body.PayloadContainerType == PayloadContainerN1SMInformation {
+				roundTrip(body.PayloadContainer, false)
+			}
+		case *DLNASTransport:
+			if body.PayloadContainerType == PayloadContainerN1SMInformation {
+				roundTrip(body.PayloadContainer, false)
+			}
+		}
+	}
+	for _, s := range vectors {
+		in, _ := hex.DecodeString(s)
+		roundTrip(in, false)
+	}
+
+	in, _ := hex.DecodeString(TestRegistrationReject)
+	m, _ := DecodeMessage(in)
+	rej, ok := m.Body.(*RegistrationReject)
+	if ok == false || rej.Cause != MMCauseCongestion ||
+		reflect.DeepEqual(rej.T3502Value, []byte{0x2c}) == false ||
+		rej.EAPMessage != nil {
+		t.Errorf("RegistrationReject: %+v", m.Body)
+	}
+
+	in, _ = hex.DecodeString(TestPDUSessionEstablishmentAccept)
+	m, _ = DecodeMessage(in)
+	m, _ = m.Plain()
+	dl := m.Body.(*DLNASTransport)
+	if *dl.PDUSessionID != 1 {
+		t.Errorf("PDU session ID expect: 1, actual: %d", *dl.PDUSessionID)
+	}
+	m, err := dl.SMMessage()
+	if err != nil {
+		t.Errorf("SMMessage: %v", err)
+	}
+	accept := m.Body.(*PDUSessionEstablishmentAccept)
+	if m.PSI != 1 || accept.PDUSessionType != PDUSessionIPv4 ||
+		net.IP(accept.PDUAddress[1:]).String() != "60.60.0.1" {
+		t.Errorf("PDUSessionEstablishmentAccept: %d %+v", m.PSI, accept)
+	}
+
+	// the unknown IE is kept and the type 1 IE is encoded in bits 5 to 8.
+	cuc := &ConfigurationUpdateCommand{
+		ConfigurationUpdateIndication: new(uint8),
+	}
+	*cuc.ConfigurationUpdateIndication = 1
+	m = &Message{EPD: EPD5GSMobilityManagement,
+		MessageType: MessageTypeConfigurationUpdateCommand,
+		Body:        cuc, Unknown: []byte{0x7f, 0x00, 0x01, 0xff}}
+	expect := []byte{0x7e, 0x00, 0x54, 0xd1, 0x7f, 0x00, 0x01, 0xff}
+	if v, _ := m.Encode(); reflect.DeepEqual(expect, v) == false {
+		t.Errorf("ConfigurationUpdateCommand\nexpect: %x\nactual: %x", expect, v)
+	}
+	if m, _ = DecodeMessage(expect); reflect.DeepEqual(m.Unknown, expect[4:]) == false {
+		t.Errorf("unknown IE expect: %x, actual: %x", expect[4:], m.Unknown)
+	}
+
+	// the optional IEs are encoded in the order received: out of the order
+	// of the clause 8, the unknown IE between the known IEs and the
+	// repeated IE, whose first one is given by the body.
+	pattern := []struct {
+		in        string
+		fullName  string
+		shortName string
+		unknown   string
+	}{
+		{"7e0054" + "4503414243" + "4303444546", "444546", "414243", ""},
+		{"7e0054" + "4303414243" + "7f0001ff" + "4503444546",
+			"414243", "444546", "7f0001ff"},
+		{"7e0054" + "4303414243" + "4303444546", "414243", "", ""},
+	}
+	for _, p := range pattern {
+		in, _ := hex.DecodeString(p.in)
+		m, err := DecodeMessage(in)
+		if err != nil {
+			t.Errorf("%s: %v", p.in, err)
+			continue
+		}
+		if v, err := m.Encode(); err != nil || reflect.DeepEqual(in, v) == false {
+			t.Errorf("round trip: %v\nexpect: %x\nactual: %x", err, in, v)
+		}
+		cuc := m.Body.(*ConfigurationUpdateCommand)
+		if hex.EncodeToString(cuc.FullNameForNetwork) != p.fullName ||
+			hex.EncodeToString(cuc.ShortNameForNetwork) != p.shortName ||
+			hex.EncodeToString(m.Unknown) != p.unknown {
+			t.Errorf("%s: %+v unknown %x", p.in, cuc, m.Unknown)
+		}
+	}
+
+	// the last plain message received is given by UE.
+	ue := NewNAS("nas_test.json")
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if m := ue.ReceivedMessage(); m == nil ||
+		m.MessageType != MessageTypeRegistrationAccept {
+		t.Errorf("ReceivedMessage: %+v", m)
+	}
+}
+
+func TestUplinkQFI(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	receive(ue, TestPDUSessionModificationCommand)
+	s := ue.PDUSession(1)
+
+	// IPv4 remote address 10.0.0.0/8, UDP, remote port range 5000-5999
+	contents := []byte{0x10, 10, 0, 0, 0, 0xff, 0, 0, 0,
+		0x30, protocolUDP, 0x51, 0x13, 0x88, 0x17, 0x6f}
+	components, err := decPacketFilterComponents(contents)
+	if err != nil {
+		t.Errorf("decPacketFilterComponents: %v", err)
+	}
+	rules := append(s.QoSRules(), QoSRule{ID: 3, Precedence: 0x10, QFI: 3,
+		PacketFilters: []PacketFilter{{ID: 1,
+			Direction: pktFilterDirUplinkOnly, Components: components}}})
+	s.setQoSRules(rules)
+
+	udp := func(dst string, srcPort, dstPort uint16) []byte {
+		pkt := make([]byte, 28)
+		pkt[0] = 0x45
+		pkt[9] = protocolUDP
+		copy(pkt[12:16], net.ParseIP("60.60.0.1").To4())
+		copy(pkt[16:20], net.ParseIP(dst).To4())
+		binary.BigEndian.PutUint16(pkt[20:22], srcPort)
+		binary.BigEndian.PutUint16(pkt[22:24], dstPort)
+		return pkt
+	}
+
+	pattern := []struct {
+		pkt  []byte
+		qfi  uint8
+		desc string
+	}{
+		{udp("10.1.2.3", 1000, 5001), 3, "remote address and port"},
+		{udp("10.1.2.3", 8080, 6000), 2, "local port"},
+		{udp("192.168.0.1", 1000, 5001), 1, "match-all"},
+	}
+	for _, p := range pattern {
+		if qfi, ok := s.UplinkQFI(p.pkt); qfi != p.qfi || ok == false {
+			t.Errorf("%s: QFI expect: %d, actual: %d %v", p.desc, p.qfi, qfi, ok)
+		}
+	}
+
+	// the packet is discarded without the match-all packet filter.
+	s.setQoSRules(rules[1:])
+	if _, ok := s.UplinkQFI(udp("192.168.0.1", 1000, 5001)); ok {
+		t.Errorf("packet matches no QoS rule but is not discarded")
+	}
+
+	// the QFI given by NG-RAN is used without the QoS rules.
+	s.setQoSRules(nil)
+	if qfi, ok := s.UplinkQFI(nil); qfi != 0 || ok == false {
+		t.Errorf("no QoS rules: QFI %d %v", qfi, ok)
+	}
+}
+
+func TestReflectiveQoS(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	// the support of the reflective QoS is indicated in 5GSM capability.
+	ue.PDUSessions[0].ReflectiveQoS = true
+	m, _ := DecodeMessage(ue.MakePDUSessionEstablishmentRequest(1))
+	m, _ = m.Plain()
+	m, err := m.Body.(*ULNASTransport).SMMessage()
+	if err != nil {
+		t.Errorf("SMMessage: %v", err)
+	}
+	req := m.Body.(*PDUSessionEstablishmentRequest)
+	if reflect.DeepEqual(req.SMCapability, []byte{smCapabilityRqoS}) == false {
+		t.Errorf("5GSM capability: %x", req.SMCapability)
+	}
+
+	receive(ue, TestPDUSessionEstablishmentAcceptRQ)
+	s := ue.PDUSession(1)
+	if ue.DecodeError != nil || s.rqTimer != time.Minute {
+		t.Errorf("RQ timer: %v %v", s.rqTimer, ue.DecodeError)
+	}
+
+	dl := make([]byte, 28)
+	dl[0] = 0x45
+	dl[1] = 0xb8
+	dl[9] = protocolUDP
+	copy(dl[12:16], net.ParseIP("10.1.2.3").To4())
+	copy(dl[16:20], net.ParseIP("60.60.0.1").To4())
+	binary.BigEndian.PutUint16(dl[20:22], 5001)
+	binary.BigEndian.PutUint16(dl[22:24], 1000)
+
+	// the uplink packet of the reverse direction
+	ul := append([]byte{}, dl...)
+	copy(ul[12:16], dl[16:20])
+	copy(ul[16:20], dl[12:16])
+	copy(ul[20:22], dl[22:24])
+	copy(ul[22:24], dl[20:22])
+
+	if qfi, _ := s.UplinkQFI(ul); qfi != 1 {
+		t.Errorf("QFI before reflective QoS expect: 1, actual: %d", qfi)
+	}
+	if err := s.DeriveQoSRule(dl, 5); err != nil {
+		t.Errorf("DeriveQoSRule: %v", err)
+	}
+	if qfi, _ := s.UplinkQFI(ul); qfi != 5 {
+		t.Errorf("QFI of UE-derived QoS rule expect: 5, actual: %d", qfi)
+	}
+	if qfi, _ := s.UplinkQFI(dl); qfi != 1 {
+		t.Errorf("QFI of other packet expect: 1, actual: %d", qfi)
+	}
+
+	// the QFI of the existing rule is updated.
+	s.DeriveQoSRule(dl, 6)
+	rules := s.DerivedQoSRules()
+	if len(rules) != 1 || rules[0].QFI != 6 ||
+		rules[0].Precedence != derivedQoSRulePrecedence {
+		t.Errorf("UE-derived QoS rules: %+v", rules)
+	}
+
+	// the rule is deleted on expiry of the RQ timer.
+	s.derivedRules[0].expire = time.Now()
+	if qfi, _ := s.UplinkQFI(ul); qfi != 1 {
+		t.Errorf("QFI after RQ timer expiry expect: 1, actual: %d", qfi)
+	}
+
+	// the reflective QoS is not used without the RQ timer.
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	if err := s.DeriveQoSRule(dl, 5); err == nil {
+		t.Errorf("UE-derived QoS rule without RQ timer")
+	}
+}
+
+func TestEmergencyRegistration(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.Emergency = true
+	ue.NoUSIM = true
+
+	// the UE without the subscription is identified by the IMEI.
+	v := ue.MakeRegistrationRequest()
+	expect, _ := hex.DecodeString(TestEmergencyRegistrationRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Emergency Registration Request\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	// the security mode control with the null algorithms is run without
+	// the authentication.
+	receive(ue, TestSecurityModeCommandNIA0)
+	if ue.DecodeError != nil || ue.MakeSecurityModeComplete() == nil {
+		t.Errorf("Security Mode Command without authentication: %v",
+			ue.DecodeError)
+	}
+
+	receive(ue, protect(ue, TestEmergencyRegistrationAccept, 1))
+	if ue.DecodeError != nil || ue.EmergencyRegistered() == false {
+		t.Errorf("not registered for emergency services: %v", ue.DecodeError)
+	}
+
+	// S-NSSAI and DNN are not given for the emergency PDU session.
+	m, _ := DecodeMessage(ue.MakePDUSessionEstablishmentRequest(1))
+	m, _ = m.Plain()
+	ul := m.Body.(*ULNASTransport)
+	if ul.RequestType == nil ||
+		*ul.RequestType != RequestTypeInitialEmergencyRequest ||
+		ul.SNSSAI != nil || ul.DNN != nil {
+		t.Errorf("Emergency PDU session request: %+v", ul)
+	}
+
+	// the emergency PDU session of the UE registered normally
+	ue = NewNAS("nas_test.json")
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.EmergencyRegistered() {
+		t.Errorf("registered for emergency services")
+	}
+
+	// 5G-IA0 is rejected for the UE registered normally.
+	receive(ue, TestSecurityModeCommandNIA0)
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString(TestSecurityModeReject)
+	if ue.DecodeError == nil || ue.sec.integrity != NIA2 ||
+		reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Security Mode Command with 5G-IA0: %v %s\nexpect: %x\nactual: %x",
+			ue.DecodeError, integrityAlgStr[ue.sec.integrity], expect, v)
+	}
+
+	ue.PDUSessions[1].Emergency = true
+	m, _ = DecodeMessage(ue.MakePDUSessionEstablishmentRequest(2))
+	m, _ = m.Plain()
+	ul = m.Body.(*ULNASTransport)
+	if ul.RequestType == nil ||
+		*ul.RequestType != RequestTypeInitialEmergencyRequest {
+		t.Errorf("Emergency PDU session request: %+v", ul)
+	}
+}
+
+func TestSMS(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.SMSOverNAS = true
+	ue.SMSCAddress = "+819000"
+
+	v := ue.MakeRegistrationRequest()
+	expect, _ := hex.DecodeString(TestRegistrationRequestSMS)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Registration Request\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.SMSAllowed() {
+		t.Errorf("SMS over NAS is not allowed but SMSAllowed")
+	}
+	if v := ue.MakeSMS("+81901234567", "hello"); v != nil ||
+		ue.EncodeError == nil {
+		t.Errorf("MO-SMS is made while SMS over NAS is not allowed: %x", v)
+	}
+	receive(ue, protect(ue, TestRegistrationAcceptSMS, 2))
+	if ue.SMSAllowed() == false {
+		t.Errorf("SMS over NAS is allowed but not SMSAllowed")
+	}
+	ue.MakeRegistrationComplete()
+
+	cpOf := func(pdu []byte) string {
+		m, _ := DecodeMessage(pdu)
+		m, _ = m.Plain()
+		ul := m.Body.(*ULNASTransport)
+		if ul.PayloadContainerType != PayloadContainerSMS {
+			t.Errorf("payload container type: %d", ul.PayloadContainerType)
+		}
+		return hex.EncodeToString(ul.PayloadContainer)
+	}
+	dlNASTransport := func(cp string) string {
+		return "7e006802" + fmt.Sprintf("%04x", len(cp)/2) + cp
+	}
+	handle := func(cp string, count uint32) ([][]byte, []Event) {
+		in, _ := hex.DecodeString(protect(ue, dlNASTransport(cp), count))
+		return ue.HandleNAS(in)
+	}
+
+	// MO-SMS
+	if cp := cpOf(ue.MakeSMS("+81901234567", "hello")); cp != TestMOSMS {
+		t.Errorf("MO-SMS\nexpect: %s\nactual: %s", TestMOSMS, cp)
+	}
+	ul, events := handle("9904", 3)
+	if len(ul) != 0 || len(events) != 0 {
+		t.Errorf("CP-ACK: %x %+v", ul, events)
+	}
+	ul, events = handle(TestMOSMSAck, 4)
+	if len(ul) != 1 || cpOf(ul[0]) != "1904" ||
+		len(events) != 1 || events[0].Type != EventSMSSent {
+		t.Errorf("RP-ACK: %x %+v", ul, events)
+	}
+
+	ue.MakeSMS("+81901234567", "hello")
+	_, events = handle(TestMOSMSError, 5)
+	if len(events) != 1 || events[0].Type != EventSMSFailed ||
+		ue.SMSError() == nil {
+		t.Errorf("RP-ERROR: %+v %v", events, ue.SMSError())
+	}
+
+	// MT-SMS
+	var received []SMS
+	ue.SMSHandler = func(sms SMS) {
+		received = append(received, sms)
+	}
+	ul, events = handle(TestMTSMS, 6)
+	if len(ul) != 2 || cpOf(ul[0]) != "8904" || cpOf(ul[1]) != "8901020205" ||
+		len(events) != 1 || events[0].Type != EventSMSReceived {
+		t.Errorf("MT-SMS: %x %+v", ul, events)
+	}
+	scts := time.Date(2021, 1, 12, 13, 5, 0, 0, time.FixedZone("", 9*60*60))
+	if len(received) != 1 || received[0].Address != "+81901234567" ||
+		received[0].Text != "hello" || received[0].Time.Equal(scts) == false {
+		t.Errorf("MT-SMS: %+v", received)
+	}
+}
+
+func TestSMSUserData(t *testing.T) {
+
+	if len(gsm7Alphabet) != 128 {
+		t.Errorf("GSM 7 bit default alphabet: %d", len(gsm7Alphabet))
+	}
+
+	pattern := []struct {
+		text string
+		dcs  uint8
+		udl  uint8
+	}{
+		{"hello", dcsGSM7, 5},
+		{"[1€]", dcsGSM7, 7},
+		{"こんにちは", dcsUCS2, 10},
+	}
+	for _, p := range pattern {
+		dcs, udl, ud, err := encUserData(p.text)
+		if err != nil || dcs != p.dcs || udl != p.udl {
+			t.Errorf("%s: DCS %d, UDL %d, %v", p.text, dcs, udl, err)
+		}
+		text, err := decUserData(dcs, int(udl), ud, false)
+		if err != nil || text != p.text {
+			t.Errorf("expect: %s, actual: %s %v", p.text, text, err)
+		}
+	}
+
+	if _, _, _, err := encUserData(strings.Repeat("a", 161)); err == nil {
+		t.Errorf("SMS longer than 160 characters is encoded")
+	}
+}
+
+func TestUEPolicy(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	ue.MakeRegistrationRequest()
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.MakeRegistrationComplete()
+
+	containerOf := func(pdu []byte) string {
+		m, _ := DecodeMessage(pdu)
+		m, _ = m.Plain()
+		ul := m.Body.(*ULNASTransport)
+		if ul.PayloadContainerType != PayloadContainerUEPolicy {
+			t.Errorf("payload container type: %d", ul.PayloadContainerType)
+		}
+		return hex.EncodeToString(ul.PayloadContainer)
+	}
+	handle := func(msg string, count uint32) ([][]byte, []Event) {
+		in, _ := hex.DecodeString(protect(ue, msg, count))
+		return ue.HandleNAS(in)
+	}
+
+	ul, events := handle(TestManageUEPolicyCommand, 2)
+	if len(ul) != 1 || containerOf(ul[0]) != "8102" ||
+		len(events) != 1 || events[0].Type != EventUEPolicyUpdated ||
+		events[0].Err != nil {
+		t.Errorf("Manage UE Policy Complete: %x %+v", ul, events)
+	}
+
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	expect := []URSPRule{
+		{
+			Precedence: 1,
+			TrafficDescriptor: []TrafficDescriptorComponent{
+				{Type: PacketFilterIPv4RemoteAddress,
+					IP: &PacketFilterComponent{
+						Type:  PacketFilterIPv4RemoteAddress,
+						IPNet: ipnet}},
+				{Type: PacketFilterProtocolID,
+					IP: &PacketFilterComponent{
+						Type: PacketFilterProtocolID, Protocol: 17}},
+				{Type: PacketFilterSingleRemotePort,
+					IP: &PacketFilterComponent{
+						Type:    PacketFilterSingleRemotePort,
+						PortLow: 5060, PortHigh: 5060}},
+			},
+			RouteSelectionDescriptors: []RouteSelectionDescriptor{
+				{Precedence: 1, DNNs: []string{"ims"}, PDUSessionType: "IPv4"},
+			},
+		},
+		{
+			Precedence: 0xff,
+			TrafficDescriptor: []TrafficDescriptorComponent{
+				{Type: TrafficDescriptorMatchAll,
+					IP: &PacketFilterComponent{
+						Type: PacketFilterMatchAll}},
+			},
+			RouteSelectionDescriptors: []RouteSelectionDescriptor{
+				{Precedence: 1, DNNs: []string{"internet"},
+					SNSSAIs: []SNSSAI{{SST: 1, SD: "010203"}}},
+			},
+		},
+	}
+	if actual := ue.URSP(); reflect.DeepEqual(expect, actual) == false {
+		t.Errorf("URSP\nexpect: %+v\nactual: %+v", expect, actual)
+	}
+
+	pattern := []struct {
+		app AppTraffic
+		dnn string
+	}{
+		{AppTraffic{RemoteAddr: net.ParseIP("10.1.2.3"), Protocol: 17,
+			RemotePort: 5060}, "ims"},
+		{AppTraffic{RemoteAddr: net.ParseIP("10.1.2.3"), Protocol: 6,
+			RemotePort: 5060}, "internet"},
+		{AppTraffic{RemoteAddr: net.ParseIP("192.168.0.1"), Protocol: 6,
+			RemotePort: 443}, "internet"},
+	}
+	for _, p := range pattern {
+		s := ue.SelectPDUSession(p.app)
+		if s == nil || s.DNN != p.dnn {
+			t.Errorf("%+v: expect %s, actual %+v", p.app, p.dnn, s)
+		}
+	}
+
+	ul, events = handle(TestManageUEPolicyCommandReject, 3)
+	if len(ul) != 1 ||
+		containerOf(ul[0]) != "8203"+"0009"+"0102f839"+"0002"+"0002"+"6f" ||
+		len(events) != 1 || events[0].Type != EventUEPolicyUpdated ||
+		events[0].Err == nil {
+		t.Errorf("Manage UE Policy Command Reject: %x %+v", ul, events)
+	}
+	if rules := ue.URSP(); len(rules) != 0 {
+		t.Errorf("UE policy section is not deleted: %+v", rules)
+	}
+	if s := ue.SelectPDUSession(pattern[0].app); s != nil {
+		t.Errorf("PDU session is selected without URSP: %+v", s)
+	}
+
+	receive(ue, protect(ue, TestManageUEPolicyCommand, 4))
+	if ue.UEPolicyCommanded() == false {
+		t.Errorf("Manage UE Policy Command is not decoded")
+	}
+	if v := ue.MakeNasPdu(); v == nil || containerOf(v) != "8102" ||
+		ue.UEPolicyCommanded() {
+		t.Errorf("Manage UE Policy Complete: %x", v)
+	}
+
+	// the malformed command deleting UPSC 1 before the truncated
+	// instruction leaves the sections unchanged and is rejected.
+	ul, events = handle("7e006805"+"0011"+"8301"+"000d"+"000b02f839"+
+		"00020001"+"00050002", 5)
+	if len(ul) != 1 ||
+		containerOf(ul[0]) != "8303"+"0009"+"0102f839"+"0000"+"0002"+"6f" ||
+		len(events) != 1 || events[0].Type != EventUEPolicyUpdated ||
+		events[0].Err == nil {
+		t.Errorf("Manage UE Policy Command Reject: %x %+v", ul, events)
+	}
+	if actual := ue.URSP(); reflect.DeepEqual(expect, actual) == false {
+		t.Errorf("URSP is changed by the malformed command: %+v", actual)
+	}
+
+	// the UE policy is not kept over the power cycle.
+	ue.PowerON()
+	if rules := ue.URSP(); len(rules) != 0 {
+		t.Errorf("UE policy is kept after power on: %+v", rules)
+	}
+}
@@ -0,0 +1,505 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Classification of the uplink packet by the QoS rules of the PDU session.
+// The packet filters of the QoS rules are evaluated in the order of the
+// precedence, and the QFI of the first QoS rule matched is marked on the
+// packet. document: 3GPP TS 23.501 5.7.1.5, TS 24.501 9.11.4.13
+
+// Table 9.11.4.13.1: packet filter component type identifier
+const (
+	PacketFilterMatchAll             = 0x01
+	PacketFilterIPv4RemoteAddress    = 0x10
+	PacketFilterIPv4LocalAddress     = 0x11
+	PacketFilterIPv6RemoteAddress    = 0x21
+	PacketFilterIPv6LocalAddress     = 0x23
+	PacketFilterProtocolID           = 0x30
+	PacketFilterSingleLocalPort      = 0x40
+	PacketFilterLocalPortRange       = 0x41
+	PacketFilterSingleRemotePort     = 0x50
+	PacketFilterRemotePortRange      = 0x51
+	PacketFilterSecurityParameterIdx = 0x60
+	PacketFilterTypeOfService        = 0x70
+	PacketFilterFlowLabel            = 0x80
+	PacketFilterDestinationMAC       = 0x81
+	PacketFilterSourceMAC            = 0x82
+	PacketFilterEthertype            = 0x87
+)
+
+var pktFilterComponentStr = map[uint8]string{
+	PacketFilterMatchAll:             "Match-all type",
+	PacketFilterIPv4RemoteAddress:    "IPv4 remote address type",
+	PacketFilterIPv4LocalAddress:     "IPv4 local address type",
+	PacketFilterIPv6RemoteAddress:    "IPv6 remote address/prefix length type",
+	PacketFilterIPv6LocalAddress:     "IPv6 local address/prefix length type",
+	PacketFilterProtocolID:           "Protocol identifier/Next header type",
+	PacketFilterSingleLocalPort:      "Single local port type",
+	PacketFilterLocalPortRange:       "Local port range type",
+	PacketFilterSingleRemotePort:     "Single remote port type",
+	PacketFilterRemotePortRange:      "Remote port range type",
+	PacketFilterSecurityParameterIdx: "Security parameter index type",
+	PacketFilterTypeOfService:        "Type of service/Traffic class type",
+	PacketFilterFlowLabel:            "Flow label type",
+	PacketFilterDestinationMAC:       "Destination MAC address type",
+	PacketFilterSourceMAC:            "Source MAC address type",
+	PacketFilterEthertype:            "Ethertype type",
+}
+
+// PacketFilterComponent is the component of the packet filter. The fields
+// used depend on Type. The remote is the destination and the local is the
+// source for the uplink packet.
+type PacketFilterComponent struct {
+	Type uint8
+
+	IPNet     *net.IPNet // address and mask or prefix length
+	Protocol  uint8
+	PortLow   uint16 // single port, or the range of ports
+	PortHigh  uint16
+	SPI       uint32
+	TOS       uint8 // type of service or traffic class, and the mask
+	TOSMask   uint8
+	Label     uint32 // flow label
+	MAC       net.HardwareAddr
+	Ethertype uint16
+}
+
+var pktFilterComponentLen = map[uint8]int{
+	PacketFilterMatchAll:             0,
+	PacketFilterIPv4RemoteAddress:    8,
+	PacketFilterIPv4LocalAddress:     8,
+	PacketFilterIPv6RemoteAddress:    17,
+	PacketFilterIPv6LocalAddress:     17,
+	PacketFilterProtocolID:           1,
+	PacketFilterSingleLocalPort:      2,
+	PacketFilterLocalPortRange:       4,
+	PacketFilterSingleRemotePort:     2,
+	PacketFilterRemotePortRange:      4,
+	PacketFilterSecurityParameterIdx: 4,
+	PacketFilterTypeOfService:        2,
+	PacketFilterFlowLabel:            3,
+	PacketFilterDestinationMAC:       6,
+	PacketFilterSourceMAC:            6,
+	PacketFilterEthertype:            2,
+}
+
+// decPacketFilterComponents decodes the packet filter contents. The
+// packet filter with the unsupported component never matches.
+func decPacketFilterComponents(v []byte) (
+	components []PacketFilterComponent, err error) {
+
+	for len(v) > 0 {
+		c := PacketFilterComponent{Type: v[0]}
+		n, ok := pktFilterComponentLen[c.Type]
+		if ok == false {
+			return nil, fmt.Errorf("unsupported packet filter component: 0x%x",
+				c.Type)
+		}
+		if len(v) < 1+n {
+			return nil, fmt.Errorf("packet filter component 0x%x too short",
+				c.Type)
+		}
+		b := v[1 : 1+n]
+		v = v[1+n:]
+
+		switch c.Type {
+		case PacketFilterIPv4RemoteAddress, PacketFilterIPv4LocalAddress:
+			c.IPNet = &net.IPNet{IP: net.IP(b[:4]), Mask: net.IPMask(b[4:8])}
+		case PacketFilterIPv6RemoteAddress, PacketFilterIPv6LocalAddress:
+			c.IPNet = &net.IPNet{IP: net.IP(b[:16]),
+				Mask: net.CIDRMask(int(b[16]), 128)}
+		case PacketFilterProtocolID:
+			c.Protocol = b[0]
+		case PacketFilterSingleLocalPort, PacketFilterSingleRemotePort:
+			c.PortLow = binary.BigEndian.Uint16(b)
+			c.PortHigh = c.PortLow
+		case PacketFilterLocalPortRange, PacketFilterRemotePortRange:
+			c.PortLow = binary.BigEndian.Uint16(b[0:2])
+			c.PortHigh = binary.BigEndian.Uint16(b[2:4])
+		case PacketFilterSecurityParameterIdx:
+			c.SPI = binary.BigEndian.Uint32(b)
+		case PacketFilterTypeOfService:
+			c.TOS, c.TOSMask = b[0], b[1]
+		case PacketFilterFlowLabel:
+			c.Label = uint32(b[0]&0x0f)<<16 | uint32(b[1])<<8 | uint32(b[2])
+		case PacketFilterDestinationMAC, PacketFilterSourceMAC:
+			c.MAC = net.HardwareAddr(b)
+		case PacketFilterEthertype:
+			c.Ethertype = binary.BigEndian.Uint16(b)
+		}
+		components = append(components, c)
+	}
+	return
+}
+
+func (c *PacketFilterComponent) String() string {
+	s := pktFilterComponentStr[c.Type]
+	switch c.Type {
+	case PacketFilterIPv4RemoteAddress, PacketFilterIPv4LocalAddress,
+		PacketFilterIPv6RemoteAddress, PacketFilterIPv6LocalAddress:
+		return fmt.Sprintf("%s: %v", s, c.IPNet)
+	case PacketFilterProtocolID:
+		return fmt.Sprintf("%s: %d", s, c.Protocol)
+	case PacketFilterSingleLocalPort, PacketFilterLocalPortRange,
+		PacketFilterSingleRemotePort, PacketFilterRemotePortRange:
+		return fmt.Sprintf("%s: %d-%d", s, c.PortLow, c.PortHigh)
+	case PacketFilterSecurityParameterIdx:
+		return fmt.Sprintf("%s: 0x%x", s, c.SPI)
+	case PacketFilterTypeOfService:
+		return fmt.Sprintf("%s: 0x%x/0x%x", s, c.TOS, c.TOSMask)
+	case PacketFilterFlowLabel:
+		return fmt.Sprintf("%s: 0x%x", s, c.Label)
+	case PacketFilterDestinationMAC, PacketFilterSourceMAC:
+		return fmt.Sprintf("%s: %v", s, c.MAC)
+	case PacketFilterEthertype:
+		return fmt.Sprintf("%s: 0x%04x", s, c.Ethertype)
+	}
+	return s
+}
+
+// packet is the fields of the packet for the packet filters.
+type packet struct {
+	src, dst   net.IP
+	protocol   uint8
+	srcPort    uint16
+	dstPort    uint16
+	hasPorts   bool
+	spi        uint32
+	hasSPI     bool
+	tos        uint8
+	label      uint32
+	srcMAC     net.HardwareAddr
+	dstMAC     net.HardwareAddr
+	ethertype  uint16
+	isEthernet bool
+}
+
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+	protocolESP = 50
+)
+
+func parseIPPacket(pkt []byte) (p packet, ok bool) {
+
+	if len(pkt) < 1 {
+		return
+	}
+	var l4 []byte
+
+	switch pkt[0] >> 4 {
+	case 4:
+		hlen := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || len(pkt) < hlen {
+			return
+		}
+		p.tos = pkt[1]
+		p.protocol = pkt[9]
+		p.src = net.IP(pkt[12:16])
+		p.dst = net.IP(pkt[16:20])
+		// the ports are only in the first fragment.
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			l4 = pkt[hlen:]
+		}
+	case 6:
+		if len(pkt) < ipv6HeaderLen {
+			return
+		}
+		p.tos = pkt[0]<<4 | pkt[1]>>4
+		p.label = uint32(pkt[1]&0x0f)<<16 | uint32(pkt[2])<<8 | uint32(pkt[3])
+		p.protocol = pkt[6]
+		p.src = net.IP(pkt[8:24])
+		p.dst = net.IP(pkt[24:40])
+		l4 = pkt[ipv6HeaderLen:]
+	default:
+		return
+	}
+
+	switch p.protocol {
+	case protocolTCP, protocolUDP:
+		if len(l4) >= 4 {
+			p.srcPort = binary.BigEndian.Uint16(l4[0:2])
+			p.dstPort = binary.BigEndian.Uint16(l4[2:4])
+			p.hasPorts = true
+		}
+	case protocolESP:
+		if len(l4) >= 4 {
+			p.spi = binary.BigEndian.Uint32(l4[0:4])
+			p.hasSPI = true
+		}
+	}
+	ok = true
+	return
+}
+
+func parseEthernetFrame(frame []byte) (p packet, ok bool) {
+
+	const headerLen = 14
+	if len(frame) < headerLen {
+		return
+	}
+	p.dstMAC = net.HardwareAddr(frame[0:6])
+	p.srcMAC = net.HardwareAddr(frame[6:12])
+	p.ethertype = binary.BigEndian.Uint16(frame[12:14])
+	p.isEthernet = true
+	ok = true
+	return
+}
+
+func (c *PacketFilterComponent) match(p *packet) bool {
+
+	switch c.Type {
+	case PacketFilterMatchAll:
+		return true
+	case PacketFilterIPv4RemoteAddress, PacketFilterIPv6RemoteAddress:
+		return p.dst != nil && c.IPNet.Contains(p.dst)
+	case PacketFilterIPv4LocalAddress, PacketFilterIPv6LocalAddress:
+		return p.src != nil && c.IPNet.Contains(p.src)
+	case PacketFilterProtocolID:
+		return p.isEthernet == false && p.protocol == c.Protocol
+	case PacketFilterSingleLocalPort, PacketFilterLocalPortRange:
+		return p.hasPorts && p.srcPort >= c.PortLow && p.srcPort <= c.PortHigh
+	case PacketFilterSingleRemotePort, PacketFilterRemotePortRange:
+		return p.hasPorts && p.dstPort >= c.PortLow && p.dstPort <= c.PortHigh
+	case PacketFilterSecurityParameterIdx:
+		return p.hasSPI && p.spi == c.SPI
+	case PacketFilterTypeOfService:
+		return p.isEthernet == false && p.tos&c.TOSMask == c.TOS&c.TOSMask
+	case PacketFilterFlowLabel:
+		return p.src.To4() == nil && p.label == c.Label
+	case PacketFilterDestinationMAC:
+		return p.isEthernet && bytes.Equal(p.dstMAC, c.MAC)
+	case PacketFilterSourceMAC:
+		return p.isEthernet && bytes.Equal(p.srcMAC, c.MAC)
+	case PacketFilterEthertype:
+		return p.isEthernet && p.ethertype == c.Ethertype
+	}
+	return false
+}
+
+// match reports whether all the components of the packet filter match.
+func (f *PacketFilter) match(p *packet) bool {
+	if f.Direction != pktFilterDirUplinkOnly &&
+		f.Direction != pktFilterDirBidirectional {
+		return false
+	}
+	if len(f.Components) == 0 {
+		return false
+	}
+	for i := range f.Components {
+		if f.Components[i].match(p) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchQoSRule returns the QoS rule of the highest precedence whose packet
+// filter matches the uplink packet, or nil if none matches. The packet is
+// the IP packet, or the Ethernet frame for the Ethernet PDU session.
+func (s *PDUSession) MatchQoSRule(pkt []byte) *QoSRule {
+
+	p, ok := s.parsePacket(pkt)
+	if ok == false {
+		return nil
+	}
+
+	// the lower value is the higher precedence.
+	qosRules := append(s.QoSRules(), s.DerivedQoSRules()...)
+	rules := make([]*QoSRule, len(qosRules))
+	for i := range qosRules {
+		rules[i] = &qosRules[i]
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Precedence < rules[j].Precedence
+	})
+
+	for _, r := range rules {
+		for i := range r.PacketFilters {
+			if r.PacketFilters[i].match(&p) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// UplinkQFI returns the QFI to be marked on the uplink packet. qfi is 0 if
+// no QoS rule is given or the QoS rule matched has no QFI, in which case
+// the QFI given by the NG-RAN is to be used. ok is false if no QoS rule
+// matches, and the packet is to be discarded (TS 23.501 5.7.1.5).
+func (s *PDUSession) UplinkQFI(pkt []byte) (qfi uint8, ok bool) {
+
+	if len(s.QoSRules()) == 0 && len(s.DerivedQoSRules()) == 0 {
+		return 0, true
+	}
+	r := s.MatchQoSRule(pkt)
+	if r == nil {
+		return 0, false
+	}
+	return r.QFI, true
+}
+
+func (s *PDUSession) parsePacket(pkt []byte) (p packet, ok bool) {
+	if s.Type == pduSessionTypeStr[PDUSessionEthernet] {
+		return parseEthernetFrame(pkt)
+	}
+	return parseIPPacket(pkt)
+}
+
+// UE-derived QoS rules by the reflective QoS. The downlink packet with
+// the RQI derives the QoS rule for the uplink packet of the reverse
+// direction, which is deleted on expiry of the RQ timer unless the RQI
+// is received again. document: 3GPP TS 23.501 5.7.5, TS 24.501 6.2.5.1.4
+
+// 6.2.5.1.4.2 the precedence value of the UE-derived QoS rule
+const derivedQoSRulePrecedence = 80
+
+type derivedQoSRule struct {
+	QoSRule
+	expire time.Time
+}
+
+func (s *PDUSession) setRQTimer(d time.Duration) {
+	s.mu.Lock()
+	s.rqTimer = d
+	s.mu.Unlock()
+}
+
+func (s *PDUSession) resetDerivedQoSRules() {
+	s.mu.Lock()
+	s.rqTimer = 0
+	s.derivedRules = nil
+	s.mu.Unlock()
+}
+
+// DeriveQoSRule creates the UE-derived QoS rule from the downlink packet
+// with the RQI, or updates the QFI of the existing one and restarts its
+// RQ timer. The packet is the IP packet, or the Ethernet frame for the
+// Ethernet PDU session.
+func (s *PDUSession) DeriveQoSRule(pkt []byte, qfi uint8) error {
+
+	p, ok := s.parsePacket(pkt)
+	if ok == false {
+		return fmt.Errorf("nas: invalid downlink packet for reflective QoS")
+	}
+	components := derivePacketFilterComponents(&p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rqTimer == 0 {
+		return fmt.Errorf("nas: reflective QoS is not used in PDU session(%d)",
+			s.ID)
+	}
+	now := time.Now()
+	expire := now.Add(s.rqTimer)
+
+	rules := s.derivedRules[:0]
+	found := false
+	for _, r := range s.derivedRules {
+		if r.expire.After(now) == false {
+			continue
+		}
+		if reflect.DeepEqual(r.PacketFilters[0].Components, components) {
+			r.QFI = qfi
+			r.expire = expire
+			found = true
+		}
+		rules = append(rules, r)
+	}
+	if found == false {
+		rules = append(rules, derivedQoSRule{
+			QoSRule: QoSRule{
+				Precedence: derivedQoSRulePrecedence,
+				QFI:        qfi,
+				PacketFilters: []PacketFilter{{
+					Direction:  pktFilterDirUplinkOnly,
+					Components: components}},
+			},
+			expire: expire,
+		})
+	}
+	s.derivedRules = rules
+	return nil
+}
+
+// DerivedQoSRules returns the UE-derived QoS rules whose RQ timer is
+// running.
+func (s *PDUSession) DerivedQoSRules() (rules []QoSRule) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, r := range s.derivedRules {
+		if r.expire.After(now) {
+			rules = append(rules, r.QoSRule)
+		}
+	}
+	return
+}
+
+// derivePacketFilterComponents returns the packet filter for the uplink
+// packet from the addresses, the ports and so on of the downlink packet,
+// where the remote is the source of the downlink packet.
+// see 5.7.5.2 in TS 23.501.
+func derivePacketFilterComponents(p *packet) (c []PacketFilterComponent) {
+
+	if p.isEthernet {
+		c = append(c,
+			PacketFilterComponent{Type: PacketFilterDestinationMAC,
+				MAC: append(net.HardwareAddr{}, p.srcMAC...)},
+			PacketFilterComponent{Type: PacketFilterSourceMAC,
+				MAC: append(net.HardwareAddr{}, p.dstMAC...)},
+			PacketFilterComponent{Type: PacketFilterEthertype,
+				Ethertype: p.ethertype})
+		return
+	}
+
+	remote := PacketFilterComponent{Type: PacketFilterIPv6RemoteAddress}
+	local := PacketFilterComponent{Type: PacketFilterIPv6LocalAddress}
+	bits := net.IPv6len * 8
+	src, dst := p.src, p.dst
+	if v := p.src.To4(); v != nil {
+		remote.Type = PacketFilterIPv4RemoteAddress
+		local.Type = PacketFilterIPv4LocalAddress
+		bits = net.IPv4len * 8
+		src, dst = v, p.dst.To4()
+	}
+	remote.IPNet = &net.IPNet{IP: append(net.IP{}, src...),
+		Mask: net.CIDRMask(bits, bits)}
+	local.IPNet = &net.IPNet{IP: append(net.IP{}, dst...),
+		Mask: net.CIDRMask(bits, bits)}
+	c = append(c, remote, local,
+		PacketFilterComponent{Type: PacketFilterProtocolID,
+			Protocol: p.protocol})
+
+	switch {
+	case p.hasPorts:
+		c = append(c,
+			PacketFilterComponent{Type: PacketFilterSingleLocalPort,
+				PortLow: p.dstPort, PortHigh: p.dstPort},
+			PacketFilterComponent{Type: PacketFilterSingleRemotePort,
+				PortLow: p.srcPort, PortHigh: p.srcPort})
+	case p.hasSPI:
+		c = append(c,
+			PacketFilterComponent{Type: PacketFilterSecurityParameterIdx,
+				SPI: p.spi})
+	}
+	c = append(c, PacketFilterComponent{Type: PacketFilterTypeOfService,
+		TOS: p.tos, TOSMask: 0xff})
+	return
+}
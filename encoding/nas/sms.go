@@ -0,0 +1,536 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SMS over NAS. The short message is relayed by the CP layer and the RP
+// layer (TS 24.011) in the payload container of UL/DL NAS transport, and
+// it is SMS-SUBMIT for MO-SMS and SMS-DELIVER for MT-SMS (TS 23.040).
+// The UE acknowledges CP-DATA by CP-ACK and the MT-SMS by RP-ACK, which
+// are given by MakeSMSResponses.
+
+// SMS is the short message submitted by MakeSMS, or delivered by the
+// network to UE.SMSHandler.
+type SMS struct {
+	Address string // the destination of MO-SMS or the originator of MT-SMS
+	Text    string
+	Time    time.Time // the service centre time stamp of MT-SMS
+}
+
+// MakeSMS makes UL NAS transport for the MO-SMS to the address. The
+// result is notified by RP-ACK or RP-ERROR in the downlink. It returns nil
+// with EncodeError if SMS over NAS is not allowed by the network.
+// 5.4.5.2 UE-initiated NAS transport procedure
+func (ue *UE) MakeSMS(address, text string) (pdu []byte) {
+
+	ue.EncodeError = nil
+	if ue.SMSAllowed() == false {
+		ue.EncodeError = fmt.Errorf("nas: SMS over NAS is not allowed")
+		ue.dprint("error: %v", ue.EncodeError)
+		return
+	}
+
+	ue.sms.tpMR++
+	tpdu, err := encSMSSubmit(ue.sms.tpMR, address, text)
+	if err != nil {
+		ue.EncodeError = err
+		ue.dprint("error: %v", err)
+		return
+	}
+
+	ue.sms.mr++
+	rpdu := []byte{rpDataMO, ue.sms.mr}
+	rpdu = append(rpdu, 0) // no RP-Originator Address
+	rpdu = append(rpdu, encRPAddress(ue.SMSCAddress)...)
+	rpdu = append(rpdu, byte(len(tpdu)))
+	rpdu = append(rpdu, tpdu...)
+
+	// TI value 7 is reserved. see 8.3.2 in TS 24.007
+	ue.sms.ti = (ue.sms.ti + 1) % 7
+	ue.sms.err = nil
+
+	cp := encCPData(ue.sms.ti<<4, rpdu)
+	pdu = ue.encSMSTransport(cp)
+	return
+}
+
+// MakeSMSResponses returns CP-ACK and RP-ACK for the SMS received, which
+// are sent in order.
+func (ue *UE) MakeSMSResponses() (pdus [][]byte) {
+
+	for _, cp := range ue.sms.pending {
+		pdus = append(pdus, ue.encSMSTransport(cp))
+	}
+	ue.sms.pending = nil
+	return
+}
+
+// SMSError returns RP-ERROR of the last MO-SMS, or nil.
+func (ue *UE) SMSError() error {
+	return ue.sms.err
+}
+
+func (ue *UE) encSMSTransport(cp []byte) (pdu []byte) {
+
+	pdu = ue.MakeULNasTransport(PayloadContainerSMS, 0, &cp)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = append(head, pdu...)
+	return
+}
+
+// 7.2 Messages for short message or notification transfer on CM
+// in TS 24.011
+const (
+	pdSMS = 0x09 // protocol discriminator. see 11.2.3.1.1 in TS 24.007
+
+	// the TI flag is set in the message to the side originating the TI.
+	tiFlag = 0x80
+
+	cpData  = 0x01
+	cpAck   = 0x04
+	cpError = 0x10
+)
+
+var cpMessageStr = map[uint8]string{
+	cpData:  "CP-DATA",
+	cpAck:   "CP-ACK",
+	cpError: "CP-ERROR",
+}
+
+// encCPData makes CP-DATA. ti is the TI flag and the TI value in bits 5
+// to 8.
+func encCPData(ti uint8, rpdu []byte) (cp []byte) {
+	cp = []byte{ti | pdSMS, cpData, byte(len(rpdu))}
+	cp = append(cp, rpdu...)
+	return
+}
+
+func encCPAck(ti uint8) (cp []byte) {
+	cp = []byte{ti | pdSMS, cpAck}
+	return
+}
+
+func (ue *UE) decSMS(cp []byte) {
+
+	if len(cp) < 2 || cp[0]&0x0f != pdSMS {
+		ue.DecodeError = fmt.Errorf("nas: invalid CP message: %x", cp)
+		return
+	}
+
+	// the response has the TI flag inverted.
+	ti := (cp[0] & 0xf0) ^ tiFlag
+	msgType := cp[1]
+	ue.dprint("%s(0x%x) TI: 0x%x", cpMessageStr[msgType], msgType, cp[0]>>4)
+
+	switch msgType {
+	case cpAck:
+		return
+	case cpError:
+		if len(cp) > 2 {
+			ue.DecodeError = fmt.Errorf("nas: CP-ERROR cause: %d", cp[2])
+		}
+		return
+	case cpData:
+	default:
+		ue.DecodeError = fmt.Errorf("nas: unknown CP message type: 0x%x",
+			msgType)
+		return
+	}
+	ue.sms.pending = append(ue.sms.pending, encCPAck(ti))
+
+	if len(cp) < 3 || len(cp) < 3+int(cp[2]) || cp[2] < 2 {
+		ue.DecodeError = fmt.Errorf("nas: invalid CP-User data: %x", cp)
+		return
+	}
+	rpdu := cp[3 : 3+int(cp[2])]
+
+	ue.indent++
+	ue.decRPDU(ti, rpdu)
+	ue.indent--
+}
+
+// 7.3 Messages for short message and notification transfer on SM-RL
+// in TS 24.011
+const (
+	rpDataMO  = 0x00
+	rpDataMT  = 0x01
+	rpAckMO   = 0x02
+	rpAckMT   = 0x03
+	rpErrorMO = 0x04
+	rpErrorMT = 0x05
+)
+
+var rpMessageStr = map[uint8]string{
+	rpDataMO:  "RP-DATA",
+	rpDataMT:  "RP-DATA",
+	rpAckMO:   "RP-ACK",
+	rpAckMT:   "RP-ACK",
+	rpErrorMO: "RP-ERROR",
+	rpErrorMT: "RP-ERROR",
+}
+
+// 8.2.5.4 RP-Cause
+const (
+	rpCauseProtocolError = 111 // Protocol error, unspecified
+)
+
+func (ue *UE) decRPDU(ti uint8, rpdu []byte) {
+
+	msgType, ref := rpdu[0], rpdu[1]
+	ue.dprint("%s(0x%x) message reference: %d",
+		rpMessageStr[msgType], msgType, ref)
+	ue.fsm.rpType = int(msgType)
+
+	switch msgType {
+	case rpDataMT:
+		sms, err := decRPDataMT(rpdu[2:])
+		if err != nil {
+			ue.DecodeError = err
+			rp := []byte{rpErrorMO, ref, 1, rpCauseProtocolError}
+			ue.sms.pending = append(ue.sms.pending, encCPData(ti, rp))
+			return
+		}
+		ue.dprinti("SMS from %s at %v: %s", sms.Address, sms.Time, sms.Text)
+		rp := []byte{rpAckMO, ref}
+		ue.sms.pending = append(ue.sms.pending, encCPData(ti, rp))
+		if ue.SMSHandler != nil {
+			ue.SMSHandler(sms)
+		}
+	case rpAckMT:
+		ue.sms.err = nil
+	case rpErrorMT:
+		ue.sms.err = fmt.Errorf("nas: RP-ERROR")
+		if len(rpdu) > 3 && rpdu[2] > 0 {
+			ue.sms.err = fmt.Errorf("nas: RP-ERROR cause: %d", rpdu[3]&0x7f)
+		}
+		ue.DecodeError = ue.sms.err
+	default:
+		ue.fsm.rpType = 0
+		ue.DecodeError = fmt.Errorf("nas: unknown RP message type: 0x%x",
+			msgType)
+	}
+}
+
+// decRPDataMT decodes RP-DATA (network to MS) following the message
+// reference.
+func decRPDataMT(v []byte) (sms SMS, err error) {
+
+	// RP-Originator Address, RP-Destination Address and RP-User Data
+	var ies [3][]byte
+	for i := range ies {
+		if len(v) < 1 || len(v) < 1+int(v[0]) {
+			err = fmt.Errorf("nas: invalid RP-DATA")
+			return
+		}
+		ies[i] = v[1 : 1+int(v[0])]
+		v = v[1+int(v[0]):]
+	}
+	sms, err = decSMSDeliver(ies[2])
+	return
+}
+
+// 8.2.5.1 Originator address element and 8.2.5.2 Destination address
+// element in TS 24.011. The length is in octets.
+func encRPAddress(address string) (v []byte) {
+
+	if address == "" {
+		return []byte{0}
+	}
+	digits, ton := encAddressDigits(address)
+	v = append([]byte{byte(1 + len(digits)), ton}, digits...)
+	return
+}
+
+// 9.2.2.2 SMS-SUBMIT type in TS 23.040
+const (
+	tpMTIDeliver = 0x00
+	tpMTISubmit  = 0x01
+	tpMTIMask    = 0x03
+	tpUDHI       = 0x40 // TP-User-Data-Header-Indication
+
+	maxSeptets = 160
+	maxOctets  = 140
+)
+
+func encSMSSubmit(mr uint8, address, text string) (tpdu []byte, err error) {
+
+	dcs, udl, ud, err := encUserData(text)
+	if err != nil {
+		return
+	}
+
+	digits, ton := encAddressDigits(address)
+	ndigits := len(strings.TrimPrefix(address, "+"))
+
+	tpdu = []byte{tpMTISubmit, mr}
+	tpdu = append(tpdu, byte(ndigits), ton)
+	tpdu = append(tpdu, digits...)
+	tpdu = append(tpdu, 0x00, dcs, udl) // TP-PID, TP-DCS and TP-UDL
+	tpdu = append(tpdu, ud...)
+	return
+}
+
+// 9.2.2.1 SMS-DELIVER type in TS 23.040
+func decSMSDeliver(tpdu []byte) (sms SMS, err error) {
+
+	invalid := fmt.Errorf("nas: invalid SMS-DELIVER: %x", tpdu)
+	if len(tpdu) < 2 || tpdu[0]&tpMTIMask != tpMTIDeliver {
+		err = invalid
+		return
+	}
+	udhi := tpdu[0]&tpUDHI != 0
+
+	// TP-Originating-Address
+	ndigits := int(tpdu[1])
+	n := 3 + (ndigits+1)/2
+	if len(tpdu) < n+10 {
+		err = invalid
+		return
+	}
+	sms.Address = decAddress(tpdu[2], tpdu[3:n], ndigits)
+	tpdu = tpdu[n:]
+
+	dcs := tpdu[1]
+	scts := tpdu[2:9]
+	loc := time.FixedZone("", decTimeZoneValue(scts[6])*15*60)
+	sms.Time = time.Date(2000+decSwappedBCD(scts[0]),
+		time.Month(decSwappedBCD(scts[1])), decSwappedBCD(scts[2]),
+		decSwappedBCD(scts[3]), decSwappedBCD(scts[4]),
+		decSwappedBCD(scts[5]), 0, loc)
+
+	sms.Text, err = decUserData(dcs, int(tpdu[9]), tpdu[10:], udhi)
+	if err != nil {
+		err = invalid
+	}
+	return
+}
+
+// 9.1.2.5 Address fields in TS 23.040
+const (
+	tonNPIInternational = 0x91
+	tonNPIUnknown       = 0x81
+	tonMask             = 0x70
+	tonInternational    = 0x10
+	tonAlphanumeric     = 0x50
+)
+
+// encAddressDigits returns the semi-octets of the address and the type
+// of address. The address with "+" is the international number.
+func encAddressDigits(address string) (digits []byte, ton uint8) {
+
+	ton = tonNPIUnknown
+	if strings.HasPrefix(address, "+") {
+		address = address[1:]
+		ton = tonNPIInternational
+	}
+	if len(address)%2 == 1 {
+		address += "f"
+	}
+	digits = Str2BCD(address)
+	return
+}
+
+func decAddress(ton uint8, v []byte, ndigits int) string {
+
+	if ton&tonMask == tonAlphanumeric {
+		s, _ := decGSM7(v, ndigits*4/7, 0)
+		return s
+	}
+
+	var b strings.Builder
+	if ton&tonMask == tonInternational {
+		b.WriteString("+")
+	}
+	for i := 0; i < ndigits && i/2 < len(v); i++ {
+		d := v[i/2] & 0x0f
+		if i%2 == 1 {
+			d = v[i/2] >> 4
+		}
+		fmt.Fprintf(&b, "%x", d)
+	}
+	return b.String()
+}
+
+// 4 SMS Data Coding Scheme in TS 23.038
+const (
+	dcsGSM7 = 0x00
+	dcs8bit = 0x04
+	dcsUCS2 = 0x08
+)
+
+// smsAlphabet returns the character set of the general data coding or
+// the data coding/message class group.
+func smsAlphabet(dcs uint8) uint8 {
+	switch {
+	case dcs&0xc0 == 0x00:
+		return dcs & 0x0c
+	case dcs&0xf0 == 0xf0:
+		return dcs & 0x04
+	}
+	return dcsGSM7
+}
+
+// encUserData encodes the text in the GSM 7 bit default alphabet, or UCS2
+// if any character is not in it. udl is in septets for the GSM 7 bit
+// default alphabet, and in octets otherwise.
+func encUserData(text string) (dcs, udl uint8, ud []byte, err error) {
+
+	if septets, ok := encGSM7Septets(text); ok {
+		if len(septets) > maxSeptets {
+			err = fmt.Errorf("nas: SMS is longer than %d characters",
+				maxSeptets)
+			return
+		}
+		dcs = dcsGSM7
+		udl = uint8(len(septets))
+		ud = packSeptets(septets)
+		return
+	}
+
+	for _, c := range utf16.Encode([]rune(text)) {
+		ud = append(ud, byte(c>>8), byte(c))
+	}
+	if len(ud) > maxOctets {
+		err = fmt.Errorf("nas: SMS is longer than %d octets", maxOctets)
+		return
+	}
+	dcs = dcsUCS2
+	udl = uint8(len(ud))
+	return
+}
+
+func decUserData(dcs uint8, udl int, ud []byte, udhi bool) (
+	text string, err error) {
+
+	switch smsAlphabet(dcs) {
+	case dcsGSM7:
+		// the user data header is followed by the fill bits to the
+		// septet boundary. see 9.2.3.24 in TS 23.040
+		skip := 0
+		if udhi && len(ud) > 0 {
+			skip = ((int(ud[0])+1)*8 + 6) / 7
+		}
+		return decGSM7(ud, udl, skip)
+	}
+
+	if udl > len(ud) {
+		err = fmt.Errorf("nas: invalid TP-UDL: %d", udl)
+		return
+	}
+	ud = ud[:udl]
+	if udhi && len(ud) > 0 {
+		if int(ud[0])+1 > len(ud) {
+			err = fmt.Errorf("nas: invalid TP-UDHL: %d", ud[0])
+			return
+		}
+		ud = ud[int(ud[0])+1:]
+	}
+
+	if smsAlphabet(dcs) == dcs8bit {
+		text = string(ud)
+		return
+	}
+	u := make([]uint16, len(ud)/2)
+	for i := range u {
+		u[i] = uint16(ud[2*i])<<8 | uint16(ud[2*i+1])
+	}
+	text = string(utf16.Decode(u))
+	return
+}
+
+// 6.2.1 GSM 7 bit Default Alphabet in TS 23.038
+var gsm7Alphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ" +
+	" !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§" +
+	"¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// 6.2.1.1 GSM 7 bit default alphabet extension table
+const gsm7Escape = 0x1b
+
+var gsm7Extension = map[byte]rune{
+	0x0a: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2f: '\\',
+	0x3c: '[', 0x3d: '~', 0x3e: ']', 0x40: '|', 0x65: '€',
+}
+
+// encGSM7Septets returns the septets of the text, or ok is false if any
+// character is not in the GSM 7 bit default alphabet.
+func encGSM7Septets(text string) (septets []byte, ok bool) {
+
+loop:
+	for _, r := range text {
+		for i, c := range gsm7Alphabet {
+			if c == r && i != gsm7Escape {
+				septets = append(septets, byte(i))
+				continue loop
+			}
+		}
+		for i, c := range gsm7Extension {
+			if c == r {
+				septets = append(septets, gsm7Escape, i)
+				continue loop
+			}
+		}
+		return nil, false
+	}
+	return septets, true
+}
+
+// 6.1.2.1 SMS Packing in TS 23.038
+func packSeptets(septets []byte) (v []byte) {
+
+	v = make([]byte, (len(septets)*7+7)/8)
+	for i, s := range septets {
+		bit := i * 7
+		v[bit/8] |= s << (bit % 8)
+		if bit%8 > 1 {
+			v[bit/8+1] |= s >> (8 - bit%8)
+		}
+	}
+	return
+}
+
+// decGSM7 decodes n septets and drops the first skip septets.
+func decGSM7(v []byte, n, skip int) (text string, err error) {
+
+	if (n*7+7)/8 > len(v) {
+		err = fmt.Errorf("nas: invalid length of septets: %d", n)
+		return
+	}
+
+	var b strings.Builder
+	escape := false
+	for i := skip; i < n; i++ {
+		bit := i * 7
+		s := v[bit/8] >> (bit % 8)
+		if bit%8 > 1 {
+			s |= v[bit/8+1] << (8 - bit%8)
+		}
+		s &= 0x7f
+
+		switch {
+		case escape:
+			if r, ok := gsm7Extension[s]; ok {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune(' ')
+			}
+			escape = false
+		case s == gsm7Escape:
+			escape = true
+		default:
+			b.WriteRune(gsm7Alphabet[s])
+		}
+	}
+	text = b.String()
+	return
+}
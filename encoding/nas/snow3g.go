@@ -0,0 +1,265 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+)
+
+// SNOW 3G stream cipher used by 128-NEA1 and 128-NIA1.
+// document: ETSI/SAGE Specification of the 3GPP Confidentiality and
+// Integrity Algorithms UEA2 & UIA2, Document 2: SNOW 3G Specification v1.1
+type snow3g struct {
+	s  [16]uint32 // LFSR
+	r1 uint32     // FSM registers
+	r2 uint32
+	r3 uint32
+}
+
+// 3.1.1 MULx
+func mulx(v, c uint8) uint8 {
+	if v&0x80 != 0 {
+		return (v << 1) ^ c
+	}
+	return v << 1
+}
+
+// 3.1.2 MULxPOW
+func mulxpow(v uint8, i int, c uint8) uint8 {
+	for ; i > 0; i-- {
+		v = mulx(v, c)
+	}
+	return v
+}
+
+// 3.4.2 The function MULalpha
+func mulalpha(c uint8) uint32 {
+	return uint32(mulxpow(c, 23, 0xa9))<<24 |
+		uint32(mulxpow(c, 245, 0xa9))<<16 |
+		uint32(mulxpow(c, 48, 0xa9))<<8 |
+		uint32(mulxpow(c, 239, 0xa9))
+}
+
+// 3.4.3 The function DIValpha
+func divalpha(c uint8) uint32 {
+	return uint32(mulxpow(c, 16, 0xa9))<<24 |
+		uint32(mulxpow(c, 39, 0xa9))<<16 |
+		uint32(mulxpow(c, 6, 0xa9))<<8 |
+		uint32(mulxpow(c, 64, 0xa9))
+}
+
+// 3.3.1 S-Box S1 and 3.3.2 S-Box S2
+// S1 uses the Rijndael S-box SR, S2 uses SQ derived from the Dickson
+// polynomial. The column mixing is the same except the constant of MULx.
+func snow3gS(w uint32, box *[256]byte, c uint8) uint32 {
+
+	w0 := box[byte(w>>24)]
+	w1 := box[byte(w>>16)]
+	w2 := box[byte(w>>8)]
+	w3 := box[byte(w)]
+
+	r0 := mulx(w0, c) ^ w1 ^ w2 ^ mulx(w3, c) ^ w3
+	r1 := mulx(w0, c) ^ w0 ^ mulx(w1, c) ^ w2 ^ w3
+	r2 := w0 ^ mulx(w1, c) ^ w1 ^ mulx(w2, c) ^ w3
+	r3 := w0 ^ w1 ^ mulx(w2, c) ^ w2 ^ mulx(w3, c)
+
+	return uint32(r0)<<24 | uint32(r1)<<16 | uint32(r2)<<8 | uint32(r3)
+}
+
+// 3.4.4 Clocking the LFSR
+func (s *snow3g) clockLFSR(f uint32) {
+
+	v := (s.s[0] << 8) ^ mulalpha(uint8(s.s[0]>>24)) ^ s.s[2] ^
+		(s.s[11] >> 8) ^ divalpha(uint8(s.s[11])) ^ f
+
+	copy(s.s[:15], s.s[1:])
+	s.s[15] = v
+	return
+}
+
+// 3.4.6 Clocking the FSM
+func (s *snow3g) clockFSM() (f uint32) {
+
+	f = (s.s[15] + s.r1) ^ s.r2
+	r := s.r2 + (s.r3 ^ s.s[5])
+	s.r3 = snow3gS(s.r2, &snow3gSQ, 0x69)
+	s.r2 = snow3gS(s.r1, &snow3gSR, 0x1b)
+	s.r1 = r
+	return
+}
+
+// 4.1 Initialisation
+func newSNOW3G(k [4]uint32, iv [4]uint32) (s *snow3g) {
+
+	s = new(snow3g)
+	one := uint32(0xffffffff)
+
+	s.s[15] = k[3] ^ iv[0]
+	s.s[14] = k[2]
+	s.s[13] = k[1]
+	s.s[12] = k[0] ^ iv[1]
+	s.s[11] = k[3] ^ one
+	s.s[10] = k[2] ^ one ^ iv[2]
+	s.s[9] = k[1] ^ one ^ iv[3]
+	s.s[8] = k[0] ^ one
+	s.s[7] = k[3]
+	s.s[6] = k[2]
+	s.s[5] = k[1]
+	s.s[4] = k[0]
+	s.s[3] = k[3] ^ one
+	s.s[2] = k[2] ^ one
+	s.s[1] = k[1] ^ one
+	s.s[0] = k[0] ^ one
+
+	for i := 0; i < 32; i++ {
+		f := s.clockFSM()
+		s.clockLFSR(f)
+	}
+
+	// 4.2 the first output of the FSM is discarded.
+	s.clockFSM()
+	s.clockLFSR(0)
+
+	return
+}
+
+// 4.2 Generation of keystream
+func (s *snow3g) keystream(n int) (z []uint32) {
+
+	z = make([]uint32, n)
+	for i := range z {
+		f := s.clockFSM()
+		z[i] = f ^ s.s[0]
+		s.clockLFSR(0)
+	}
+	return
+}
+
+// the key is given as K = k3 || k2 || k1 || k0 in the specification.
+func snow3gKey(key []byte) (k [4]uint32) {
+	for i := 0; i < 4; i++ {
+		k[3-i] = binary.BigEndian.Uint32(key[i*4:])
+	}
+	return
+}
+
+// TS 33.401 B.1.2 128-EEA1
+// UEA2 f8 in the ETSI/SAGE Document 1 with BEARER in 5 bit.
+func nea1(key []byte, count uint32, bearer, dir uint8, in []byte) (out []byte) {
+
+	var iv [4]uint32
+	iv[3] = count
+	iv[2] = uint32(bearer&0x1f)<<27 | uint32(dir&0x1)<<26
+	iv[1] = iv[3]
+	iv[0] = iv[2]
+
+	s := newSNOW3G(snow3gKey(key), iv)
+	z := s.keystream((len(in) + 3) / 4)
+
+	out = make([]byte, len(in))
+	ks := make([]byte, 4)
+	for i := range in {
+		if i%4 == 0 {
+			binary.BigEndian.PutUint32(ks, z[i/4])
+		}
+		out[i] = in[i] ^ ks[i%4]
+	}
+	return
+}
+
+// multiplication in GF(2^64) defined in 4.3 of the UIA2 specification.
+func mul64x(v, c uint64) uint64 {
+	if v&0x8000000000000000 != 0 {
+		return (v << 1) ^ c
+	}
+	return v << 1
+}
+
+func mul64(v, p, c uint64) (r uint64) {
+	for i := 0; i < 64; i++ {
+		if (p>>uint(i))&0x1 != 0 {
+			r ^= v
+		}
+		v = mul64x(v, c)
+	}
+	return
+}
+
+// TS 33.401 B.2.2 128-EIA1
+// UIA2 f9 in the ETSI/SAGE Document 1 with FRESH = BEARER || 0...0.
+func nia1(key []byte, count uint32, bearer, dir uint8, msg []byte) (mac []byte) {
+
+	fresh := uint32(bearer&0x1f) << 27
+	d := uint32(dir & 0x1)
+
+	var iv [4]uint32
+	iv[3] = count
+	iv[2] = fresh
+	iv[1] = count ^ (d << 31)
+	iv[0] = fresh ^ (d << 15)
+
+	s := newSNOW3G(snow3gKey(key), iv)
+	z := s.keystream(5)
+
+	p := uint64(z[0])<<32 | uint64(z[1])
+	q := uint64(z[2])<<32 | uint64(z[3])
+
+	const c = 0x1b
+	length := uint64(len(msg)) * 8
+	blocks := (len(msg) + 7) / 8
+
+	var eval uint64
+	for i := 0; i < blocks; i++ {
+		m := make([]byte, 8)
+		copy(m, msg[i*8:])
+		eval = mul64(eval^binary.BigEndian.Uint64(m), p, c)
+	}
+	eval ^= length
+	eval = mul64(eval, q, c)
+
+	mac = make([]byte, 4)
+	binary.BigEndian.PutUint32(mac, uint32(eval>>32)^z[4])
+	return
+}
+
+// SR is the Rijndael S-box.
+var snow3gSR = [256]byte{
+	0x63, 0x7c, 0x77, 0x7b, 0xf2, 0x6b, 0x6f, 0xc5, 0x30, 0x01, 0x67, 0x2b, 0xfe, 0xd7, 0xab, 0x76,
+	0xca, 0x82, 0xc9, 0x7d, 0xfa, 0x59, 0x47, 0xf0, 0xad, 0xd4, 0xa2, 0xaf, 0x9c, 0xa4, 0x72, 0xc0,
+	0xb7, 0xfd, 0x93, 0x26, 0x36, 0x3f, 0xf7, 0xcc, 0x34, 0xa5, 0xe5, 0xf1, 0x71, 0xd8, 0x31, 0x15,
+	0x04, 0xc7, 0x23, 0xc3, 0x18, 0x96, 0x05, 0x9a, 0x07, 0x12, 0x80, 0xe2, 0xeb, 0x27, 0xb2, 0x75,
+	0x09, 0x83, 0x2c, 0x1a, 0x1b, 0x6e, 0x5a, 0xa0, 0x52, 0x3b, 0xd6, 0xb3, 0x29, 0xe3, 0x2f, 0x84,
+	0x53, 0xd1, 0x00, 0xed, 0x20, 0xfc, 0xb1, 0x5b, 0x6a, 0xcb, 0xbe, 0x39, 0x4a, 0x4c, 0x58, 0xcf,
+	0xd0, 0xef, 0xaa, 0xfb, 0x43, 0x4d, 0x33, 0x85, 0x45, 0xf9, 0x02, 0x7f, 0x50, 0x3c, 0x9f, 0xa8,
+	0x51, 0xa3, 0x40, 0x8f, 0x92, 0x9d, 0x38, 0xf5, 0xbc, 0xb6, 0xda, 0x21, 0x10, 0xff, 0xf3, 0xd2,
+	0xcd, 0x0c, 0x13, 0xec, 0x5f, 0x97, 0x44, 0x17, 0xc4, 0xa7, 0x7e, 0x3d, 0x64, 0x5d, 0x19, 0x73,
+	0x60, 0x81, 0x4f, 0xdc, 0x22, 0x2a, 0x90, 0x88, 0x46, 0xee, 0xb8, 0x14, 0xde, 0x5e, 0x0b, 0xdb,
+	0xe0, 0x32, 0x3a, 0x0a, 0x49, 0x06, 0x24, 0x5c, 0xc2, 0xd3, 0xac, 0x62, 0x91, 0x95, 0xe4, 0x79,
+	0xe7, 0xc8, 0x37, 0x6d, 0x8d, 0xd5, 0x4e, 0xa9, 0x6c, 0x56, 0xf4, 0xea, 0x65, 0x7a, 0xae, 0x08,
+	0xba, 0x78, 0x25, 0x2e, 0x1c, 0xa6, 0xb4, 0xc6, 0xe8, 0xdd, 0x74, 0x1f, 0x4b, 0xbd, 0x8b, 0x8a,
+	0x70, 0x3e, 0xb5, 0x66, 0x48, 0x03, 0xf6, 0x0e, 0x61, 0x35, 0x57, 0xb9, 0x86, 0xc1, 0x1d, 0x9e,
+	0xe1, 0xf8, 0x98, 0x11, 0x69, 0xd9, 0x8e, 0x94, 0x9b, 0x1e, 0x87, 0xe9, 0xce, 0x55, 0x28, 0xdf,
+	0x8c, 0xa1, 0x89, 0x0d, 0xbf, 0xe6, 0x42, 0x68, 0x41, 0x99, 0x2d, 0x0f, 0xb0, 0x54, 0xbb, 0x16,
+}
+
+// SQ is derived from the Dickson polynomial g49 over GF(2^8).
+var snow3gSQ = [256]byte{
+	0x25, 0x24, 0x73, 0x67, 0xd7, 0xae, 0x5c, 0x30, 0xa4, 0xee, 0x6e, 0xcb, 0x7d, 0xb5, 0x82, 0xdb,
+	0xe4, 0x8e, 0x48, 0x49, 0x4f, 0x5d, 0x6a, 0x78, 0x70, 0x88, 0xe8, 0x5f, 0x5e, 0x84, 0x65, 0xe2,
+	0xd8, 0xe9, 0xcc, 0xed, 0x40, 0x2f, 0x11, 0x28, 0x57, 0xd2, 0xac, 0xe3, 0x4a, 0x15, 0x1b, 0xb9,
+	0xb2, 0x80, 0x85, 0xa6, 0x2e, 0x02, 0x47, 0x29, 0x07, 0x4b, 0x0e, 0xc1, 0x51, 0xaa, 0x89, 0xd4,
+	0xca, 0x01, 0x46, 0xb3, 0xef, 0xdd, 0x44, 0x7b, 0xc2, 0x7f, 0xbe, 0xc3, 0x9f, 0x20, 0x4c, 0x64,
+	0x83, 0xa2, 0x68, 0x42, 0x13, 0xb4, 0x41, 0xcd, 0xba, 0xc6, 0xbb, 0x6d, 0x4d, 0x71, 0x21, 0xf4,
+	0x8d, 0xb0, 0xe5, 0x93, 0xfe, 0x8f, 0xe6, 0xcf, 0x43, 0x45, 0x31, 0x22, 0x37, 0x36, 0x96, 0xfa,
+	0xbc, 0x0f, 0x08, 0x52, 0x1d, 0x55, 0x1a, 0xc5, 0x4e, 0x23, 0x69, 0x7a, 0x92, 0xff, 0x5b, 0x5a,
+	0xeb, 0x9a, 0x1c, 0xa9, 0xd1, 0x7e, 0x0d, 0xfc, 0x50, 0x8a, 0xb6, 0x62, 0xf5, 0x0a, 0xf8, 0xdc,
+	0x03, 0x3c, 0x0c, 0x39, 0xf1, 0xb8, 0xf3, 0x3d, 0xf2, 0xd5, 0x97, 0x66, 0x81, 0x32, 0xa0, 0x00,
+	0x06, 0xce, 0xf6, 0xea, 0xb7, 0x17, 0xf7, 0x8c, 0x79, 0xd6, 0xa7, 0xbf, 0x8b, 0x3f, 0x1f, 0x53,
+	0x63, 0x75, 0x35, 0x2c, 0x60, 0xfd, 0x27, 0xd3, 0x94, 0xa5, 0x7c, 0xa1, 0x05, 0x58, 0x2d, 0xbd,
+	0xd9, 0xc7, 0xaf, 0x6b, 0x54, 0x0b, 0xe0, 0x38, 0x04, 0xc8, 0x9d, 0xe7, 0x14, 0xb1, 0x87, 0x9c,
+	0xdf, 0x6f, 0xf9, 0xda, 0x2a, 0xc4, 0x59, 0x16, 0x74, 0x91, 0xab, 0x26, 0x61, 0x76, 0x34, 0x2b,
+	0xad, 0x99, 0xfb, 0x72, 0xec, 0x33, 0x12, 0xde, 0x98, 0x3b, 0xc0, 0x9b, 0x3e, 0x18, 0x10, 0x3a,
+	0x56, 0xe1, 0x77, 0xc9, 0x1e, 0x9e, 0x95, 0xa3, 0x90, 0x19, 0xa8, 0x6c, 0x09, 0xd0, 0xf0, 0x86,
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SUCI concealment by the Elliptic Curve Integrated Encryption Scheme.
+// document: 3GPP TS 33.501 Annex C.3
+const (
+	eciesEncKeyLen = 16 // AES-128 key
+	eciesICBLen    = 16 // initial counter block of AES-128 CTR
+	eciesMacKeyLen = 32 // HMAC-SHA-256 key
+	eciesMacLen    = 8  // truncated MAC tag
+)
+
+// C.3.4.1 Profile A
+func concealProfileA(hnPubKey, plain []byte, rand io.Reader) (
+	out []byte, err error) {
+
+	curve := ecdh.X25519()
+	hnPub, err := curve.NewPublicKey(hnPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network public key: %v", err)
+	}
+
+	ephKey := make([]byte, 32)
+	if _, err = io.ReadFull(rand, ephKey); err != nil {
+		return
+	}
+	ephPriv, err := curve.NewPrivateKey(ephKey)
+	if err != nil {
+		return
+	}
+	ephPub := ephPriv.PublicKey().Bytes()
+
+	shared, err := ephPriv.ECDH(hnPub)
+	if err != nil {
+		return
+	}
+
+	out = append(out, ephPub...)
+	out = append(out, eciesEncrypt(shared, ephPub, plain)...)
+	return
+}
+
+// C.3.4.2 Profile B
+func concealProfileB(hnPubKey, plain []byte, rand io.Reader) (
+	out []byte, err error) {
+
+	hnPub, err := p256PublicKey(hnPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network public key: %v", err)
+	}
+
+	ephKey := make([]byte, 32)
+	if _, err = io.ReadFull(rand, ephKey); err != nil {
+		return
+	}
+	ephPriv, err := ecdh.P256().NewPrivateKey(ephKey)
+	if err != nil {
+		return
+	}
+	ephPub := p256Compress(ephPriv.PublicKey().Bytes())
+
+	shared, err := ephPriv.ECDH(hnPub)
+	if err != nil {
+		return
+	}
+
+	out = append(out, ephPub...)
+	out = append(out, eciesEncrypt(shared, ephPub, plain)...)
+	return
+}
+
+// p256PublicKey accepts both the compressed and the uncompressed form.
+func p256PublicKey(key []byte) (*ecdh.PublicKey, error) {
+	if len(key) == 33 {
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), key)
+		if x == nil {
+			return nil, fmt.Errorf("not a point on P-256")
+		}
+		key = elliptic.Marshal(elliptic.P256(), x, y)
+	}
+	return ecdh.P256().NewPublicKey(key)
+}
+
+// p256Compress converts the uncompressed point (0x04 || X || Y)
+// into the compressed form (SEC 1 Version 2.0, 2.3.3).
+func p256Compress(key []byte) (c []byte) {
+	c = append(c, 0x02|(key[64]&1))
+	c = append(c, key[1:33]...)
+	return
+}
+
+func eciesKeys(shared, ephPub []byte) (encKey, icb, macKey []byte) {
+	k := x963KDF(shared, ephPub,
+		eciesEncKeyLen+eciesICBLen+eciesMacKeyLen)
+	encKey = k[:eciesEncKeyLen]
+	icb = k[eciesEncKeyLen : eciesEncKeyLen+eciesICBLen]
+	macKey = k[eciesEncKeyLen+eciesICBLen:]
+	return
+}
+
+// eciesEncrypt derives the keys from the shared secret and returns
+// the ciphertext followed by the MAC tag (C.3.2 steps 3 to 5).
+func eciesEncrypt(shared, ephPub, plain []byte) (out []byte) {
+
+	encKey, icb, macKey := eciesKeys(shared, ephPub)
+
+	block, _ := aes.NewCipher(encKey)
+	out = make([]byte, len(plain))
+	cipher.NewCTR(block, icb).XORKeyStream(out, plain)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(out)
+	out = append(out, mac.Sum(nil)[:eciesMacLen]...)
+	return
+}
+
+func eciesDecrypt(shared, ephPub, in []byte) (plain []byte, err error) {
+
+	if len(in) < eciesMacLen {
+		return nil, fmt.Errorf("scheme output too short")
+	}
+	ct := in[:len(in)-eciesMacLen]
+	tag := in[len(in)-eciesMacLen:]
+
+	encKey, icb, macKey := eciesKeys(shared, ephPub)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ct)
+	if hmac.Equal(mac.Sum(nil)[:eciesMacLen], tag) == false {
+		return nil, fmt.Errorf("MAC tag mismatch")
+	}
+
+	block, _ := aes.NewCipher(encKey)
+	plain = make([]byte, len(ct))
+	cipher.NewCTR(block, icb).XORKeyStream(plain, ct)
+	return
+}
+
+// DeconcealSUCI recovers the SUPI from the SUCI with the home network
+// private key as the SIDF does (TS 33.501 6.12.2). suci is the value part
+// of the 5GS mobile identity IE (9.11.3.4) without the length octets.
+// The SUPI is returned as the digits of MCC, MNC and MSIN.
+func DeconcealSUCI(suci, hnPrivKey []byte) (supi string, err error) {
+
+	if len(suci) < 8 {
+		return "", fmt.Errorf("SUCI too short: %d octets", len(suci))
+	}
+	if suci[0]&0x7 != TypeIDSUCI || (suci[0]>>4)&0x7 != SUPIFormatIMSI {
+		return "", fmt.Errorf("not an IMSI based SUCI: 0x%02x", suci[0])
+	}
+	plmn := suci[1:4]
+	scheme := suci[6] & 0xf
+	so := suci[8:]
+
+	var msin []byte
+	switch scheme {
+	case ProtectionSchemeNull:
+		msin = so
+	case ProtectionSchemeProfileA:
+		msin, err = deconcealProfileA(hnPrivKey, so)
+	case ProtectionSchemeProfileB:
+		msin, err = deconcealProfileB(hnPrivKey, so)
+	default:
+		err = fmt.Errorf("unsupported protection scheme: %d", scheme)
+	}
+	if err != nil {
+		return
+	}
+
+	mcc := bcd2str(plmn[0:1]) + bcd2str(plmn[1:2])[:1]
+	mnc := bcd2str(plmn[2:3])
+	if plmn[1]>>4 != 0xf {
+		mnc = bcd2str(plmn[1:2])[1:] + mnc
+	}
+	supi = mcc + mnc + strings.TrimSuffix(bcd2str(msin), "f")
+	return
+}
+
+func deconcealProfileA(hnPrivKey, so []byte) (plain []byte, err error) {
+
+	const ephPubLen = 32
+	if len(so) < ephPubLen {
+		return nil, fmt.Errorf("scheme output too short")
+	}
+
+	curve := ecdh.X25519()
+	hnPriv, err := curve.NewPrivateKey(hnPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network private key: %v", err)
+	}
+	ephPub, err := curve.NewPublicKey(so[:ephPubLen])
+	if err != nil {
+		return
+	}
+	shared, err := hnPriv.ECDH(ephPub)
+	if err != nil {
+		return
+	}
+	return eciesDecrypt(shared, so[:ephPubLen], so[ephPubLen:])
+}
+
+func deconcealProfileB(hnPrivKey, so []byte) (plain []byte, err error) {
+
+	const ephPubLen = 33
+	if len(so) < ephPubLen {
+		return nil, fmt.Errorf("scheme output too short")
+	}
+
+	hnPriv, err := ecdh.P256().NewPrivateKey(hnPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home network private key: %v", err)
+	}
+	ephPub, err := p256PublicKey(so[:ephPubLen])
+	if err != nil {
+		return
+	}
+	shared, err := hnPriv.ECDH(ephPub)
+	if err != nil {
+		return
+	}
+	return eciesDecrypt(shared, so[:ephPubLen], so[ephPubLen:])
+}
+
+// bcd2str returns the digits in the order of the BCD coding, i.e.
+// the lower nibble first.
+func bcd2str(bcd []byte) (s string) {
+	for _, v := range bcd {
+		s += fmt.Sprintf("%x%x", v&0xf, v>>4)
+	}
+	return
+}
+
+// ANSI-X9.63-KDF with SHA-256.
+// document: SEC 1 Version 2.0, 3.6.1
+func x963KDF(z, sharedInfo []byte, length int) (k []byte) {
+
+	counter := make([]byte, 4)
+	for i := uint32(1); len(k) < length; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h := sha256.New()
+		h.Write(z)
+		h.Write(counter)
+		h.Write(sharedInfo)
+		k = h.Sum(k)
+	}
+	return k[:length]
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"time"
+)
+
+// 10.2 Timers of 5GS mobility management
+// 10.3 Timers of 5GS session management
+// the value is the timer number.
+const (
+	T3502 = 3502
+	T3510 = 3510
+	T3511 = 3511
+	T3517 = 3517
+	T3521 = 3521
+	T3580 = 3580
+	T3582 = 3582
+)
+
+var defaultTimerValue = map[int]time.Duration{
+	T3502: 12 * time.Minute,
+	T3510: 15 * time.Second,
+	T3511: 10 * time.Second,
+	T3517: 15 * time.Second,
+	T3521: 15 * time.Second,
+	T3580: 16 * time.Second,
+	T3582: 16 * time.Second,
+}
+
+const (
+	// the procedure is aborted on the 5th expiry.
+	maxRetransmission = 4
+	// 5.5.1.2.7 registration attempt counter
+	maxRegistrationAttempt = 5
+)
+
+// TimerEvent is notified to UE.TimerCh on expiry of the NAS timer.
+// It is given back to UE.TimerExpired in the same goroutine as the other
+// UE methods.
+type TimerEvent struct {
+	UE    *UE
+	Timer int
+	PSI   uint8 // PDU session identity for the 5GSM timers
+	seq   uint64
+}
+
+type nasTimerKey struct {
+	id  int
+	psi uint8
+}
+
+type nasTimer struct {
+	timer *time.Timer
+	seq   uint64
+	count int // number of retransmissions
+
+	// resend returns the message to be retransmitted on expiry, and
+	// abort is called when the procedure is aborted.
+	resend func() []byte
+	abort  func()
+}
+
+// SetTimerValue overrides the timer value given in TS 24.501 10.2 and 10.3.
+func (ue *UE) SetTimerValue(id int, d time.Duration) {
+	if ue.tm.value == nil {
+		ue.tm.value = map[int]time.Duration{}
+	}
+	ue.tm.value[id] = d
+}
+
+func (ue *UE) timerValue(id int) time.Duration {
+	if d, ok := ue.tm.value[id]; ok {
+		return d
+	}
+	if id == T3502 && ue.Recv.t3502 > 0 {
+		return time.Duration(ue.Recv.t3502) * time.Second
+	}
+	return defaultTimerValue[id]
+}
+
+// startTimer starts the timer if UE.TimerCh is set. The running timer of
+// the same id is restarted.
+func (ue *UE) startTimer(id int, psi uint8, resend func() []byte, abort func()) {
+
+	if ue.TimerCh == nil {
+		return
+	}
+	ue.stopTimer(id, psi)
+	if ue.tm.timers == nil {
+		ue.tm.timers = map[nasTimerKey]*nasTimer{}
+	}
+
+	t := &nasTimer{resend: resend, abort: abort}
+	ue.tm.timers[nasTimerKey{id, psi}] = t
+	ue.runTimer(id, psi, t)
+}
+
+func (ue *UE) runTimer(id int, psi uint8, t *nasTimer) {
+
+	ue.tm.seq++
+	t.seq = ue.tm.seq
+
+	d := ue.timerValue(id)
+	ev := TimerEvent{UE: ue, Timer: id, PSI: psi, seq: t.seq}
+	ch := ue.TimerCh
+	t.timer = time.AfterFunc(d, func() {
+		// never block the timer goroutine when the channel is full.
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	ue.dprint("start T%d: %v", id, d)
+}
+
+func (ue *UE) stopTimer(id int, psi uint8) {
+
+	key := nasTimerKey{id, psi}
+	if t, ok := ue.tm.timers[key]; ok {
+		t.timer.Stop()
+		delete(ue.tm.timers, key)
+		ue.dprint("stop T%d", id)
+	}
+}
+
+func (ue *UE) stopAllTimers() {
+	for _, t := range ue.tm.timers {
+		t.timer.Stop()
+	}
+	ue.tm.timers = nil
+}
+
+// TimerRunning reports whether the timer is running. psi is ignored
+// for the 5GMM timers.
+func (ue *UE) TimerRunning(id int, psi uint8) bool {
+	if id < T3580 {
+		psi = 0
+	}
+	_, ok := ue.tm.timers[nasTimerKey{id, psi}]
+	return ok
+}
+
+// TimerExpired handles the expiry notified by TimerCh. It returns the
+// message to be retransmitted, or nil if the procedure is aborted or
+// nothing is to be sent. The event of the timer which has been stopped
+// in the meantime is ignored.
+func (ue *UE) TimerExpired(ev TimerEvent) (pdu []byte) {
+
+	key := nasTimerKey{ev.Timer, ev.PSI}
+	t, ok := ue.tm.timers[key]
+	if ok == false || t.seq != ev.seq {
+		return
+	}
+	ue.dprint("T%d expired (retransmission: %d)", ev.Timer, t.count)
+
+	if t.resend != nil && t.count < maxRetransmission {
+		t.count++
+		pdu = t.resend()
+		ue.runTimer(ev.Timer, ev.PSI, t)
+		return
+	}
+
+	delete(ue.tm.timers, key)
+	if t.abort != nil {
+		t.abort()
+	}
+	return
+}
+
+// abortRegistration counts the registration attempt on expiry of T3510,
+// and starts T3511 to retry, or T3502 after the 5th attempt.
+// 5.5.1.2.7 c) T3510 timeout
+func (ue *UE) abortRegistration() {
+
+	ue.tm.regAttempt++
+	if ue.tm.regAttempt < maxRegistrationAttempt {
+		ue.startTimer(T3511, 0, nil, nil)
+		return
+	}
+	ue.startTimer(T3502, 0, nil, func() {
+		ue.tm.regAttempt = 0
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import "fmt"
+
+// Unstructured PDU session. The payload is not interpreted by the UE nor
+// the network. The application sends the uplink payload by
+// SendUnstructured, which the user plane takes from UnstructuredUplink,
+// and the downlink payload given by the user plane to RecvUnstructured is
+// delivered to UnstructuredHandler.
+// document: 3GPP TS 23.501 5.6.10.3
+const unstructuredQueueLen = 16
+
+// SendUnstructured queues the uplink payload of the Unstructured PDU
+// session to be sent by the user plane.
+func (s *PDUSession) SendUnstructured(payload []byte) error {
+
+	if err := s.unstructuredActive(); err != nil {
+		return err
+	}
+	select {
+	case s.unstructuredQueue() <- payload:
+		return nil
+	default:
+		return fmt.Errorf("PDU session(%d): uplink queue is full", s.ID)
+	}
+}
+
+// UnstructuredUplink returns the channel of the uplink payload queued by
+// SendUnstructured.
+func (s *PDUSession) UnstructuredUplink() <-chan []byte {
+	return s.unstructuredQueue()
+}
+
+// RecvUnstructured delivers the downlink payload of the Unstructured PDU
+// session to UnstructuredHandler.
+func (s *PDUSession) RecvUnstructured(payload []byte) error {
+
+	if err := s.unstructuredActive(); err != nil {
+		return err
+	}
+	if s.UnstructuredHandler == nil {
+		return fmt.Errorf("PDU session(%d) has no UnstructuredHandler", s.ID)
+	}
+	s.UnstructuredHandler(payload)
+	return nil
+}
+
+func (s *PDUSession) unstructuredActive() error {
+	if s.Type != "Unstructured" {
+		return fmt.Errorf("PDU session(%d) is not Unstructured: %s",
+			s.ID, s.Type)
+	}
+	if s.SMstate != SMActive {
+		return fmt.Errorf("PDU session(%d) is not active", s.ID)
+	}
+	return nil
+}
+
+func (s *PDUSession) unstructuredQueue() chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unstructuredUL == nil {
+		s.unstructuredUL = make(chan []byte, unstructuredQueueLen)
+	}
+	return s.unstructuredUL
+}
@@ -0,0 +1,634 @@
+// Copyright 2021 hhorai. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found
+// in the LICENSE file.
+
+package nas
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// UE policy delivery service. The PCF manages the UE policy sections by
+// MANAGE UE POLICY COMMAND in the UE policy container of DL NAS transport,
+// and the URSP rules in the sections select the PDU session for the
+// traffic of the application.
+// document: 3GPP TS 24.501 Annex D, TS 24.526 5.2
+
+// D.6.1 UE policy delivery service message type
+const (
+	manageUEPolicyCommand       = 0x01
+	manageUEPolicyComplete      = 0x02
+	manageUEPolicyCommandReject = 0x03
+)
+
+// D.6.2 UE policy part type
+const (
+	uePolicyPartURSP  = 0x01
+	uePolicyPartANDSP = 0x02
+)
+
+// the cause of the instruction failed. see D.6.3
+const (
+	uePolicyCauseProtocolError = 111 // Protocol error, unspecified
+)
+
+// the UE policy section is identified by PLMN ID and UE policy section
+// code (UPSC).
+type uePolicySectionKey struct {
+	plmn [3]byte
+	upsc uint16
+}
+
+type uePolicyResult struct {
+	key   uePolicySectionKey
+	order uint16 // order of the instruction failed
+	cause uint8
+}
+
+// URSPRule is the UE route selection policy rule (TS 24.526 5.2).
+type URSPRule struct {
+	Precedence                uint8
+	TrafficDescriptor         []TrafficDescriptorComponent
+	RouteSelectionDescriptors []RouteSelectionDescriptor
+}
+
+// Table 5.2.1: Traffic descriptor component type identifier in TS 24.526.
+// The IP descriptors are coded as the packet filter components.
+const (
+	TrafficDescriptorMatchAll      = PacketFilterMatchAll
+	TrafficDescriptorOSIDAppID     = 0x08
+	TrafficDescriptorDNN           = 0x88
+	TrafficDescriptorConnCapabilty = 0x90
+	TrafficDescriptorFQDN          = 0x91
+	TrafficDescriptorOSAppID       = 0xa0
+)
+
+// Connection capabilities in TS 24.526 5.2
+const (
+	ConnCapabilityIMS      = 0x01
+	ConnCapabilityMMS      = 0x02
+	ConnCapabilitySUPL     = 0x04
+	ConnCapabilityInternet = 0x08
+)
+
+type TrafficDescriptorComponent struct {
+	Type                   uint8
+	IP                     *PacketFilterComponent // the IP descriptor
+	OSID                   []byte
+	OSAppID                string
+	DNN                    string
+	FQDN                   string
+	ConnectionCapabilities []uint8
+}
+
+// Table 5.2.2: Route selection descriptor component type identifier in
+// TS 24.526
+const (
+	RouteSelectionSSCMode             = 0x01
+	RouteSelectionSNSSAI              = 0x02
+	RouteSelectionDNN                 = 0x04
+	RouteSelectionPDUSessionType      = 0x08
+	RouteSelectionPreferredAccessType = 0x10
+	RouteSelectionMultiAccess         = 0x11
+	RouteSelectionNonSeamlessOffload  = 0x20
+)
+
+// RouteSelectionDescriptor is matched by the PDU session of any of the
+// S-NSSAIs and any of the DNNs given.
+type RouteSelectionDescriptor struct {
+	Precedence          uint8
+	SSCMode             uint8 // 0 if not given
+	SNSSAIs             []SNSSAI
+	DNNs                []string
+	PDUSessionType      string // "" if not given
+	PreferredAccessType uint8
+	MultiAccess         bool
+	NonSeamlessOffload  bool
+}
+
+// AppTraffic is the traffic of the application to select the PDU session
+// by the URSP rules. The zero value of the field is not matched except by
+// the match-all traffic descriptor.
+type AppTraffic struct {
+	OSAppID              string
+	RemoteAddr           net.IP
+	Protocol             uint8
+	RemotePort           uint16
+	DNN                  string
+	FQDN                 string
+	ConnectionCapability uint8
+}
+
+// URSP returns the URSP rules in all the UE policy sections installed, in
+// the order of the precedence.
+func (ue *UE) URSP() (rules []URSPRule) {
+
+	for _, section := range ue.policy.sections {
+		rules = append(rules, section...)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Precedence < rules[j].Precedence
+	})
+	return
+}
+
+// SelectPDUSession returns the PDU session for the application traffic by
+// the route selection descriptor of the URSP rule of the highest precedence
+// matching the traffic, or nil if no PDU session is selected. The active
+// PDU session is preferred to the one to be established.
+// see 6.6.2.3 in TS 23.503
+func (ue *UE) SelectPDUSession(app AppTraffic) *PDUSession {
+
+	for _, r := range ue.URSP() {
+		if r.match(&app) == false {
+			continue
+		}
+		rsds := append([]RouteSelectionDescriptor{},
+			r.RouteSelectionDescriptors...)
+		sort.SliceStable(rsds, func(i, j int) bool {
+			return rsds[i].Precedence < rsds[j].Precedence
+		})
+
+		for _, d := range rsds {
+			var selected *PDUSession
+			for _, s := range ue.PDUSessions {
+				if d.match(s) == false {
+					continue
+				}
+				if s.SMstate == SMActive {
+					return s
+				}
+				if selected == nil {
+					selected = s
+				}
+			}
+			if selected != nil {
+				return selected
+			}
+		}
+	}
+	return nil
+}
+
+// match reports whether all the components of the traffic descriptor
+// match the traffic.
+func (r *URSPRule) match(app *AppTraffic) bool {
+
+	p := packet{dst: app.RemoteAddr, protocol: app.Protocol,
+		dstPort: app.RemotePort, hasPorts: app.RemotePort != 0}
+
+	for _, c := range r.TrafficDescriptor {
+		switch c.Type {
+		case TrafficDescriptorOSIDAppID, TrafficDescriptorOSAppID:
+			if c.OSAppID != app.OSAppID {
+				return false
+			}
+		case TrafficDescriptorDNN:
+			if c.DNN != app.DNN {
+				return false
+			}
+		case TrafficDescriptorFQDN:
+			if strings.EqualFold(c.FQDN, app.FQDN) == false {
+				return false
+			}
+		case TrafficDescriptorConnCapabilty:
+			found := false
+			for _, v := range c.ConnectionCapabilities {
+				found = found || v == app.ConnectionCapability
+			}
+			if found == false {
+				return false
+			}
+		default:
+			if c.IP == nil || c.IP.match(&p) == false {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// match reports whether the PDU session is given by the route selection
+// descriptor.
+func (d *RouteSelectionDescriptor) match(s *PDUSession) bool {
+
+	if d.NonSeamlessOffload {
+		return false
+	}
+	// IPv4v6 is requested for the PDU session without the type.
+	sessionType := s.Type
+	if sessionType == "" {
+		sessionType = pduSessionTypeStr[PDUSessionIPv4v6]
+	}
+	if d.PDUSessionType != "" && d.PDUSessionType != sessionType {
+		return false
+	}
+	if len(d.DNNs) > 0 {
+		found := false
+		for _, dnn := range d.DNNs {
+			found = found || strings.EqualFold(dnn, s.DNN)
+		}
+		if found == false {
+			return false
+		}
+	}
+	if len(d.SNSSAIs) > 0 {
+		found := false
+		for _, snssai := range d.SNSSAIs {
+			found = found || (snssai.SST == s.SNSSAI.SST &&
+				strings.EqualFold(snssai.SD, s.SNSSAI.SD))
+		}
+		if found == false {
+			return false
+		}
+	}
+	return true
+}
+
+// decUEPolicyContainer decodes the UE policy delivery service message in
+// the payload container of DL NAS transport.
+func (ue *UE) decUEPolicyContainer(v []byte) {
+
+	if len(v) < 2 {
+		ue.DecodeError = fmt.Errorf("nas: invalid UE policy container: %x", v)
+		return
+	}
+	pti, msgType := v[0], v[1]
+
+	switch msgType {
+	case manageUEPolicyCommand:
+		ue.decManageUEPolicyCommand(pti, v[2:])
+	default:
+		ue.DecodeError = fmt.Errorf(
+			"nas: unsupported UE policy delivery service message: 0x%x",
+			msgType)
+	}
+}
+
+// D.5.1 Manage UE policy command
+// D.2.2 Network-requested UE policy management procedure
+// The instructions are applied to a copy of the UE policy sections, which
+// replaces them only if the whole command is decoded. The malformed
+// command leaves the sections unchanged and is answered by Manage UE
+// Policy Command Reject.
+func (ue *UE) decManageUEPolicyCommand(pti uint8, v []byte) {
+
+	ue.dprint("Manage UE Policy Command PTI: %d", pti)
+
+	ue.policy.pti = pti
+	ue.policy.results = nil
+	ue.fsm.policy = true
+
+	var key uePolicySectionKey
+	var order uint16
+	malformed := func(err error) {
+		ue.DecodeError = err
+		ue.policy.results = append(ue.policy.results,
+			uePolicyResult{key, order, uePolicyCauseProtocolError})
+	}
+
+	// D.6.2 UE policy section management list
+	list, _, err := splitLV16(v)
+	if err != nil {
+		malformed(fmt.Errorf("nas: invalid UE policy section "+
+			"management list: %v", err))
+		return
+	}
+
+	sections := map[uePolicySectionKey][]URSPRule{}
+	for k, rules := range ue.policy.sections {
+		sections[k] = rules
+	}
+
+	ue.indent++
+	defer func() { ue.indent-- }()
+
+	for len(list) > 0 {
+		var sublist []byte
+		sublist, list, err = splitLV16(list)
+		if err != nil || len(sublist) < 3 {
+			malformed(fmt.Errorf("nas: invalid UE policy section "+
+				"management sublist: %x", sublist))
+			return
+		}
+		key = uePolicySectionKey{}
+		order = 0
+		copy(key.plmn[:], sublist[:3])
+		plmn := sublist[:3]
+		ue.decPLMN(&plmn)
+		instructions := sublist[3:]
+
+		for order = 1; len(instructions) > 0; order++ {
+			var instruction []byte
+			key.upsc = 0
+			instruction, instructions, err = splitLV16(instructions)
+			if err != nil || len(instruction) < 2 {
+				malformed(fmt.Errorf("nas: invalid instruction: %x",
+					instruction))
+				return
+			}
+			key.upsc = binary.BigEndian.Uint16(instruction)
+			ue.dprinti("Instruction %d: UPSC %d", order, key.upsc)
+
+			// the section of the empty contents is deleted. see D.2.2.2
+			contents := instruction[2:]
+			if len(contents) == 0 {
+				delete(sections, key)
+				continue
+			}
+
+			rules, err := ue.decUEPolicySectionContents(contents)
+			if err != nil {
+				ue.dprinti("error: %v", err)
+				ue.policy.results = append(ue.policy.results,
+					uePolicyResult{key, order, uePolicyCauseProtocolError})
+				continue
+			}
+			sections[key] = rules
+		}
+	}
+
+	ue.policy.sections = sections
+}
+
+// decUEPolicySectionContents returns the URSP rules in the UE policy
+// parts. The other UE policy parts are ignored.
+func (ue *UE) decUEPolicySectionContents(v []byte) (
+	rules []URSPRule, err error) {
+
+	for len(v) > 0 {
+		var part []byte
+		part, v, err = splitLV16(v)
+		if err != nil || len(part) < 1 {
+			return nil, fmt.Errorf("invalid UE policy part: %x", part)
+		}
+		partType := part[0] & 0x0f
+		if partType != uePolicyPartURSP {
+			ue.dprinti("info: UE policy part type(%d) is not supported",
+				partType)
+			continue
+		}
+		urspRules, err := decURSPRules(part[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range urspRules {
+			ue.dprinti("URSP rule: %+v", r)
+		}
+		rules = append(rules, urspRules...)
+	}
+	return
+}
+
+// 5.2 Encoding of UE policy part type URSP in TS 24.526
+func decURSPRules(v []byte) (rules []URSPRule, err error) {
+
+	for len(v) > 0 {
+		var b, td, rsdList []byte
+		b, v, err = splitLV16(v)
+		if err != nil || len(b) < 1 {
+			return nil, fmt.Errorf("invalid URSP rule: %x", b)
+		}
+		r := URSPRule{Precedence: b[0]}
+
+		td, b, err = splitLV16(b[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid traffic descriptor: %x", b)
+		}
+		if r.TrafficDescriptor, err = decTrafficDescriptor(td); err != nil {
+			return nil, err
+		}
+
+		rsdList, _, err = splitLV16(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route selection descriptor "+
+				"list: %x", b)
+		}
+		for len(rsdList) > 0 {
+			var rsd, contents []byte
+			rsd, rsdList, err = splitLV16(rsdList)
+			if err != nil || len(rsd) < 1 {
+				return nil, fmt.Errorf("invalid route selection "+
+					"descriptor: %x", rsd)
+			}
+			contents, _, err = splitLV16(rsd[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid route selection "+
+					"descriptor contents: %x", rsd)
+			}
+			d, err := decRouteSelectionDescriptor(contents)
+			if err != nil {
+				return nil, err
+			}
+			d.Precedence = rsd[0]
+			r.RouteSelectionDescriptors = append(
+				r.RouteSelectionDescriptors, d)
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+func decTrafficDescriptor(v []byte) (
+	components []TrafficDescriptorComponent, err error) {
+
+	for len(v) > 0 {
+		c := TrafficDescriptorComponent{Type: v[0]}
+		v = v[1:]
+
+		var b []byte
+		switch c.Type {
+		case TrafficDescriptorOSIDAppID:
+			if len(v) < 16 {
+				return nil, fmt.Errorf("invalid OS Id: %x", v)
+			}
+			c.OSID = v[:16]
+			b, v, err = splitLV8(v[16:])
+			c.OSAppID = string(b)
+		case TrafficDescriptorOSAppID:
+			b, v, err = splitLV8(v)
+			c.OSAppID = string(b)
+		case TrafficDescriptorDNN:
+			b, v, err = splitLV8(v)
+			c.DNN = decDNNName(b)
+		case TrafficDescriptorFQDN:
+			b, v, err = splitLV8(v)
+			c.FQDN = decDNNName(b)
+		case TrafficDescriptorConnCapabilty:
+			b, v, err = splitLV8(v)
+			c.ConnectionCapabilities = b
+		default:
+			n, ok := pktFilterComponentLen[c.Type]
+			if ok == false || len(v) < n {
+				return nil, fmt.Errorf(
+					"unsupported traffic descriptor component: 0x%x", c.Type)
+			}
+			ip, e := decPacketFilterComponents(append([]byte{c.Type}, v[:n]...))
+			if e != nil {
+				return nil, e
+			}
+			c.IP = &ip[0]
+			v = v[n:]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid traffic descriptor component "+
+				"0x%x: %v", c.Type, err)
+		}
+		components = append(components, c)
+	}
+	return
+}
+
+func decRouteSelectionDescriptor(v []byte) (
+	d RouteSelectionDescriptor, err error) {
+
+	for len(v) > 0 {
+		t := v[0]
+		v = v[1:]
+
+		var b []byte
+		switch t {
+		case RouteSelectionSSCMode, RouteSelectionPDUSessionType,
+			RouteSelectionPreferredAccessType:
+			if len(v) < 1 {
+				return d, fmt.Errorf("route selection descriptor component "+
+					"0x%x too short", t)
+			}
+			switch t {
+			case RouteSelectionSSCMode:
+				d.SSCMode = v[0] & 0x07
+			case RouteSelectionPDUSessionType:
+				d.PDUSessionType = pduSessionTypeStr[v[0]&0x07]
+			case RouteSelectionPreferredAccessType:
+				d.PreferredAccessType = v[0]
+			}
+			v = v[1:]
+		case RouteSelectionSNSSAI:
+			b, v, err = splitLV8(v)
+			if err == nil && len(b) >= 1 {
+				snssai := SNSSAI{SST: int(b[0])}
+				if len(b) >= 4 {
+					snssai.SD = fmt.Sprintf("%x", b[1:4])
+				}
+				d.SNSSAIs = append(d.SNSSAIs, snssai)
+			}
+		case RouteSelectionDNN:
+			b, v, err = splitLV8(v)
+			d.DNNs = append(d.DNNs, decDNNName(b))
+		case RouteSelectionMultiAccess:
+			d.MultiAccess = true
+		case RouteSelectionNonSeamlessOffload:
+			d.NonSeamlessOffload = true
+		default:
+			return d, fmt.Errorf(
+				"unsupported route selection descriptor component: 0x%x", t)
+		}
+		if err != nil {
+			return d, fmt.Errorf("invalid route selection descriptor "+
+				"component 0x%x: %v", t, err)
+		}
+	}
+	return
+}
+
+// decDNNName decodes the length-value labels of the DNN or the FQDN.
+func decDNNName(v []byte) string {
+
+	var labels []string
+	for len(v) > 0 {
+		n := int(v[0])
+		if n+1 > len(v) {
+			break
+		}
+		labels = append(labels, string(v[1:1+n]))
+		v = v[1+n:]
+	}
+	return strings.Join(labels, ".")
+}
+
+func splitLV8(v []byte) (value, rest []byte, err error) {
+	if len(v) < 1 || len(v) < 1+int(v[0]) {
+		return nil, nil, fmt.Errorf("too short: %x", v)
+	}
+	return v[1 : 1+int(v[0])], v[1+int(v[0]):], nil
+}
+
+func splitLV16(v []byte) (value, rest []byte, err error) {
+	if len(v) < 2 {
+		return nil, nil, fmt.Errorf("too short: %x", v)
+	}
+	n := int(binary.BigEndian.Uint16(v))
+	if len(v) < 2+n {
+		return nil, nil, fmt.Errorf("too short: %x", v)
+	}
+	return v[2 : 2+n], v[2+n:], nil
+}
+
+// D.5.2 Manage UE policy complete
+func (ue *UE) MakeManageUEPolicyComplete() (pdu []byte) {
+
+	c := []byte{ue.policy.pti, manageUEPolicyComplete}
+	pdu = ue.encUEPolicyTransport(c)
+	return
+}
+
+// D.5.3 Manage UE policy command reject
+// the results are grouped by PLMN ID in the UE policy section management
+// result (D.6.3).
+func (ue *UE) MakeManageUEPolicyCommandReject() (pdu []byte) {
+
+	var result []byte
+	for i := 0; i < len(ue.policy.results); {
+		plmn := ue.policy.results[i].key.plmn
+		j := i
+		for j < len(ue.policy.results) &&
+			ue.policy.results[j].key.plmn == plmn {
+			j++
+		}
+		result = append(result, byte(j-i))
+		result = append(result, plmn[:]...)
+		for _, r := range ue.policy.results[i:j] {
+			v := make([]byte, 5)
+			binary.BigEndian.PutUint16(v[0:2], r.key.upsc)
+			binary.BigEndian.PutUint16(v[2:4], r.order)
+			v[4] = r.cause
+			result = append(result, v...)
+		}
+		i = j
+	}
+
+	c := []byte{ue.policy.pti, manageUEPolicyCommandReject}
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(result)))
+	c = append(c, length...)
+	c = append(c, result...)
+
+	pdu = ue.encUEPolicyTransport(c)
+	return
+}
+
+// UEPolicyRejected reports whether any instruction of the last Manage UE
+// Policy Command failed, i.e. Manage UE Policy Command Reject is to be sent.
+func (ue *UE) UEPolicyRejected() bool {
+	return len(ue.policy.results) > 0
+}
+
+// UEPolicyCommanded reports whether the network sent Manage UE Policy
+// Command and the response has not been sent yet.
+func (ue *UE) UEPolicyCommanded() bool {
+	return ue.commanded(MessageTypeDLNasTransport) && ue.fsm.policy
+}
+
+func (ue *UE) encUEPolicyTransport(c []byte) (pdu []byte) {
+
+	pdu = ue.MakeULNasTransport(PayloadContainerUEPolicy, 0, &c)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = append(head, pdu...)
+	return
+}
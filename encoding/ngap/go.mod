@@ -1 +1,3 @@
 module github.com/hhorai/gnbsim/encoding/ngap
+
+go 1.27.1
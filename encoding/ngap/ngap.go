@@ -38,15 +38,22 @@ const (
 	idAllowedNSSAI              = 0
 	idAMFName                   = 1
 	idAMFUENGAPID               = 10
+	idCause                     = 15
 	idDefaultPagingDRX          = 21
+	idFiveGSTMSI                = 26
 	idGlobalRANNodeID           = 27
 	idGUAMI                     = 28
 	idMaskedIMEISV              = 34
 	idMobilityRestrictionList   = 36
 	idNASPDU                    = 38
+	idPDUSessResModListModReq   = 64
+	idPDUSessResModListModRes   = 65
+	idPDUSessResRelListRelRes   = 70
 	idPDUSessResSetupListCxtReq = 71
+	idPDUSessResSetupListCxtRes = 72
 	idPDUSessResSetupListSUReq  = 74
 	idPDUSessResSetupListSURes  = 75
+	idPDUSessResToRelListRelCmd = 79
 	idPLMNSupportList           = 80
 	idRANUENGAPID               = 85
 	idRelativeAMFCapacity       = 86
@@ -55,9 +62,11 @@ const (
 	idServedGUAMIList           = 96
 	idSupportedTAList           = 102
 	idUEContextRequest          = 112
+	idUENGAPIDs                 = 114
 	idUESecurityCapabilities    = 119
 	idUserLocationInformation   = 121
 	idPDUSessionType            = 134
+	idQosFlowAddOrModifyReqList = 135
 	idQosFlowSetupRequestList   = 136
 	idULNGUUPTNLInformation     = 139
 )
@@ -66,15 +75,22 @@ var ieID = map[int]string{
 	idAllowedNSSAI:              "id-AllowedNSSAI",
 	idAMFName:                   "id-AMFName",
 	idAMFUENGAPID:               "id-AMF-UE-NGAP-ID",
+	idCause:                     "id-Cause",
 	idDefaultPagingDRX:          "",
+	idFiveGSTMSI:                "id-FiveG-S-TMSI",
 	idGlobalRANNodeID:           "",
 	idGUAMI:                     "id-GUAMI",
 	idMaskedIMEISV:              "id-MaskedIMEISV",
 	idMobilityRestrictionList:   "id-MobilityRestrictionList",
 	idNASPDU:                    "id-NAS-PDU",
+	idPDUSessResModListModReq:   "id-PDUSessionResourceModifyListModReq",
+	idPDUSessResModListModRes:   "id-PDUSessionResourceModifyListModRes",
+	idPDUSessResRelListRelRes:   "id-PDUSessionResourceReleasedListRelRes",
 	idPDUSessResSetupListCxtReq: "id-PDUSessionResourceSetupListCxtReq",
+	idPDUSessResSetupListCxtRes: "id-PDUSessionResourceSetupListCxtRes",
 	idPDUSessResSetupListSUReq:  "id-PDUSessionResourceSetupListSUReq",
 	idPDUSessResSetupListSURes:  "id-PDUSessionResourceSetupListSURes",
+	idPDUSessResToRelListRelCmd: "id-PDUSessionResourceToReleaseListRelCmd",
 	idPLMNSupportList:           "id-PLMNSupportList",
 	idRANUENGAPID:               "id-RAN-UE-NGAP-ID",
 	idRelativeAMFCapacity:       "id-RelativeAMFCapacity",
@@ -83,9 +99,11 @@ var ieID = map[int]string{
 	idServedGUAMIList:           "id-ServedGUAMIList",
 	idSupportedTAList:           "",
 	idUEContextRequest:          "",
+	idUENGAPIDs:                 "id-UE-NGAP-IDs",
 	idUESecurityCapabilities:    "id-UESecurityCapabilities",
 	idUserLocationInformation:   "",
 	idPDUSessionType:            "id-PDUSessionType",
+	idQosFlowAddOrModifyReqList: "id-QosFlowAddOrModifyRequestList",
 	idQosFlowSetupRequestList:   "id-QosFlowSetupRequestList",
 	idULNGUUPTNLInformation:     "id-UL-NGU-UP-TNLInformation",
 }
@@ -99,35 +117,59 @@ type GNB struct {
 	NGAPPeerAddr    string
 	GTPuLocalAddr   string
 	GTPuIFname      string
-	GTPuTEID        uint32
+	GTPuTEID        uint32 // local TEID of the first PDU session
 	UE              nas.UE // base parameter to be used for each UE
 
-	Recv struct {
-		GTPuPeerAddr net.IP
-		GTPuPeerTEID uint32
-	}
+	// HandleNAS delivers the downlink NAS messages to nas.UE.HandleNAS,
+	// and the results are taken by Camper.TakeNAS.
+	HandleNAS bool
 
 	Camper []*Camper
 
 	DecodeError error
 	dbgLevel    int
-	indent      int // indent for debug print.
+	indent      int    // indent for debug print.
+	teidCount   uint32 // number of the local TEIDs allocated
 }
 
 type Camper struct {
-	GNB          *GNB // camped in this gNB
-	UE           *nas.UE
-	GTPu	     *gtp.GTP
-	AmfId        uint32
-	RanId        uint32
-	RRCstate     int
-	PDUSessionID uint8
-	QosFlowID    uint8
+	GNB         *GNB // camped in this gNB
+	UE          *nas.UE
+	AmfId       uint32
+	RanId       uint32
+	RRCstate    int
+	PDUSessions []*PDUSessionResource
 
 	SendMsg *[]byte
 	RecvMsg *[]byte
 
 	camperType int
+
+	// PDU session resources requested in Initial Context Setup Request.
+	pduSessionCxtReq bool
+
+	// PDU sessions in the request to be answered by the next response.
+	pduSessionReq []*PDUSessionResource
+
+	// resources released by the last PDU Session Resource Release Command.
+	released []*PDUSessionResource
+
+	// uplink NAS messages and events given by nas.UE.HandleNAS.
+	nasUL     [][]byte
+	nasEvents []nas.Event
+}
+
+// PDUSessionResource is the resources of a PDU session set up in the gNB.
+type PDUSessionResource struct {
+	ID        uint8
+	QosFlowID uint8
+	GTPu      *gtp.GTP
+	LocalTEID uint32
+	PeerAddr  net.IP
+	PeerTEID  uint32
+
+	// QoS flows added or modified by PDU Session Resource Modify Request.
+	qosFlowModified []uint8
 }
 
 const (
@@ -135,6 +177,12 @@ const (
 	CAMPER_TYPE_NORMAL    = 1
 )
 
+// RRC state of the camper. see TS 38.331 4.2.1 UE states.
+const (
+	RRC_IDLE      = 0
+	RRC_CONNECTED = 1
+)
+
 func NewNGAP(filename string) (p *GNB) {
 
 	bytes, err := ioutil.ReadFile(filename)
@@ -175,6 +223,95 @@ func (gnb *GNB) LookupCamperByUE(ue *nas.UE) (c *Camper) {
 	return
 }
 
+// PDUSession returns the resources of the PDU session, or nil if they are
+// not set up.
+func (c *Camper) PDUSession(id uint8) *PDUSessionResource {
+	for _, s := range c.PDUSessions {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// addPDUSessionReq adds the PDU session in the request to the list to be
+// answered. the resources are allocated if the session is a new one.
+func (gnb *GNB) addPDUSessionReq(c *Camper, id uint8) (s *PDUSessionResource) {
+	s = c.PDUSession(id)
+	if s == nil {
+		s = &PDUSessionResource{ID: id, LocalTEID: gnb.allocTEID()}
+		c.PDUSessions = append(c.PDUSessions, s)
+	}
+	c.pduSessionReq = append(c.pduSessionReq, s)
+	return
+}
+
+// lastPDUSessionReq returns the PDU session of the item being decoded,
+// or nil if no PDU Session ID is decoded yet.
+func (c *Camper) lastPDUSessionReq() *PDUSessionResource {
+	if c == nil || len(c.pduSessionReq) == 0 {
+		return nil
+	}
+	return c.pduSessionReq[len(c.pduSessionReq)-1]
+}
+
+// releasePDUSessionReq releases the resources of the PDU session in
+// Release Command. The session not set up is answered as released
+// without any resources. see TS 38.413 8.2.2.4 Abnormal Conditions
+func (c *Camper) releasePDUSessionReq(id uint8) {
+	s := c.PDUSession(id)
+	if s == nil {
+		s = &PDUSessionResource{ID: id}
+	} else {
+		c.delPDUSession(id)
+		c.released = append(c.released, s)
+	}
+	c.pduSessionReq = append(c.pduSessionReq, s)
+}
+
+// ReleasedPDUSession returns the resources of the PDU session released by
+// the last PDU Session Resource Release Command, which are to be cleaned
+// up by the application, or nil if it was not set up.
+func (c *Camper) ReleasedPDUSession(id uint8) *PDUSessionResource {
+	for _, s := range c.released {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *Camper) delPDUSession(id uint8) {
+	for i, s := range c.PDUSessions {
+		if s.ID == id {
+			c.PDUSessions = append(c.PDUSessions[:i], c.PDUSessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// allocTEID allocates the local TEID for the PDU session. the TEIDs
+// follow GTPuTEID, which is chosen at random if not given.
+func (gnb *GNB) allocTEID() (teid uint32) {
+	if gnb.GTPuTEID == 0 {
+		gnb.GTPuTEID = rand.Uint32()
+	}
+	teid = gnb.GTPuTEID + gnb.teidCount
+	gnb.teidCount++
+	return
+}
+
+func (gnb *GNB) LookupCamperByAmfId(id uint32) (c *Camper) {
+
+	for _, c = range gnb.Camper {
+		if c.AmfId == id {
+			return
+		}
+	}
+	c = nil
+	return
+}
+
 func (gnb *GNB) LookupCamperByRanId(id uint32) (c *Camper) {
 
 	for _, c = range gnb.Camper {
@@ -188,10 +325,25 @@ func (gnb *GNB) LookupCamperByRanId(id uint32) (c *Camper) {
 
 func (gnb *GNB) SendtoUE(c *Camper, pdu *[]byte) {
 
-	if pdu != nil {
-		c.UE.SetIndent(gnb.indent)
-		c.UE.Receive(pdu)
+	if pdu == nil {
+		return
+	}
+	c.UE.SetIndent(gnb.indent)
+	if gnb.HandleNAS {
+		ul, events := c.UE.HandleNAS(*pdu)
+		c.nasUL = append(c.nasUL, ul...)
+		c.nasEvents = append(c.nasEvents, events...)
+		return
 	}
+	c.UE.Receive(pdu)
+	return
+}
+
+// TakeNAS returns the uplink NAS messages to be sent in order and the
+// events given by nas.UE.HandleNAS since the last call.
+func (c *Camper) TakeNAS() (ul [][]byte, events []nas.Event) {
+	ul, events = c.nasUL, c.nasEvents
+	c.nasUL, c.nasEvents = nil, nil
 	return
 }
 
@@ -219,6 +371,11 @@ func (gnb *GNB) Decode(pdu *[]byte) {
 
 	gnb.DecodeError = err
 
+	if procCode == idUEContextRelease && c != nil {
+		gnb.dprint("UE(RAN UE NGAP ID=%d) goes to RRC IDLE", c.RanId)
+		c.RRCstate = RRC_IDLE
+	}
+
 	if c != nil && c.UE.DecodeError != nil {
 		gnb.DecodeError = c.UE.DecodeError
 	}
@@ -265,9 +422,11 @@ func (gnb *GNB) decPDUSessionResourceSetupListSUReq(
 	seqNum := int(readPduByte(pdu)) + 1
 	gnb.dprint("number of sequence: %d", seqNum)
 
+	c.pduSessionReq = nil
+
 	for i := 0; i < seqNum; i++ {
 		seq := readPduByte(pdu)
-		gnb.decPDUSessionID(c, pdu)
+		gnb.addPDUSessionReq(c, gnb.decPDUSessionID(pdu))
 
 		seq <<= 1 // skip extension marker
 
@@ -339,49 +498,474 @@ PDUSessionResourceSetupItemSURes ::= SEQUENCE {
 }
 */
 func (gnb *GNB) encPDUSessionResourceSetupListSURes(c *Camper) (v []byte) {
+	return gnb.encPDUSessionResourceSetupListRes(c, idPDUSessResSetupListSURes)
+}
 
-	head, _ := encProtocolIE(idPDUSessResSetupListSURes, ignore)
+// PDUSessionResourceSetupListCxtRes in
+// 9.2.2.2 INITIAL CONTEXT SETUP RESPONSE has the same structure.
+func (gnb *GNB) encPDUSessionResourceSetupListCxtRes(c *Camper) (v []byte) {
+	return gnb.encPDUSessionResourceSetupListRes(c, idPDUSessResSetupListCxtRes)
+}
 
-	_, v, _ = per.EncSequenceOf(1, 1, 256, false)
-	bf, _ := per.EncSequence(true, 1, 0)
-	v = append(v, bf.Value...)
+func (gnb *GNB) encPDUSessionResourceSetupListRes(
+	c *Camper, id int64) (v []byte) {
+
+	head, _ := encProtocolIE(id, ignore)
+
+	_, v, _ = per.EncSequenceOf(uint(len(c.pduSessionReq)), 1, 256, false)
+	for _, s := range c.pduSessionReq {
+		bf, _ := per.EncSequence(true, 1, 0)
+		v = append(v, bf.Value...)
+
+		tmp := gnb.encPDUSessionID(s.ID)
+		v = append(v, tmp...)
+
+		tmp = gnb.encPDUSessionResourceSetupResponseTransfer(s)
+		bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
+		v = append(v, bf.Value...)
+		v = append(v, tmp...)
+	}
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+
+	return
+}
+
+// 9.2.1.3 PDU SESSION RESOURCE RELEASE COMMAND
+/*
+PDUSessionResourceReleaseCommand ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {PDUSessionResourceReleaseCommandIEs} },
+    ...
+}
 
-	tmp := gnb.encPDUSessionID(c)
+PDUSessionResourceReleaseCommandIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                          CRITICALITY reject  TYPE AMF-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                          CRITICALITY reject  TYPE RAN-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RANPagingPriority                       CRITICALITY ignore  TYPE RANPagingPriority                          PRESENCE optional       }|
+    { ID id-NAS-PDU                                 CRITICALITY ignore  TYPE NAS-PDU                                    PRESENCE optional       }|
+    { ID id-PDUSessionResourceToReleaseListRelCmd   CRITICALITY reject  TYPE PDUSessionResourceToReleaseListRelCmd      PRESENCE mandatory  },
+    ...
+}
+
+PDUSessionResourceToReleaseListRelCmd ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF PDUSessionResourceToReleaseItemRelCmd
+
+PDUSessionResourceToReleaseItemRelCmd ::= SEQUENCE {
+    pDUSessionID                                PDUSessionID,
+    pDUSessionResourceReleaseCommandTransfer    OCTET STRING (CONTAINING PDUSessionResourceReleaseCommandTransfer),
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceToReleaseItemRelCmd-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) decPDUSessionResourceToReleaseListRelCmd(
+	c *Camper, pdu *[]byte, length int) {
+
+	seqNum := int(readPduByte(pdu)) + 1
+	gnb.dprint("number of sequence: %d", seqNum)
+
+	c.pduSessionReq = nil
+	c.released = nil
+
+	for i := 0; i < seqNum; i++ {
+		readPduByte(pdu) // extension marker and option
+		c.releasePDUSessionReq(gnb.decPDUSessionID(pdu))
+		gnb.decPDUSessionResourceReleaseCommandTransfer(pdu)
+	}
+
+	return
+}
+
+// 9.2.1.4 PDU SESSION RESOURCE RELEASE RESPONSE
+/*
+PDUSessionResourceReleaseResponse ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {PDUSessionResourceReleaseResponseIEs} },
+    ...
+}
+
+PDUSessionResourceReleaseResponseIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                          CRITICALITY ignore  TYPE AMF-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                          CRITICALITY ignore  TYPE RAN-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-PDUSessionResourceReleasedListRelRes    CRITICALITY ignore  TYPE PDUSessionResourceReleasedListRelRes       PRESENCE mandatory  }|
+    { ID id-UserLocationInformation                 CRITICALITY ignore  TYPE UserLocationInformation                    PRESENCE optional       }|
+    { ID id-CriticalityDiagnostics                  CRITICALITY ignore  TYPE CriticalityDiagnostics                     PRESENCE optional       },
+    ...
+}
+*/
+func (gnb *GNB) MakePDUSessionResourceReleaseResponse(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(successfulOutcome, idPDUSessResRelease, reject)
+
+	v := encProtocolIEContainer(3)
+
+	tmp := gnb.encAMFUENGAPID(c)
 	v = append(v, tmp...)
 
-	tmp = gnb.encPDUSessionResourceSetupResponseTransfer(c)
-	bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
-	v = append(v, bf.Value...)
+	tmp = gnb.encRANUENGAPID()
+	v = append(v, tmp...)
+
+	tmp = gnb.encPDUSessionResourceReleasedListRelRes(c)
+	v = append(v, tmp...)
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// PDU Session Resource Released List is defined in
+// 9.2.1.4 PDU SESSION RESOURCE RELEASE RESPONSE
+/*
+PDUSessionResourceReleasedListRelRes ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF PDUSessionResourceReleasedItemRelRes
+
+PDUSessionResourceReleasedItemRelRes ::= SEQUENCE {
+    pDUSessionID                                PDUSessionID,
+    pDUSessionResourceReleaseResponseTransfer   OCTET STRING (CONTAINING PDUSessionResourceReleaseResponseTransfer),
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceReleasedItemRelRes-ExtIEs} }    OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) encPDUSessionResourceReleasedListRelRes(c *Camper) (v []byte) {
+
+	head, _ := encProtocolIE(idPDUSessResRelListRelRes, ignore)
+
+	_, v, _ = per.EncSequenceOf(uint(len(c.pduSessionReq)), 1, 256, false)
+	for _, s := range c.pduSessionReq {
+		bf, _ := per.EncSequence(true, 1, 0)
+		v = append(v, bf.Value...)
+
+		tmp := gnb.encPDUSessionID(s.ID)
+		v = append(v, tmp...)
+
+		tmp = gnb.encPDUSessionResourceReleaseResponseTransfer()
+		bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
+		v = append(v, bf.Value...)
+		v = append(v, tmp...)
+	}
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+
+	return
+}
+
+// 9.2.1.7 PDU SESSION RESOURCE MODIFY REQUEST
+/*
+PDUSessionResourceModifyRequest ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {PDUSessionResourceModifyRequestIEs} },
+    ...
+}
+
+PDUSessionResourceModifyRequestIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                          CRITICALITY reject  TYPE AMF-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                          CRITICALITY reject  TYPE RAN-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RANPagingPriority                       CRITICALITY ignore  TYPE RANPagingPriority                          PRESENCE optional       }|
+    { ID id-PDUSessionResourceModifyListModReq      CRITICALITY reject  TYPE PDUSessionResourceModifyListModReq         PRESENCE mandatory  },
+    ...
+}
+
+PDUSessionResourceModifyListModReq ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF PDUSessionResourceModifyItemModReq
+
+PDUSessionResourceModifyItemModReq ::= SEQUENCE {
+    pDUSessionID                                PDUSessionID,
+    nAS-PDU                                     NAS-PDU                                             OPTIONAL,
+    pDUSessionResourceModifyRequestTransfer     OCTET STRING (CONTAINING PDUSessionResourceModifyRequestTransfer),
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceModifyItemModReq-ExtIEs} }  OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) decPDUSessionResourceModifyListModReq(
+	c *Camper, pdu *[]byte, length int) {
+
+	seqNum := int(readPduByte(pdu)) + 1
+	gnb.dprint("number of sequence: %d", seqNum)
+
+	c.pduSessionReq = nil
+
+	for i := 0; i < seqNum; i++ {
+		// TODO: generic per decoder.
+		// 0000 0000
+		// ^           extension marker
+		//  ^^         options
+		opt := readPduByte(pdu)
+		s := gnb.addPDUSessionReq(c, gnb.decPDUSessionID(pdu))
+		s.qosFlowModified = nil
+
+		if opt&0x40 != 0 {
+			gnb.decNASPDU(c, pdu)
+		}
+		gnb.decPDUSessionResourceModifyRequestTransfer(c, pdu)
+	}
+
+	return
+}
+
+// 9.2.1.8 PDU SESSION RESOURCE MODIFY RESPONSE
+/*
+PDUSessionResourceModifyResponse ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {PDUSessionResourceModifyResponseIEs} },
+    ...
+}
+
+PDUSessionResourceModifyResponseIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                              CRITICALITY ignore  TYPE AMF-UE-NGAP-ID                                 PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                              CRITICALITY ignore  TYPE RAN-UE-NGAP-ID                                 PRESENCE mandatory  }|
+    { ID id-PDUSessionResourceModifyListModRes          CRITICALITY ignore  TYPE PDUSessionResourceModifyListModRes             PRESENCE optional       }|
+    { ID id-PDUSessionResourceFailedToModifyListModRes  CRITICALITY ignore  TYPE PDUSessionResourceFailedToModifyListModRes     PRESENCE optional       }|
+    { ID id-UserLocationInformation                     CRITICALITY ignore  TYPE UserLocationInformation                        PRESENCE optional       }|
+    { ID id-CriticalityDiagnostics                      CRITICALITY ignore  TYPE CriticalityDiagnostics                         PRESENCE optional       },
+    ...
+}
+*/
+func (gnb *GNB) MakePDUSessionResourceModifyResponse(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(successfulOutcome, idPDUSessResModify, reject)
+
+	v := encProtocolIEContainer(3)
+
+	tmp := gnb.encAMFUENGAPID(c)
 	v = append(v, tmp...)
 
-	bf, _ = per.EncLengthDeterminant(len(v), 0, 0)
+	tmp = gnb.encRANUENGAPID()
+	v = append(v, tmp...)
+
+	tmp = gnb.encPDUSessionResourceModifyListModRes(c)
+	v = append(v, tmp...)
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// PDU Session Resource Modify Response List is defined in
+// 9.2.1.8 PDU SESSION RESOURCE MODIFY RESPONSE
+/*
+PDUSessionResourceModifyListModRes ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF PDUSessionResourceModifyItemModRes
+
+PDUSessionResourceModifyItemModRes ::= SEQUENCE {
+    pDUSessionID                                PDUSessionID,
+    pDUSessionResourceModifyResponseTransfer    OCTET STRING (CONTAINING PDUSessionResourceModifyResponseTransfer),
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceModifyItemModRes-ExtIEs} }  OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) encPDUSessionResourceModifyListModRes(c *Camper) (v []byte) {
+
+	head, _ := encProtocolIE(idPDUSessResModListModRes, ignore)
+
+	_, v, _ = per.EncSequenceOf(uint(len(c.pduSessionReq)), 1, 256, false)
+	for _, s := range c.pduSessionReq {
+		bf, _ := per.EncSequence(true, 1, 0)
+		v = append(v, bf.Value...)
+
+		tmp := gnb.encPDUSessionID(s.ID)
+		v = append(v, tmp...)
+
+		tmp = gnb.encPDUSessionResourceModifyResponseTransfer(s)
+		bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
+		v = append(v, bf.Value...)
+		v = append(v, tmp...)
+	}
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
 	head = append(head, bf.Value...)
 	v = append(head, v...)
 
 	return
 }
 
-// 9.2.2.2 INITIAL CONTEXT SETUP RESPONSE
+// 9.2.2.2 INITIAL CONTEXT SETUP RESPONSE
+/*
+InitialContextSetupResponse ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {InitialContextSetupResponseIEs} },
+    ...
+}
+
+InitialContextSetupResponseIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                              CRITICALITY ignore  TYPE AMF-UE-NGAP-ID                                 PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                              CRITICALITY ignore  TYPE RAN-UE-NGAP-ID                                 PRESENCE mandatory  }|
+    { ID id-PDUSessionResourceSetupListCxtRes           CRITICALITY ignore  TYPE PDUSessionResourceSetupListCxtRes              PRESENCE optional       }|
+    { ID id-PDUSessionResourceFailedToSetupListCxtRes   CRITICALITY ignore  TYPE PDUSessionResourceFailedToSetupListCxtRes      PRESENCE optional       }|
+    { ID id-CriticalityDiagnostics                      CRITICALITY ignore  TYPE CriticalityDiagnostics                         PRESENCE optional       },
+    ...
+}
+*/
+func (gnb *GNB) MakeInitialContextSetupResponse(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(successfulOutcome, idInitialContextSetup, reject)
+
+	num := uint(2)
+	if c.pduSessionCxtReq {
+		num++
+	}
+	v := encProtocolIEContainer(num)
+
+	tmp := gnb.encAMFUENGAPID(c)
+	v = append(v, tmp...)
+
+	tmp = gnb.encRANUENGAPID()
+	v = append(v, tmp...)
+
+	if c.pduSessionCxtReq {
+		tmp = gnb.encPDUSessionResourceSetupListCxtRes(c)
+		v = append(v, tmp...)
+		c.pduSessionCxtReq = false
+	}
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// 9.2.2.4 UE CONTEXT RELEASE REQUEST
+/*
+UEContextReleaseRequest ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseRequest-IEs} },
+    ...
+}
+
+UEContextReleaseRequest-IEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                          CRITICALITY reject  TYPE AMF-UE-NGAP-ID                         PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                          CRITICALITY reject  TYPE RAN-UE-NGAP-ID                         PRESENCE mandatory  }|
+    { ID id-PDUSessionResourceListCxtRelReq         CRITICALITY reject  TYPE PDUSessionResourceListCxtRelReq        PRESENCE optional   }|
+    { ID id-Cause                                   CRITICALITY ignore  TYPE Cause                                  PRESENCE mandatory  },
+    ...
+}
+*/
+func (gnb *GNB) MakeUEContextReleaseRequest(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(initiatingMessage, idUEContextReleaseRequest, ignore)
+
+	v := encProtocolIEContainer(3)
+
+	tmp := gnb.encAMFUENGAPID(c)
+	v = append(v, tmp...)
+
+	tmp = gnb.encRANUENGAPID()
+	v = append(v, tmp...)
+
+	tmp = gnb.encCause(causeRadioNetwork, causeRadioNetworkUserInactivity)
+	v = append(v, tmp...)
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// 9.2.2.5 UE CONTEXT RELEASE COMMAND
+/*
+UEContextReleaseCommand ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseCommand-IEs} },
+    ...
+}
+
+UEContextReleaseCommand-IEs NGAP-PROTOCOL-IES ::= {
+    { ID id-UE-NGAP-IDs     CRITICALITY reject  TYPE UE-NGAP-IDs    PRESENCE mandatory  }|
+    { ID id-Cause           CRITICALITY ignore  TYPE Cause          PRESENCE mandatory  },
+    ...
+}
+
+UE-NGAP-IDs ::= CHOICE {
+    uE-NGAP-ID-pair     UE-NGAP-ID-pair,
+    aMF-UE-NGAP-ID      AMF-UE-NGAP-ID,
+    choice-Extensions       ProtocolIE-SingleContainer { {UE-NGAP-IDs-ExtIEs} }
+}
+
+UE-NGAP-ID-pair ::= SEQUENCE{
+    aMF-UE-NGAP-ID      AMF-UE-NGAP-ID,
+    rAN-UE-NGAP-ID      RAN-UE-NGAP-ID,
+    iE-Extensions       ProtocolExtensionContainer { {UE-NGAP-ID-pair-ExtIEs} } OPTIONAL,
+    ...
+}
+*/
+const (
+	ueNGAPIDPair = iota
+	ueNGAPIDAMFOnly
+)
+
+func (gnb *GNB) decUENGAPIDs(pdu *[]byte, length int) (c *Camper, err error) {
+
+	v := readPduByteSlice(pdu, length)
+
+	// TODO: generic per decoder.
+	// 0000 0000
+	// ^^          choice
+	//   ^         extension marker (UE-NGAP-ID-pair)
+	//    ^        option (UE-NGAP-ID-pair)
+	//     ^^^     length of AMF-UE-NGAP-ID
+	choice := v[0] >> 6
+	switch choice {
+	case ueNGAPIDPair:
+		amfIDLen := int((v[0]>>1)&0x7) + 1
+		v = v[1:]
+		amfID := readUint(v[:amfIDLen])
+		v = v[amfIDLen:]
+
+		// ^^          length of RAN-UE-NGAP-ID
+		ranIDLen := int(v[0]>>6) + 1
+		v = v[1:]
+		ranID := readUint(v[:ranIDLen])
+
+		gnb.dprint("AMF-UE-NGAP-ID: %d", amfID)
+		gnb.dprint("RAN-UE-NGAP-ID: %d", ranID)
+		c = gnb.LookupCamperByRanId(uint32(ranID))
+	case ueNGAPIDAMFOnly:
+		amfIDLen := int((v[0]>>3)&0x7) + 1
+		v = v[1:]
+		amfID := readUint(v[:amfIDLen])
+
+		gnb.dprint("AMF-UE-NGAP-ID: %d", amfID)
+		c = gnb.LookupCamperByAmfId(uint32(amfID))
+	}
+
+	if c == nil {
+		err = fmt.Errorf("cannot find camper for UE-NGAP-IDs: %02x", v)
+	}
+	return
+}
+
+// 9.2.2.6 UE CONTEXT RELEASE COMPLETE
 /*
-InitialContextSetupResponse ::= SEQUENCE {
-    protocolIEs     ProtocolIE-Container        { {InitialContextSetupResponseIEs} },
+UEContextReleaseComplete ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseComplete-IEs} },
     ...
 }
 
-InitialContextSetupResponseIEs NGAP-PROTOCOL-IES ::= {
+UEContextReleaseComplete-IEs NGAP-PROTOCOL-IES ::= {
     { ID id-AMF-UE-NGAP-ID                              CRITICALITY ignore  TYPE AMF-UE-NGAP-ID                                 PRESENCE mandatory  }|
     { ID id-RAN-UE-NGAP-ID                              CRITICALITY ignore  TYPE RAN-UE-NGAP-ID                                 PRESENCE mandatory  }|
-    { ID id-PDUSessionResourceSetupListCxtRes           CRITICALITY ignore  TYPE PDUSessionResourceSetupListCxtRes              PRESENCE optional       }|
-    { ID id-PDUSessionResourceFailedToSetupListCxtRes   CRITICALITY ignore  TYPE PDUSessionResourceFailedToSetupListCxtRes      PRESENCE optional       }|
-    { ID id-CriticalityDiagnostics                      CRITICALITY ignore  TYPE CriticalityDiagnostics                         PRESENCE optional       },
+    { ID id-UserLocationInformation                     CRITICALITY ignore  TYPE UserLocationInformation                        PRESENCE optional   }|
+    { ID id-InfoOnRecommendedCellsAndRANNodesForPaging  CRITICALITY ignore  TYPE InfoOnRecommendedCellsAndRANNodesForPaging     PRESENCE optional   }|
+    { ID id-PDUSessionResourceListCxtRelCpl             CRITICALITY reject  TYPE PDUSessionResourceListCxtRelCpl                PRESENCE optional   }|
+    { ID id-CriticalityDiagnostics                      CRITICALITY ignore  TYPE CriticalityDiagnostics                         PRESENCE optional   },
     ...
 }
 */
-func (gnb *GNB) MakeInitialContextSetupResponse(ue *nas.UE) (pdu []byte) {
+func (gnb *GNB) MakeUEContextReleaseComplete(ue *nas.UE) (pdu []byte) {
 
 	c := gnb.LookupCamperByUE(ue)
 
-	pdu = encNgapPdu(successfulOutcome, idInitialContextSetup, reject)
+	pdu = encNgapPdu(successfulOutcome, idUEContextRelease, reject)
 
 	v := encProtocolIEContainer(2)
 
@@ -421,10 +1005,18 @@ InitialUEMessage-IEs NGAP-PROTOCOL-IES ::= {
 func (gnb *GNB) MakeInitialUEMessage(ue *nas.UE) (pdu []byte) {
 
 	c := gnb.LookupCamperByUE(ue)
+	c.RRCstate = RRC_CONNECTED
 
 	pdu = encNgapPdu(initiatingMessage, idInitialUEMessage, ignore)
 
-	v := encProtocolIEContainer(5)
+	// 5G-S-TMSI is provided by the UE returning from CM-IDLE.
+	stmsi := ue.FiveGSTMSI()
+
+	num := uint(5)
+	if stmsi != nil {
+		num++
+	}
+	v := encProtocolIEContainer(num)
 
 	tmp := gnb.encRANUENGAPID()
 	v = append(v, tmp...)
@@ -435,9 +1027,14 @@ func (gnb *GNB) MakeInitialUEMessage(ue *nas.UE) (pdu []byte) {
 	tmp, _ = gnb.encUserLocationInformation(reject)
 	v = append(v, tmp...)
 
-	tmp, _ = gnb.encRRCEstablishmentCause(rrcMoSignalling)
+	tmp, _ = gnb.encRRCEstablishmentCause(rrcEstablishmentCause(ue))
 	v = append(v, tmp...)
 
+	if stmsi != nil {
+		tmp = gnb.encFiveGSTMSI(stmsi)
+		v = append(v, tmp...)
+	}
+
 	tmp, _ = gnb.encUEContextRequest()
 	v = append(v, tmp...)
 
@@ -585,21 +1182,29 @@ UnsuccessfulOutcome ::= SEQUENCE {
 */
 
 const (
-	idDownlinkNASTransport = 4
-	idInitialContextSetup  = 14
-	idInitialUEMessage     = 15
-	idNGSetup              = 21
-	idPDUSessResSetup      = 29
-	idUplinkNASTransport   = 46
+	idDownlinkNASTransport    = 4
+	idInitialContextSetup     = 14
+	idInitialUEMessage        = 15
+	idNGSetup                 = 21
+	idPDUSessResModify        = 26
+	idPDUSessResRelease       = 28
+	idPDUSessResSetup         = 29
+	idUEContextRelease        = 41
+	idUEContextReleaseRequest = 42
+	idUplinkNASTransport      = 46
 )
 
 var procCodeStr = map[int]string{
-	idDownlinkNASTransport: "id-DownlinkNASTransport",
-	idInitialContextSetup:  "id-InitialContextSetup",
-	idInitialUEMessage:     "id-InitialUEMessage",
-	idNGSetup:              "id-NGSetup",
-	idPDUSessResSetup:      "id-PDUSessionResourceSetup",
-	idUplinkNASTransport:   "id-UplinkNASTransport",
+	idDownlinkNASTransport:    "id-DownlinkNASTransport",
+	idInitialContextSetup:     "id-InitialContextSetup",
+	idInitialUEMessage:        "id-InitialUEMessage",
+	idNGSetup:                 "id-NGSetup",
+	idPDUSessResModify:        "id-PDUSessionResourceModify",
+	idPDUSessResRelease:       "id-PDUSessionResourceRelease",
+	idPDUSessResSetup:         "id-PDUSessionResourceSetup",
+	idUEContextRelease:        "id-UEContextRelease",
+	idUEContextReleaseRequest: "id-UEContextReleaseRequest",
+	idUplinkNASTransport:      "id-UplinkNASTransport",
 }
 
 const (
@@ -730,20 +1335,33 @@ func (gnb *GNB) decProtocolIE(c *Camper, pdu *[]byte) (c2 *Camper, err error) {
 	switch id {
 	case idAMFUENGAPID: //10
 		c2, err = gnb.decAMFUENGAPID(pdu, length)
+	case idCause: // 15
+		gnb.decCause(pdu, length)
 	case idNASPDU: // 38
 		gnb.decNASPDU(c, pdu)
+	case idPDUSessResModListModReq: // 64
+		gnb.decPDUSessionResourceModifyListModReq(c, pdu, length)
 	case idPDUSessResSetupListCxtReq: // 71
 		gnb.decPDUSessionResourceSetupListCtxReq(c, pdu, length)
+		if c != nil {
+			c.pduSessionCxtReq = true
+		}
 	case idPDUSessResSetupListSUReq: // 74
 		gnb.decPDUSessionResourceSetupListSUReq(c, pdu, length)
+	case idPDUSessResToRelListRelCmd: // 79
+		gnb.decPDUSessionResourceToReleaseListRelCmd(c, pdu, length)
 	case idRANUENGAPID: // 85
 		c2, err = gnb.decRANUENGAPID(c, pdu, length)
+	case idUENGAPIDs: // 114
+		c2, err = gnb.decUENGAPIDs(pdu, length)
 	case idPDUSessionType: // 134
 		gnb.decPDUSessionType(pdu, length)
+	case idQosFlowAddOrModifyReqList: // 135
+		err = gnb.decQosFlowAddOrModifyRequestList(c, pdu, length)
 	case idQosFlowSetupRequestList: // 136
-		gnb.decQosFlowSetupRequestList(c, pdu, length)
+		err = gnb.decQosFlowSetupRequestList(c, pdu, length)
 	case idULNGUUPTNLInformation: // 139
-		gnb.decUPTransportLayerInformation(pdu, length)
+		err = gnb.decUPTransportLayerInformation(c, pdu, length)
 	default:
 		dump := readPduByteSlice(pdu, length)
 		// gnb.DecodeError = fmt.Errorf("ngap: docoding id(%d) not supported yet.", id)
@@ -754,6 +1372,80 @@ func (gnb *GNB) decProtocolIE(c *Camper, pdu *[]byte) (c2 *Camper, err error) {
 	return
 }
 
+// 9.3.1.2 Cause
+/*
+Cause ::= CHOICE {
+    radioNetwork        CauseRadioNetwork,
+    transport           CauseTransport,
+    nas                 CauseNas,
+    protocol            CauseProtocol,
+    misc                CauseMisc,
+    choice-Extensions       ProtocolIE-SingleContainer { {Cause-ExtIEs} }
+}
+*/
+const (
+	causeRadioNetwork = iota
+	causeTransport
+	causeNas
+	causeProtocol
+	causeMisc
+)
+
+var causeStr = map[int]string{
+	causeRadioNetwork: "radioNetwork",
+	causeTransport:    "transport",
+	causeNas:          "nas",
+	causeProtocol:     "protocol",
+	causeMisc:         "misc",
+}
+
+// the largest value in the root of each cause enumeration.
+var causeMax = map[int]uint{
+	causeRadioNetwork: 44,
+	causeTransport:    1,
+	causeNas:          3,
+	causeProtocol:     6,
+	causeMisc:         5,
+}
+
+const (
+	causeRadioNetworkUserInactivity = 20
+)
+
+func (gnb *GNB) encCause(group int, value uint) (v []byte) {
+
+	head, _ := encProtocolIE(idCause, ignore)
+
+	b, _, _ := per.EncChoice(group, 0, 5, false)
+	b2, _, _ := per.EncEnumerated(value, 0, causeMax[group], true)
+	b = per.MergeBitField(b, b2)
+	v = b.Value
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+	return
+}
+
+func (gnb *GNB) decCause(pdu *[]byte, length int) {
+
+	v := readPduByteSlice(pdu, length)
+
+	// TODO: generic per decoder.
+	// 0000 0000
+	// ^^^         choice
+	//    ^        extension marker
+	//     ^^^^... value
+	group := int(v[0] >> 5)
+	val := uint16(v[0]) << 8
+	if len(v) > 1 {
+		val |= uint16(v[1])
+	}
+	value := (val << 4) >> (16 - bits.Len(causeMax[group]))
+	gnb.dprint("Cause: %s (%d)", causeStr[group], value)
+	return
+}
+
 // 9.3.1.5 Global RAN Node ID
 /*
   It returns only GNB-ID for now.
@@ -927,14 +1619,27 @@ QosFlowLevelQosParameters ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) decQosFlowLevelQosParameters(item *per.BitField) {
-	// 0000 0000
-	// ^         extension marker
-	//  ^^^ ^    optional bit
-	//
-	gnb.dprinti("Qos Flow Level Qos Prameters: not supported yet")
-	gnb.decQosCharacteristics(item)
-	gnb.decAllocationAndRetentionPriority(item)
+func (gnb *GNB) decQosFlowLevelQosParameters(r *per.Reader) {
+
+	ext, opt := r.DecSequence(true, 4)
+	gnb.dprinti("Qos Flow Level Qos Parameters")
+	gnb.decQosCharacteristics(r)
+	gnb.decAllocationAndRetentionPriority(r)
+	if opt&0x8 != 0 {
+		gnb.decGBRQosInformation(r)
+	}
+	if opt&0x4 != 0 {
+		r.DecEnumerated(0, 0, true) // ReflectiveQosAttribute
+	}
+	if opt&0x2 != 0 {
+		r.DecEnumerated(0, 0, true) // AdditionalQosFlowInformation
+	}
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
+	}
 
 	return
 }
@@ -1013,8 +1718,69 @@ AllocationAndRetentionPriority ::= SEQUENCE {
     iE-Extensions       ProtocolExtensionContainer { {AllocationAndRetentionPriority-ExtIEs} } OPTIONAL,
     ...
 }
+
+PriorityLevelARP ::= INTEGER (1..15)
+Pre-emptionCapability ::= ENUMERATED {shall-not-trigger-pre-emption, may-trigger-pre-emption, ...}
+Pre-emptionVulnerability ::= ENUMERATED {not-pre-emptable, pre-emptable, ...}
+*/
+func (gnb *GNB) decAllocationAndRetentionPriority(r *per.Reader) {
+
+	ext, opt := r.DecSequence(true, 1)
+	prio := r.DecInteger(1, 15, false)
+	r.DecEnumerated(0, 1, true) // Pre-emptionCapability
+	r.DecEnumerated(0, 1, true) // Pre-emptionVulnerability
+	gnb.dprinti("Allocation and Retention Priority: priority level: %d", prio)
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
+	}
+
+	return
+}
+
+// 9.3.1.20 GBR QoS Flow Information
+/*
+GBR-QosInformation ::= SEQUENCE {
+    maximumFlowBitRateDL        BitRate,
+    maximumFlowBitRateUL        BitRate,
+    guaranteedFlowBitRateDL     BitRate,
+    guaranteedFlowBitRateUL     BitRate,
+    notificationControl         NotificationControl                                 OPTIONAL,
+    maximumPacketLossRateDL     PacketLossRate                                      OPTIONAL,
+    maximumPacketLossRateUL     PacketLossRate                                      OPTIONAL,
+    iE-Extensions       ProtocolExtensionContainer { {GBR-QosInformation-ExtIEs} }  OPTIONAL,
+    ...
+}
+
+BitRate ::= INTEGER (0..4000000000000, ...)
+PacketLossRate ::= INTEGER (0..1000, ...)
+NotificationControl ::= ENUMERATED {notification-requested, ...}
 */
-func (gnb *GNB) decAllocationAndRetentionPriority(item *per.BitField) {
+func (gnb *GNB) decGBRQosInformation(r *per.Reader) {
+
+	ext, opt := r.DecSequence(true, 4)
+	for i := 0; i < 4; i++ {
+		r.DecInteger(0, 4000000000000, true)
+	}
+	if opt&0x8 != 0 {
+		r.DecEnumerated(0, 0, true)
+	}
+	if opt&0x4 != 0 {
+		r.DecInteger(0, 1000, true)
+	}
+	if opt&0x2 != 0 {
+		r.DecInteger(0, 1000, true)
+	}
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
+	}
+	gnb.dprinti("GBR Qos Information")
+
 	return
 }
 
@@ -1071,7 +1837,8 @@ GTPTunnel ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) encUPTransportLayerInformation(pre *per.BitField) (pdu []byte) {
+func (gnb *GNB) encUPTransportLayerInformation(
+	s *PDUSessionResource, pre *per.BitField) (pdu []byte) {
 
 	const gTPTunnel = 0
 	bf, _, _ := per.EncChoice(gTPTunnel, 0, 1, false)
@@ -1087,13 +1854,14 @@ func (gnb *GNB) encUPTransportLayerInformation(pre *per.BitField) (pdu []byte) {
 	tmp := gnb.encTransportLayerAddress(pre)
 	pdu = append(pdu, tmp...)
 
-	tmp = gnb.encGTPTEID()
+	tmp = gnb.encGTPTEID(s.LocalTEID)
 	pdu = append(pdu, tmp...)
 
 	return
 }
 
-func (gnb *GNB) decUPTransportLayerInformation(pdu *[]byte, length int) {
+func (gnb *GNB) decUPTransportLayerInformation(
+	c *Camper, pdu *[]byte, length int) (err error) {
 
 	var tli per.BitField
 	tli.Value = readPduByteSlice(pdu, length)
@@ -1108,8 +1876,12 @@ func (gnb *GNB) decUPTransportLayerInformation(pdu *[]byte, length int) {
 	tli = per.ShiftLeft(tli, 3) // skip the above bits
 	tli.Len -= 3
 
-	gnb.decTransportLayerAddress(&tli)
-	gnb.decGTPTEID(&tli.Value)
+	s := c.lastPDUSessionReq()
+	if s == nil {
+		return fmt.Errorf("UPTransportLayerInformation: no PDU Session ID")
+	}
+	s.PeerAddr = gnb.decTransportLayerAddress(&tli)
+	s.PeerTEID = gnb.decGTPTEID(&tli.Value)
 
 	return
 }
@@ -1137,7 +1909,7 @@ func (gnb *GNB) encTransportLayerAddress(pre *per.BitField) (pdu []byte) {
 	return
 }
 
-func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
+func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) (addr net.IP) {
 
 	gnb.dprint("Transport Layer Address")
 
@@ -1152,11 +1924,9 @@ func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
 
 	*tla = per.ShiftLeft(*tla, tla.Len%8) // skip remaining preamble
 
-	var addr net.IP
 	octLen := int((length-1)/8 + 1)
 	addr = readPduByteSlice(&tla.Value, octLen)
 	gnb.dprinti("address: %v", addr)
-	gnb.Recv.GTPuPeerAddr = addr
 
 	return
 }
@@ -1165,28 +1935,23 @@ func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
 /*
 GTP-TEID ::= OCTET STRING (SIZE(4))
 */
-func (gnb *GNB) encGTPTEID() (pdu []byte) {
+func (gnb *GNB) encGTPTEID(id uint32) (pdu []byte) {
 
 	const min = 4
 	const max = 4
 	const extmark = false
 
 	teid := make([]byte, 4)
-	// 999 for now, should be a random value.
-	if gnb.GTPuTEID == 0 {
-		gnb.GTPuTEID = rand.Uint32()
-	}
-	binary.BigEndian.PutUint32(teid, gnb.GTPuTEID)
+	binary.BigEndian.PutUint32(teid, id)
 	_, pdu, _ = per.EncOctetString(teid, min, max, extmark)
 
 	return
 }
 
-func (gnb *GNB) decGTPTEID(pdu *[]byte) {
+func (gnb *GNB) decGTPTEID(pdu *[]byte) (id uint32) {
 
-	id := readPduUint32(pdu)
+	id = readPduUint32(pdu)
 	gnb.dprint("GTP TEID: %d", id)
-	gnb.Recv.GTPuPeerTEID = id
 
 	return
 }
@@ -1201,7 +1966,7 @@ QosFlowPerTNLInformation ::= SEQUENCE {
 }
 */
 func (gnb *GNB) encQosFlowPerTNLInformation(
-	c *Camper, pre *per.BitField) (pdu []byte) {
+	s *PDUSessionResource, pre *per.BitField) (pdu []byte) {
 
 	bf, _ := per.EncSequence(true, 1, 0)
 	if pre != nil { // has inherited preamble
@@ -1209,10 +1974,10 @@ func (gnb *GNB) encQosFlowPerTNLInformation(
 	}
 	pre = &bf
 
-	tmp := gnb.encUPTransportLayerInformation(pre)
+	tmp := gnb.encUPTransportLayerInformation(s, pre)
 	pdu = append(pdu, tmp...)
 
-	tmp = gnb.encAssociatedQosFlowList(c)
+	tmp = gnb.encAssociatedQosFlowList(s)
 	pdu = append(pdu, tmp...)
 
 	return
@@ -1350,15 +2115,14 @@ func (gnb *GNB) decSNSSAI(pdu *[]byte) {
 /*
 PDUSessionID ::= INTEGER (0..255)
 */
-func (gnb *GNB) encPDUSessionID(c *Camper) (pdu []byte) {
-	_, pdu, _ = per.EncInteger(int64(c.PDUSessionID), 0, 255, false)
+func (gnb *GNB) encPDUSessionID(id uint8) (pdu []byte) {
+	_, pdu, _ = per.EncInteger(int64(id), 0, 255, false)
 	return
 }
 
-func (gnb *GNB) decPDUSessionID(c *Camper, pdu *[]byte) (val int) {
-	val = int(readPduByte(pdu))
-	gnb.dprinti("PDU Session ID: %d", val)
-	c.PDUSessionID = uint8(val)
+func (gnb *GNB) decPDUSessionID(pdu *[]byte) (id uint8) {
+	id = readPduByte(pdu)
+	gnb.dprinti("PDU Session ID: %d", id)
 	return
 }
 
@@ -1366,27 +2130,20 @@ func (gnb *GNB) decPDUSessionID(c *Camper, pdu *[]byte) (val int) {
 /*
 QosFlowIdentifier ::= INTEGER (0..63, ...)
 */
-func (gnb *GNB) encQosFlowIdentifier(c *Camper) (bf per.BitField) {
+func (gnb *GNB) encQosFlowIdentifier(id uint8) (bf per.BitField) {
 
 	const min = 0
 	const max = 63
 	const extmark = true
-	bf, _, _ = per.EncInteger(int64(c.QosFlowID), min, max, extmark)
+	bf, _, _ = per.EncInteger(int64(id), min, max, extmark)
 
 	return
 }
 
-func (gnb *GNB) decQosFlowIdentifier(c *Camper, item *per.BitField) {
+func (gnb *GNB) decQosFlowIdentifier(r *per.Reader) (id uint8) {
 
-	// TODO: generic per decoder.
-	// 000 0000
-	// ^        extension marker
-	//  ^^ ^^^^ integer
-	id := item.Value[0]
-	id >>= 1
-	item.Len -= 7
+	id = uint8(r.DecInteger(0, 63, true))
 	gnb.dprinti("Qos Flow Identifier: %d", id)
-	c.QosFlowID = id
 	return
 }
 
@@ -1446,20 +2203,20 @@ AssociatedQosFlowItem ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) encAssociatedQosFlowList(c *Camper) (pdu []byte) {
+func (gnb *GNB) encAssociatedQosFlowList(s *PDUSessionResource) (pdu []byte) {
 
 	const min = 1
 	const max = 64
 	const extmark = false
 
 	bf, _, _ := per.EncSequenceOf(1, min, max, extmark)
-	pdu = gnb.encAssociatedQosFlowItem(c, &bf)
+	pdu = gnb.encAssociatedQosFlowItem(s, &bf)
 
 	return
 }
 
 func (gnb *GNB) encAssociatedQosFlowItem(
-	c *Camper, pre *per.BitField) (pdu []byte) {
+	s *PDUSessionResource, pre *per.BitField) (pdu []byte) {
 
 	const optnum = 2
 	const optflag = 0
@@ -1469,7 +2226,7 @@ func (gnb *GNB) encAssociatedQosFlowItem(
 	if pre != nil {
 		bf = per.MergeBitField(*pre, bf)
 	}
-	bf2 := gnb.encQosFlowIdentifier(c)
+	bf2 := gnb.encQosFlowIdentifier(s.QosFlowID)
 	bf = per.MergeBitField(bf, bf2)
 	pdu = bf.Value
 
@@ -1506,6 +2263,31 @@ const (
 	rrcMcsPriorityAccess
 )
 
+func rrcEstablishmentCause(ue *nas.UE) uint {
+
+	// the emergency registration
+	if ue.Emergency && ue.MMstate == nas.MMRegisteredInitiated {
+		return rrcEmergency
+	}
+
+	if ue.MMstate != nas.MMServiceRequestInitiated {
+		return rrcMoSignalling
+	}
+
+	switch ue.ServiceType() {
+	case nas.ServiceTypeData:
+		return rrcMoData
+	case nas.ServiceTypeMobileTerminatedServices:
+		return rrcMtAccess
+	case nas.ServiceTypeEmergencyServices,
+		nas.ServiceTypeEmergencyServicesFallback:
+		return rrcEmergency
+	case nas.ServiceTypeHighPriorityAccess:
+		return rrcHighPriorityAccess
+	}
+	return rrcMoSignalling
+}
+
 func (gnb *GNB) encRRCEstablishmentCause(cause uint) (v []byte, err error) {
 
 	head, err := encProtocolIE(idRRCEstablishmentCause, ignore)
@@ -1591,6 +2373,39 @@ func (gnb *GNB) decRANUENGAPID(
 	return
 }
 
+// 9.3.3.20 5G-S-TMSI
+/*
+FiveG-S-TMSI ::= SEQUENCE {
+    aMFSetID        AMFSetID,
+    aMFPointer      AMFPointer,
+    fiveG-TMSI      FiveG-TMSI,
+    iE-Extensions       ProtocolExtensionContainer { { FiveG-S-TMSI-ExtIEs} } OPTIONAL,
+    ...
+}
+
+AMFSetID ::= BIT STRING (SIZE(10))
+AMFPointer ::= BIT STRING (SIZE(6))
+FiveG-TMSI ::= OCTET STRING (SIZE(4))
+*/
+func (gnb *GNB) encFiveGSTMSI(stmsi []byte) (v []byte) {
+
+	head, _ := encProtocolIE(idFiveGSTMSI, reject)
+
+	// AMF Set ID and AMF Pointer are packed in the first 2 octets
+	// of 5G-S-TMSI in NAS as well.
+	b, _ := per.EncSequence(true, 1, 0)
+	var ids per.BitField
+	ids.Value = stmsi[:2]
+	ids.Len = 16
+	b = per.MergeBitField(b, ids)
+	v = append(b.Value, stmsi[2:]...)
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+	return
+}
+
 // 9.3.3.4 NAS-PDU
 /*
 NAS-PDU ::= OCTET STRING
@@ -1691,6 +2506,124 @@ func (gnb *GNB) decPDUSessionResourceSetupRequestTransfer(
 	return
 }
 
+// 9.3.4.3 PDU Session Resource Modify Request Transfer
+/*
+PDUSessionResourceModifyRequestTransfer ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {PDUSessionResourceModifyRequestTransferIEs} },
+    ...
+}
+
+PDUSessionResourceModifyRequestTransferIEs NGAP-PROTOCOL-IES ::= {
+    { ID id-PDUSessionAggregateMaximumBitRate       CRITICALITY reject  TYPE PDUSessionAggregateMaximumBitRate          PRESENCE optional   }|
+    { ID id-UL-NGU-UP-TNLModifyList                 CRITICALITY reject  TYPE UL-NGU-UP-TNLModifyList                    PRESENCE optional   }|
+    { ID id-NetworkInstance                         CRITICALITY reject  TYPE NetworkInstance                            PRESENCE optional   }|
+    { ID id-QosFlowAddOrModifyRequestList           CRITICALITY reject  TYPE QosFlowAddOrModifyRequestList              PRESENCE optional   }|
+    { ID id-QosFlowToReleaseList                    CRITICALITY reject  TYPE QosFlowListWithCause                       PRESENCE optional   }|
+    { ID id-AdditionalUL-NGU-UP-TNLInformation      CRITICALITY reject  TYPE UPTransportLayerInformationList            PRESENCE optional   }|
+    { ID id-CommonNetworkInstance                   CRITICALITY ignore  TYPE CommonNetworkInstance                      PRESENCE optional   },
+    ...
+}
+*/
+func (gnb *GNB) decPDUSessionResourceModifyRequestTransfer(
+	c *Camper, pdu *[]byte) {
+
+	gnb.dprint("PDU Session Resource Modify Request Transfer")
+	length, _ := per.DecLengthDeterminant(pdu, 0)
+	pdu2 := readPduByteSlice(pdu, length)
+	gnb.decProtocolIEContainer(c, &pdu2)
+
+	return
+}
+
+// 9.3.4.4 PDU Session Resource Modify Response Transfer
+/*
+PDUSessionResourceModifyResponseTransfer ::= SEQUENCE {
+    dL-NGU-UP-TNLInformation                UPTransportLayerInformation                                         OPTIONAL,
+    uL-NGU-UP-TNLInformation                UPTransportLayerInformation                                         OPTIONAL,
+    qosFlowAddOrModifyResponseList          QosFlowAddOrModifyResponseList                                      OPTIONAL,
+    additionalDLQosFlowPerTNLInformation    QosFlowPerTNLInformationList                                        OPTIONAL,
+    qosFlowFailedToAddOrModifyList          QosFlowListWithCause                                                OPTIONAL,
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceModifyResponseTransfer-ExtIEs} }    OPTIONAL,
+    ...
+}
+
+QosFlowAddOrModifyResponseList ::= SEQUENCE (SIZE(1..maxnoofQosFlows)) OF QosFlowAddOrModifyResponseItem
+
+QosFlowAddOrModifyResponseItem ::= SEQUENCE {
+    qosFlowIdentifier       QosFlowIdentifier,
+    iE-Extensions       ProtocolExtensionContainer { {QosFlowAddOrModifyResponseItem-ExtIEs} } OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) encPDUSessionResourceModifyResponseTransfer(
+	s *PDUSessionResource) (pdu []byte) {
+
+	if len(s.qosFlowModified) == 0 {
+		bf, _ := per.EncSequence(true, 6, 0)
+		pdu = bf.Value
+		return
+	}
+
+	const maxnoofQosFlows = 64
+	bf, _ := per.EncSequence(true, 6, 0x08)
+	bf2, _, _ := per.EncSequenceOf(uint(len(s.qosFlowModified)),
+		1, maxnoofQosFlows, false)
+	bf = per.MergeBitField(bf, bf2)
+
+	for _, qfi := range s.qosFlowModified {
+		bf2, _ = per.EncSequence(true, 1, 0)
+		bf = per.MergeBitField(bf, bf2)
+		bf2, _, _ = per.EncInteger(int64(qfi), 0, 63, true)
+		bf = per.MergeBitField(bf, bf2)
+	}
+	pdu = bf.Value
+
+	return
+}
+
+// 9.3.4.12 PDU Session Resource Release Command Transfer
+/*
+PDUSessionResourceReleaseCommandTransfer ::= SEQUENCE {
+    cause                   Cause,
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceReleaseCommandTransfer-ExtIEs} }    OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) decPDUSessionResourceReleaseCommandTransfer(pdu *[]byte) {
+
+	gnb.dprint("PDU Session Resource Release Command Transfer")
+	length := int(readPduByte(pdu))
+	v := readPduByteSlice(pdu, length)
+
+	// skip the extension marker and the option bit of the sequence
+	// so that the cause starts from the top of the first octet.
+	cause := make([]byte, len(v))
+	for i := range v {
+		cause[i] = v[i] << 2
+		if i+1 < len(v) {
+			cause[i] |= v[i+1] >> 6
+		}
+	}
+	gnb.decCause(&cause, len(cause))
+
+	return
+}
+
+// 9.3.4.21 PDU Session Resource Release Response Transfer
+/*
+PDUSessionResourceReleaseResponseTransfer ::= SEQUENCE {
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceReleaseResponseTransfer-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) encPDUSessionResourceReleaseResponseTransfer() (pdu []byte) {
+
+	bf, _ := per.EncSequence(true, 1, 0)
+	pdu = bf.Value
+
+	return
+}
+
 // 9.3.4.2 PDU Session Resource Setup Response Transfer
 /*
 PDUSessionResourceSetupResponseTransfer ::= SEQUENCE {
@@ -1703,11 +2636,11 @@ PDUSessionResourceSetupResponseTransfer ::= SEQUENCE {
 }
 */
 func (gnb *GNB) encPDUSessionResourceSetupResponseTransfer(
-	c *Camper) (pdu []byte) {
+	s *PDUSessionResource) (pdu []byte) {
 
 	bf, _ := per.EncSequence(true, 4, 0)
 	pre := &bf
-	pdu = gnb.encQosFlowPerTNLInformation(c, pre)
+	pdu = gnb.encQosFlowPerTNLInformation(s, pre)
 
 	return
 }
@@ -1736,6 +2669,8 @@ func (gnb *GNB) decPDUSessionResourceSetupListCtxReq(c *Camper, pdu *[]byte, len
 	itemNum += 1
 	list.Len = len(list.Value) * 8
 
+	c.pduSessionReq = nil
+
 	for i := 0; i < itemNum; i++ {
 		gnb.dprint("Item %d", i)
 		gnb.decPDUSessionResourceSetupItemCxtReq(c, &list)
@@ -1768,7 +2703,7 @@ func (gnb *GNB) decPDUSessionResourceSetupItemCxtReq(
 	}
 	*item = per.ShiftLeft(*item, 8)
 
-	gnb.decPDUSessionID(c, &item.Value)
+	gnb.addPDUSessionReq(c, gnb.decPDUSessionID(&item.Value))
 
 	gnb.dprinti("NAS-PDU: %v", hasNasPdu)
 	if hasNasPdu {
@@ -1896,7 +2831,121 @@ QosCharacteristics ::= CHOICE {
     choice-Extensions       ProtocolIE-SingleContainer { {QosCharacteristics-ExtIEs} }
 }
 */
-func (gnb *GNB) decQosCharacteristics(item *per.BitField) {
+func (gnb *GNB) decQosCharacteristics(r *per.Reader) {
+
+	switch r.DecChoice(0, 2, false) {
+	case 0:
+		gnb.decNonDynamic5QIDescriptor(r)
+	case 1:
+		gnb.decDynamic5QIDescriptor(r)
+	default:
+		skipProtocolIESingleContainer(r)
+	}
+
+	return
+}
+
+// 9.3.1.28 Non Dynamic 5QI Descriptor
+/*
+NonDynamic5QIDescriptor ::= SEQUENCE {
+    fiveQI                      FiveQI,
+    priorityLevelQos            PriorityLevelQos                                        OPTIONAL,
+    averagingWindow             AveragingWindow                                         OPTIONAL,
+    maximumDataBurstVolume      MaximumDataBurstVolume                                  OPTIONAL,
+    iE-Extensions       ProtocolExtensionContainer { {NonDynamic5QIDescriptor-ExtIEs} } OPTIONAL,
+    ...
+}
+
+FiveQI ::= INTEGER (0..255, ...)
+PriorityLevelQos ::= INTEGER (1..127, ...)
+AveragingWindow ::= INTEGER (0..4095, ...)
+MaximumDataBurstVolume ::= INTEGER (0..4095, ..., 4096.. 2000000)
+*/
+func (gnb *GNB) decNonDynamic5QIDescriptor(r *per.Reader) {
+
+	ext, opt := r.DecSequence(true, 4)
+	fiveQI := r.DecInteger(0, 255, true)
+	gnb.dprinti("5QI: %d", fiveQI)
+	if opt&0x8 != 0 {
+		r.DecInteger(1, 127, true)
+	}
+	if opt&0x4 != 0 {
+		r.DecInteger(0, 4095, true)
+	}
+	if opt&0x2 != 0 {
+		r.DecInteger(0, 4095, true)
+	}
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
+	}
+
+	return
+}
+
+// 9.3.1.18 Dynamic 5QI Descriptor
+/*
+Dynamic5QIDescriptor ::= SEQUENCE {
+    priorityLevelQos            PriorityLevelQos,
+    packetDelayBudget           PacketDelayBudget,
+    packetErrorRate             PacketErrorRate,
+    fiveQI                      FiveQI                                              OPTIONAL,
+    delayCritical               DelayCritical                                       OPTIONAL,
+    averagingWindow             AveragingWindow                                     OPTIONAL,
+    maximumDataBurstVolume      MaximumDataBurstVolume                              OPTIONAL,
+    iE-Extensions       ProtocolExtensionContainer { {Dynamic5QIDescriptor-ExtIEs} } OPTIONAL,
+    ...
+}
+
+PacketDelayBudget ::= INTEGER (0..1023, ...)
+
+PacketErrorRate ::= SEQUENCE {
+    pERScalar       INTEGER (0..9, ...),
+    pERExponent     INTEGER (0..9, ...),
+    iE-Extensions       ProtocolExtensionContainer { {PacketErrorRate-ExtIEs} } OPTIONAL,
+    ...
+}
+
+DelayCritical ::= ENUMERATED {delay-critical, non-delay-critical, ...}
+*/
+func (gnb *GNB) decDynamic5QIDescriptor(r *per.Reader) {
+
+	ext, opt := r.DecSequence(true, 5)
+	r.DecInteger(1, 127, true)
+	r.DecInteger(0, 1023, true)
+
+	perExt, perOpt := r.DecSequence(true, 1)
+	r.DecInteger(0, 9, true)
+	r.DecInteger(0, 9, true)
+	if perOpt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if perExt {
+		r.SkipExtensions()
+	}
+
+	if opt&0x10 != 0 {
+		fiveQI := r.DecInteger(0, 255, true)
+		gnb.dprinti("5QI: %d", fiveQI)
+	}
+	if opt&0x8 != 0 {
+		r.DecEnumerated(0, 1, true)
+	}
+	if opt&0x4 != 0 {
+		r.DecInteger(0, 4095, true)
+	}
+	if opt&0x2 != 0 {
+		r.DecInteger(0, 4095, true)
+	}
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
+	}
+
 	return
 }
 
@@ -1915,45 +2964,128 @@ QosFlowSetupRequestItem ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) decQosFlowSetupRequestList(c *Camper, pdu *[]byte, length int) {
+func (gnb *GNB) decQosFlowSetupRequestList(
+	c *Camper, pdu *[]byte, length int) (err error) {
 
-	var qoslist per.BitField
-	qoslist.Value = readPduByteSlice(pdu, length)
-	qoslist.Len = len(qoslist.Value) * 8
-	gnb.dprint("dump: %02x", qoslist.Value)
+	r := per.NewReader(readPduByteSlice(pdu, length))
+	s := c.lastPDUSessionReq()
+	if s == nil {
+		return fmt.Errorf("QosFlowSetupRequestList: no PDU Session ID")
+	}
+	itemNum := r.DecSequenceOf(1, 64)
 
-	// TODO: generic per decoder.
-	// 0000 00 00
-	// ^^^^ ^^    sequence of 1-64
-	itemNum := int(qoslist.Value[0])
-	itemNum >>= 2
-	itemNum += 1
+	for i := 0; i < itemNum && r.Err == nil; i++ {
+		gnb.dprint("Item %d", i)
+		qfi := gnb.decQosFlowSetupRequestItem(r)
+		if i == 0 {
+			s.QosFlowID = qfi
+		}
+	}
+
+	if r.Err != nil {
+		err = fmt.Errorf("QosFlowSetupRequestList: %v", r.Err)
+	}
+	return
+}
 
-	qoslist = per.ShiftLeft(qoslist, 6)
-	qoslist.Len -= 6
+func (gnb *GNB) decQosFlowSetupRequestItem(r *per.Reader) (qfi uint8) {
 
-	for i := 0; i < itemNum; i++ {
-		gnb.dprint("Item %d", i)
-		gnb.decQosFlowSetupRequestItem(c, &qoslist)
+	ext, opt := r.DecSequence(true, 2)
+	qfi = gnb.decQosFlowIdentifier(r)
+	gnb.decQosFlowLevelQosParameters(r)
+	if opt&0x2 != 0 {
+		r.DecInteger(0, 15, true) // E-RAB-ID
+	}
+	if opt&0x1 != 0 {
+		skipProtocolExtensionContainer(r)
+	}
+	if ext {
+		r.SkipExtensions()
 	}
 
 	return
 }
 
-func (gnb *GNB) decQosFlowSetupRequestItem(c *Camper, item *per.BitField) {
+// QoS Flow Add or Modify Request List is defined in
+// 9.3.4.3 PDU Session Resource Modify Request Transfer
+/*
+QosFlowAddOrModifyRequestList ::= SEQUENCE (SIZE(1..maxnoofQosFlows)) OF QosFlowAddOrModifyRequestItem
+
+QosFlowAddOrModifyRequestItem ::= SEQUENCE {
+    qosFlowIdentifier               QosFlowIdentifier,
+    qosFlowLevelQosParameters       QosFlowLevelQosParameters                                   OPTIONAL,
+    e-RAB-ID                        E-RAB-ID                                                    OPTIONAL,
+    iE-Extensions       ProtocolExtensionContainer { {QosFlowAddOrModifyRequestItem-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) decQosFlowAddOrModifyRequestList(
+	c *Camper, pdu *[]byte, length int) (err error) {
+
+	r := per.NewReader(readPduByteSlice(pdu, length))
+	s := c.lastPDUSessionReq()
+	if s == nil {
+		return fmt.Errorf("QosFlowAddOrModifyRequestList: no PDU Session ID")
+	}
+	itemNum := r.DecSequenceOf(1, 64)
 
-	// TODO: generic per decoder.
-	// 00 0000 0000
-	// ^            extension marker
-	//  ^ ^         options
-	*item = per.ShiftLeft(*item, 3)
-	item.Len -= 3
-	gnb.decQosFlowIdentifier(c, item)
-	gnb.decQosFlowLevelQosParameters(item)
+	for i := 0; i < itemNum && r.Err == nil; i++ {
+		gnb.dprint("Item %d", i)
+
+		ext, opt := r.DecSequence(true, 3)
+		qfi := gnb.decQosFlowIdentifier(r)
+		if opt&0x4 != 0 {
+			gnb.decQosFlowLevelQosParameters(r)
+		}
+		if opt&0x2 != 0 {
+			r.DecInteger(0, 15, true) // E-RAB-ID
+		}
+		if opt&0x1 != 0 {
+			skipProtocolExtensionContainer(r)
+		}
+		if ext {
+			r.SkipExtensions()
+		}
+		if r.Err == nil {
+			s.qosFlowModified = append(s.qosFlowModified, qfi)
+		}
+	}
 
+	if r.Err != nil {
+		err = fmt.Errorf("QosFlowAddOrModifyRequestList: %v", r.Err)
+	}
 	return
 }
 
+// ProtocolExtensionContainer and ProtocolIE-SingleContainer are defined in
+// 9.4.7 Container Definitions
+/*
+ProtocolExtensionContainer {NGAP-PROTOCOL-EXTENSION : IEsSetParam} ::=
+    SEQUENCE (SIZE (1..maxProtocolExtensions)) OF
+    ProtocolExtensionField {{IEsSetParam}}
+
+ProtocolExtensionField {NGAP-PROTOCOL-EXTENSION : IEsSetParam} ::= SEQUENCE {
+    id                  NGAP-PROTOCOL-EXTENSION.&id             ({IEsSetParam}),
+    criticality         NGAP-PROTOCOL-EXTENSION.&criticality    ({IEsSetParam}{@id}),
+    extensionValue      NGAP-PROTOCOL-EXTENSION.&Extension      ({IEsSetParam}{@id})
+}
+
+ProtocolIE-SingleContainer {NGAP-PROTOCOL-IES : IEsSetParam} ::=
+    ProtocolIE-Field {{IEsSetParam}}
+*/
+func skipProtocolExtensionContainer(r *per.Reader) {
+	n := r.DecSequenceOf(1, 65535)
+	for i := 0; i < n && r.Err == nil; i++ {
+		skipProtocolIESingleContainer(r)
+	}
+}
+
+func skipProtocolIESingleContainer(r *per.Reader) {
+	r.DecConstrainedWholeNumber(0, 65535) // id
+	r.DecEnumerated(0, 2, false)          // criticality
+	r.SkipOpenType()
+}
+
 //-----
 func readPduByte(pdu *[]byte) (val byte) {
 	val = byte((*pdu)[0])
@@ -1973,6 +3105,14 @@ func readPduUint32(pdu *[]byte) (val uint32) {
 	return
 }
 
+// readUint returns the value of big endian octets.
+func readUint(v []byte) (val uint64) {
+	for _, b := range v {
+		val = val<<8 | uint64(b)
+	}
+	return
+}
+
 func readPduByteSlice(pdu *[]byte, length int) (val []byte) {
 	val = (*pdu)[:length]
 	*pdu = (*pdu)[length:]
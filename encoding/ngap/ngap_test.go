@@ -12,12 +12,18 @@ import (
 
 // send message
 var TestNGSetupRequest string = "00150028000003001b00080002f839000000040066001000000000010002f839000010080102030015400100"
-var TestInitialUEMessage string = "000f40470000050055000200000026001d1c7e004179000d0102f8392143000010325476981001202e0480a000000079000f4002f839000004001002f839000001005a4001180070400100"
+var TestInitialUEMessage string = "000f40470000050055000200000026001d1c7e004179000d0102f8392143000010325476981001202e04f0f000000079000f4002f839000004001002f839000001005a4001180070400100"
 var TestULAuthenticationResponse string = "002e403c000004000a0002000100550002000000260016157e00572d10803adcacc364fc000bdc0f65e324eaa10079400f4002f839000004001002f839000001"
 var TestULSecurityModeComplete string = "002e403d000004000a0002000100550002000000260017167e0452a73e0c007e005e7700090500000001000001f10079400f4002f839000004001002f839000001"
 var TestInitialContextSetupResponse string = "200e000f000002000a00020001005500020000"
 var TestULRegistrationComplete string = "002e4031000004000a000200010055000200000026000b0a7e042cbd08cf017e00430079400f4002f839000004001002f839000001"
+var TestUEContextReleaseRequest string = "002a4015000003000a00020001005500020000000f40020500"
+var TestUEContextReleaseComplete string = "2029000f000002000a00020001005500020000"
 var TestPDUSessionResourceSetupResponse string = "201d0024000003000a00020001005500020000004b40110000010d0003e0c0a80103000003e70001"
+var TestPDUSessionResourceSetupResponse2 string = "201d0024000003000a00020001005500020000004b40110000020d0003e0c0a80103000003e80001"
+var TestPDUSessionResourceModifyResponse string = "201a001a000003000a000200010055000200000041400700000103100008"
+var TestPDUSessionResourceModifyResponse2 string = "201a001b000003000a00020001005500020000004140080000010410080404"
+var TestPDUSessionResourceReleaseResponse string = "201c0018000003000a00020001005500020000004640050000010100"
 
 // receive message
 var TestNGSetupResponse string = "20150031000004000100050100414d4600600008000002f839cafe0000564001ff005000100002f839000110080102031008112233"
@@ -25,7 +31,12 @@ var TestDLAuthenticationRequest string = "0004403e000003000a00020001005500020000
 var TestDLSecurityModeCommand string = "00044029000003000a0002000100550002000000260016157e036c2b24e2007e005d02000480a00000e1360100"
 var TestInitialContextSetupRequest string = "000e0080a7000009000a00020001005500020000001c00070002f839cafe000000000a2201010203100811223300770009000004000000000000005e002013663ab7286c9a6af7cba0b1fd9e6ed48045d4356d46ff3944c81c63324fd803002440040002f839002240080000000100ffff0100264036357e02930d75cf017e0242010177000b0202f839cafe000000000154070002f839000001150a040101020304011122335e010616012c"
 var TestInitialContextSetupRequest2 string = "000e0080f500000b000a00020001005500020000006e0008080f4240200f4240001c00070002f839cafe000047002a000001402001020321000003008b000a01f07f00000800000001008600010000880007000000000938000000000a2201010203100811223300770009000000100000000000005e0020473007e30d4d0d77a7073e5b43b909562b7a8c461fc7ef0b73ab4026edbb91aa002440040002f839002240080000000100ffff010026404a497e02809e40eb027e006801003a2e0101c211000901000631310101ff00060103e80103e859322905013c3c0001220401010203790006002041010109250908696e7465726e65741201"
+var TestUEContextReleaseCommand string = "002900100000020072000400010000000f400140"
+var TestPDUSessionResourceModifyRequest string = "001a004f000003000a000200010055000200000040003c004001297e00680100212e0100cb7a0011010003d0ff01020008213103401f90200279000602204101010712010e0000010087000701010000073800"
+var TestPDUSessionResourceModifyRequest2 string = "001a0055000003000a0002000100550002000000400042004001297e00680100212e0100cb7a0011010003d0ff01020008213103401f9020027900060220410101071201140000010087000d05008000093810100000073800"
+var TestPDUSessionResourceReleaseCommand string = "001c002a000004000a000200010055000200000026400e0d7e00680100052e0102d3241201004f00050000010110"
 var TestDLPDUSessionEstablishmentAccept string = "001d006d000003000a00020001005500020000004a005a0040012f7e0222994e9f027e00680100202e0100c21100090100063131010100000601e80301e80359322905013c3c00011201402001020321000003008b000a01f0c0a801120000000100860001000088000700010000093800"
+var TestDLPDUSessionEstablishmentAccept2 string = "001d0066000003000a00020001005500020000004a0053004002287e00680100202e0200c21100090100063131010100000601e80301e80359322905013c3c00021202402001020321000003008b000a01f0c0a801120000000200860001000088000700010000093800"
 
 var TestOpen5gsNGSetupResponse string = "201500320000040001000e05806f70656e3567732d616d663000600008000002f83901004000564001ff005000080002f83900000008"
 var TestOpen5gsDLAuthenticationRequest string = "0004403e000003000a000200020055000200000026002b2a7e00560002000021d231c4098df35d5ea33e62ffad05d2fa2010aaf6a4fd4c3b800059dc4597900d4b1f"
@@ -111,6 +122,24 @@ func TestMakeInitialUEMessage(t *testing.T) {
 	}
 }
 
+func TestRRCEstablishmentCause(t *testing.T) {
+
+	_, ue := initEnv()
+
+	ue.MakeRegistrationRequest()
+	if v := rrcEstablishmentCause(ue); v != rrcMoSignalling {
+		t.Errorf("RRC establishment cause expect: %d, actual: %d",
+			rrcMoSignalling, v)
+	}
+
+	ue.Emergency = true
+	ue.MakeRegistrationRequest()
+	if v := rrcEstablishmentCause(ue); v != rrcEmergency {
+		t.Errorf("RRC establishment cause of emergency registration "+
+			"expect: %d, actual: %d", rrcEmergency, v)
+	}
+}
+
 func TestMakeUplinkNASTransport(t *testing.T) {
 
 	gnb, ue := initEnv()
@@ -152,6 +181,48 @@ func TestMakeUplinkNASTransport(t *testing.T) {
 	}
 }
 
+func TestHandleNAS(t *testing.T) {
+
+	gnb, ue := initEnv()
+	gnb.HandleNAS = true
+	c := gnb.LookupCamperByUE(ue)
+
+	pattern := []struct {
+		in     string
+		expect string
+		event  int
+	}{
+		{TestDLAuthenticationRequest, TestULAuthenticationResponse, 0},
+		{TestDLSecurityModeCommand, TestULSecurityModeComplete, 0},
+		{TestInitialContextSetupRequest, TestULRegistrationComplete,
+			nas.EventRegistered},
+	}
+
+	ue.MakeRegistrationRequest()
+	for _, p := range pattern {
+		recvfromNW(gnb, p.in)
+		ul, events := c.TakeNAS()
+		if len(ul) != 1 {
+			t.Errorf("uplink NAS messages expect: 1, actual: %d", len(ul))
+			continue
+		}
+		gnb.RecvfromUE(ue, &ul[0])
+
+		v := gnb.MakeUplinkNASTransport(ue)
+		expect, _ := hex.DecodeString(p.expect)
+		if reflect.DeepEqual(expect, v) == false {
+			t.Errorf("UplinkNASTransport\nexpect: %x\nactual: %x", expect, v)
+		}
+		if p.event != 0 && (len(events) != 1 || events[0].Type != p.event) {
+			t.Errorf("events expect: %s, actual: %+v",
+				nas.EventStr[p.event], events)
+		}
+	}
+	if ul, events := c.TakeNAS(); ul != nil || events != nil {
+		t.Errorf("TakeNAS is not cleared: %x, %+v", ul, events)
+	}
+}
+
 func TestMakeNGSetupRequest(t *testing.T) {
 
 	gnb, _ := initEnv()
@@ -185,12 +256,26 @@ func TestDecode(t *testing.T) {
 			"free5gc: DL Security Mode Command"},
 		{TestInitialContextSetupRequest,
 			"free5gc: Initial Context Setup Request"},
-		{TestInitialContextSetupRequest2,
-			"free5gc: Initial Context Setup Request #2"},
 		{TestDLPDUSessionEstablishmentAccept,
 			"free5gc: PDU Session Establishment Accept"},
 	}
 
+	// captured in another session. the NAS message has the same NAS COUNT
+	// as PDU Session Establishment Accept, and would be a replay.
+	pattern3 := []struct {
+		in_str string
+		desc   string
+	}{
+		{TestNGSetupResponse,
+			"free5gc: NG Setup Response"},
+		{TestDLAuthenticationRequest,
+			"free5gc: DL Authentication Request"},
+		{TestDLSecurityModeCommand,
+			"free5gc: DL Security Mode Command"},
+		{TestInitialContextSetupRequest2,
+			"free5gc: Initial Context Setup Request #2"},
+	}
+
 	pattern2 := []struct {
 		in_str string
 		desc   string
@@ -225,6 +310,20 @@ func TestDecode(t *testing.T) {
 
 	gnb, ue = initEnv()
 
+	for _, p := range pattern3 {
+		fmt.Printf("---------- test decode: %s\n", p.desc)
+
+		gnb.SetDebugLevel(1)
+		ue.SetDebugLevel(1)
+		recvfromNW(gnb, p.in_str)
+
+		if gnb.DecodeError != nil {
+			t.Errorf("%s: %v", p.desc, gnb.DecodeError)
+		}
+	}
+
+	gnb, ue = initEnv()
+
 	for _, p := range pattern2 {
 		fmt.Printf("---------- test decode: %s\n", p.desc)
 
@@ -237,3 +336,173 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestUEContextRelease(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	pdu := ue.MakeRegistrationRequest()
+	gnb.RecvfromUE(ue, &pdu)
+	gnb.MakeInitialUEMessage(ue)
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	v := gnb.MakeUEContextReleaseRequest(ue)
+	expect, _ := hex.DecodeString(TestUEContextReleaseRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("UEContextReleaseRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	c := gnb.LookupCamperByUE(ue)
+	if c.RRCstate != RRC_CONNECTED {
+		t.Errorf("RRC state before release\nexpect: %d\nactual: %d",
+			RRC_CONNECTED, c.RRCstate)
+	}
+	recvfromNW(gnb, TestUEContextReleaseCommand)
+	if gnb.DecodeError != nil {
+		t.Errorf("UEContextReleaseCommand: %v", gnb.DecodeError)
+	}
+	if c.RRCstate != RRC_IDLE {
+		t.Errorf("RRC state after release\nexpect: %d\nactual: %d",
+			RRC_IDLE, c.RRCstate)
+	}
+
+	v = gnb.MakeUEContextReleaseComplete(ue)
+	expect, _ = hex.DecodeString(TestUEContextReleaseComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("UEContextReleaseComplete\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestPDUSessionResourceRelease(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	pdu := ue.MakeRegistrationRequest()
+	gnb.RecvfromUE(ue, &pdu)
+	gnb.MakeInitialUEMessage(ue)
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	recvfromNW(gnb, TestPDUSessionResourceReleaseCommand)
+	if gnb.DecodeError != nil {
+		t.Errorf("PDUSessionResourceReleaseCommand: %v", gnb.DecodeError)
+	}
+	if ue.PDUSessionReleaseCommanded() == false {
+		t.Errorf("PDU Session Release Command is not delivered to UE")
+	}
+
+	// no resources are allocated for the session not set up.
+	c := gnb.LookupCamperByUE(ue)
+	if c.PDUSession(1) != nil || c.ReleasedPDUSession(1) != nil {
+		t.Errorf("PDU session resources for unknown ID: %+v", c.PDUSessions)
+	}
+
+	v := gnb.MakePDUSessionResourceReleaseResponse(ue)
+	expect, _ := hex.DecodeString(TestPDUSessionResourceReleaseResponse)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionResourceReleaseResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	// the transfer without PDU Session ID is not decoded.
+	c.pduSessionReq = nil
+	tli := []byte{0x00}
+	if err := gnb.decUPTransportLayerInformation(c, &tli, 1); err == nil {
+		t.Errorf("UPTransportLayerInformation without PDU Session ID")
+	}
+}
+
+func TestPDUSessionResourceModify(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	pdu := ue.MakeRegistrationRequest()
+	gnb.RecvfromUE(ue, &pdu)
+	gnb.MakeInitialUEMessage(ue)
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	recvfromNW(gnb, TestPDUSessionResourceModifyRequest)
+	if gnb.DecodeError != nil {
+		t.Errorf("PDUSessionResourceModifyRequest: %v", gnb.DecodeError)
+	}
+	if ue.PDUSessionModificationCommanded() == false {
+		t.Errorf("PDU Session Modification Command is not delivered to UE")
+	}
+
+	v := gnb.MakePDUSessionResourceModifyResponse(ue)
+	expect, _ := hex.DecodeString(TestPDUSessionResourceModifyResponse)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionResourceModifyResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestPDUSessionResourceModifyQosFlows(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	pdu := ue.MakeRegistrationRequest()
+	gnb.RecvfromUE(ue, &pdu)
+	gnb.MakeInitialUEMessage(ue)
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	// QoS flow 1 and 2 with QoS Flow Level QoS Parameters.
+	recvfromNW(gnb, TestPDUSessionResourceModifyRequest2)
+	if gnb.DecodeError != nil {
+		t.Errorf("PDUSessionResourceModifyRequest: %v", gnb.DecodeError)
+	}
+
+	v := gnb.MakePDUSessionResourceModifyResponse(ue)
+	expect, _ := hex.DecodeString(TestPDUSessionResourceModifyResponse2)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionResourceModifyResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestMultiplePDUSessionResources(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	recvfromNW(gnb, TestNGSetupResponse)
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+	recvfromNW(gnb, TestDLSecurityModeCommand)
+	recvfromNW(gnb, TestInitialContextSetupRequest)
+	recvfromNW(gnb, TestDLPDUSessionEstablishmentAccept)
+	gnb.MakePDUSessionResourceSetupResponse(ue)
+
+	recvfromNW(gnb, TestDLPDUSessionEstablishmentAccept2)
+	if gnb.DecodeError != nil {
+		t.Errorf("PDUSessionResourceSetupRequest: %v", gnb.DecodeError)
+	}
+	v := gnb.MakePDUSessionResourceSetupResponse(ue)
+	expect, _ := hex.DecodeString(TestPDUSessionResourceSetupResponse2)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionResourceSetupResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	c := gnb.LookupCamperByUE(ue)
+	expectTEID := []struct {
+		local uint32
+		peer  uint32
+	}{
+		{999, 1},
+		{1000, 2},
+	}
+	for i, e := range expectTEID {
+		s := c.PDUSession(uint8(i + 1))
+		if s == nil || s.LocalTEID != e.local || s.PeerTEID != e.peer {
+			t.Errorf("PDU session(%d) TEID expect: %+v, actual: %+v",
+				i+1, e, s)
+		}
+	}
+
+	// the resources are released by the command, not by the response.
+	recvfromNW(gnb, TestPDUSessionResourceReleaseCommand)
+	if c.PDUSession(1) != nil || c.PDUSession(2) == nil {
+		t.Errorf("PDU session resources after release: %+v", c.PDUSessions)
+	}
+	if r := c.ReleasedPDUSession(1); r == nil || r.LocalTEID != 999 {
+		t.Errorf("released PDU session resources: %+v", r)
+	}
+	gnb.MakePDUSessionResourceReleaseResponse(ue)
+	if c.PDUSession(2) == nil {
+		t.Errorf("PDU session resources after response: %+v", c.PDUSessions)
+	}
+}
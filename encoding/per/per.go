@@ -391,3 +391,178 @@ func EncChoice(input, min, max int, extmark bool) (
 	bf, v, err = EncInteger(int64(input), int64(min), int64(max), extmark)
 	return
 }
+
+// Reader decodes the ALIGNED PER in the octets. The alignment is relative
+// to the first octet, so the octets should be the whole value of the open
+// type, e.g. the value of the protocol IE. The first error is kept in Err
+// and the following reads return zero.
+type Reader struct {
+	v   []byte
+	pos int // bit position
+	Err error
+}
+
+func NewReader(v []byte) *Reader {
+	return &Reader{v: v}
+}
+
+// ReadBits returns the n bits, n <= 64, as the unsigned integer.
+func (r *Reader) ReadBits(n int) (val uint64) {
+	if r.Err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.v)*8 {
+		r.Err = fmt.Errorf("per: %d bits at bit %d exceed %d octets",
+			n, r.pos, len(r.v))
+		return 0
+	}
+	for i := 0; i < n; i++ {
+		b := r.v[r.pos/8] >> (7 - uint(r.pos%8)) & 0x1
+		val = val<<1 | uint64(b)
+		r.pos++
+	}
+	return
+}
+
+// Align skips the padding bits to the octet boundary.
+func (r *Reader) Align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+// ReadOctets returns the n octets after the alignment.
+func (r *Reader) ReadOctets(n int) (v []byte) {
+	r.Align()
+	if r.Err != nil {
+		return nil
+	}
+	if r.pos/8+n > len(r.v) {
+		r.Err = fmt.Errorf("per: %d octets at octet %d exceed %d octets",
+			n, r.pos/8, len(r.v))
+		return nil
+	}
+	v = r.v[r.pos/8 : r.pos/8+n]
+	r.pos += n * 8
+	return
+}
+
+// DecConstrainedWholeNumber is the decoder for
+// 11.5.7 Encoding of a constrained whole number
+func (r *Reader) DecConstrainedWholeNumber(min, max int64) int64 {
+
+	rng := uint64(max - min + 1)
+	switch {
+	case rng == 1:
+		return min
+	case rng <= 255: // bit-field case
+		return min + int64(r.ReadBits(bits.Len64(rng-1)))
+	case rng == 256: // one-octet case
+		r.Align()
+		return min + int64(r.ReadBits(8))
+	case rng <= 65536: // two-octet case
+		r.Align()
+		return min + int64(r.ReadBits(16))
+	}
+
+	// indefinite length case
+	octets := (bits.Len64(rng-1) + 7) / 8
+	n := int(r.DecConstrainedWholeNumber(1, int64(octets)))
+	return min + int64(readUint(r.ReadOctets(n)))
+}
+
+// DecLengthDeterminant is the decoder for the unconstrained length of
+// 11.9.3.6 and 11.9.3.7. The fragmentation is not supported.
+func (r *Reader) DecLengthDeterminant() int {
+	r.Align()
+	if r.ReadBits(1) == 0 {
+		return int(r.ReadBits(7))
+	}
+	if r.ReadBits(1) == 0 {
+		return int(r.ReadBits(14))
+	}
+	if r.Err == nil {
+		r.Err = fmt.Errorf("per: fragmented length is not supported")
+	}
+	return 0
+}
+
+// DecInteger is the decoder for
+// 13. Encoding the integer type
+// the value out of the extension root is decoded as the unconstrained
+// whole number.
+func (r *Reader) DecInteger(min, max int64, extmark bool) int64 {
+	if extmark && r.ReadBits(1) == 1 {
+		n := r.DecLengthDeterminant()
+		return int64(readUint(r.ReadOctets(n)))
+	}
+	return r.DecConstrainedWholeNumber(min, max)
+}
+
+// DecEnumerated is the decoder for
+// 14. Encoding the enumerated type
+// the value out of the extension root is decoded as the normally small
+// non-negative whole number (11.6) after max.
+func (r *Reader) DecEnumerated(min, max uint, extmark bool) uint {
+	if extmark && r.ReadBits(1) == 1 {
+		if r.ReadBits(1) == 0 {
+			return max + 1 + uint(r.ReadBits(6))
+		}
+		n := r.DecLengthDeterminant()
+		return max + 1 + uint(readUint(r.ReadOctets(n)))
+	}
+	return uint(r.DecConstrainedWholeNumber(int64(min), int64(max)))
+}
+
+// DecSequence returns the extension bit and the bit-map of the optional
+// components of the sequence preamble.
+// 19. Encoding the sequence type
+func (r *Reader) DecSequence(extmark bool, optnum int) (ext bool, opt uint) {
+	if extmark {
+		ext = r.ReadBits(1) == 1
+	}
+	opt = uint(r.ReadBits(optnum))
+	return
+}
+
+// DecSequenceOf returns the number of the components.
+// 20. Encoding the sequence-of type
+func (r *Reader) DecSequenceOf(min, max int) int {
+	return int(r.DecConstrainedWholeNumber(int64(min), int64(max)))
+}
+
+// DecChoice returns the index of the alternative.
+// 23. Encoding the choice type
+func (r *Reader) DecChoice(min, max int, extmark bool) int {
+	return int(r.DecInteger(int64(min), int64(max), extmark))
+}
+
+// SkipOpenType skips the value of the open type.
+// 11.2 Open type fields
+func (r *Reader) SkipOpenType() {
+	r.ReadOctets(r.DecLengthDeterminant())
+}
+
+// SkipExtensions skips the extension additions of the sequence whose
+// extension bit is set. see 19.7 to 19.9
+func (r *Reader) SkipExtensions() {
+	// normally small length of the bit-map. see 11.9.3.4
+	n := 1
+	if r.ReadBits(1) == 0 {
+		n += int(r.ReadBits(6))
+	} else {
+		n = r.DecLengthDeterminant()
+	}
+	present := 0
+	for i := 0; i < n; i++ {
+		present += int(r.ReadBits(1))
+	}
+	for i := 0; i < present; i++ {
+		r.SkipOpenType()
+	}
+}
+
+func readUint(v []byte) (val uint64) {
+	for _, b := range v {
+		val = val<<8 | uint64(b)
+	}
+	return
+}
@@ -457,3 +457,35 @@ func compBitFieldAndValueAndErr(ebf BitField, ev []byte, eerr bool,
 	}
 	return true
 }
+
+func TestReader(t *testing.T) {
+
+	r := NewReader([]byte{0xa2, 0x00, 0xff, 0x12, 0x34, 0x20, 0x03, 0xe8,
+		0x01, 0x01, 0xaa, 0x82, 0x01})
+
+	if v := r.ReadBits(3); v != 5 {
+		t.Errorf("bits expect: 5, got %d", v)
+	}
+	if v := r.DecConstrainedWholeNumber(0, 63); v != 4 {
+		t.Errorf("bit-field expect: 4, got %d", v)
+	}
+	if v := r.DecConstrainedWholeNumber(0, 255); v != 0xff {
+		t.Errorf("one-octet expect: 255, got %d", v)
+	}
+	if v := r.DecInteger(0, 65535, false); v != 0x1234 {
+		t.Errorf("two-octet expect: 0x1234, got 0x%x", v)
+	}
+	if v := r.DecInteger(0, 4000000000000, false); v != 1000 {
+		t.Errorf("indefinite length expect: 1000, got %d", v)
+	}
+
+	// one extension addition of one octet
+	r.SkipExtensions()
+	if v := r.DecLengthDeterminant(); v != 0x201 || r.Err != nil {
+		t.Errorf("length expect: 0x201, got 0x%x (%v)", v, r.Err)
+	}
+
+	if r.ReadOctets(1); r.Err == nil {
+		t.Errorf("no error at the end of octets")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/hhorai/gnbsim/encoding/gtp"
 	"github.com/hhorai/gnbsim/encoding/nas"
@@ -11,6 +12,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,11 +23,32 @@ type testSession struct {
 	info *sctp.SndRcvInfo
 	gnb  *ngap.GNB
 	//gtpu *gtp.GTP
+
+	// set when the N3 tunnel is closed after the PDU sessions are released.
+	closed bool
+
+	// notified when the IPv6 address is formed by the router advertisement.
+	raCh chan *nas.PDUSession
+
+	// the TAP devices of the Ethernet PDU sessions by the local TEID.
+	mu   sync.Mutex
+	taps map[uint32]*netlink.Tuntap
+
+	// expiry of the NAS timers of all the UEs.
+	timerCh chan nas.TimerEvent
+
+	// the messages read from AMF. they are decoded by the main goroutine
+	// which also handles the expiry of the NAS timers.
+	rxCh chan []byte
 }
 
 func newTest() (t *testSession) {
 
 	t = new(testSession)
+	t.raCh = make(chan *nas.PDUSession, 1)
+	t.taps = make(map[uint32]*netlink.Tuntap)
+	t.timerCh = make(chan nas.TimerEvent, 16)
+	t.rxCh = make(chan []byte, 16)
 
 	return
 }
@@ -75,42 +100,70 @@ func (t *testSession) recvfromAMF(timeout time.Duration) {
 		timeout = defaultTimer
 	}
 
-	c := make(chan bool, 1)
-	go func() {
+	// the NAS message is retransmitted while waiting for the answer.
+	expired := time.After(timeout * time.Second)
+	for {
+		select {
+		case buf := <-t.rxCh:
+			fmt.Printf("dump: %x\n", buf)
+			t.gnb.Decode(&buf)
+			return
+		case ev := <-t.timerCh:
+			t.handleTimerExpiry(ev)
+		case <-expired:
+			log.Printf("read: timeout")
+			return
+		}
+	}
+}
+
+// readAMF keeps reading from AMF and passes the messages to recvfromAMF
+// through rxCh, so that the UEs are handled only by the main goroutine.
+func (t *testSession) readAMF() {
+	for {
 		buf := make([]byte, 1500)
 		n, info, err := t.conn.SCTPRead(buf)
-		t.info = info
-
 		if err != nil {
 			log.Fatalf("failed to read: %v", err)
 		}
-		log.Printf("read: len %d, info: %+v", n, t.info)
+		log.Printf("read: len %d, info: %+v", n, info)
+		t.rxCh <- buf[:n]
+	}
+}
 
-		buf = buf[:n]
-		fmt.Printf("dump: %x\n", buf)
-		t.gnb.Decode(&buf)
-		c <- true
-	}()
-	select {
-	case <-c:
-		break
-	case <-time.After(timeout * time.Second):
-		log.Printf("read: timeout")
+// handleTimerExpiry retransmits the NAS message on expiry of the NAS timer.
+// The aborted procedures are not retried since they are run in turn.
+func (t *testSession) handleTimerExpiry(ev nas.TimerEvent) {
+
+	ue := ev.UE
+	log.Printf("NAS timer T%d expired (PSI: %d)", ev.Timer, ev.PSI)
+
+	pdu := ue.TimerExpired(ev)
+	if pdu == nil {
+		return
 	}
+	log.Printf("retransmit NAS message for T%d", ev.Timer)
+
+	gnb := t.gnb
+	gnb.RecvfromUE(ue, &pdu)
+	buf := gnb.MakeUplinkNASTransport(ue)
+	t.sendtoAMF(buf)
 	return
 }
 
 func initRAN() (t *testSession) {
 
-	t = new(testSession)
+	t = newTest()
 	gnb := ngap.NewNGAP("example.json")
 	gnb.SetDebugLevel(1)
+	gnb.HandleNAS = true
 
 	conn, info := setupSCTP(gnb)
 
 	t.gnb = gnb
 	t.conn = conn
 	t.info = info
+	go t.readAMF()
 
 	pdu := gnb.MakeNGSetupRequest()
 	t.sendtoAMF(pdu)
@@ -121,9 +174,10 @@ func initRAN() (t *testSession) {
 
 func initRANwithoutSCTP() (t *testSession) {
 
-	t = new(testSession)
+	t = newTest()
 	gnb := ngap.NewNGAP("example.json")
 	gnb.SetDebugLevel(1)
+	gnb.HandleNAS = true
 
 	t.gnb = gnb
 
@@ -137,6 +191,11 @@ func (t *testSession) initUE() {
 	ue := &tmp
 	ue.PowerON()
 	ue.SetDebugLevel(1)
+	ue.TimerCh = t.timerCh
+	// CP-ACK and RP-ACK for the MT-SMS are sent by sendNAS.
+	ue.SMSHandler = func(sms nas.SMS) {
+		log.Printf("SMS from %s: %s", sms.Address, sms.Text)
+	}
 	gnb.CampIn(ue)
 
 	return
@@ -155,38 +214,85 @@ func (t *testSession) registrateUE(ue *nas.UE) {
 	gnb := t.gnb
 
 	pdu := ue.MakeRegistrationRequest()
+	if pdu == nil {
+		log.Fatalf("failed to make Registration Request: %v", ue.EncodeError)
+	}
 	gnb.RecvfromUE(ue, &pdu)
 
 	buf := gnb.MakeInitialUEMessage(ue)
 	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
 
-	pdu = ue.MakeAuthenticationResponse()
-	gnb.RecvfromUE(ue, &pdu)
-	buf = gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	// the identity, authentication and security mode commands are
+	// answered by the state machine until Registration Accept in
+	// Initial Context Setup Request.
+	const maxExchanges = 8
+	for i := 0; i < maxExchanges && ue.MMstate != nas.MMRegistered; i++ {
+		t.recvfromAMF(0)
+		checkRejected(ue)
+		ul, _ := t.takeNAS(ue)
+
+		if ue.MMstate == nas.MMRegistered {
+			buf = gnb.MakeInitialContextSetupResponse(ue)
+			t.sendtoAMF(buf)
+		}
+		t.sendNAS(ue, ul)
+	}
+	if ue.MMstate != nas.MMRegistered {
+		log.Fatalf("registration failed: %s", nas.MMstateStr[ue.MMstate])
+	}
 
-	pdu = ue.MakeSecurityModeComplete()
-	gnb.RecvfromUE(ue, &pdu)
-	buf = gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	// for Configuration Update Command from open5gs AMF.
+	t.recvfromAMF(3)
+	ul, _ := t.takeNAS(ue)
+	t.sendNAS(ue, ul)
 
-	buf = gnb.MakeInitialContextSetupResponse(ue)
-	t.sendtoAMF(buf)
+	return
+}
 
-	pdu = ue.MakeRegistrationComplete()
-	gnb.RecvfromUE(ue, &pdu)
-	buf = gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
+// takeNAS returns the uplink NAS messages and the events given by the
+// state machine for the downlink NAS messages received.
+func (t *testSession) takeNAS(ue *nas.UE) (ul [][]byte, events []nas.Event) {
+
+	ul, events = t.gnb.LookupCamperByUE(ue).TakeNAS()
+	for _, ev := range events {
+		log.Printf("NAS event: %s (PSI: %d, error: %v)",
+			nas.EventStr[ev.Type], ev.PSI, ev.Err)
+		// Manage UE Policy Complete or Command Reject is in ul.
+		if ev.Type == nas.EventUEPolicyUpdated {
+			log.Printf("URSP: %+v", ue.URSP())
+		}
+	}
+	return
+}
 
-	// for Configuration Update Command from open5gs AMF.
-	t.recvfromAMF(3)
+// sendNAS sends the uplink NAS messages in order.
+func (t *testSession) sendNAS(ue *nas.UE, ul [][]byte) {
 
+	gnb := t.gnb
+	for i := range ul {
+		gnb.RecvfromUE(ue, &ul[i])
+		buf := gnb.MakeUplinkNASTransport(ue)
+		t.sendtoAMF(buf)
+	}
 	return
 }
 
+func hasEvent(events []nas.Event, evType int) bool {
+	for _, ev := range events {
+		if ev.Type == evType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRejected stops the flow when AMF rejected the registration.
+func checkRejected(ue *nas.UE) {
+	if err, ok := ue.DecodeError.(*nas.RejectError); ok {
+		log.Fatalf("registration failed: %v", err)
+	}
+}
+
 func (t *testSession) deregistrateAll() {
 	gnb := t.gnb
 	for _, c := range gnb.Camper {
@@ -204,6 +310,8 @@ func (t *testSession) deregistrateUE(ue *nas.UE) {
 	buf := gnb.MakeUplinkNASTransport(ue)
 	t.sendtoAMF(buf)
 	t.recvfromAMF(0)
+	ul, _ := t.takeNAS(ue)
+	t.sendNAS(ue, ul)
 
 	return
 }
@@ -212,23 +320,163 @@ func (t *testSession) establishPDUSessionAll() {
 	gnb := t.gnb
 	for _, c := range gnb.Camper {
 		ue := c.UE
-		t.establishPDUSession(ue)
+		for _, s := range ue.PDUSessions {
+			t.establishPDUSession(ue, s.ID)
+		}
+	}
+}
+
+func (t *testSession) establishPDUSession(ue *nas.UE, id uint8) {
+
+	gnb := t.gnb
+
+	pdu := ue.MakePDUSessionEstablishmentRequest(id)
+	if pdu == nil {
+		log.Printf("PDU session(%d) is not requested: %v", id, ue.EncodeError)
+		return
+	}
+	gnb.RecvfromUE(ue, &pdu)
+	buf := gnb.MakeUplinkNASTransport(ue)
+	t.sendtoAMF(buf)
+	t.recvfromAMF(0)
+
+	ul, events := t.takeNAS(ue)
+	if hasEvent(events, nas.EventPDUSessionEstablished) {
+		buf = gnb.MakePDUSessionResourceSetupResponse(ue)
+		t.sendtoAMF(buf)
+	}
+	t.sendNAS(ue, ul)
+
+	return
+}
+
+func (t *testSession) releaseUEContextAll() {
+	gnb := t.gnb
+	for _, c := range gnb.Camper {
+		ue := c.UE
+		t.releaseUEContext(ue)
+	}
+}
+
+// releaseUEContext moves the UE to CM-IDLE by the gNB initiated
+// UE context release.
+func (t *testSession) releaseUEContext(ue *nas.UE) {
+
+	gnb := t.gnb
+
+	buf := gnb.MakeUEContextReleaseRequest(ue)
+	t.sendtoAMF(buf)
+	t.recvfromAMF(0)
+
+	buf = gnb.MakeUEContextReleaseComplete(ue)
+	t.sendtoAMF(buf)
+
+	return
+}
+
+func (t *testSession) serviceRequestAll() {
+	gnb := t.gnb
+	for _, c := range gnb.Camper {
+		ue := c.UE
+		t.serviceRequest(ue)
 	}
 }
 
-func (t *testSession) establishPDUSession(ue *nas.UE) {
+// serviceRequest brings the UE back from CM-IDLE with the 5G-S-TMSI.
+func (t *testSession) serviceRequest(ue *nas.UE) {
 
 	gnb := t.gnb
 
-	pdu := ue.MakePDUSessionEstablishmentRequest()
+	pdu := ue.MakeServiceRequest(nas.ServiceTypeData)
+	gnb.RecvfromUE(ue, &pdu)
+
+	buf := gnb.MakeInitialUEMessage(ue)
+	t.sendtoAMF(buf)
+	t.recvfromAMF(0)
+	ul, _ := t.takeNAS(ue)
+	if err, ok := ue.DecodeError.(*nas.RejectError); ok {
+		log.Printf("service request failed: %v", err)
+		t.sendNAS(ue, ul)
+		return
+	}
+
+	buf = gnb.MakeInitialContextSetupResponse(ue)
+	t.sendtoAMF(buf)
+	t.sendNAS(ue, ul)
+
+	return
+}
+
+func (t *testSession) releasePDUSessionAll(
+	gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+
+	gnb := t.gnb
+	for _, c := range gnb.Camper {
+		ue := c.UE
+		for _, s := range ue.PDUSessions {
+			if s.SMstate == nas.SMActive {
+				t.releasePDUSession(ue, s.ID)
+			}
+		}
+	}
+
+	t.closed = true
+	gtpConn.Close()
+	if err := delTunnel(tun); err != nil {
+		log.Printf("failed to delTunnel: %v", err)
+	}
+	return
+}
+
+// releasePDUSession releases the PDU session by the UE requested
+// procedure and removes the address and the rule added for the session.
+func (t *testSession) releasePDUSession(ue *nas.UE, id uint8) {
+
+	gnb := t.gnb
+	r := gnb.LookupCamperByUE(ue).PDUSession(id)
+	s := ue.PDUSession(id)
+	addrs := []struct {
+		ifname  string
+		ip      net.IP
+		masklen int
+	}{{gnb.GTPuIFname, s.Address, 28}, {tunName, s.Address6, 64}}
+
+	pdu := ue.MakePDUSessionReleaseRequest(id)
 	gnb.RecvfromUE(ue, &pdu)
 	buf := gnb.MakeUplinkNASTransport(ue)
 	t.sendtoAMF(buf)
 	t.recvfromAMF(0)
+	ul, events := t.takeNAS(ue)
+	if hasEvent(events, nas.EventPDUSessionReleased) == false {
+		log.Printf("PDU session release failed: %v", ue.DecodeError)
+		t.sendNAS(ue, ul)
+		return
+	}
 
-	buf = gnb.MakePDUSessionResourceSetupResponse(ue)
+	buf = gnb.MakePDUSessionResourceReleaseResponse(ue)
 	t.sendtoAMF(buf)
 
+	// PDU Session Release Complete by the state machine.
+	t.sendNAS(ue, ul)
+
+	if r != nil {
+		r.GTPu = nil
+		if err := t.delEthernet(r.LocalTEID); err != nil {
+			log.Printf("failed to delEthernet: %v", err)
+		}
+	}
+	for _, a := range addrs {
+		if a.ip == nil {
+			continue
+		}
+		if err := delRuleLocal(a.ip); err != nil {
+			log.Printf("failed to delRuleLocal: %v", err)
+		}
+		if err := delIP(a.ifname, a.ip, a.masklen); err != nil {
+			log.Printf("failed to delIP: %v", err)
+		}
+	}
+
 	return
 }
 
@@ -237,7 +485,6 @@ func (t *testSession) setupN3Tunnel() (gtpConn *net.UDPConn, tun *netlink.Tuntap
 	gnb := t.gnb
 	log.Printf("GTP-U interface name: %s\n", gnb.GTPuIFname)
 	log.Printf("GTP-U local addr: %v\n", gnb.GTPuLocalAddr)
-	log.Printf("GTP-U peer addr : %v\n", gnb.Recv.GTPuPeerAddr)
 
 	laddr := &net.UDPAddr{
 		IP:   net.ParseIP(gnb.GTPuLocalAddr),
@@ -250,7 +497,7 @@ func (t *testSession) setupN3Tunnel() (gtpConn *net.UDPConn, tun *netlink.Tuntap
 		return
 	}
 
-	tun, err = addTunnel("gtp-gnb")
+	tun, err = addTunnel(tunName, netlink.TUNTAP_MODE_TUN)
 	if err != nil {
 		log.Fatalln(err)
 		return
@@ -264,24 +511,30 @@ func (t *testSession) setupN3Tunnel() (gtpConn *net.UDPConn, tun *netlink.Tuntap
 	return
 }
 
-func addTunnel(tunname string) (tun *netlink.Tuntap, err error) {
+// tunName is the TUN device for the IP PDU sessions.
+const tunName = "gtp-gnb"
+
+// addTunnel adds the TUN device for the IP PDU sessions, or the TAP device
+// for the Ethernet PDU session.
+func addTunnel(tunname string, mode netlink.TuntapMode) (
+	tun *netlink.Tuntap, err error) {
 
 	link, _ := netlink.LinkByName(tunname)
 	netlink.LinkDel(link) // Delete first.
 
 	tun = &netlink.Tuntap{
 		LinkAttrs: netlink.LinkAttrs{Name: tunname},
-		Mode:      netlink.TUNTAP_MODE_TUN,
+		Mode:      mode,
 		Flags:     netlink.TUNTAP_DEFAULTS | netlink.TUNTAP_NO_PI,
 		Queues:    1,
 	}
 
 	if err = netlink.LinkAdd(tun); err != nil {
-		err = fmt.Errorf("failed to ADD tun device=gtp0: %s", err)
+		err = fmt.Errorf("failed to ADD tun device=%s: %s", tunname, err)
 		return
 	}
 	if err = netlink.LinkSetUp(tun); err != nil {
-		err = fmt.Errorf("failed to UP tun device=gtp0: %s", err)
+		err = fmt.Errorf("failed to UP tun device=%s: %s", tunname, err)
 		return
 	}
 	return
@@ -289,21 +542,59 @@ func addTunnel(tunname string) (tun *netlink.Tuntap, err error) {
 
 const routeTableID = 1001
 
+// ipNet returns the network of the address for both IPv4 and IPv6.
+func ipNet(ip net.IP, masklen int) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(masklen, 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(masklen, 8*net.IPv6len)}
+}
+
+// hostNet returns the network of the single address.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return ipNet(ip, 8*net.IPv4len)
+	}
+	return ipNet(ip, 8*net.IPv6len)
+}
+
 func addRoute(tun *netlink.Tuntap) (err error) {
 
-	route := &netlink.Route{
-		Dst: &net.IPNet{
-			IP:   net.IPv4zero,
-			Mask: net.CIDRMask(0, 32),
-		}, // default route
-		LinkIndex: tun.Attrs().Index,  // dev gtp-<ECI>
-		Scope:     netlink.SCOPE_LINK, // scope link
-		Protocol:  4,                  // proto static
-		Priority:  1,                  // metric 1
-		Table:     routeTableID,       // table <ECI>
+	for _, dst := range []net.IP{net.IPv4zero, net.IPv6zero} {
+		route := &netlink.Route{
+			Dst:       ipNet(dst, 0),      // default route
+			LinkIndex: tun.Attrs().Index,  // dev gtp-<ECI>
+			Scope:     netlink.SCOPE_LINK, // scope link
+			Protocol:  4,                  // proto static
+			Priority:  1,                  // metric 1
+			Table:     routeTableID,       // table <ECI>
+		}
+
+		if err = netlink.RouteReplace(route); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func delTunnel(tun *netlink.Tuntap) (err error) {
+
+	for _, fd := range tun.Fds {
+		fd.Close()
 	}
 
-	err = netlink.RouteReplace(route)
+	for _, dst := range []net.IP{net.IPv4zero, net.IPv6zero} {
+		route := &netlink.Route{
+			Dst:       ipNet(dst, 0),
+			LinkIndex: tun.Attrs().Index,
+			Table:     routeTableID,
+		}
+		if err = netlink.RouteDel(route); err != nil {
+			return
+		}
+	}
+
+	err = netlink.LinkDel(tun)
 	return
 }
 
@@ -311,48 +602,257 @@ func (t *testSession) runUPlaneAll(
 	ctx context.Context, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
 
 	for _, c := range t.gnb.Camper {
-		t.runUPlane(ctx, c, gtpConn, tun)
+		for _, s := range c.UE.PDUSessions {
+			if s.SMstate == nas.SMActive {
+				t.runUPlane(c, s)
+			}
+		}
+	}
+
+	go t.decap(gtpConn, tun)
+	go t.encap(gtpConn, tun)
+
+	for _, c := range t.gnb.Camper {
+		for _, s := range c.UE.PDUSessions {
+			switch {
+			case s.SMstate != nas.SMActive:
+			case s.Type == "Ethernet":
+				t.runUPlaneEthernet(gtpConn, c, s)
+			case s.Type == "Unstructured":
+				t.runUPlaneUnstructured(ctx, gtpConn, c, s)
+			case s.InterfaceID != nil:
+				t.runUPlaneIPv6(gtpConn, c, s)
+			}
+		}
+	}
+
+	for _, c := range t.gnb.Camper {
+		selected := c.UE.SelectPDUSession(probeTraffic(c.UE.URL))
+		for _, s := range c.UE.PDUSessions {
+			// the HTTP probe goes over the PDU session selected by URSP
+			// if the UE policy is installed.
+			if selected != nil && s != selected {
+				continue
+			}
+			for _, addr := range []net.IP{s.Address, s.Address6} {
+				if addr != nil {
+					t.doUPlane(ctx, c.UE, addr)
+				}
+			}
+		}
 	}
 	return
 }
 
-func (t *testSession) runUPlane(ctx context.Context, c *ngap.Camper,
-	gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+// probeTraffic returns the traffic of the HTTP probe to select the PDU
+// session by URSP.
+func probeTraffic(rawURL string) (app nas.AppTraffic) {
+
+	app.Protocol = 6 // TCP
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	app.FQDN = u.Hostname()
+	app.RemoteAddr = net.ParseIP(u.Hostname())
+
+	port, err := strconv.Atoi(u.Port())
+	switch {
+	case err == nil:
+		app.RemotePort = uint16(port)
+	case u.Scheme == "https":
+		app.RemotePort = 443
+	default:
+		app.RemotePort = 80
+	}
+	return
+}
+
+// runUPlane sets up the tunnel, the address and the rule of the PDU session.
+func (t *testSession) runUPlane(c *ngap.Camper, s *nas.PDUSession) {
 
 	gnb := t.gnb
-	ue := c.UE
-	c.GTPu = gtp.NewGTP(gnb.GTPuTEID, gnb.Recv.GTPuPeerTEID)
-	gtpu := c.GTPu
+	r := c.PDUSession(s.ID)
+	if r == nil {
+		log.Printf("PDU session(%d) resources are not set up", s.ID)
+		return
+	}
+	r.GTPu = gtp.NewGTP(r.LocalTEID, r.PeerTEID)
+	gtpu := r.GTPu
 	gtpu.SetExtensionHeader(true)
-	gtpu.SetQosFlowID(c.QosFlowID)
+	gtpu.SetQosFlowID(r.QosFlowID)
 
-	log.Printf("GTP-U Peer TEID: %v\n", gnb.Recv.GTPuPeerTEID)
-	log.Printf("GTP-U Local TEID: %v\n", gnb.GTPuTEID)
+	log.Printf("PDU session ID: %d, DNN: %s\n", s.ID, s.DNN)
+	log.Printf("GTP-U Peer addr: %v\n", r.PeerAddr)
+	log.Printf("GTP-U Peer TEID: %v\n", r.PeerTEID)
+	log.Printf("GTP-U Local TEID: %v\n", r.LocalTEID)
 	log.Printf("QoS Flow ID: %d\n", gtpu.QosFlowID)
 
-	log.Printf("UE address: %v\n", ue.Recv.PDUAddress)
-	err := addIP(gnb.GTPuIFname, ue.Recv.PDUAddress, 28)
+	if s.Address == nil {
+		// IPv6 only, Ethernet or Unstructured. the address is formed,
+		// or the TAP device is added after the tunnel is up.
+		return
+	}
+
+	log.Printf("UE address: %v\n", s.Address)
+	err := addIP(gnb.GTPuIFname, s.Address, 28)
 	if err != nil {
 		log.Fatalf("failed to addIP: %v", err)
 		return
 	}
 
-	err = addRuleLocal(ue.Recv.PDUAddress)
+	err = addRuleLocal(s.Address)
 	if err != nil {
 		log.Fatalf("failed to addRuleLocal: %v", err)
 		return
 	}
 
-	go t.decap(c, gtpConn, tun)
-	go t.encap(c, gtpConn, tun)
-	t.doUPlane(ctx, c)
+	return
+}
 
-	/*
+// runUPlaneIPv6 sends the router solicitation over the tunnel, and adds
+// the IPv6 address formed by the router advertisement on the TUN device
+// and its rule.
+func (t *testSession) runUPlaneIPv6(
+	gtpConn *net.UDPConn, c *ngap.Camper, s *nas.PDUSession) {
+
+	r := c.PDUSession(s.ID)
+	if r == nil || r.GTPu == nil {
+		return
+	}
+
+	log.Printf("UE link local address: %v\n", s.LinkLocalAddress())
+	paddr := &net.UDPAddr{
+		IP:   r.PeerAddr,
+		Port: gtp.Port,
+	}
+
+	const retry = 3
+	for i := 0; i < retry && s.Address6 == nil; i++ {
+		payload := r.GTPu.Encap(s.MakeRouterSolicitation())
+		if _, err := gtpConn.WriteToUDP(payload, paddr); err != nil {
+			log.Fatalln(err)
+			return
+		}
 		select {
-		case <-ctx.Done():
-			log.Fatalf("exit gnbsim")
+		case <-t.raCh:
+		case <-time.After(4 * time.Second): // RFC 4861 RTR_SOLICITATION_INTERVAL
 		}
-	*/
+	}
+	if s.Address6 == nil {
+		log.Printf("no router advertisement for PDU session(%d)", s.ID)
+		return
+	}
+
+	log.Printf("UE IPv6 address: %v\n", s.Address6)
+	err := addIP6(tunName, s.Address6, 64)
+	if err != nil {
+		log.Fatalf("failed to addIP6: %v", err)
+		return
+	}
+
+	err = addRuleLocal(s.Address6)
+	if err != nil {
+		log.Fatalf("failed to addRuleLocal: %v", err)
+		return
+	}
+
+	return
+}
+
+// runUPlaneEthernet adds the TAP device for the Ethernet PDU session,
+// which exchanges the Ethernet frames with the tunnel.
+func (t *testSession) runUPlaneEthernet(
+	gtpConn *net.UDPConn, c *ngap.Camper, s *nas.PDUSession) {
+
+	r := c.PDUSession(s.ID)
+	if r == nil || r.GTPu == nil {
+		return
+	}
+
+	// the name is limited to 15 characters.
+	name := fmt.Sprintf("gnb-eth%x", r.LocalTEID)
+	tap, err := addTunnel(name, netlink.TUNTAP_MODE_TAP)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+	log.Printf("TAP device %s for PDU session(%d)\n", name, s.ID)
+
+	t.mu.Lock()
+	t.taps[r.LocalTEID] = tap
+	t.mu.Unlock()
+
+	go t.encapEthernet(gtpConn, tap, s, r)
+	return
+}
+
+func (t *testSession) lookupTap(teid uint32) *netlink.Tuntap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.taps[teid]
+}
+
+// delEthernet deletes the TAP device of the Ethernet PDU session if any.
+func (t *testSession) delEthernet(teid uint32) (err error) {
+
+	t.mu.Lock()
+	tap := t.taps[teid]
+	delete(t.taps, teid)
+	t.mu.Unlock()
+
+	if tap == nil {
+		return
+	}
+	for _, fd := range tap.Fds {
+		fd.Close()
+	}
+	err = netlink.LinkDel(tap)
+	return
+}
+
+// runUPlaneUnstructured sends the uplink payload given by
+// nas.PDUSession.SendUnstructured over the Unstructured PDU session. The
+// downlink payload is given to nas.PDUSession.UnstructuredHandler, which
+// logs it unless the application set it.
+func (t *testSession) runUPlaneUnstructured(ctx context.Context,
+	gtpConn *net.UDPConn, c *ngap.Camper, s *nas.PDUSession) {
+
+	r := c.PDUSession(s.ID)
+	if r == nil || r.GTPu == nil {
+		return
+	}
+	if s.UnstructuredHandler == nil {
+		s.UnstructuredHandler = func(payload []byte) {
+			log.Printf("PDU session(%d) unstructured payload: %x",
+				s.ID, payload)
+		}
+	}
+	paddr := &net.UDPAddr{
+		IP:   r.PeerAddr,
+		Port: gtp.Port,
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case payload := <-s.UnstructuredUplink():
+				if r.GTPu == nil { // PDU session released
+					return
+				}
+				_, err := gtpConn.WriteToUDP(r.GTPu.Encap(payload), paddr)
+				if err != nil {
+					log.Printf("PDU session(%d): %v", s.ID, err)
+				}
+			}
+		}
+	}()
+
+	if err := s.SendUnstructured([]byte("gnbsim")); err != nil {
+		log.Printf("PDU session(%d): %v", s.ID, err)
+	}
 	return
 }
 
@@ -368,10 +868,7 @@ func addIP(ifname string, ip net.IP, masklen int) (err error) {
 		return err
 	}
 
-	netToAdd := &net.IPNet{
-		IP:   ip,
-		Mask: net.CIDRMask(masklen, 32),
-	}
+	netToAdd := ipNet(ip, masklen)
 
 	var addr netlink.Addr
 	var found bool
@@ -400,6 +897,36 @@ func addIP(ifname string, ip net.IP, masklen int) (err error) {
 	return
 }
 
+// addIP6 adds the IPv6 address formed by SLAAC. The duplicate address
+// detection is not run on the TUN device without ARP.
+func addIP6(ifname string, ip net.IP, masklen int) (err error) {
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{
+		IPNet: ipNet(ip, masklen),
+	}
+	err = netlink.AddrReplace(link, addr)
+	return
+}
+
+func delIP(ifname string, ip net.IP, masklen int) (err error) {
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{
+		IPNet: ipNet(ip, masklen),
+	}
+	err = netlink.AddrDel(link, addr)
+	return
+}
+
 func addRuleLocal(ip net.IP) (err error) {
 
 	// 0: NETLINK_ROUTE, no definition found.
@@ -408,26 +935,77 @@ func addRuleLocal(ip net.IP) (err error) {
 		return err
 	}
 
-	mask32 := &net.IPNet{
-		IP:   ip,
-		Mask: net.CIDRMask(32, 32),
-	}
+	host := hostNet(ip)
 
 	for _, r := range rules {
-		if r.Src == mask32 && r.Table == routeTableID {
+		if r.Src == host && r.Table == routeTableID {
 			return
 		}
 	}
 
 	rule := netlink.NewRule()
-	rule.Src = mask32
+	rule.Src = host
 	rule.Table = routeTableID
 	err = netlink.RuleAdd(rule)
 
 	return
 }
 
-func (t *testSession) decap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+func delRuleLocal(ip net.IP) (err error) {
+
+	rule := netlink.NewRule()
+	rule.Src = hostNet(ip)
+	rule.Table = routeTableID
+	err = netlink.RuleDel(rule)
+
+	return
+}
+
+// lookupByTEID returns the camper and the PDU session resources of
+// the local TEID.
+func (t *testSession) lookupByTEID(teid uint32) (
+	*ngap.Camper, *ngap.PDUSessionResource) {
+	for _, c := range t.gnb.Camper {
+		for _, r := range c.PDUSessions {
+			if r.LocalTEID == teid {
+				return c, r
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lookupByUEAddr returns the PDU session and the PDU session resources
+// of the UE address.
+func (t *testSession) lookupByUEAddr(addr net.IP) (
+	*nas.PDUSession, *ngap.PDUSessionResource) {
+	for _, c := range t.gnb.Camper {
+		for _, s := range c.UE.PDUSessions {
+			if s.Address.Equal(addr) || s.Address6.Equal(addr) {
+				return s, c.PDUSession(s.ID)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// encapUplink encapsulates the uplink packet with the QFI of the QoS rule
+// matching the packet. ok is false if the packet is to be discarded.
+func encapUplink(s *nas.PDUSession, r *ngap.PDUSessionResource,
+	pkt []byte) (payload []byte, ok bool) {
+
+	qfi, ok := s.UplinkQFI(pkt)
+	if ok == false {
+		return
+	}
+	if qfi == 0 {
+		qfi = r.QosFlowID
+	}
+	payload = r.GTPu.EncapWithQFI(pkt, qfi)
+	return
+}
+
+func (t *testSession) decap(gtpConn *net.UDPConn, tun *netlink.Tuntap) {
 
 	fd := tun.Fds[0]
 
@@ -435,12 +1013,59 @@ func (t *testSession) decap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.T
 	for {
 		n, _, err := gtpConn.ReadFromUDP(buf)
 		if err != nil {
+			if t.closed { // PDU sessions released
+				return
+			}
 			log.Fatalln(err)
 			return
 		}
-		payload := c.GTPu.Decap(buf[:n])
+		if n < 8 {
+			continue
+		}
+		c, r := t.lookupByTEID(binary.BigEndian.Uint32(buf[4:8]))
+		if r == nil || r.GTPu == nil {
+			continue
+		}
+		gtpu := r.GTPu
+		payload, info := gtpu.DecapWithInfo(buf[:n])
 		//fmt.Printf("decap: %x\n", payload)
 
+		s := c.UE.PDUSession(r.ID)
+		if s == nil {
+			continue
+		}
+		// the uplink QoS rule is derived from the packet with the RQI.
+		if info != nil && info.RQI {
+			if err := s.DeriveQoSRule(payload, info.QFI); err != nil {
+				log.Printf("PDU session(%d): %v", s.ID, err)
+			}
+		}
+		switch s.Type {
+		case "Ethernet":
+			if tap := t.lookupTap(r.LocalTEID); tap != nil {
+				tap.Fds[0].Write(payload)
+			}
+			continue
+		case "Unstructured":
+			if err := s.RecvUnstructured(payload); err != nil {
+				log.Printf("PDU session(%d): %v", s.ID, err)
+			}
+			continue
+		}
+
+		// the router advertisement is for the UE, not for the TUN device.
+		if nas.IsRouterAdvertisement(payload) {
+			if err := s.RecvRouterAdvertisement(payload); err != nil {
+				log.Printf("PDU session(%d): %v", s.ID, err)
+				continue
+			}
+			select {
+			case t.raCh <- s:
+			default:
+			}
+			continue
+		}
+
 		_, err = fd.Write(payload)
 		if err != nil {
 			log.Fatalln(err)
@@ -449,22 +1074,42 @@ func (t *testSession) decap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.T
 	}
 }
 
-func (t *testSession) encap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+func (t *testSession) encap(gtpConn *net.UDPConn, tun *netlink.Tuntap) {
 
 	fd := tun.Fds[0]
-	paddr := &net.UDPAddr{
-		IP:   t.gnb.Recv.GTPuPeerAddr,
-		Port: gtp.Port,
-	}
 
 	buf := make([]byte, 2048)
 	for {
 		n, err := fd.Read(buf)
 		if err != nil {
+			if t.closed { // PDU sessions released
+				return
+			}
 			log.Fatalln(err)
 			return
 		}
-		payload := c.GTPu.Encap(buf[:n])
+		// the PDU session is selected by the source address.
+		var src net.IP
+		switch {
+		case n >= 20 && buf[0]>>4 == 4:
+			src = net.IP(buf[12:16])
+		case n >= 40 && buf[0]>>4 == 6:
+			src = net.IP(buf[8:24])
+		default:
+			continue
+		}
+		s, r := t.lookupByUEAddr(src)
+		if r == nil || r.GTPu == nil {
+			continue
+		}
+		payload, ok := encapUplink(s, r, buf[:n])
+		if ok == false {
+			continue
+		}
+		paddr := &net.UDPAddr{
+			IP:   r.PeerAddr,
+			Port: gtp.Port,
+		}
 
 		_, err = gtpConn.WriteToUDP(payload, paddr)
 		if err != nil {
@@ -475,13 +1120,48 @@ func (t *testSession) encap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.T
 	return
 }
 
-func (t *testSession) doUPlane(ctx context.Context, c *ngap.Camper) {
+func (t *testSession) encapEthernet(
+	gtpConn *net.UDPConn, tap *netlink.Tuntap,
+	s *nas.PDUSession, r *ngap.PDUSessionResource) {
 
-	fmt.Printf("doUPlane\n")
+	fd := tap.Fds[0]
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := fd.Read(buf)
+		if err != nil {
+			if t.lookupTap(r.LocalTEID) == nil { // PDU session released
+				return
+			}
+			log.Fatalln(err)
+			return
+		}
+		if n < 14 || r.GTPu == nil { // Ethernet header
+			continue
+		}
+		payload, ok := encapUplink(s, r, buf[:n])
+		if ok == false {
+			continue
+		}
+		paddr := &net.UDPAddr{
+			IP:   r.PeerAddr,
+			Port: gtp.Port,
+		}
+
+		_, err = gtpConn.WriteToUDP(payload, paddr)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+}
 
-	ue := c.UE
+func (t *testSession) doUPlane(
+	ctx context.Context, ue *nas.UE, addr net.IP) {
 
-	laddr, err := net.ResolveTCPAddr("tcp", ue.Recv.PDUAddress.String()+":0")
+	fmt.Printf("doUPlane\n")
+
+	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr.String(), "0"))
 	if err != nil {
 		return
 	}
@@ -542,6 +1222,15 @@ func main() {
 	t.runUPlaneAll(ctx, gtpConn, tun)
 	time.Sleep(time.Second * 1)
 
+	t.releaseUEContextAll()
+	time.Sleep(time.Second * 1)
+
+	t.serviceRequestAll()
+	time.Sleep(time.Second * 1)
+
+	t.releasePDUSessionAll(gtpConn, tun)
+	time.Sleep(time.Second * 1)
+
 	t.deregistrateAll()
 	time.Sleep(time.Second * 1)
 
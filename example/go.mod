@@ -1,5 +1,13 @@
 module example
 
+go 1.27.1
+
 require (
+	github.com/ishidawataru/sctp v0.0.0-20251114114122-19ddcbc6aae2
 	github.com/vishvananda/netlink v1.1.1-0.20200603190747-5400e006d43d
 )
+
+require (
+	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
+	golang.org/x/sys v0.0.0-20200121082415-34d275377bf9 // indirect
+)
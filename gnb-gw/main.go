@@ -6,6 +6,8 @@ import (
 	"os/signal"
 	"context"
 	"syscall"
+
+	"github.com/hhorai/gnbsim/encoding/nas"
 )
 
 func main() {
@@ -34,25 +36,56 @@ func main() {
 
 	for _, c := range gnb.Camper {
 		ue := c.UE
-		t.establishPDUSession(ue)
+		for _, s := range ue.PDUSessions {
+			t.establishPDUSession(ue, s.ID)
+		}
 	}
 	log.Printf("before user plane setup")
 
 	fatalCh := make(chan error, 1)
 
-	for _, c := range gnb.Camper {
-		go func() {
+	// the user plane is set up in turn since the GTP device is shared.
+	go func() {
+		for _, c := range gnb.Camper {
 			if err := setupUserPlane(t, ctx,c); err != nil {
 				fatalCh <- err
+				return
 			}
-		}()
-	}
+		}
+	}()
 
 	for {
 		select {
 		case err := <-fatalCh:
 			log.Printf("FATAL: %s", err)
 			return
+		case buf := <-t.rxCh:
+			t.decode(buf)
+			for _, c := range gnb.Camper {
+				t.handleNAS(c.UE)
+			}
+		case <-sigCh:
+			for _, c := range gnb.Camper {
+				for _, s := range c.UE.PDUSessions {
+					if s.SMstate == nas.SMActive {
+						t.releasePDUSession(c.UE, s.ID)
+					}
+				}
+			}
+			cleanupUserPlane(t)
+			return
+		case ev := <-t.timerCh:
+			t.handleTimerExpiry(ev)
+		case ue := <-t.t3512Ch:
+			// no periodic update after the de-registration.
+			if ue.MMstate != nas.MMRegistered {
+				log.Printf("skip periodic registration update for %s: %s",
+					ue.SUPI, nas.MMstateStr[ue.MMstate])
+				continue
+			}
+			t.updateRegistration(ue,
+				nas.RegistrationTypePeriodicRegistrationUpdating)
+			t.startT3512(ue)
 		}
 	}
 
@@ -9,6 +9,7 @@ import (
 	"github.com/ishidawataru/sctp"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,16 @@ type testSession struct {
 	ue   *nas.UE
 	gtpu *gtp.GTP
 	uConn *gtpv1.UPlaneConn
+	rxCh chan []byte
+	timerCh chan nas.TimerEvent
+
+	// the periodic registration update timers of the UEs.
+	t3512Ch chan *nas.UE
+	t3512   map[*nas.UE]*time.Timer
+
+	// the UE addresses of the tunnels by the local TEID.
+	mu    sync.Mutex
+	addrs map[uint32]net.IP
 }
 
 func setupSCTP(gnb *ngap.GNB) (conn *sctp.SCTPConn, info *sctp.SndRcvInfo) {
@@ -72,28 +83,40 @@ func (t *testSession) recvfromAMF(timeout time.Duration) {
 		timeout = defaultTimer
 	}
 
-	c := make(chan bool, 1)
-	go func() {
+	// the NAS message is retransmitted while waiting for the answer.
+	expired := time.After(timeout * time.Second)
+	for {
+		select {
+		case buf := <-t.rxCh:
+			t.decode(buf)
+			return
+		case ev := <-t.timerCh:
+			t.handleTimerExpiry(ev)
+		case <-expired:
+			log.Printf("read: timeout")
+			return
+		}
+	}
+}
+
+// readAMF keeps reading from AMF so that the messages initiated by AMF
+// are also delivered to the main loop through rxCh. t.info is only read
+// by sendtoAMF on the main loop and not updated here.
+func (t *testSession) readAMF() {
+	for {
 		buf := make([]byte, 1500)
 		n, info, err := t.conn.SCTPRead(buf)
-		t.info = info
-
 		if err != nil {
 			log.Fatalf("failed to read: %v", err)
 		}
-		log.Printf("read: len %d, info: %+v", n, t.info)
-
-		buf = buf[:n]
-		fmt.Printf("dump: %x\n", buf)
-		t.gnb.Decode(&buf)
-		c <- true
-	}()
-	select {
-	case <-c:
-		break
-	case <-time.After(timeout * time.Second):
-		log.Printf("read: timeout")
+		log.Printf("read: len %d, info: %+v", n, info)
+		t.rxCh <- buf[:n]
 	}
+}
+
+func (t *testSession) decode(buf []byte) {
+	fmt.Printf("dump: %x\n", buf)
+	t.gnb.Decode(&buf)
 	return
 }
 
@@ -105,6 +128,7 @@ func initRAN() (t *testSession) {
 	log.Printf("read gnb.json")
 	log.Printf("GNB Values \n%v\n",gnb)
 	gnb.SetDebugLevel(1)
+	gnb.HandleNAS = true
 
 	conn, info := setupSCTP(gnb)
 
@@ -112,6 +136,13 @@ func initRAN() (t *testSession) {
 	t.conn = conn
 	t.info = info
 
+	t.addrs = make(map[uint32]net.IP)
+	t.rxCh = make(chan []byte, 16)
+	t.timerCh = make(chan nas.TimerEvent, 16)
+	t.t3512Ch = make(chan *nas.UE, 16)
+	t.t3512 = make(map[*nas.UE]*time.Timer)
+	go t.readAMF()
+
 	pdu := gnb.MakeNGSetupRequest()
 	t.sendtoAMF(pdu)
 	t.recvfromAMF(0)
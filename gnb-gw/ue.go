@@ -2,67 +2,232 @@ package main
 
 import (
 	"log"
+	"time"
 	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
 )
 
 func (t *testSession) registerUE(ue *nas.UE) {
-	log.Printf("registerUE function called for %v",ue)
+	log.Printf("registerUE function called for %s",ue.SUPI)
 
 	log.Printf("send registration request -->")
 	pdu := ue.MakeRegistrationRequest()
+	if pdu == nil {
+		log.Fatalf("failed to make registration request: %v", ue.EncodeError)
+	}
 	t.gnb.RecvfromUE(ue,&pdu)
 
 	log.Printf("send initial UE message -->")
 	buf := t.gnb.MakeInitialUEMessage(ue)
 	t.sendtoAMF(buf)
-	log.Printf("receive initial UE message <--")
-	t.recvfromAMF(0)
 
-	log.Printf("receive authentication response <--")
-	pdu = ue.MakeAuthenticationResponse()
-	t.gnb.RecvfromUE(ue,&pdu)
+	// the identity, authentication and security mode commands are
+	// answered by the state machine until Registration Accept in
+	// Initial Context Setup Request.
+	const maxExchanges = 8
+	for i := 0; i < maxExchanges && ue.MMstate != nas.MMRegistered; i++ {
+		log.Printf("receive downlink NAS message <--")
+		t.recvfromAMF(0)
+		checkRejected(ue)
+		ul, _ := t.takeNAS(ue)
 
-	log.Printf("send uplink NAS transport -->")
-	buf = t.gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
-	log.Printf("receive uplink NAS transport <--")
+		if ue.MMstate == nas.MMRegistered {
+			log.Printf("send initial context setup response -->")
+			buf = t.gnb.MakeInitialContextSetupResponse(ue)
+			t.sendtoAMF(buf)
+		}
+		t.sendNAS(ue, ul)
+	}
+	if ue.MMstate != nas.MMRegistered {
+		log.Fatalf("registration failed: %s", nas.MMstateStr[ue.MMstate])
+	}
+
+	log.Printf("receive configuration command <--")
+	// for Configuration Update Command from open5gs AMF.
+	t.recvfromAMF(3)
+	t.handleNAS(ue)
+
+	t.startT3512(ue)
+	return
+}
+
+// takeNAS returns the uplink NAS messages and the events given by the
+// state machine for the downlink NAS messages received.
+func (t *testSession) takeNAS(ue *nas.UE) (ul [][]byte, events []nas.Event) {
+	ul, events = t.gnb.LookupCamperByUE(ue).TakeNAS()
+	for _, ev := range events {
+		log.Printf("NAS event for %s: %s (PSI: %d, error: %v)",
+			ue.SUPI, nas.EventStr[ev.Type], ev.PSI, ev.Err)
+	}
+	return
+}
+
+// sendNAS sends the uplink NAS messages in order.
+func (t *testSession) sendNAS(ue *nas.UE, ul [][]byte) {
+	for i := range ul {
+		log.Printf("send uplink NAS transport -->")
+		t.gnb.RecvfromUE(ue,&ul[i])
+		buf := t.gnb.MakeUplinkNASTransport(ue)
+		t.sendtoAMF(buf)
+	}
+	return
+}
+
+// handleNAS answers the downlink NAS messages by the events of the state
+// machine. The NGAP responses precede the NAS responses to the NAS
+// messages carried in the NGAP requests.
+func (t *testSession) handleNAS(ue *nas.UE) {
+	ul, events := t.takeNAS(ue)
+	c := t.gnb.LookupCamperByUE(ue)
+
+	// the resources released by the release command.
+	var released []*ngap.PDUSessionResource
+	for _, ev := range events {
+		switch ev.Type {
+		case nas.EventPDUSessionEstablished:
+			log.Printf("send PDU session resource setup response -->")
+			buf := t.gnb.MakePDUSessionResourceSetupResponse(ue)
+			t.sendtoAMF(buf)
+		case nas.EventPDUSessionModified:
+			t.modifyPDUSession(ue, ev.PSI)
+		case nas.EventPDUSessionReleased:
+			released = append(released, c.ReleasedPDUSession(ev.PSI))
+			log.Printf("send PDU session resource release response -->")
+			buf := t.gnb.MakePDUSessionResourceReleaseResponse(ue)
+			t.sendtoAMF(buf)
+		}
+	}
+
+	t.sendNAS(ue, ul)
+
+	for _, r := range released {
+		cleanupPDUSession(t, r)
+	}
+	for _, ev := range events {
+		switch ev.Type {
+		case nas.EventUEPolicyUpdated:
+			// Manage UE Policy Complete or Command Reject is sent above.
+			log.Printf("URSP of %s: %+v", ue.SUPI, ue.URSP())
+		case nas.EventDeregistered:
+			t.deregistered(ue)
+		case nas.EventReregistrationRequired:
+			t.registerUE(ue)
+		}
+	}
+	return
+}
+
+// checkRejected stops the flow when AMF rejected the registration.
+func checkRejected(ue *nas.UE) {
+	if err, ok := ue.DecodeError.(*nas.RejectError); ok {
+		log.Fatalf("registration failed: %v", err)
+	}
+}
+
+// deregistered releases the UE context after the de-registration,
+// e.g. on the UDM purge or the subscriber withdrawal by the network.
+// Deregistration Accept is sent by the state machine.
+func (t *testSession) deregistered(ue *nas.UE) {
+	log.Printf("deregistered function called for %s",ue.SUPI)
+	t.stopT3512(ue)
+
+	log.Printf("receive UE context release command <--")
 	t.recvfromAMF(0)
+	log.Printf("send UE context release complete -->")
+	buf := t.gnb.MakeUEContextReleaseComplete(ue)
+	t.sendtoAMF(buf)
+
+	return
+}
+
+// updateRegistration runs the mobility or periodic registration update
+// with the 5G-GUTI. The UE in RRC IDLE comes back with Initial UE Message.
+func (t *testSession) updateRegistration(ue *nas.UE, regType uint8) {
+	log.Printf("updateRegistration function called for %s",ue.SUPI)
 
-	log.Printf("receive security mode complete <--")
-	pdu = ue.MakeSecurityModeComplete()
+	log.Printf("send registration request -->")
+	pdu := ue.MakeRegistrationUpdate(regType)
+	if pdu == nil {
+		log.Printf("failed to make registration request: %v", ue.EncodeError)
+		return
+	}
 	t.gnb.RecvfromUE(ue,&pdu)
 
-	log.Printf("send uplink NAS transport -->")
-	buf = t.gnb.MakeUplinkNASTransport(ue)
+	var buf []byte
+	if c := t.gnb.LookupCamperByUE(ue); c.RRCstate == ngap.RRC_IDLE {
+		log.Printf("send initial UE message -->")
+		buf = t.gnb.MakeInitialUEMessage(ue)
+	} else {
+		log.Printf("send uplink NAS transport -->")
+		buf = t.gnb.MakeUplinkNASTransport(ue)
+	}
 	t.sendtoAMF(buf)
-	log.Printf("receive uplink NAS transport <--")
+	log.Printf("receive registration accept <--")
 	t.recvfromAMF(0)
+	if err, ok := ue.DecodeError.(*nas.RejectError); ok {
+		log.Printf("registration update failed: %v", err)
+	}
+	// Registration Complete by the state machine.
+	t.handleNAS(ue)
 
-	log.Printf("send initial context setup -->")
-	buf = t.gnb.MakeInitialContextSetupResponse(ue)
-	t.sendtoAMF(buf)
+	return
+}
 
-	log.Printf("receive registration complete <--")
-	pdu = ue.MakeRegistrationComplete()
-	t.gnb.RecvfromUE(ue,&pdu)
+// startT3512 notifies the UE to t3512Ch on expiry of the periodic
+// registration update timer given in Registration Accept.
+func (t *testSession) startT3512(ue *nas.UE) {
+	t.stopT3512(ue)
+	d := ue.T3512()
+	if d == 0 {
+		return
+	}
+	log.Printf("start T3512 for %s: %v", ue.SUPI, d)
+	t.t3512[ue] = time.AfterFunc(d, func() {
+		t.t3512Ch <- ue
+	})
+}
 
-	log.Printf("send uplink NAS transport -->")
-	buf = t.gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
+// stopT3512 stops the periodic registration update timer of the UE.
+func (t *testSession) stopT3512(ue *nas.UE) {
+	if tm, ok := t.t3512[ue]; ok {
+		tm.Stop()
+		delete(t.t3512, ue)
+	}
+}
 
-	log.Printf("receive configuration command <--")
-	// for Configuration Update Command from open5gs AMF.
-	t.recvfromAMF(3)
+// handleTimerExpiry retransmits the NAS message on expiry of the NAS timer,
+// and registers the UE again on expiry of T3511 or T3502.
+func (t *testSession) handleTimerExpiry(ev nas.TimerEvent) {
+	ue := ev.UE
+	log.Printf("NAS timer T%d expired for %s (PSI: %d)", ev.Timer, ue.SUPI, ev.PSI)
+
+	pdu := ue.TimerExpired(ev)
+	if pdu != nil {
+		log.Printf("retransmit NAS message -->")
+		t.gnb.RecvfromUE(ue,&pdu)
+		buf := t.gnb.MakeUplinkNASTransport(ue)
+		t.sendtoAMF(buf)
+		return
+	}
 
+	switch ev.Timer {
+	case nas.T3511, nas.T3502:
+		if ue.MMstate == nas.MMDeregistared {
+			t.registerUE(ue)
+		}
+	}
 	return
 }
 
-
-func (t *testSession) establishPDUSession(ue *nas.UE) {
-	log.Printf("establishPDUSession RAN function called")
+func (t *testSession) establishPDUSession(ue *nas.UE, id uint8) {
+	log.Printf("establishPDUSession RAN function called for %d", id)
 
 	log.Printf("receive PDU session <--")
-	pdu := ue.MakePDUSessionEstablishmentRequest()
+	pdu := ue.MakePDUSessionEstablishmentRequest(id)
+	if pdu == nil {
+		log.Printf("PDU session(%d) is not requested: %v", id, ue.EncodeError)
+		return
+	}
 	t.gnb.RecvfromUE(ue,&pdu)
 
 	log.Printf("send uplink NAS transport -->")
@@ -70,14 +235,48 @@ func (t *testSession) establishPDUSession(ue *nas.UE) {
 	t.sendtoAMF(buf)
 	log.Printf("receive uplink ack <--")
 	t.recvfromAMF(0)
+	t.handleNAS(ue)
 
-	log.Printf("send PDU session setup -->")
-	buf = t.gnb.MakePDUSessionResourceSetupResponse(ue)
+	return
+}
+
+// modifyPDUSession answers the PDU Session Resource Modify Request.
+// PDU Session Modification Complete or Command Reject in it is sent by
+// the state machine.
+func (t *testSession) modifyPDUSession(ue *nas.UE, id uint8) {
+	log.Printf("modifyPDUSession RAN function called for %d", id)
+
+	if s := ue.PDUSession(id); s != nil {
+		log.Printf("QoS rules: %+v", s.QoSRules())
+		log.Printf("QoS flow descriptions: %+v", s.QoSFlowDescriptions())
+	}
+
+	log.Printf("send PDU session resource modify response -->")
+	buf := t.gnb.MakePDUSessionResourceModifyResponse(ue)
 	t.sendtoAMF(buf)
 
 	return
 }
 
+// releasePDUSession releases the PDU session by the UE requested
+// procedure. PDU Session Release Command is answered by handleNAS.
+func (t *testSession) releasePDUSession(ue *nas.UE, id uint8) {
+	log.Printf("releasePDUSession RAN function called for %d", id)
+
+	log.Printf("receive PDU session release request <--")
+	pdu := ue.MakePDUSessionReleaseRequest(id)
+	t.gnb.RecvfromUE(ue,&pdu)
+
+	log.Printf("send uplink NAS transport -->")
+	buf := t.gnb.MakeUplinkNASTransport(ue)
+	t.sendtoAMF(buf)
+	log.Printf("receive PDU session release command <--")
+	t.recvfromAMF(0)
+	t.handleNAS(ue)
+
+	return
+}
+
 func (t *testSession) initUE() {
 	log.Printf("Init UE function called")
 	gnb := t.gnb
@@ -85,6 +284,11 @@ func (t *testSession) initUE() {
 	ue := &tmp
 	ue.PowerON()
 	ue.SetDebugLevel(1)
+	ue.TimerCh = t.timerCh
+	// CP-ACK and RP-ACK for the MT-SMS are sent by handleNAS.
+	ue.SMSHandler = func(sms nas.SMS) {
+		log.Printf("SMS from %s: %s", sms.Address, sms.Text)
+	}
 	gnb.CampIn(ue)
 
 	return
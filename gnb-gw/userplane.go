@@ -11,57 +11,62 @@ import (
 	"time"
 )
 
-func runUserPlane(t *testSession, gnbAddress string, gtpInterface string, ctx context.Context, c*ngap.Camper) error {
+func runUserPlane(t *testSession, gnbAddress string, gtpInterface string, ctx context.Context, r *ngap.PDUSessionResource, ueAddress net.IP) error {
 	log.Printf("runUserPlane function called with variables %s %s", gnbAddress, gtpInterface)
 
 	gnb := t.gnb
-	ue := c.UE
-
-	localAddress := &net.UDPAddr{
-		IP:   net.ParseIP(gnbAddress),
-		Port: gtp.Port,
-	}
-	log.Printf("gNB UDP local address: %v\n", localAddress)
 
-	conn := gtpv1.NewUPlaneConn(localAddress)
-	if err := conn.EnableKernelGTP(gtpInterface, gtpv1.RoleSGSN); err != nil {
-		return err
-	}
-	t.uConn=conn
-	log.Printf("enabled kernel gtp device %s", gtpInterface)
+	// the kernel GTP device is shared by all the PDU sessions.
+	conn := t.uConn
+	if conn == nil {
+		localAddress := &net.UDPAddr{
+			IP:   net.ParseIP(gnbAddress),
+			Port: gtp.Port,
+		}
+		log.Printf("gNB UDP local address: %v\n", localAddress)
 
-	go func() {
-		log.Printf("about to listen and serve")
-		if err := conn.ListenAndServe(ctx); err != nil {
-			log.Println(err)
-			return
+		conn = gtpv1.NewUPlaneConn(localAddress)
+		if err := conn.EnableKernelGTP(gtpInterface, gtpv1.RoleSGSN); err != nil {
+			return err
 		}
-		log.Println("conn.ListenAndServe exited")
-	}()
+		t.uConn=conn
+		log.Printf("enabled kernel gtp device %s", gtpInterface)
+
+		go func() {
+			log.Printf("about to listen and serve")
+			if err := conn.ListenAndServe(ctx); err != nil {
+				log.Println(err)
+				return
+			}
+			log.Println("conn.ListenAndServe exited")
+		}()
 		log.Printf("Started userplane on %s", localAddress)
 
-	if err := conn.AddTunnelOverride(
-		gnb.Recv.GTPuPeerAddr, ue.Recv.PDUAddress,
-		gnb.Recv.GTPuPeerTEID, gnb.GTPuTEID); err != nil {
-		log.Println(err)
-		return err
-	}
-	log.Printf("created tunnel from %s %s",gnb.Recv.GTPuPeerAddr, ue.Recv.PDUAddress)
+		time.Sleep(time.Second * 3)
 
-	time.Sleep(time.Second * 3)
+		if err := addRoute(conn); err != nil {
+			log.Fatalf("failed to addRoute: %v", err)
+			return err
+		}
+	}
 
-	if err := addRoute(conn); err != nil {
-		log.Fatalf("failed to addRoute: %v", err)
+	if err := conn.AddTunnelOverride(
+		r.PeerAddr, ueAddress, r.PeerTEID, r.LocalTEID); err != nil {
+		log.Println(err)
 		return err
 	}
+	log.Printf("created tunnel from %s %s",r.PeerAddr, ueAddress)
+	t.mu.Lock()
+	t.addrs[r.LocalTEID] = ueAddress
+	t.mu.Unlock()
 
-	err := addIP(gnb.GTPuIFname, ue.Recv.PDUAddress, 24)
+	err := addIP(gnb.GTPuIFname, ueAddress, 24)
 	if err != nil {
 		log.Fatalf("failed to addIP: %v", err)
 		return err
 	}
 
-	err = addRule(gtpInterface,ue.Recv.PDUAddress)
+	err = addRule(gtpInterface,ueAddress)
 	if err != nil {
 		log.Fatalf("failed to addRule: %v", err)
 		return err
@@ -126,31 +131,105 @@ func addRule(ifname string, ip net.IP) error{
 	return netlink.RuleAdd(rule)
 }
 
+func delIP(ifname string, ip net.IP, mask int) error{
+	log.Printf("delIP function called with %s %v %d",ifname, ip, mask)
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, 32)}}
+	return netlink.AddrDel(link, addr)
+}
+
+func delRule(ifname string, ip net.IP) error{
+	log.Printf("delRule function called")
+
+	mask32 := &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 24)}
+	rule := netlink.NewRule()
+	rule.IifName = ifname
+	rule.Src = mask32
+	rule.Table = 1001
+
+	return netlink.RuleDel(rule)
+}
+
 func setupUserPlane(t *testSession, ctx context.Context, c *ngap.Camper) error  {
 	log.Printf("setupUserPlane function called")
 
 	gnb := t.gnb
 	ue := c.UE
 
-	c.GTPu = gtp.NewGTP(gnb.GTPuTEID, gnb.Recv.GTPuPeerTEID)
-	gtpu := c.GTPu
-	gtpu.SetExtensionHeader(true)
-	gtpu.SetQosFlowID(c.QosFlowID)
-
-	log.Printf("GTPuIFname: %s\n", gnb.GTPuIFname)
-	log.Printf("GTP-U Peer: %v\n", gnb.Recv.GTPuPeerAddr)
-	log.Printf("GTP-U Peer TEID: %v\n", gnb.Recv.GTPuPeerTEID)
-	log.Printf("GTP-U Local TEID: %v\n", gnb.GTPuTEID)
-	log.Printf("QoS Flow ID: %d\n", gtpu.QosFlowID)
-	log.Printf("UE address: %v\n", ue.Recv.PDUAddress)
+	for _, s := range ue.PDUSessions {
+		r := c.PDUSession(s.ID)
+		if r == nil {
+			continue
+		}
+		if s.Address == nil {
+			switch {
+			case s.InterfaceID != nil:
+				log.Printf("PDU session %d: IPv6 is not supported by the kernel GTP device", s.ID)
+			case s.Type == "Ethernet" || s.Type == "Unstructured":
+				log.Printf("PDU session %d: %s is not supported by the kernel GTP device", s.ID, s.Type)
+			}
+			continue
+		}
 
-	if err := runUserPlane(t,gnb.GTPuLocalAddr,gnb.GTPuIFname,ctx,c); err !=nil{
-		return err
+		r.GTPu = gtp.NewGTP(r.LocalTEID, r.PeerTEID)
+		gtpu := r.GTPu
+		gtpu.SetExtensionHeader(true)
+		gtpu.SetQosFlowID(r.QosFlowID)
+
+		log.Printf("PDU session ID: %d, DNN: %s\n", s.ID, s.DNN)
+		log.Printf("GTPuIFname: %s\n", gnb.GTPuIFname)
+		log.Printf("GTP-U Peer: %v\n", r.PeerAddr)
+		log.Printf("GTP-U Peer TEID: %v\n", r.PeerTEID)
+		log.Printf("GTP-U Local TEID: %v\n", r.LocalTEID)
+		log.Printf("QoS Flow ID: %d\n", gtpu.QosFlowID)
+		log.Printf("UE address: %v\n", s.Address)
+
+		if err := runUserPlane(t,gnb.GTPuLocalAddr,gnb.GTPuIFname,ctx,r,s.Address); err !=nil{
+			return err
+		}
 	}
 
 	return nil
 }
 
+// cleanupPDUSession removes the tunnel, the address and the rule
+// added for the released PDU session.
+func cleanupPDUSession(t *testSession, r *ngap.PDUSessionResource) {
+	if r == nil {
+		return
+	}
+	r.GTPu = nil
+
+	t.mu.Lock()
+	ip := t.addrs[r.LocalTEID]
+	delete(t.addrs, r.LocalTEID)
+	t.mu.Unlock()
+	log.Printf("cleanupPDUSession function called with %v", ip)
+
+	gnb := t.gnb
+	if ip == nil { // IPv6 only or the user plane is not set up.
+		return
+	}
+
+	if u := t.uConn; u != nil {
+		if err := u.DelTunnelByMSAddress(ip); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := delRule(gnb.GTPuIFname, ip); err != nil {
+		log.Println(err)
+	}
+	if err := delIP(gnb.GTPuIFname, ip, 24); err != nil {
+		log.Println(err)
+	}
+
+	return
+}
 
 func cleanupUserPlane(t *testSession){
 	log.Printf("cleanupUserPlane function called")